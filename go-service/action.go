@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GitHub Actions mode (`infrakit-go-service action`) runs the command named
+// by the `command` input. Every other INPUT_* variable becomes a request
+// key, with kebab- or snake-case input names turned into camelCase (GitHub
+// uppercases names, so `output-dir` rather than `outputDir`); values that
+// parse as JSON keep their type and empty inputs are left out. The result
+// is written to GITHUB_OUTPUT and GITHUB_STEP_SUMMARY and failures become
+// error annotations.
+
+// actionInput builds the command and request from INPUT_* variables.
+func actionInput(environ []string) (string, map[string]interface{}, error) {
+	input := map[string]interface{}{}
+	cmd := ""
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, "INPUT_") || strings.TrimSpace(value) == "" {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, "INPUT_"))
+		if key == "command" {
+			cmd = strings.TrimSpace(value)
+			continue
+		}
+		key = camelCase(strings.ReplaceAll(key, "_", "-"))
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			v = value
+		}
+		input[key] = v
+	}
+	if cmd == "" {
+		return "", nil, errors.New("the 'command' input is required")
+	}
+	return cmd, input, nil
+}
+
+// writeActionResult publishes a result: annotations on w, scalar fields and
+// the full result as step outputs, and a markdown step summary.
+func writeActionResult(w io.Writer, cmd string, result map[string]interface{}) error {
+	for _, a := range actionAnnotations(result) {
+		fmt.Fprintln(w, a)
+	}
+	if path := os.Getenv("GITHUB_OUTPUT"); path != "" {
+		outputs := map[string]string{"result": toJSON(result)}
+		for k, v := range result {
+			switch t := v.(type) {
+			case string:
+				outputs[k] = t
+			case bool, float64, int, int64:
+				outputs[k] = fmt.Sprint(t)
+			}
+		}
+		if err := appendActionFile(path, formatActionOutputs(outputs)); err != nil {
+			return err
+		}
+	}
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		if err := appendActionFile(path, actionSummary(cmd, result)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendActionFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// formatActionOutputs uses the multiline `name<<delimiter` syntax, with a
+// random delimiter so that output values cannot inject other outputs.
+func formatActionOutputs(outputs map[string]string) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	delimiter := "infrakit_" + hex.EncodeToString(buf)
+	keys := make([]string, 0, len(outputs))
+	for k := range outputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s<<%s\n%s\n%s\n", k, delimiter, outputs[k], delimiter)
+	}
+	return b.String()
+}
+
+func actionSummary(cmd string, result map[string]interface{}) string {
+	var b strings.Builder
+	status := "✅ passed"
+	if result["success"] != true {
+		status = "❌ failed"
+	} else if result["passed"] == false {
+		status = "❌ checks failed"
+	}
+	fmt.Fprintf(&b, "### infrakit %s: %s\n\n", cmd, status)
+	if msg := resultError(result); msg != "" {
+		fmt.Fprintf(&b, "```\n%s\n```\n\n", strings.TrimSpace(msg))
+	}
+	if report, ok := result["report"].(string); ok && report != "" {
+		fmt.Fprintf(&b, "```\n%s```\n\n", report)
+	}
+	if diff, ok := result["diff"].(string); ok && diff != "" {
+		fmt.Fprintf(&b, "<details><summary>Diff</summary>\n\n```diff\n%s```\n\n</details>\n\n", diff)
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err == nil {
+		fmt.Fprintf(&b, "<details><summary>Result</summary>\n\n```json\n%s\n```\n\n</details>\n\n", data)
+	}
+	return b.String()
+}
+
+// actionAnnotations turns failures into workflow commands: the top-level
+// error, every nested entry that failed with an error, assertion failures
+// and findings that carry a severity. Entries naming a file (path, file or
+// manifestFile) are annotated on that file.
+func actionAnnotations(result map[string]interface{}) []string {
+	var out []string
+	var walk func(v interface{}, key string)
+	walk = func(v interface{}, key string) {
+		switch t := v.(type) {
+		case []interface{}:
+			for _, item := range t {
+				walk(item, key)
+			}
+		case map[string]interface{}:
+			msg, _ := t["error"].(string)
+			if msg == "" {
+				msg, _ = t["message"].(string)
+			}
+			severity, _ := t["severity"].(string)
+			if msg != "" && (t["success"] == false || severity != "" || key == "failures") {
+				out = append(out, actionAnnotation(t, severity, msg))
+			}
+			for _, k := range sortedKeys(t) {
+				walk(t[k], k)
+			}
+		}
+	}
+	walk(deepCopyJSON(result), "")
+	return out
+}
+
+func actionAnnotation(entry map[string]interface{}, severity, msg string) string {
+	level := "error"
+	switch strings.ToLower(severity) {
+	case "warning", "warn", "medium", "low":
+		level = "warning"
+	case "info", "notice":
+		level = "notice"
+	}
+	var props []string
+	for _, k := range []string{"path", "file", "manifestFile"} {
+		if file, ok := entry[k].(string); ok && file != "" {
+			props = append(props, "file="+escapeActionProperty(file))
+			break
+		}
+	}
+	if line, ok := entry["line"].(float64); ok {
+		props = append(props, fmt.Sprintf("line=%d", int(line)))
+	}
+	for _, k := range []string{"id", "kind", "rule"} {
+		if title, ok := entry[k].(string); ok && title != "" {
+			props = append(props, "title="+escapeActionProperty(title))
+			break
+		}
+	}
+	cmd := "::" + level
+	if len(props) > 0 {
+		cmd += " " + strings.Join(props, ",")
+	}
+	return cmd + "::" + escapeActionData(msg)
+}
+
+func escapeActionData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(strings.TrimSpace(s))
+}
+
+func escapeActionProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// deepCopyJSON round-trips v through JSON so typed slices and structs in a
+// result become plain maps and lists.
+func deepCopyJSON(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	json.Unmarshal(data, &out)
+	return out
+}
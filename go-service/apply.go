@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// releaseLabel marks every object apply-k8s applies for a release, so that
+// prune finds what a later revision no longer contains.
+const releaseLabel = "infrakit.io/release"
+
+const defaultWaitTimeout = 5 * time.Minute
+
+var releaseNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// applyRequest is the request body for apply-k8s. The manifest comes from
+// the usual manifest, manifestFile or name/chart keys.
+type applyRequest struct {
+	// Release names the deployment: its objects are labelled with it and
+	// every apply is recorded as a revision rollback can return to.
+	Release   string `json:"release"`
+	Namespace string `json:"namespace"`
+	// CreateNamespace creates Namespace first when it does not exist.
+	CreateNamespace bool `json:"createNamespace"`
+	// ServerSide uses server-side apply, owned by FieldManager (default
+	// "infrakit"); ForceConflicts takes over fields other managers own.
+	ServerSide     bool   `json:"serverSide"`
+	FieldManager   string `json:"fieldManager"`
+	ForceConflicts bool   `json:"forceConflicts"`
+	// DryRun is "client" or "server" to only report what would happen.
+	DryRun string `json:"dryRun"`
+	// Wait waits up to Timeout (a Go duration, default 5m) for workloads
+	// to roll out and Jobs to complete.
+	Wait    bool   `json:"wait"`
+	Timeout string `json:"timeout"`
+	// Prune deletes the release's objects the manifest no longer contains.
+	Prune bool `json:"prune"`
+	// Backup saves the live state of the objects, in BackupDir, before
+	// applying them.
+	Backup    bool   `json:"backup"`
+	BackupDir string `json:"backupDir"`
+}
+
+// applyResult is what happened to one resource. Action is kubectl's
+// ("created", "configured", "unchanged", "serverside-applied") or "pruned".
+type applyResult struct {
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+}
+
+// waitResult is the readiness of one workload after an apply.
+type waitResult struct {
+	Resource string `json:"resource"`
+	Ready    bool   `json:"ready"`
+	Message  string `json:"message,omitempty"`
+}
+
+// revision is one recorded apply of a release.
+type revision struct {
+	Release    string        `json:"release"`
+	Revision   int           `json:"revision"`
+	Namespace  string        `json:"namespace,omitempty"`
+	AppliedAt  string        `json:"appliedAt"`
+	Status     string        `json:"status"` // "applied" or "failed"
+	RollbackOf int           `json:"rollbackOf,omitempty"`
+	Resources  []resourceRef `json:"resources"`
+	Manifest   string        `json:"manifest,omitempty"`
+}
+
+// applyK8s applies a manifest and reports the result per resource. With a
+// release it records a revision, and can prune what earlier revisions
+// created and this one no longer renders.
+func applyK8s(input map[string]interface{}) map[string]interface{} {
+	var req applyRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := req.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	if len(objects) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No manifest provided",
+		}
+	}
+	return applyRelease(input, req, objects, 0)
+}
+
+func (req *applyRequest) check() error {
+	if req.Release != "" && !releaseNamePattern.MatchString(req.Release) {
+		return errors.New("'release' must be a lowercase DNS name")
+	}
+	if req.Prune && req.Release == "" {
+		return errors.New("'prune' needs a 'release' to select the objects to prune")
+	}
+	if req.CreateNamespace && req.Namespace == "" {
+		return errors.New("'createNamespace' needs a 'namespace'")
+	}
+	if req.DryRun != "" && req.DryRun != "client" && req.DryRun != "server" {
+		return errors.New("'dryRun' must be client or server")
+	}
+	if req.ServerSide && req.FieldManager == "" {
+		req.FieldManager = "infrakit"
+	}
+	if req.Timeout != "" {
+		if _, err := time.ParseDuration(req.Timeout); err != nil {
+			return errors.New("Invalid timeout: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// applyRelease applies objects, records the revision, prunes and waits as
+// req asks. rollbackOf is the revision a rollback returns to.
+func applyRelease(input map[string]interface{}, req applyRequest, objects []map[string]interface{}, rollbackOf int) map[string]interface{} {
+	if req.Release != "" {
+		for _, obj := range objects {
+			metadata, ok := obj["metadata"].(map[string]interface{})
+			if !ok {
+				metadata = map[string]interface{}{}
+				obj["metadata"] = metadata
+			}
+			labels, ok := metadata["labels"].(map[string]interface{})
+			if !ok {
+				labels = map[string]interface{}{}
+				metadata["labels"] = labels
+			}
+			labels[releaseLabel] = req.Release
+		}
+	}
+	manifest := encodeManifest(objects)
+	var archive string
+	if req.Backup && req.DryRun == "" {
+		var err error
+		if archive, _, err = backupLive(input, inNamespace(objects, req.Namespace)); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Pre-apply backup failed: " + err.Error(),
+			}
+		}
+	}
+	// A dry run changes nothing, the namespace included.
+	var namespaceCreated bool
+	if req.CreateNamespace && req.DryRun == "" {
+		created, err := ensureNamespace(input, req.Namespace)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		namespaceCreated = created
+	}
+	args := []string{"apply", "-f", "-"}
+	if req.Namespace != "" {
+		args = append(args, "-n", req.Namespace)
+	}
+	if req.ServerSide {
+		args = append(args, "--server-side")
+		if req.ForceConflicts {
+			args = append(args, "--force-conflicts")
+		}
+	}
+	if req.FieldManager != "" {
+		args = append(args, "--field-manager="+req.FieldManager)
+	}
+	if req.DryRun != "" {
+		args = append(args, "--dry-run="+req.DryRun)
+	}
+	out, applyErr := runKubectl(input, manifest, args...)
+	results := parseApplyOutput(string(out))
+
+	result := map[string]interface{}{
+		"success":   applyErr == nil,
+		"resources": results,
+	}
+	if req.DryRun != "" {
+		result["dryRun"] = req.DryRun
+	}
+	if archive != "" {
+		result["backup"] = archive
+	}
+	if namespaceCreated {
+		result["namespaceCreated"] = req.Namespace
+	}
+	if req.Release != "" {
+		result["release"] = req.Release
+	}
+	if req.Release != "" && req.DryRun == "" {
+		rev := revision{
+			Release:    req.Release,
+			Namespace:  req.Namespace,
+			AppliedAt:  time.Now().UTC().Format(time.RFC3339),
+			Status:     "applied",
+			RollbackOf: rollbackOf,
+			Manifest:   manifest,
+		}
+		if applyErr != nil {
+			rev.Status = "failed"
+		}
+		for _, obj := range objects {
+			rev.Resources = append(rev.Resources, refOf(obj))
+		}
+		if n, err := saveRevision(input, rev); err != nil {
+			result["revisionError"] = err.Error()
+		} else {
+			result["revision"] = n
+		}
+	}
+	if applyErr != nil {
+		result["error"] = applyErr.Error()
+		if wantDiagnostics(input) && req.DryRun == "" {
+			result["diagnostics"] = collectDiagnostics(input, objects)
+		}
+		return result
+	}
+
+	if req.Prune {
+		pruned, err := pruneRelease(input, req, manifest)
+		if err != nil {
+			result["success"] = false
+			result["error"] = "Prune failed: " + err.Error()
+			return result
+		}
+		results = append(results, pruned...)
+		result["resources"] = results
+	}
+
+	if req.Wait && req.DryRun == "" {
+		timeout := defaultWaitTimeout
+		if req.Timeout != "" {
+			timeout, _ = time.ParseDuration(req.Timeout)
+		}
+		waited := waitForResources(input, objects, req.Namespace, timeout)
+		result["wait"] = waited
+		var notReady []string
+		for _, w := range waited {
+			if !w.Ready {
+				notReady = append(notReady, w.Resource)
+			}
+		}
+		if len(notReady) > 0 {
+			result["success"] = false
+			result["error"] = "Not ready within " + timeout.String() + ": " + strings.Join(notReady, ", ")
+			if wantDiagnostics(input) {
+				result["diagnostics"] = collectDiagnostics(input, objects)
+			}
+		}
+	}
+	return result
+}
+
+// parseApplyOutput reads kubectl apply's "<resource> <action>" lines.
+func parseApplyOutput(out string) []applyResult {
+	results := []applyResult{}
+	for _, line := range strings.Split(out, "\n") {
+		resource, action, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		action = strings.TrimSuffix(strings.TrimSuffix(action, " (server dry run)"), " (dry run)")
+		results = append(results, applyResult{Resource: resource, Action: action})
+	}
+	return results
+}
+
+// pruneRelease deletes the live objects labelled with the release that
+// manifest no longer contains, or with a dry run only lists them.
+func pruneRelease(input map[string]interface{}, req applyRequest, manifest string) ([]applyResult, error) {
+	orphanInput := map[string]interface{}{}
+	for k, v := range input {
+		orphanInput[k] = v
+	}
+	delete(orphanInput, "manifestFile")
+	delete(orphanInput, "release")
+	orphanInput["manifest"] = manifest
+	orphanInput["selector"] = releaseLabel + "=" + req.Release
+	orphans := findOrphans(orphanInput)
+	if orphans["success"] != true {
+		return nil, errors.New(fmt.Sprint(orphans["error"]))
+	}
+	var pruned []applyResult
+	for _, o := range orphans["orphans"].([]map[string]interface{}) {
+		ref := o["resource"].(resourceRef)
+		if req.DryRun == "" {
+			args := []string{"delete", kubectlResourceArg(ref), "--ignore-not-found"}
+			if ref.Namespace != "" {
+				args = append(args, "-n", ref.Namespace)
+			}
+			if _, err := runKubectl(input, "", args...); err != nil {
+				return pruned, fmt.Errorf("%s: %v", ref, err)
+			}
+		}
+		pruned = append(pruned, applyResult{Resource: kubectlResourceArg(ref), Action: "pruned"})
+	}
+	return pruned, nil
+}
+
+// waitForResources waits, concurrently and up to timeout, for the
+// workloads among objects to finish rolling out and for Jobs to complete.
+// Other kinds are not waited for.
+func waitForResources(input map[string]interface{}, objects []map[string]interface{}, namespace string, timeout time.Duration) []waitResult {
+	results := []waitResult{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := newSemaphore(8)
+	for _, obj := range objects {
+		ref := refOf(obj)
+		var args []string
+		switch {
+		case ref.Kind == "Job":
+			args = []string{"wait", "--for=condition=complete", kubectlResourceArg(ref)}
+		case rolloutWorkloadKinds[ref.Kind] && ref.Kind != "Rollout":
+			args = []string{"rollout", "status", kubectlResourceArg(ref), "--watch"}
+		default:
+			continue
+		}
+		args = append(args, "--timeout="+strconv.Itoa(int(timeout.Seconds()))+"s")
+		if ns := firstNonEmpty(ref.Namespace, namespace); ns != "" {
+			args = append(args, "-n", ns)
+		}
+		wg.Add(1)
+		go func(ref resourceRef, args []string) {
+			defer wg.Done()
+			defer sem.acquire()()
+			w := waitResult{Resource: ref.String(), Ready: true}
+			if out, err := runKubectl(input, "", args...); err != nil {
+				w.Ready = false
+				w.Message = strings.TrimSpace(string(out) + "\n" + err.Error())
+			}
+			mu.Lock()
+			results = append(results, w)
+			mu.Unlock()
+		}(ref, args)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Resource < results[j].Resource })
+	return results
+}
+
+// revisionDir returns where a release's revisions on the request's
+// cluster are kept: <INFRAKIT_REVISION_DIR>/<cluster>/<release>.
+func revisionDir(input map[string]interface{}, release string) (string, error) {
+	cluster, err := clusterCacheKey(input)
+	if err != nil {
+		return "", err
+	}
+	base := os.Getenv("INFRAKIT_REVISION_DIR")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".infrakit", "revisions")
+	}
+	return filepath.Join(base, cluster, release), nil
+}
+
+// loadRevisions returns a release's recorded revisions, oldest first.
+func loadRevisions(input map[string]interface{}, release string) ([]revision, error) {
+	dir, err := revisionDir(input, release)
+	if err != nil {
+		return nil, err
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var revs []revision
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var rev revision
+		if err := json.Unmarshal(data, &rev); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		revs = append(revs, rev)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Revision < revs[j].Revision })
+	return revs, nil
+}
+
+// saveRevision records rev as the release's next revision, keeping the
+// newest INFRAKIT_REVISION_HISTORY (default 10), and returns its number.
+func saveRevision(input map[string]interface{}, rev revision) (int, error) {
+	dir, err := revisionDir(input, rev.Release)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return 0, err
+	}
+	revs, err := loadRevisions(input, rev.Release)
+	if err != nil {
+		return 0, err
+	}
+	rev.Revision = 1
+	if len(revs) > 0 {
+		rev.Revision = revs[len(revs)-1].Revision + 1
+	}
+	data, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	// O_EXCL settles concurrent applies of the same release.
+	for {
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%06d.json", rev.Revision)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if os.IsExist(err) {
+			rev.Revision++
+			if data, err = json.MarshalIndent(rev, "", "  "); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return 0, err
+		}
+		break
+	}
+	keep := envLimit("INFRAKIT_REVISION_HISTORY", 10)
+	for i := 0; keep > 0 && i < len(revs)+1-keep; i++ {
+		os.Remove(filepath.Join(dir, fmt.Sprintf("%06d.json", revs[i].Revision)))
+	}
+	return rev.Revision, nil
+}
+
+// rollbackRequest is the request body for rollback.
+type rollbackRequest struct {
+	Release string `json:"release"`
+	// Revision to return to; by default the last applied one before the
+	// current revision.
+	Revision int `json:"revision"`
+	// List only returns the recorded revisions.
+	List bool `json:"list"`
+}
+
+// rollbackK8s re-applies a recorded revision of a release and prunes what
+// later revisions added, recording the result as a new revision. The
+// apply-k8s options (serverSide, wait, ...) apply as they do there.
+func rollbackK8s(input map[string]interface{}) map[string]interface{} {
+	var req rollbackRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if !releaseNamePattern.MatchString(req.Release) {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'release' must be provided as a lowercase DNS name",
+		}
+	}
+	revs, err := loadRevisions(input, req.Release)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read revisions: " + err.Error(),
+		}
+	}
+	if req.List {
+		list := []revision{}
+		for _, r := range revs {
+			r.Manifest = ""
+			list = append(list, r)
+		}
+		return map[string]interface{}{
+			"success":   true,
+			"release":   req.Release,
+			"revisions": list,
+		}
+	}
+
+	var target *revision
+	for i := len(revs) - 1; i >= 0; i-- {
+		r := revs[i]
+		if req.Revision != 0 && r.Revision == req.Revision || req.Revision == 0 && i < len(revs)-1 && r.Status == "applied" {
+			target = &revs[i]
+			break
+		}
+	}
+	if target == nil {
+		msg := "No earlier applied revision of " + req.Release + " to roll back to"
+		if req.Revision != 0 {
+			msg = fmt.Sprintf("Revision %d of %s is not recorded", req.Revision, req.Release)
+		}
+		return map[string]interface{}{
+			"success": false,
+			"error":   msg,
+		}
+	}
+	objects, err := parseManifest(target.Manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Revision %d: %v", target.Revision, err),
+		}
+	}
+
+	var apply applyRequest
+	if err := decodeInput(input, &apply); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	apply.Release = req.Release
+	apply.Namespace = firstNonEmpty(apply.Namespace, target.Namespace)
+	apply.Prune = true
+	if err := apply.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	result := applyRelease(input, apply, objects, target.Revision)
+	result["rolledBackTo"] = target.Revision
+	return result
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// The audit log is configured by:
+//
+//	INFRAKIT_AUDIT_SINKS  where every command run is recorded, comma
+//	                      separated: jsonl:<path>, sqlite:<path> (through
+//	                      the sqlite3 tool) or an http(s) webhook URL, or
+//	                      "none" (default jsonl:<ops dir>/audit.jsonl)
+//	INFRAKIT_AUDIT_TOKEN  bearer token sent to webhooks
+//
+// Unlike the history `ops` lists, the audit log is never trimmed.
+const (
+	auditTimeout = 10 * time.Second
+	// auditTimeFormat has a fixed width, so times compare as strings.
+	auditTimeFormat     = "2006-01-02T15:04:05.000Z"
+	defaultHistoryLimit = 50
+)
+
+// auditRecord is one command run, as the audit log keeps it.
+type auditRecord struct {
+	ID         string `json:"id"`
+	RequestID  string `json:"requestId,omitempty"`
+	Command    string `json:"command"`
+	StartedAt  string `json:"startedAt"`
+	FinishedAt string `json:"finishedAt"`
+	DurationMs int64  `json:"durationMs"`
+	// Status is succeeded or failed; Passed is set for checks.
+	Status    string `json:"status"`
+	Passed    *bool  `json:"passed,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// InputHash is the SHA-256 of the request as replay records it, with
+	// credentials redacted.
+	InputHash string `json:"inputHash"`
+	// User and Host run the process; Caller is the client of a served
+	// request.
+	User   string       `json:"user,omitempty"`
+	Host   string       `json:"host,omitempty"`
+	Caller *auditCaller `json:"caller,omitempty"`
+	// Cluster is the API server a cluster-facing command targeted, through
+	// the kubeconfig Context.
+	Cluster   string `json:"cluster,omitempty"`
+	Context   string `json:"context,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// auditCaller is the client of a served request: where it connected from
+// and the name its X-Caller header gives, such as a CI job. The name is
+// the client's own claim; serve authenticates only its token.
+type auditCaller struct {
+	Address   string `json:"address"`
+	Name      string `json:"name,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+type auditCallerKey struct{}
+
+// withAuditCaller returns ctx for a request served to caller.
+func withAuditCaller(ctx context.Context, caller auditCaller) context.Context {
+	return context.WithValue(ctx, auditCallerKey{}, caller)
+}
+
+// newAuditRecord starts the audit record of op, which runs request.
+func newAuditRecord(ctx context.Context, op *operation, request map[string]interface{}) auditRecord {
+	rec := auditRecord{
+		ID:        op.ID,
+		RequestID: op.RequestID,
+		Command:   op.Command,
+		StartedAt: op.started.UTC().Format(auditTimeFormat),
+	}
+	redacted := deepCopyObject(request)
+	delete(redacted, requestContextKey)
+	redact(redacted, "")
+	if data, err := json.Marshal(redacted); err == nil {
+		sum := sha256.Sum256(data)
+		rec.InputHash = hex.EncodeToString(sum[:])
+	}
+	if u, err := user.Current(); err == nil {
+		rec.User = u.Username
+	}
+	rec.Host, _ = os.Hostname()
+	if caller, ok := ctx.Value(auditCallerKey{}).(auditCaller); ok {
+		rec.Caller = &caller
+	}
+	rec.Context, _ = request["context"].(string)
+	rec.Namespace, _ = request["namespace"].(string)
+	return rec
+}
+
+// recordAudit writes op's audit record, with result's outcome, to every
+// sink. Like the rest of the bookkeeping it never fails the command; a
+// sink that cannot take the record is logged.
+func recordAudit(op *operation, result map[string]interface{}) {
+	sinks := configuredAuditSinks()
+	if len(sinks) == 0 {
+		return
+	}
+	rec := op.audit
+	rec.FinishedAt = op.started.Add(time.Duration(op.DurationMs) * time.Millisecond).UTC().Format(auditTimeFormat)
+	rec.DurationMs = op.DurationMs
+	rec.Status = op.Status
+	if passed, ok := result["passed"].(bool); ok {
+		rec.Passed = &passed
+	}
+	if op.Status == "failed" {
+		rec.ErrorCode = resultCode(result)
+		rec.Error = resultError(result)
+	}
+	if c, ok := lookupCommand(op.Command); ok && clusterFacing(c) && op.input != nil {
+		rec.Cluster = knownClusterServer(op.input)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	for _, s := range sinks {
+		if err := s.write(ctx, rec); err != nil {
+			slog.Warn("Failed to write audit record", "sink", s.String(), "id", rec.ID, "error", err)
+		}
+	}
+}
+
+// auditSink stores audit records.
+type auditSink interface {
+	fmt.Stringer
+	write(ctx context.Context, rec auditRecord) error
+}
+
+// auditStore is an auditSink that history can read back.
+type auditStore interface {
+	auditSink
+	query(ctx context.Context, f historyFilter) ([]auditRecord, error)
+}
+
+// auditSinks parses an INFRAKIT_AUDIT_SINKS value; "" is the default sink.
+func auditSinks(spec string) ([]auditSink, error) {
+	if spec == "" {
+		spec = "jsonl:" + filepath.Join(opsDir(), "audit.jsonl")
+	}
+	var sinks []auditSink
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		kind, path, _ := strings.Cut(entry, ":")
+		switch {
+		case entry == "none":
+		case strings.HasPrefix(entry, "https://") || strings.HasPrefix(entry, "http://"):
+			sinks = append(sinks, webhookAuditSink{url: entry, token: os.Getenv("INFRAKIT_AUDIT_TOKEN")})
+		case (kind == "jsonl" || kind == "sqlite") && path != "":
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
+			if kind == "jsonl" {
+				sinks = append(sinks, jsonlAuditSink{abs})
+			} else {
+				sinks = append(sinks, sqliteAuditSink{abs})
+			}
+		default:
+			return nil, fmt.Errorf("audit sink %q is not jsonl:<path>, sqlite:<path>, a webhook URL or none", entry)
+		}
+	}
+	return sinks, nil
+}
+
+// configuredAuditSinks returns the sinks of INFRAKIT_AUDIT_SINKS, or the
+// default sink when it is invalid, so that records are never lost to a typo.
+func configuredAuditSinks() []auditSink {
+	sinks, err := auditSinks(os.Getenv("INFRAKIT_AUDIT_SINKS"))
+	if err != nil {
+		slog.Warn("Invalid INFRAKIT_AUDIT_SINKS; using the default sink", "error", err)
+		sinks, _ = auditSinks("")
+	}
+	return sinks
+}
+
+// jsonlAuditSink appends records to a file, one JSON object a line.
+type jsonlAuditSink struct {
+	path string
+}
+
+func (s jsonlAuditSink) String() string { return "jsonl:" + s.path }
+
+func (s jsonlAuditSink) write(ctx context.Context, rec auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Other processes append to the same file.
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (s jsonlAuditSink) query(ctx context.Context, f historyFilter) ([]auditRecord, error) {
+	if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var records []auditRecord
+	for _, line := range readHistory(s.path) {
+		var rec auditRecord
+		if json.Unmarshal([]byte(line), &rec) == nil && f.matches(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// sqliteAuditSink keeps records in an SQLite database, through the
+// sqlite3 tool: each record whole, with the columns history filters on.
+type sqliteAuditSink struct {
+	path string
+}
+
+func (s sqliteAuditSink) String() string { return "sqlite:" + s.path }
+
+const sqliteAuditSchema = `CREATE TABLE IF NOT EXISTS audit (
+	id TEXT PRIMARY KEY,
+	started_at TEXT NOT NULL,
+	command TEXT NOT NULL,
+	status TEXT NOT NULL,
+	record TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_started_at ON audit (started_at);
+`
+
+func (s sqliteAuditSink) write(ctx context.Context, rec auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	_, err = s.run(ctx, sqliteAuditSchema+fmt.Sprintf("INSERT INTO audit (id, started_at, command, status, record) VALUES (%s, %s, %s, %s, %s);\n",
+		sqlQuote(rec.ID), sqlQuote(rec.StartedAt), sqlQuote(rec.Command), sqlQuote(rec.Status), sqlQuote(string(data))))
+	return err
+}
+
+func (s sqliteAuditSink) query(ctx context.Context, f historyFilter) ([]auditRecord, error) {
+	if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	// The columns narrow the scan; matches has the last word.
+	where := []string{"1"}
+	if f.Since != "" {
+		where = append(where, "started_at >= "+sqlQuote(f.Since))
+	}
+	if f.Until != "" {
+		where = append(where, "started_at <= "+sqlQuote(f.Until))
+	}
+	if f.Command != "" {
+		where = append(where, "command = "+sqlQuote(f.Command))
+	}
+	if f.Status != "" {
+		where = append(where, "status = "+sqlQuote(f.Status))
+	}
+	out, err := s.run(ctx, sqliteAuditSchema+"SELECT record FROM audit WHERE "+strings.Join(where, " AND ")+";\n")
+	if err != nil {
+		return nil, err
+	}
+	var records []auditRecord
+	for _, line := range strings.Split(string(out), "\n") {
+		var rec auditRecord
+		if line != "" && json.Unmarshal([]byte(line), &rec) == nil && f.matches(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// run runs script against the database; records are JSON without line
+// breaks, so each selected one is a line of the output.
+func (s sqliteAuditSink) run(ctx context.Context, script string) ([]byte, error) {
+	cmd := toolCommand(ctx, "sqlite3", "-batch", "-bail", "-noheader", "-list", "-cmd", ".timeout 5000", s.path)
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	out, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if err != nil {
+		return nil, errors.New(strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return out, nil
+}
+
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// webhookAuditSink posts each record as JSON.
+type webhookAuditSink struct {
+	url, token string
+}
+
+func (s webhookAuditSink) String() string { return s.url }
+
+func (s webhookAuditSink) write(ctx context.Context, rec auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := (&http.Client{Timeout: auditTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// historyRequest is the request body for history.
+type historyRequest struct {
+	Command string `json:"command"`
+	Status  string `json:"status"`
+	// Caller is a local user, or the name or address of a served
+	// request's client.
+	Caller string `json:"caller"`
+	// Cluster is an API server URL, or part of one, or a context.
+	Cluster string `json:"cluster"`
+	// Since and Until are times (RFC 3339 or a date) or durations before
+	// now, such as 24h.
+	Since string `json:"since"`
+	Until string `json:"until"`
+	Limit int    `json:"limit"`
+	// Sink is the jsonl: or sqlite: store to read; by default the first of
+	// INFRAKIT_AUDIT_SINKS that can be read.
+	Sink string `json:"sink"`
+}
+
+// historyFilter is a historyRequest with its times in auditTimeFormat.
+type historyFilter struct {
+	historyRequest
+}
+
+func (r historyRequest) filter(now time.Time) (historyFilter, error) {
+	f := historyFilter{r}
+	if r.Status != "" && r.Status != "succeeded" && r.Status != "failed" {
+		return f, errors.New("'status' must be succeeded or failed")
+	}
+	for _, t := range []*string{&f.Since, &f.Until} {
+		if *t == "" {
+			continue
+		}
+		parsed, err := parseHistoryTime(*t, now)
+		if err != nil {
+			return f, err
+		}
+		*t = parsed.UTC().Format(auditTimeFormat)
+	}
+	return f, nil
+}
+
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q: use RFC 3339, a date or a duration such as 24h", s)
+}
+
+// matches reports whether rec passes every filter of f.
+func (f historyFilter) matches(rec auditRecord) bool {
+	switch {
+	case f.Command != "" && rec.Command != f.Command,
+		f.Status != "" && rec.Status != f.Status,
+		f.Since != "" && rec.StartedAt < f.Since,
+		f.Until != "" && rec.StartedAt > f.Until:
+		return false
+	}
+	if f.Caller != "" {
+		matched := rec.User == f.Caller
+		if c := rec.Caller; c != nil {
+			host, _, err := net.SplitHostPort(c.Address)
+			if err != nil {
+				host = c.Address
+			}
+			matched = matched || c.Name == f.Caller || host == f.Caller || c.Address == f.Caller
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.Cluster != "" && rec.Context != f.Cluster && (rec.Cluster == "" || !strings.Contains(rec.Cluster, f.Cluster)) {
+		return false
+	}
+	return true
+}
+
+// history answers who ran what, where and when from the audit log: the
+// runs matching every filter given, newest first.
+func history(input map[string]interface{}) map[string]interface{} {
+	var req historyRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	f, err := req.filter(time.Now())
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	sinks := configuredAuditSinks()
+	if req.Sink != "" {
+		if sinks, err = auditSinks(req.Sink); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Invalid sink: " + err.Error(),
+			}
+		}
+	}
+	var store auditStore
+	for _, s := range sinks {
+		if st, ok := s.(auditStore); ok {
+			store = st
+			break
+		}
+	}
+	if store == nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No jsonl: or sqlite: audit sink to read; pass 'sink'",
+		}
+	}
+	records, err := store.query(requestContext(input), f)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read the audit log " + store.String() + ": " + err.Error(),
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].StartedAt > records[j].StartedAt })
+	total := len(records)
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	if records == nil {
+		records = []auditRecord{}
+	}
+
+	var report strings.Builder
+	tw := tabwriter.NewWriter(&report, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STARTED\tCOMMAND\tSTATUS\tBY\tCLUSTER\tDURATION")
+	for _, rec := range records {
+		by := rec.User
+		if c := rec.Caller; c != nil {
+			by = firstNonEmpty(c.Name, c.Address)
+		}
+		status := rec.Status
+		if rec.Passed != nil && !*rec.Passed {
+			status += " (checks failed)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", rec.StartedAt, rec.Command, status, by,
+			firstNonEmpty(rec.Cluster, rec.Context, "-"), (time.Duration(rec.DurationMs) * time.Millisecond).String())
+	}
+	tw.Flush()
+	fmt.Fprintf(&report, "%d of %d matching runs in %s\n", len(records), total, store)
+	return map[string]interface{}{
+		"success": true,
+		"sink":    store.String(),
+		"total":   total,
+		"records": records,
+		"report":  report.String(),
+	}
+}
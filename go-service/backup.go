@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupIndex is stored as index.json at the root of every backup archive.
+type backupIndex struct {
+	CreatedAt string        `json:"createdAt"`
+	Saved     []backupEntry `json:"saved"`
+	// Absent lists resources that did not exist at backup time, so a restore
+	// can remove what the apply created.
+	Absent []resourceRef `json:"absent"`
+}
+
+type backupEntry struct {
+	Resource resourceRef `json:"resource"`
+	File     string      `json:"file"`
+}
+
+// serverFields are set by the API server and would make a restore conflict.
+var serverFields = []string{"resourceVersion", "uid", "creationTimestamp", "generation", "managedFields", "selfLink"}
+
+// backupDir returns where backup archives are written.
+func backupDir(input map[string]interface{}) string {
+	if dir, ok := input["backupDir"].(string); ok && dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("INFRAKIT_BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-backups")
+	}
+	return filepath.Join(home, ".infrakit", "backups")
+}
+
+// kubectlResourceArg names a resource unambiguously for kubectl get/delete,
+// e.g. "Deployment.v1.apps/web" or "ConfigMap/settings".
+func kubectlResourceArg(ref resourceRef) string {
+	group, version := splitAPIVersion(ref.APIVersion)
+	if group == "" {
+		return ref.Kind + "/" + ref.Name
+	}
+	return ref.Kind + "." + version + "." + group + "/" + ref.Name
+}
+
+// backupLive exports the live state of every object the manifest touches to
+// a timestamped tar.gz archive and returns the archive path.
+func backupLive(input map[string]interface{}, objects []map[string]interface{}) (string, *backupIndex, error) {
+	index := &backupIndex{CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	files := map[string][]byte{}
+	for i, obj := range objects {
+		ref := refOf(obj)
+		if ref.Name == "" {
+			continue
+		}
+		args := []string{"get", kubectlResourceArg(ref), "-o", "json", "--ignore-not-found"}
+		if ref.Namespace != "" {
+			args = append(args, "-n", ref.Namespace)
+		}
+		out, err := runKubectl(input, "", args...)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read %s: %v", ref, err)
+		}
+		if strings.TrimSpace(string(out)) == "" {
+			index.Absent = append(index.Absent, ref)
+			continue
+		}
+		var live map[string]interface{}
+		if err := json.Unmarshal(out, &live); err != nil {
+			return "", nil, fmt.Errorf("failed to decode %s: %v", ref, err)
+		}
+		meta := nestedMap(live, "metadata")
+		for _, f := range serverFields {
+			delete(meta, f)
+		}
+		delete(live, "status")
+		name := fmt.Sprintf("%03d-%s.yaml", i, strings.ToLower(strings.ReplaceAll(ref.String(), "/", "_")))
+		files[name] = []byte(encodeYAML(live))
+		index.Saved = append(index.Saved, backupEntry{Resource: ref, File: name})
+	}
+
+	dir := backupDir(input)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, "backup-"+time.Now().UTC().Format("20060102T150405.000000000Z")+".tar.gz")
+	if err := writeBackupArchive(path, index, files); err != nil {
+		os.Remove(path)
+		return "", nil, err
+	}
+	return path, index, nil
+}
+
+// inNamespace returns objects with namespace set on the namespaced ones
+// that set none, where `kubectl apply -n` and helm put them, so that
+// backupLive reads them from there. Changed objects are copies.
+func inNamespace(objects []map[string]interface{}, namespace string) []map[string]interface{} {
+	if namespace == "" {
+		return objects
+	}
+	out := make([]map[string]interface{}, len(objects))
+	for i, obj := range objects {
+		out[i] = obj
+		if nestedMap(obj, "metadata") == nil || nestedString(obj, "metadata", "namespace") != "" || !isNamespaced(nestedString(obj, "kind"), objects) {
+			continue
+		}
+		c := deepCopyObject(obj)
+		nestedMap(c, "metadata")["namespace"] = namespace
+		out[i] = c
+	}
+	return out
+}
+
+func writeBackupArchive(path string, index *backupIndex, files map[string][]byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	indexJSON, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	write := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := write("index.json", indexJSON); err != nil {
+		return err
+	}
+	for _, entry := range index.Saved {
+		if err := write(entry.File, files[entry.File]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func readBackupArchive(path string) (*backupIndex, map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[hdr.Name] = data
+	}
+	var index backupIndex
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		return nil, nil, errors.New("archive has no valid index.json")
+	}
+	return &index, files, nil
+}
+
+// backupResources exports the live state of everything in input["manifest"]
+// (or a rendered chart) without changing the cluster.
+func backupResources(input map[string]interface{}) map[string]interface{} {
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	path, index, err := backupLive(input, objects)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Backup failed: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"archive": path,
+		"saved":   len(index.Saved),
+		"absent":  index.Absent,
+	}
+}
+
+// restoreBackup re-applies the resources saved in input["archive"]. With
+// input["deleteCreated"], resources that did not exist at backup time are
+// deleted too, returning the cluster to its pre-apply state.
+func restoreBackup(input map[string]interface{}) map[string]interface{} {
+	path, ok := input["archive"].(string)
+	if !ok || path == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No archive provided",
+		}
+	}
+	index, files, err := readBackupArchive(path)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read backup: " + err.Error(),
+		}
+	}
+
+	var b strings.Builder
+	for _, entry := range index.Saved {
+		b.WriteString("---\n")
+		b.Write(files[entry.File])
+	}
+	result := map[string]interface{}{
+		"success":  true,
+		"restored": len(index.Saved),
+	}
+	if len(index.Saved) > 0 {
+		output, err := runKubectl(input, b.String(), "apply", "-f", "-")
+		if err != nil {
+			failure := map[string]interface{}{
+				"success": false,
+				"error":   string(output) + err.Error(),
+			}
+			if objects, perr := parseManifest(b.String()); perr == nil && wantDiagnostics(input) {
+				failure["diagnostics"] = collectDiagnostics(input, objects)
+			}
+			return failure
+		}
+		result["applyOutput"] = string(output)
+	}
+
+	if deleteCreated, _ := input["deleteCreated"].(bool); deleteCreated {
+		var deleted []resourceRef
+		for _, ref := range index.Absent {
+			args := []string{"delete", kubectlResourceArg(ref), "--ignore-not-found"}
+			if ref.Namespace != "" {
+				args = append(args, "-n", ref.Namespace)
+			}
+			if _, err := runKubectl(input, "", args...); err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"error":   "Failed to delete " + ref.String() + ": " + err.Error(),
+				}
+			}
+			deleted = append(deleted, ref)
+		}
+		result["deleted"] = deleted
+	}
+	return result
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// batchJob is one command of a batch request.
+type batchJob struct {
+	// ID keys the result; it defaults to job-<n>.
+	ID      string                 `json:"id"`
+	Command string                 `json:"command"`
+	Input   map[string]interface{} `json:"input"`
+}
+
+// batchRequest is the request body for batch.
+type batchRequest struct {
+	Jobs []batchJob `json:"jobs"`
+	// Defaults are merged into every job's input, e.g. shared cluster
+	// access; keys the job sets win.
+	Defaults map[string]interface{} `json:"defaults"`
+	// Parallelism is the number of workers (default: CPU count). helm and
+	// kubectl processes stay within their process-wide limits regardless.
+	Parallelism int `json:"parallelism"`
+	// FailFast skips the jobs not yet started once one fails.
+	FailFast bool `json:"failFast"`
+}
+
+// batchExcluded are, with serveExcluded, the commands a batch job cannot
+// run.
+var batchExcluded = map[string]bool{"batch": true}
+
+// batch runs many commands (renders, validations, any mix) in one process
+// with a pool of workers, and returns each job's result keyed by its ID
+// with its timing. Job failures are reported per job; the batch itself
+// only fails on a malformed request, and passes when every job succeeded.
+func batch(input map[string]interface{}) map[string]interface{} {
+	var req batchRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if len(req.Jobs) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No jobs provided",
+		}
+	}
+	seen := map[string]bool{}
+	for i := range req.Jobs {
+		j := &req.Jobs[i]
+		if j.ID == "" {
+			j.ID = fmt.Sprintf("job-%d", i+1)
+		}
+		if seen[j.ID] {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Duplicate job id " + j.ID,
+			}
+		}
+		seen[j.ID] = true
+		if _, ok := lookupCommand(j.Command); !ok || batchExcluded[j.Command] || serveExcluded[j.Command] {
+			return map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Job %s: %q is not a command batch can run", j.ID, j.Command),
+			}
+		}
+		merged := map[string]interface{}{}
+		for k, v := range req.Defaults {
+			merged[k] = deepCopy(v)
+		}
+		for k, v := range j.Input {
+			merged[k] = v
+		}
+		// Streams would interleave on stdout.
+		if merged["stream"] == true {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Job " + j.ID + ": 'stream' is not available in a batch; use 'outputFile'",
+			}
+		}
+		j.Input = merged
+	}
+	parallelism := req.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	results := make([]map[string]interface{}, len(req.Jobs))
+	jobs := make(chan int)
+	var stop sync.Once
+	stopped := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism && w < len(req.Jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				j := req.Jobs[i]
+				began := time.Now()
+				result := runBatchJob(requestContext(input), j)
+				results[i] = map[string]interface{}{
+					"command":    j.Command,
+					"success":    result["success"] == true && result["passed"] != false,
+					"queuedMs":   began.Sub(start).Milliseconds(),
+					"durationMs": time.Since(began).Milliseconds(),
+					"result":     result,
+				}
+				if req.FailFast && results[i]["success"] != true {
+					stop.Do(func() { close(stopped) })
+				}
+			}
+		}()
+	}
+feed:
+	for i := range req.Jobs {
+		select {
+		case jobs <- i:
+		case <-stopped:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	byID := map[string]interface{}{}
+	succeeded, failed, skipped := 0, 0, 0
+	for i, j := range req.Jobs {
+		r := results[i]
+		switch {
+		case r == nil:
+			skipped++
+			r = map[string]interface{}{"command": j.Command, "success": false, "skipped": true}
+		case r["success"] == true:
+			succeeded++
+		default:
+			failed++
+		}
+		byID[j.ID] = r
+	}
+	return map[string]interface{}{
+		"success":    true,
+		"passed":     failed+skipped == 0,
+		"results":    byID,
+		"succeeded":  succeeded,
+		"failed":     failed,
+		"skipped":    skipped,
+		"durationMs": time.Since(start).Milliseconds(),
+	}
+}
+
+// runBatchJob runs one job as a request of its own, with its own cluster
+// access and timeout within the batch's; a panicking job fails alone.
+func runBatchJob(ctx context.Context, j batchJob) (result map[string]interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("%s panicked: %v", j.Command, r),
+			}
+		}
+	}()
+	if rejected := precheckEnvelope(j.Command, j.Input); rejected != nil {
+		return rejected
+	}
+	cleanup, err := prepareClusterAccess(ctx, j.Input)
+	if err != nil {
+		return failureResult(j.Command, j.Input, err)
+	}
+	defer cleanup()
+	result, _ = dispatch(ctx, j.Command, j.Input)
+	return result
+}
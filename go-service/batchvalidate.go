@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const defaultBatchParallelism = 4
+
+// batchInput are the request keys of validateInBatches.
+type batchInput struct {
+	BatchSize   int `json:"batchSize"`
+	Parallelism int `json:"parallelism"`
+}
+
+// validateInBatches dry-runs a manifest input["batchSize"] documents at a
+// time, input["parallelism"] batches at once, so a bundle of thousands of
+// documents neither times out as one giant apply nor fails as a whole over
+// a single bad document. Every batch is reported; the manifest is valid
+// only when all of them are.
+func validateInBatches(input map[string]interface{}, manifest string, batchSize int) map[string]interface{} {
+	parallelism := defaultBatchParallelism
+	if n, ok := input["parallelism"].(float64); ok && n > 0 {
+		parallelism = int(n)
+	}
+
+	docs := splitYAMLDocuments(manifest)
+	type batch struct {
+		first, last int
+		docs        []string
+	}
+	var batches []batch
+	for i := 0; i < len(docs); i += batchSize {
+		end := i + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		batches = append(batches, batch{i + 1, end, docs[i:end]})
+	}
+
+	results := make([]map[string]interface{}, len(batches))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := range batches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			b := batches[i]
+			result := map[string]interface{}{
+				"batch":     i + 1,
+				"documents": []int{b.first, b.last},
+			}
+			results[i] = result
+			tmpfile, err := createTemp(requestContext(input), "k8s-validate-batch-")
+			if err != nil {
+				result["success"] = false
+				result["error"] = "Failed to create temp file: " + err.Error()
+				return
+			}
+			defer os.Remove(tmpfile.Name())
+			_, err = tmpfile.WriteString("---\n" + strings.Join(b.docs, "\n---\n") + "\n")
+			if cerr := tmpfile.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				result["success"] = false
+				result["error"] = "Failed to write manifest: " + err.Error()
+				return
+			}
+			validation := runValidation(input, tmpfile.Name())
+			result["success"] = validation["success"]
+			if err, ok := validation["error"]; ok {
+				result["error"] = err
+			}
+			// Documents are numbered within the manifest, not the batch.
+			resources, _ := validation["resources"].([]validatedResource)
+			for j := range resources {
+				resources[j].Document += b.first - 1
+			}
+			result["resources"] = resources
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []interface{}
+	resources := []validatedResource{}
+	for _, r := range results {
+		if r["success"] != true {
+			failed = append(failed, r["batch"])
+		}
+		batchResources, _ := r["resources"].([]validatedResource)
+		resources = append(resources, batchResources...)
+		delete(r, "resources")
+	}
+	response := map[string]interface{}{
+		"success":   len(failed) == 0,
+		"documents": len(docs),
+		"batches":   results,
+		"resources": resources,
+	}
+	if len(failed) == 0 {
+		response["message"] = "Manifest validated successfully"
+	} else {
+		response["failedBatches"] = failed
+		response["error"] = fmt.Sprintf("Validation failed in %d of %d batches", len(failed), len(batches))
+	}
+	return response
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subprocessNanos accumulates time spent waiting on helm and kubectl, so
+// bench can separate it from the service's own overhead.
+var subprocessNanos int64
+
+// trackSubprocess adds the time since start to subprocessNanos; use it as
+// `defer trackSubprocess(time.Now())` around a subprocess.
+func trackSubprocess(start time.Time) {
+	atomic.AddInt64(&subprocessNanos, int64(time.Since(start)))
+}
+
+// benchRequest is the request body for bench.
+type benchRequest struct {
+	Name  string `json:"name"`
+	Chart string `json:"chart"`
+	// Manifest is validated as is when no chart is given.
+	Manifest string `json:"manifest"`
+	// Operation is render (default), validate or render-validate.
+	Operation   string `json:"operation"`
+	Iterations  int    `json:"iterations"`
+	Parallelism int    `json:"parallelism"`
+}
+
+// bench runs a render and/or validation input["iterations"] times and
+// reports latency percentiles and how much of the time was spent in helm
+// and kubectl, to quantify what caching and other modes save.
+func bench(input map[string]interface{}) map[string]interface{} {
+	var req benchRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Operation == "" {
+		req.Operation = "render"
+	}
+	render := req.Operation == "render" || req.Operation == "render-validate"
+	validate := req.Operation == "validate" || req.Operation == "render-validate"
+	if !render && !validate {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Unknown operation " + req.Operation + "; expected render, validate or render-validate",
+		}
+	}
+	if render && (req.Name == "" || req.Chart == "") {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Both 'name' and 'chart' must be provided",
+		}
+	}
+	if !render && req.Manifest == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No manifest provided",
+		}
+	}
+	if req.Iterations <= 0 {
+		req.Iterations = 10
+	}
+	if req.Parallelism <= 0 {
+		req.Parallelism = 1
+	}
+
+	iteration := func() error {
+		manifest := req.Manifest
+		if render {
+			var err error
+			if manifest, err = renderChart(requestContext(input), req.Name, req.Chart); err != nil {
+				return err
+			}
+		}
+		if validate {
+			tmpfile, err := createTemp(requestContext(input), "bench-")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(tmpfile.Name())
+			defer tmpfile.Close()
+			if _, err := tmpfile.WriteString(manifest); err != nil {
+				return err
+			}
+			if result := runValidation(input, tmpfile.Name()); result["success"] != true {
+				msg, _ := result["error"].(string)
+				return errors.New(msg)
+			}
+		}
+		return nil
+	}
+
+	latencies := make([]time.Duration, req.Iterations)
+	errs := make([]error, req.Iterations)
+	sem := make(chan struct{}, req.Parallelism)
+	var wg sync.WaitGroup
+	subprocessBefore := atomic.LoadInt64(&subprocessNanos)
+	start := time.Now()
+	for i := 0; i < req.Iterations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			began := time.Now()
+			errs[i] = iteration()
+			latencies[i] = time.Since(began)
+		}(i)
+	}
+	wg.Wait()
+	wall := time.Since(start)
+	subprocess := time.Duration(atomic.LoadInt64(&subprocessNanos) - subprocessBefore)
+
+	var total time.Duration
+	failures := 0
+	var firstError string
+	for i, d := range latencies {
+		total += d
+		if errs[i] != nil {
+			failures++
+			if firstError == "" {
+				firstError = errs[i].Error()
+			}
+		}
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		return ms(sorted[int(p*float64(len(sorted)-1)+0.5)])
+	}
+
+	result := map[string]interface{}{
+		"success":     true,
+		"operation":   req.Operation,
+		"iterations":  req.Iterations,
+		"parallelism": req.Parallelism,
+		"failures":    failures,
+		"latencyMs": map[string]interface{}{
+			"min":  ms(sorted[0]),
+			"p50":  percentile(0.50),
+			"p90":  percentile(0.90),
+			"p99":  percentile(0.99),
+			"max":  ms(sorted[len(sorted)-1]),
+			"mean": ms(total / time.Duration(req.Iterations)),
+		},
+		"wallMs":        ms(wall),
+		"perSecond":     float64(req.Iterations) / wall.Seconds(),
+		"subprocessMs":  ms(subprocess),
+		"overheadMs":    ms(total - subprocess),
+		"subprocessPct": 100 * subprocess.Seconds() / total.Seconds(),
+	}
+	if firstError != "" {
+		result["firstError"] = firstError
+	}
+	return result
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,1219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file evaluates the subset of CEL (https://github.com/google/cel-spec)
+// used by ValidatingAdmissionPolicy expressions over decoded manifests:
+// literals, field selection and indexing, has(), the logical, relational,
+// arithmetic and `in` operators, the conditional operator, list and map
+// literals, the all/exists/exists_one/map/filter macros and the common
+// string, list and conversion functions. Numbers are compared across int
+// and double, since manifests decoded from JSON carry doubles only.
+
+// celProgram is a parsed expression.
+type celProgram struct {
+	source string
+	root   celNode
+}
+
+type celNode interface{}
+
+type (
+	celLiteral struct{ value interface{} }
+	celIdent   struct{ name string }
+	celSelect  struct {
+		operand celNode
+		field   string
+	}
+	celIndex struct{ operand, index celNode }
+	celCall  struct {
+		target celNode
+		fn     string
+		args   []celNode
+	}
+	celUnary struct {
+		op      string
+		operand celNode
+	}
+	celBinary struct {
+		op          string
+		left, right celNode
+	}
+	celTernary  struct{ cond, then, otherwise celNode }
+	celListExpr struct{ items []celNode }
+	celMapExpr  struct{ keys, values []celNode }
+)
+
+func compileCEL(source string) (*celProgram, error) {
+	tokens, err := lexCEL(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &celParser{tokens: tokens}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != celEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+	}
+	return &celProgram{source: source, root: root}, nil
+}
+
+// eval evaluates the program with the given variables (object, params,
+// variables, ...), which must be CEL values (see celValue).
+func (p *celProgram) eval(vars map[string]interface{}) (interface{}, error) {
+	return (&celEnv{vars: vars}).eval(p.root)
+}
+
+// celValue converts decoded YAML/JSON to CEL values: int64 for integers
+// and the rest as is.
+func celValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int:
+		return int64(t)
+	case int64, float64, string, bool, nil:
+		return t
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = celValue(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, val := range t {
+			s[i] = celValue(val)
+		}
+		return s
+	}
+	return v
+}
+
+// Lexer.
+
+const (
+	celEOF = iota
+	celIdentTok
+	celNumber
+	celString
+	celOp
+)
+
+type celToken struct {
+	kind  int
+	text  string
+	value interface{}
+	pos   int
+}
+
+var celOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "[", "]", "(", ")", "{", "}"}
+
+func lexCEL(src string) ([]celToken, error) {
+	var tokens []celToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '/' && strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"' || c == '\'' || ((c == 'r' || c == 'R' || c == 'b' || c == 'B') && i+1 < len(src) && (src[i+1] == '"' || src[i+1] == '\'')):
+			s, n, err := lexCELString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at offset %d", err, i)
+			}
+			tokens = append(tokens, celToken{celString, src[i : i+n], s, i})
+			i += n
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+				j += 2
+				for j < len(src) && strings.IndexByte("0123456789abcdefABCDEF", src[j]) >= 0 {
+					j++
+				}
+				n, err := strconv.ParseInt(src[i+2:j], 16, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid number %q", src[i:j])
+				}
+				if j < len(src) && (src[j] == 'u' || src[j] == 'U') {
+					j++
+				}
+				tokens = append(tokens, celToken{celNumber, src[i:j], n, i})
+				i = j
+				continue
+			}
+			isDouble := false
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				if src[j] == '.' {
+					// 1.size() is a method call on 1, not a double.
+					if j+1 >= len(src) || src[j+1] < '0' || src[j+1] > '9' {
+						break
+					}
+					isDouble = true
+				}
+				if src[j] == 'e' || src[j] == 'E' {
+					isDouble = true
+				}
+				j++
+			}
+			text := src[i:j]
+			var value interface{}
+			var err error
+			if isDouble {
+				value, err = strconv.ParseFloat(text, 64)
+			} else {
+				value, err = strconv.ParseInt(text, 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", text)
+			}
+			if j < len(src) && (src[j] == 'u' || src[j] == 'U') && !isDouble {
+				j++
+			}
+			tokens = append(tokens, celToken{celNumber, src[i:j], value, i})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, celToken{celIdentTok, src[i:j], nil, i})
+			i = j
+		default:
+			matched := false
+			for _, op := range celOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, celToken{celOp, op, nil, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, celToken{kind: celEOF, pos: len(src)}), nil
+}
+
+// lexCELString reads a quoted, raw (r"...") or triple-quoted string
+// literal, returning its value and length in src.
+func lexCELString(src string) (string, int, error) {
+	i, raw := 0, false
+	if src[0] == 'r' || src[0] == 'R' {
+		raw, i = true, 1
+	} else if src[0] == 'b' || src[0] == 'B' {
+		i = 1
+	}
+	quote := src[i : i+1]
+	if strings.HasPrefix(src[i:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	i += len(quote)
+	var b strings.Builder
+	for i < len(src) {
+		if strings.HasPrefix(src[i:], quote) {
+			return b.String(), i + len(quote), nil
+		}
+		c := src[i]
+		if c == '\n' && len(quote) == 1 {
+			break
+		}
+		if c != '\\' || raw {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 >= len(src) {
+			break
+		}
+		i++
+		switch e := src[i]; e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\', '"', '\'', '`', '?':
+			b.WriteByte(e)
+		case 'x', 'u', 'U':
+			n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+			if i+n >= len(src) {
+				return "", 0, errors.New("invalid escape")
+			}
+			code, err := strconv.ParseUint(src[i+1:i+1+n], 16, 32)
+			if err != nil {
+				return "", 0, errors.New("invalid escape")
+			}
+			b.WriteRune(rune(code))
+			i += n
+		default:
+			return "", 0, fmt.Errorf("invalid escape \\%c", e)
+		}
+		i++
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// Parser.
+
+type celParser struct {
+	tokens []celToken
+	pos    int
+}
+
+func (p *celParser) peek() celToken { return p.tokens[p.pos] }
+
+func (p *celParser) next() celToken {
+	t := p.tokens[p.pos]
+	if t.kind != celEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *celParser) accept(op string) bool {
+	if t := p.peek(); t.kind == celOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *celParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		if t.kind == celEOF {
+			return fmt.Errorf("expected %q at end of expression", op)
+		}
+		return fmt.Errorf("expected %q at offset %d, got %q", op, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *celParser) expr() (celNode, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	then, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return celTernary{cond, then, otherwise}, nil
+}
+
+var celPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *celParser) binary(level int) (celNode, error) {
+	if level == len(celPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != celOp && !(t.kind == celIdentTok && t.text == "in") {
+			return left, nil
+		}
+		found := false
+		for _, op := range celPrecedence[level] {
+			if t.text == op {
+				found = true
+			}
+		}
+		if !found {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = celBinary{t.text, left, right}
+	}
+}
+
+func (p *celParser) unary() (celNode, error) {
+	if p.accept("!") {
+		operand, err := p.unary()
+		return celUnary{"!", operand}, err
+	}
+	if p.accept("-") {
+		operand, err := p.unary()
+		return celUnary{"-", operand}, err
+	}
+	return p.member()
+}
+
+func (p *celParser) member() (celNode, error) {
+	node, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != celIdentTok {
+				return nil, fmt.Errorf("expected a field name at offset %d", t.pos)
+			}
+			if p.accept("(") {
+				args, err := p.args(")")
+				if err != nil {
+					return nil, err
+				}
+				node = celCall{node, t.text, args}
+				continue
+			}
+			node = celSelect{node, t.text}
+		case p.accept("["):
+			index, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = celIndex{node, index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *celParser) args(closing string) ([]celNode, error) {
+	var args []celNode
+	if p.accept(closing) {
+		return args, nil
+	}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(closing) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		// A trailing comma is allowed.
+		if p.accept(closing) {
+			return args, nil
+		}
+	}
+}
+
+func (p *celParser) primary() (celNode, error) {
+	t := p.next()
+	switch t.kind {
+	case celNumber, celString:
+		return celLiteral{t.value}, nil
+	case celIdentTok:
+		switch t.text {
+		case "true":
+			return celLiteral{true}, nil
+		case "false":
+			return celLiteral{false}, nil
+		case "null":
+			return celLiteral{nil}, nil
+		}
+		if p.accept("(") {
+			args, err := p.args(")")
+			if err != nil {
+				return nil, err
+			}
+			return celCall{nil, t.text, args}, nil
+		}
+		return celIdent{t.text}, nil
+	case celOp:
+		switch t.text {
+		case "(":
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		case "[":
+			items, err := p.args("]")
+			return celListExpr{items}, err
+		case "{":
+			var m celMapExpr
+			if p.accept("}") {
+				return m, nil
+			}
+			for {
+				k, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				m.keys, m.values = append(m.keys, k), append(m.values, v)
+				if p.accept("}") {
+					return m, nil
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if p.accept("}") {
+					return m, nil
+				}
+			}
+		}
+	case celEOF:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+// Evaluation.
+
+type celEnv struct {
+	vars   map[string]interface{}
+	parent *celEnv
+}
+
+func (e *celEnv) lookup(name string) (interface{}, bool) {
+	for env := e; env != nil; env = env.parent {
+		if v, ok := env.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (e *celEnv) with(name string, value interface{}) *celEnv {
+	return &celEnv{vars: map[string]interface{}{name: value}, parent: e}
+}
+
+func (e *celEnv) eval(node celNode) (interface{}, error) {
+	switch n := node.(type) {
+	case celLiteral:
+		return n.value, nil
+	case celIdent:
+		v, ok := e.lookup(n.name)
+		if !ok {
+			return nil, fmt.Errorf("undeclared reference to %q", n.name)
+		}
+		return v, nil
+	case celSelect:
+		operand, err := e.eval(n.operand)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := operand.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot select %q from %s", n.field, celTypeName(operand))
+		}
+		v, ok := m[n.field]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", n.field)
+		}
+		return v, nil
+	case celIndex:
+		operand, err := e.eval(n.operand)
+		if err != nil {
+			return nil, err
+		}
+		index, err := e.eval(n.index)
+		if err != nil {
+			return nil, err
+		}
+		return celIndexValue(operand, index)
+	case celUnary:
+		v, err := e.eval(n.operand)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "!":
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("no such overload: !%s", celTypeName(v))
+			}
+			return !b, nil
+		default:
+			switch t := v.(type) {
+			case int64:
+				return -t, nil
+			case float64:
+				return -t, nil
+			}
+			return nil, fmt.Errorf("no such overload: -%s", celTypeName(v))
+		}
+	case celBinary:
+		return e.evalBinary(n)
+	case celTernary:
+		cond, err := e.eval(n.cond)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := cond.(bool)
+		if !ok {
+			return nil, fmt.Errorf("condition is %s, not bool", celTypeName(cond))
+		}
+		if b {
+			return e.eval(n.then)
+		}
+		return e.eval(n.otherwise)
+	case celListExpr:
+		list := make([]interface{}, len(n.items))
+		for i, item := range n.items {
+			v, err := e.eval(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case celMapExpr:
+		m := map[string]interface{}{}
+		for i := range n.keys {
+			k, err := e.eval(n.keys[i])
+			if err != nil {
+				return nil, err
+			}
+			v, err := e.eval(n.values[i])
+			if err != nil {
+				return nil, err
+			}
+			m[celToString(k)] = v
+		}
+		return m, nil
+	case celCall:
+		return e.evalCall(n)
+	}
+	return nil, fmt.Errorf("cannot evaluate %T", node)
+}
+
+func (e *celEnv) evalBinary(n celBinary) (interface{}, error) {
+	if n.op == "&&" || n.op == "||" {
+		// Errors are absorbed when the other side decides the result, so
+		// the operators commute as CEL requires.
+		short := n.op == "||"
+		left, lerr := e.eval(n.left)
+		if lerr == nil && left == short {
+			return short, nil
+		}
+		right, rerr := e.eval(n.right)
+		if rerr == nil && right == short {
+			return short, nil
+		}
+		for _, err := range []error{lerr, rerr} {
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := left.(bool); !ok {
+			return nil, fmt.Errorf("no such overload: %s %s %s", celTypeName(left), n.op, celTypeName(right))
+		}
+		if _, ok := right.(bool); !ok {
+			return nil, fmt.Errorf("no such overload: %s %s %s", celTypeName(left), n.op, celTypeName(right))
+		}
+		return !short, nil
+	}
+	left, err := e.eval(n.left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.eval(n.right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return celEqual(left, right), nil
+	case "!=":
+		return !celEqual(left, right), nil
+	case "in":
+		switch t := right.(type) {
+		case []interface{}:
+			for _, item := range t {
+				if celEqual(left, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			k, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, found := t[k]
+			return found, nil
+		}
+		return nil, fmt.Errorf("no such overload: %s in %s", celTypeName(left), celTypeName(right))
+	case "<", "<=", ">", ">=":
+		c, err := celCompare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+	return celArithmetic(n.op, left, right)
+}
+
+func celArithmetic(op string, left, right interface{}) (interface{}, error) {
+	if op == "+" {
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []interface{}:
+			if r, ok := right.([]interface{}); ok {
+				return append(append([]interface{}{}, l...), r...), nil
+			}
+		}
+	}
+	li, lInt := left.(int64)
+	ri, rInt := right.(int64)
+	if lInt && rInt {
+		switch op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "/", "%":
+			if ri == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if op == "/" {
+				return li / ri, nil
+			}
+			return li % ri, nil
+		}
+	}
+	lf, lok := celNumberValue(left)
+	rf, rok := celNumberValue(right)
+	if lok && rok {
+		switch op {
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		case "/":
+			return lf / rf, nil
+		case "%":
+			return math.Mod(lf, rf), nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s %s %s", celTypeName(left), op, celTypeName(right))
+}
+
+func celNumberValue(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+func celEqual(a, b interface{}) bool {
+	if af, ok := celNumberValue(a); ok {
+		bf, ok := celNumberValue(b)
+		return ok && af == bf
+	}
+	switch at := a.(type) {
+	case []interface{}:
+		bt, ok := b.([]interface{})
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for i := range at {
+			if !celEqual(at[i], bt[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bt, ok := b.(map[string]interface{})
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k, v := range at {
+			if w, ok := bt[k]; !ok || !celEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func celCompare(a, b interface{}) (int, error) {
+	if af, ok := celNumberValue(a); ok {
+		if bf, ok := celNumberValue(b); ok {
+			switch {
+			case af < bf:
+				return -1, nil
+			case af > bf:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	switch at := a.(type) {
+	case string:
+		if bt, ok := b.(string); ok {
+			return strings.Compare(at, bt), nil
+		}
+	case bool:
+		if bt, ok := b.(bool); ok {
+			switch {
+			case at == bt:
+				return 0, nil
+			case bt:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, fmt.Errorf("no such overload: %s < %s", celTypeName(a), celTypeName(b))
+}
+
+func celIndexValue(operand, index interface{}) (interface{}, error) {
+	switch t := operand.(type) {
+	case []interface{}:
+		f, ok := celNumberValue(index)
+		if !ok || f != math.Trunc(f) {
+			return nil, fmt.Errorf("invalid list index %v", index)
+		}
+		i := int(f)
+		if i < 0 || i >= len(t) {
+			return nil, fmt.Errorf("index out of range: %d", i)
+		}
+		return t[i], nil
+	case map[string]interface{}:
+		k, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid map key %v", index)
+		}
+		v, ok := t[k]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", k)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("cannot index %s", celTypeName(operand))
+}
+
+func celTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null_type"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// celToString renders a value as string() does.
+func celToString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case nil:
+		return "null"
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+var celMacros = map[string]bool{"all": true, "exists": true, "exists_one": true, "map": true, "filter": true}
+
+func (e *celEnv) evalCall(n celCall) (interface{}, error) {
+	if n.target == nil && n.fn == "has" {
+		if len(n.args) != 1 {
+			return nil, errors.New("has() takes one field selection")
+		}
+		sel, ok := n.args[0].(celSelect)
+		if !ok {
+			return nil, errors.New("has() argument must be a field selection")
+		}
+		operand, err := e.eval(sel.operand)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := operand.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot test field %q of %s", sel.field, celTypeName(operand))
+		}
+		_, found := m[sel.field]
+		return found, nil
+	}
+	if n.target != nil && celMacros[n.fn] {
+		if v, ok := n.args[0].(celIdent); ok && len(n.args) >= 2 {
+			return e.evalMacro(n, v.name)
+		}
+	}
+
+	var args []interface{}
+	if n.target != nil {
+		target, err := e.eval(n.target)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, target)
+	}
+	for _, a := range n.args {
+		v, err := e.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	return celFunction(n.fn, args)
+}
+
+func (e *celEnv) evalMacro(n celCall, name string) (interface{}, error) {
+	target, err := e.eval(n.target)
+	if err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	switch t := target.(type) {
+	case []interface{}:
+		items = t
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			items = append(items, k)
+		}
+	default:
+		return nil, fmt.Errorf("%s() needs a list or map, got %s", n.fn, celTypeName(target))
+	}
+	predicate := func(item interface{}, node celNode) (bool, error) {
+		v, err := e.with(name, item).eval(node)
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("%s() predicate returned %s", n.fn, celTypeName(v))
+		}
+		return b, nil
+	}
+	switch n.fn {
+	case "all", "exists":
+		// Like && and ||, a decisive element wins over errors elsewhere.
+		want := n.fn == "exists"
+		var firstErr error
+		for _, item := range items {
+			b, err := predicate(item, n.args[1])
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if b == want {
+				return want, nil
+			}
+		}
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return !want, nil
+	case "exists_one":
+		count := 0
+		for _, item := range items {
+			b, err := predicate(item, n.args[1])
+			if err != nil {
+				return nil, err
+			}
+			if b {
+				count++
+			}
+		}
+		return count == 1, nil
+	case "filter":
+		out := []interface{}{}
+		for _, item := range items {
+			b, err := predicate(item, n.args[1])
+			if err != nil {
+				return nil, err
+			}
+			if b {
+				out = append(out, item)
+			}
+		}
+		return out, nil
+	}
+	// map(x, f) or map(x, p, f)
+	out := []interface{}{}
+	for _, item := range items {
+		if len(n.args) == 3 {
+			b, err := predicate(item, n.args[1])
+			if err != nil {
+				return nil, err
+			}
+			if !b {
+				continue
+			}
+		}
+		v, err := e.with(name, item).eval(n.args[len(n.args)-1])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// celFunction applies a function or method; for methods args[0] is the
+// receiver.
+func celFunction(fn string, args []interface{}) (interface{}, error) {
+	bad := func() (interface{}, error) {
+		types := make([]string, len(args))
+		for i, a := range args {
+			types[i] = celTypeName(a)
+		}
+		return nil, fmt.Errorf("no such overload: %s(%s)", fn, strings.Join(types, ", "))
+	}
+	str := func(i int) (string, bool) {
+		if i >= len(args) {
+			return "", false
+		}
+		s, ok := args[i].(string)
+		return s, ok
+	}
+	switch fn {
+	case "size":
+		if len(args) != 1 {
+			return bad()
+		}
+		switch t := args[0].(type) {
+		case string:
+			return int64(utf8.RuneCountInString(t)), nil
+		case []interface{}:
+			return int64(len(t)), nil
+		case map[string]interface{}:
+			return int64(len(t)), nil
+		}
+	case "dyn":
+		if len(args) == 1 {
+			return args[0], nil
+		}
+	case "int", "uint":
+		if len(args) != 1 {
+			return bad()
+		}
+		switch t := args[0].(type) {
+		case int64:
+			return t, nil
+		case float64:
+			return int64(t), nil
+		case string:
+			n, err := strconv.ParseInt(t, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to int", t)
+			}
+			return n, nil
+		}
+	case "double":
+		if len(args) != 1 {
+			return bad()
+		}
+		switch t := args[0].(type) {
+		case int64:
+			return float64(t), nil
+		case float64:
+			return t, nil
+		case string:
+			f, err := strconv.ParseFloat(t, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to double", t)
+			}
+			return f, nil
+		}
+	case "string":
+		if len(args) == 1 {
+			switch args[0].(type) {
+			case []interface{}, map[string]interface{}:
+				return bad()
+			}
+			return celToString(args[0]), nil
+		}
+	case "bool":
+		if len(args) == 1 {
+			switch t := args[0].(type) {
+			case bool:
+				return t, nil
+			case string:
+				b, err := strconv.ParseBool(t)
+				if err != nil {
+					return nil, fmt.Errorf("cannot convert %q to bool", t)
+				}
+				return b, nil
+			}
+		}
+	case "type":
+		if len(args) == 1 {
+			return celTypeName(args[0]), nil
+		}
+	case "matches":
+		s, ok1 := str(0)
+		pattern, ok2 := str(1)
+		if !ok1 || !ok2 || len(args) != 2 {
+			return bad()
+		}
+		re, err := cachedRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+		}
+		return re.MatchString(s), nil
+	case "startsWith", "endsWith", "contains", "indexOf", "lastIndexOf":
+		s, ok1 := str(0)
+		sub, ok2 := str(1)
+		if !ok1 || !ok2 || len(args) != 2 {
+			return bad()
+		}
+		switch fn {
+		case "startsWith":
+			return strings.HasPrefix(s, sub), nil
+		case "endsWith":
+			return strings.HasSuffix(s, sub), nil
+		case "contains":
+			return strings.Contains(s, sub), nil
+		case "indexOf":
+			return int64(strings.Index(s, sub)), nil
+		}
+		return int64(strings.LastIndex(s, sub)), nil
+	case "lowerAscii", "upperAscii", "trim":
+		s, ok := str(0)
+		if !ok || len(args) != 1 {
+			return bad()
+		}
+		switch fn {
+		case "lowerAscii":
+			return strings.ToLower(s), nil
+		case "upperAscii":
+			return strings.ToUpper(s), nil
+		}
+		return strings.TrimSpace(s), nil
+	case "split":
+		s, ok1 := str(0)
+		sep, ok2 := str(1)
+		if !ok1 || !ok2 || len(args) != 2 {
+			return bad()
+		}
+		var out []interface{}
+		for _, part := range strings.Split(s, sep) {
+			out = append(out, part)
+		}
+		return out, nil
+	case "replace":
+		s, ok1 := str(0)
+		old, ok2 := str(1)
+		repl, ok3 := str(2)
+		if !ok1 || !ok2 || !ok3 || len(args) != 3 {
+			return bad()
+		}
+		return strings.ReplaceAll(s, old, repl), nil
+	case "substring":
+		s, ok := str(0)
+		if !ok || len(args) < 2 || len(args) > 3 {
+			return bad()
+		}
+		runes := []rune(s)
+		start, ok1 := args[1].(int64)
+		end := int64(len(runes))
+		ok2 := true
+		if len(args) == 3 {
+			end, ok2 = args[2].(int64)
+		}
+		if !ok1 || !ok2 || start < 0 || end < start || end > int64(len(runes)) {
+			return nil, fmt.Errorf("substring(%v, %v) out of range", args[1], end)
+		}
+		return string(runes[start:end]), nil
+	case "join":
+		list, ok := args[0].([]interface{})
+		sep := ""
+		if len(args) == 2 {
+			sep, _ = args[1].(string)
+		}
+		if !ok || len(args) > 2 {
+			return bad()
+		}
+		parts := make([]string, len(list))
+		for i, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return bad()
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, sep), nil
+	}
+	return bad()
+}
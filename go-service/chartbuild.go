@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// chartLockMismatch is a dependency on which Chart.yaml and Chart.lock
+// disagree.
+type chartLockMismatch struct {
+	Name       string `json:"name"`
+	Repository string `json:"repository"`
+	Constraint string `json:"constraint,omitempty"`
+	Locked     string `json:"locked,omitempty"`
+	Problem    string `json:"problem"`
+}
+
+// chartLockError reports a Chart.lock that no longer matches Chart.yaml,
+// which `helm dependency build` would refuse as well.
+type chartLockError struct {
+	Chart      string
+	Mismatches []chartLockMismatch
+}
+
+func (e *chartLockError) Error() string {
+	var problems []string
+	for _, m := range e.Mismatches {
+		problems = append(problems, m.Name+": "+m.Problem)
+	}
+	return fmt.Sprintf("Chart.lock of %s is out of date with Chart.yaml (%s); run helm dependency update", e.Chart, strings.Join(problems, "; "))
+}
+
+// ensureChartDependencies puts the dependencies of a local chart directory
+// into its charts/ directory, as `helm dependency build` does, so that the
+// chart renders without that step. Locked versions are verified against
+// Chart.yaml and taken from the helm cache, pulled on first use; the
+// dependencies that cannot be (local file:// charts, versions that are
+// neither locked nor pinned) are left to `helm dependency build`.
+// Dependencies already in charts/ are kept.
+func ensureChartDependencies(ctx context.Context, chart string) error {
+	deps, err := readChartDependencies(filepath.Join(chart, "Chart.yaml"))
+	if err != nil || len(deps) == 0 {
+		return nil
+	}
+	versions := map[string]string{}
+	lock, err := readChartDependencies(filepath.Join(chart, "Chart.lock"))
+	if err == nil {
+		if mismatches := verifyChartLock(deps, lock); len(mismatches) > 0 {
+			return &chartLockError{Chart: chart, Mismatches: mismatches}
+		}
+		for _, d := range lock {
+			versions[d.Name+"@"+d.Repository] = d.Version
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to read Chart.lock: %v", err)
+	}
+
+	chartsDir := filepath.Join(chart, "charts")
+	build := false
+	for _, d := range deps {
+		version := firstNonEmpty(versions[d.Name+"@"+d.Repository], d.Version)
+		if chartDependencyPresent(chartsDir, d.Name, version) {
+			continue
+		}
+		ref, args := dependencyChartRef(d, version)
+		if ref == "" {
+			build = true
+			continue
+		}
+		archive, _, err := cachedChart(ctx, ref, args)
+		if err != nil {
+			return fmt.Errorf("dependency %s: %v", d.Name, err)
+		}
+		if archive == "" {
+			build = true
+			continue
+		}
+		if err := installChartDependency(chartsDir, d.Name, version, archive); err != nil {
+			return fmt.Errorf("dependency %s: %v", d.Name, err)
+		}
+	}
+	if !build {
+		return nil
+	}
+	unlock, err := lockHelmCache(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := runHelm(ctx, "dependency", "build", chart); err != nil {
+		return errors.New("helm dependency build failed: " + err.Error())
+	}
+	return nil
+}
+
+// verifyChartLock compares the dependencies of Chart.yaml with those
+// Chart.lock pins.
+func verifyChartLock(deps, lock []chartDependency) []chartLockMismatch {
+	locked := map[string]chartDependency{}
+	for _, d := range lock {
+		locked[d.Name+"@"+d.Repository] = d
+	}
+	var mismatches []chartLockMismatch
+	for _, d := range deps {
+		key := d.Name + "@" + d.Repository
+		l, ok := locked[key]
+		delete(locked, key)
+		m := chartLockMismatch{Name: d.Name, Repository: d.Repository, Constraint: d.Version, Locked: l.Version}
+		switch {
+		case !ok:
+			m.Problem = "not in Chart.lock"
+		case d.Version == "":
+			continue
+		default:
+			c, err := parseSemverConstraint(d.Version)
+			v, valid := parseSemver(l.Version)
+			if err != nil || !valid || c.allows(v) {
+				continue
+			}
+			m.Problem = fmt.Sprintf("locked version %s does not satisfy %s", l.Version, d.Version)
+		}
+		mismatches = append(mismatches, m)
+	}
+	for _, l := range lock {
+		if _, ok := locked[l.Name+"@"+l.Repository]; ok {
+			mismatches = append(mismatches, chartLockMismatch{Name: l.Name, Repository: l.Repository, Locked: l.Version, Problem: "no longer in Chart.yaml"})
+		}
+	}
+	return mismatches
+}
+
+// dependencyChartRef returns the chart reference and helm arguments that
+// pull a dependency at version, or "" for dependencies only helm can
+// build.
+func dependencyChartRef(d chartDependency, version string) (string, []string) {
+	repo := strings.TrimSuffix(d.Repository, "/")
+	args := []string{"--version", version}
+	switch {
+	case !exactChartVersion.MatchString(version):
+		return "", nil
+	case strings.HasPrefix(repo, "oci://"):
+		return repo + "/" + d.Name, args
+	case strings.HasPrefix(repo, "@") || strings.HasPrefix(repo, "alias:"):
+		return strings.TrimPrefix(strings.TrimPrefix(repo, "@"), "alias:") + "/" + d.Name, args
+	case strings.HasPrefix(repo, "http://") || strings.HasPrefix(repo, "https://"):
+		return d.Name, append(args, "--repo", repo)
+	}
+	return "", nil
+}
+
+// chartDependencyPresent reports whether charts/ holds the dependency, as
+// an archive of the version or, when it is not known, any version, or
+// unpacked.
+func chartDependencyPresent(chartsDir, name, version string) bool {
+	if _, err := os.Stat(filepath.Join(chartsDir, name, "Chart.yaml")); err == nil {
+		return true
+	}
+	if exactChartVersion.MatchString(version) {
+		_, err := os.Stat(filepath.Join(chartsDir, name+"-"+strings.TrimPrefix(version, "v")+".tgz"))
+		return err == nil
+	}
+	archives, _ := chartDependencyArchives(chartsDir, name)
+	return len(archives) > 0
+}
+
+// chartDependencyArchives lists the archives of a dependency in charts/.
+func chartDependencyArchives(chartsDir, name string) ([]string, error) {
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(name) + `-v?\d+\.\d+\.\d+.*\.tgz$`)
+	entries, err := os.ReadDir(chartsDir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, e := range entries {
+		if pattern.MatchString(e.Name()) {
+			archives = append(archives, filepath.Join(chartsDir, e.Name()))
+		}
+	}
+	return archives, nil
+}
+
+// installChartDependency copies a cached archive into charts/, replacing
+// archives of other versions of the dependency, which helm would otherwise
+// load as well.
+func installChartDependency(chartsDir, name, version, archive string) error {
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(chartsDir, 0o755); err != nil {
+		return err
+	}
+	stale, _ := chartDependencyArchives(chartsDir, name)
+	// Written next to charts/, not in it, where helm would load it.
+	f, err := os.CreateTemp(filepath.Dir(chartsDir), ".dependency-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	target := filepath.Join(chartsDir, name+"-"+strings.TrimPrefix(version, "v")+".tgz")
+	if err == nil {
+		err = os.Rename(f.Name(), target)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	for _, path := range stale {
+		if path != target {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
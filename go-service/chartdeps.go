@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chartDepsRequest is the request body for check-chart-deps.
+type chartDepsRequest struct {
+	// Chart is a chart directory.
+	Chart string `json:"chart"`
+	// IncludePrerelease considers pre-release versions as updates.
+	IncludePrerelease bool `json:"includePrerelease"`
+	// FailOn fails the check ("passed": false) when an update of this size
+	// or larger exists: "major", "minor" or "patch".
+	FailOn string `json:"failOn"`
+}
+
+// chartDependency is a dependency from Chart.yaml.
+type chartDependency struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Repository string `json:"repository"`
+	Alias      string `json:"alias,omitempty"`
+}
+
+var updateRank = map[string]int{"none": 0, "prerelease": 1, "patch": 2, "minor": 3, "major": 4}
+
+// checkChartDeps compares the dependencies a chart declares with the latest
+// versions their repositories publish. For each dependency it reports the
+// version in use (the Chart.lock version, or else the lowest the constraint
+// accepts), the latest release, the update's size (patch, minor or major),
+// and the newest version the declared constraint accepts, i.e. what `helm
+// dependency update` would pick without editing Chart.yaml.
+func checkChartDeps(input map[string]interface{}) map[string]interface{} {
+	var req chartDepsRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Chart == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No chart provided",
+		}
+	}
+	if _, ok := updateRank[req.FailOn]; req.FailOn != "" && (!ok || req.FailOn == "none") {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'failOn' must be major, minor or patch",
+		}
+	}
+	deps, err := readChartDependencies(filepath.Join(req.Chart, "Chart.yaml"))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read Chart.yaml: " + err.Error(),
+		}
+	}
+	locked := map[string]string{}
+	if lock, err := readChartDependencies(filepath.Join(req.Chart, "Chart.lock")); err == nil {
+		for _, d := range lock {
+			locked[d.Name+"@"+d.Repository] = d.Version
+		}
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	indexes := map[string]map[string][]string{}
+	var results []map[string]interface{}
+	var report strings.Builder
+	outdated, failing, errorsSeen := 0, 0, 0
+	for _, d := range deps {
+		entry := map[string]interface{}{
+			"name":       d.Name,
+			"repository": d.Repository,
+			"constraint": d.Version,
+		}
+		if d.Alias != "" {
+			entry["alias"] = d.Alias
+		}
+		results = append(results, entry)
+		if d.Repository == "" || strings.HasPrefix(d.Repository, "file://") {
+			entry["status"] = "local"
+			fmt.Fprintf(&report, "- %s (local)\n", d.Name)
+			continue
+		}
+		versions, err := repositoryChartVersions(requestContext(input), client, indexes, d)
+		if err != nil {
+			entry["status"] = "error"
+			entry["error"] = err.Error()
+			errorsSeen++
+			fmt.Fprintf(&report, "? %s: %s\n", d.Name, firstLines(err.Error(), 1))
+			continue
+		}
+
+		constraint, cerr := parseSemverConstraint(d.Version)
+		current, hasCurrent := parseSemver(locked[d.Name+"@"+d.Repository])
+		if hasCurrent {
+			entry["locked"] = current.String()
+		}
+		var latest, latestAllowed, lowestAllowed *semver
+		for _, s := range versions {
+			v, ok := parseSemver(s)
+			if !ok || (v.Pre != "" && !req.IncludePrerelease) {
+				continue
+			}
+			if latest == nil || compareSemver(v, *latest) > 0 {
+				latest = &v
+			}
+			if cerr == nil && constraint.allows(v) {
+				if latestAllowed == nil || compareSemver(v, *latestAllowed) > 0 {
+					latestAllowed = &v
+				}
+				if lowestAllowed == nil || compareSemver(v, *lowestAllowed) < 0 {
+					lowestAllowed = &v
+				}
+			}
+		}
+		if latest == nil {
+			entry["status"] = "error"
+			entry["error"] = "the repository lists no released versions of " + d.Name
+			errorsSeen++
+			fmt.Fprintf(&report, "? %s: no released versions\n", d.Name)
+			continue
+		}
+		if !hasCurrent {
+			if lowestAllowed == nil {
+				entry["status"] = "error"
+				entry["error"] = fmt.Sprintf("no published version matches %q", d.Version)
+				errorsSeen++
+				fmt.Fprintf(&report, "? %s: no published version matches %s\n", d.Name, d.Version)
+				continue
+			}
+			current = *lowestAllowed
+		}
+		update := semverChange(current, *latest)
+		entry["current"] = current.String()
+		entry["latest"] = latest.String()
+		entry["update"] = update
+		if latestAllowed != nil {
+			entry["latestAllowed"] = latestAllowed.String()
+		}
+		// The latest release needs a Chart.yaml edit when the constraint
+		// does not accept it.
+		entry["constraintAllowsLatest"] = cerr == nil && constraint.allows(*latest)
+		if update == "none" {
+			entry["status"] = "up-to-date"
+			fmt.Fprintf(&report, "✓ %s %s\n", d.Name, current)
+			continue
+		}
+		entry["status"] = "outdated"
+		outdated++
+		mark := "!"
+		if req.FailOn != "" && updateRank[update] >= updateRank[req.FailOn] {
+			failing++
+			mark = "✗"
+		}
+		fmt.Fprintf(&report, "%s %s %s -> %s (%s)\n", mark, d.Name, current, latest, update)
+	}
+	fmt.Fprintf(&report, "%d dependencies, %d outdated\n", len(deps), outdated)
+	return map[string]interface{}{
+		"success":      true,
+		"passed":       failing == 0 && errorsSeen == 0,
+		"dependencies": results,
+		"outdated":     outdated,
+		"report":       report.String(),
+	}
+}
+
+// readChartDependencies reads the dependency list of a Chart.yaml or
+// Chart.lock.
+func readChartDependencies(path string) ([]chartDependency, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeYAML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var deps []chartDependency
+	for _, item := range nestedSlice(asObject(doc), "dependencies") {
+		d := asObject(item)
+		// Unquoted versions such as 1.2 decode as numbers.
+		field := func(key string) string {
+			if v, ok := d[key]; ok && v != nil {
+				return fmt.Sprint(v)
+			}
+			return ""
+		}
+		deps = append(deps, chartDependency{Name: field("name"), Version: field("version"), Repository: field("repository"), Alias: field("alias")})
+	}
+	return deps, nil
+}
+
+// repositoryChartVersions lists the published versions of a dependency:
+// from the index.yaml of an HTTP repository, from `helm search repo` for a
+// repository referenced by name ("@name" or "alias:name"), or from `helm
+// show chart` for OCI, which only reveals the latest version.
+func repositoryChartVersions(ctx context.Context, client *http.Client, indexes map[string]map[string][]string, d chartDependency) ([]string, error) {
+	repo := strings.TrimSuffix(d.Repository, "/")
+	switch {
+	case strings.HasPrefix(repo, "oci://"):
+		out, err := runHelm(ctx, "show", "chart", repo+"/"+d.Name)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := decodeYAML(string(out))
+		if err != nil {
+			return nil, err
+		}
+		version := nestedString(asObject(doc), "version")
+		if version == "" {
+			return nil, errors.New("helm show chart returned no version")
+		}
+		return []string{version}, nil
+	case strings.HasPrefix(repo, "@") || strings.HasPrefix(repo, "alias:"):
+		name := strings.TrimPrefix(strings.TrimPrefix(repo, "@"), "alias:")
+		if err := ensureHelmRepositories(ctx); err != nil {
+			return nil, err
+		}
+		out, err := runHelm(ctx, "search", "repo", name+"/"+d.Name, "--versions", "--devel", "-o", "json")
+		if err != nil {
+			return nil, err
+		}
+		var found []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(out, &found); err != nil {
+			return nil, err
+		}
+		var versions []string
+		for _, f := range found {
+			if f.Name == name+"/"+d.Name {
+				versions = append(versions, f.Version)
+			}
+		}
+		return versions, nil
+	case strings.HasPrefix(repo, "http://") || strings.HasPrefix(repo, "https://"):
+		index, ok := indexes[repo]
+		if !ok {
+			var err error
+			if index, err = fetchRepositoryIndex(client, repo); err != nil {
+				return nil, err
+			}
+			indexes[repo] = index
+		}
+		versions, ok := index[d.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not in %s", d.Name, repo)
+		}
+		return versions, nil
+	}
+	return nil, fmt.Errorf("unsupported repository %q", d.Repository)
+}
+
+// fetchRepositoryIndex downloads a repository's index.yaml and returns the
+// versions of each chart.
+func fetchRepositoryIndex(client *http.Client, repo string) (map[string][]string, error) {
+	data, err := fetchRelease(client, repo+"/index.yaml", 256<<20)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s/index.yaml: %v", repo, err)
+	}
+	index := map[string][]string{}
+	entries := nestedMap(asObject(doc), "entries")
+	for _, name := range sortedKeys(entries) {
+		list, _ := entries[name].([]interface{})
+		for _, e := range list {
+			if v := nestedString(asObject(e), "version"); v != "" {
+				index[name] = append(index[name], v)
+			}
+		}
+		sort.Strings(index[name])
+	}
+	return index, nil
+}
+
+func asObject(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
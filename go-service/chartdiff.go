@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// chartDiffRequest is the request body for diff-chart-versions.
+type chartDiffRequest struct {
+	Name        string `json:"name"`
+	Chart       string `json:"chart"`
+	FromVersion string `json:"fromVersion"`
+	ToVersion   string `json:"toVersion"`
+	// FromChart and ToChart replace Chart for one side, e.g. to compare a
+	// local checkout against the published release.
+	FromChart   string                 `json:"fromChart"`
+	ToChart     string                 `json:"toChart"`
+	Namespace   string                 `json:"namespace"`
+	ValuesFiles []string               `json:"valuesFiles"`
+	Values      map[string]interface{} `json:"values"`
+	// Ignore masks fields that change on every bump, as for snapshot.
+	Ignore []string `json:"ignore"`
+}
+
+// requiredValuePattern finds `required "message" .Values.x` calls.
+var requiredValuePattern = regexp.MustCompile("required\\s+(?:\"(?:[^\"\\\\]|\\\\.)*\"|`[^`]*`)\\s+\\(?\\s*\\.Values\\.([\\w.]+)")
+
+// diffChartVersions renders two versions of a chart with the same values
+// and reports what a bump changes: added, removed and changed resources
+// with the changed fields, API version changes, values that the new version
+// adds, drops or newly requires, and a unified diff of the normalized
+// manifests.
+func diffChartVersions(input map[string]interface{}) map[string]interface{} {
+	var req chartDiffRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	from := renderJobSpec{Name: req.Name, Chart: firstNonEmpty(req.FromChart, req.Chart), Version: req.FromVersion,
+		Namespace: req.Namespace, ValuesFiles: req.ValuesFiles, Values: req.Values}
+	to := from
+	to.Chart, to.Version = firstNonEmpty(req.ToChart, req.Chart), req.ToVersion
+	if req.Name == "" || from.Chart == "" || to.Chart == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'name' and either 'chart' or both 'fromChart' and 'toChart' must be provided",
+		}
+	}
+	if from.Chart == to.Chart && from.Version == to.Version {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'fromVersion' and 'toVersion' must differ",
+		}
+	}
+
+	result := map[string]interface{}{
+		"success": true,
+		"from":    map[string]interface{}{"chart": from.Chart, "version": from.Version},
+		"to":      map[string]interface{}{"chart": to.Chart, "version": to.Version},
+	}
+	fromFiles, err := chartFiles(requestContext(input), from.Chart, from.Version)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read chart " + from.Chart + ": " + err.Error(),
+		}
+	}
+	toFiles, err := chartFiles(requestContext(input), to.Chart, to.Version)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read chart " + to.Chart + ": " + err.Error(),
+		}
+	}
+	fromValues, toValues := chartValuePaths(fromFiles), chartValuePaths(toFiles)
+	result["newValues"] = missingFrom(toValues, fromValues)
+	result["removedValues"] = missingFrom(fromValues, toValues)
+	result["newRequiredValues"] = missingFrom(requiredValues(toFiles), requiredValues(fromFiles))
+
+	var a, b strings.Builder
+	if _, err := renderJob(requestContext(input), &a, from); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to render " + from.Chart + " " + from.Version + ": " + err.Error(),
+		}
+	}
+	// The new version failing to render with the current values is a
+	// finding, typically a newly required value, not a failed request.
+	if _, err := renderJob(requestContext(input), &b, to); err != nil {
+		result["renders"] = false
+		result["renderError"] = strings.TrimSpace(err.Error())
+		return result
+	}
+	result["renders"] = true
+
+	fromObjects, err := maskedObjects(a.String(), req.Ignore)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	toObjects, err := maskedObjects(b.String(), req.Ignore)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	added, removed, changed, apiChanges := compareObjects(fromObjects, toObjects)
+	result["added"] = added
+	result["removed"] = removed
+	result["changed"] = changed
+	result["apiVersionChanges"] = apiChanges
+
+	fromNormalized, _ := normalizeManifest(a.String(), req.Ignore)
+	toNormalized, _ := normalizeManifest(b.String(), req.Ignore)
+	if diff := unifiedDiff(fromNormalized, toNormalized,
+		strings.TrimSpace(from.Chart+" "+from.Version), strings.TrimSpace(to.Chart+" "+to.Version)); diff != "" {
+		result["diff"] = diff
+	}
+	return result
+}
+
+// errChartNotLocal is the error of readChartFiles for a chart it cannot
+// read without helm.
+var errChartNotLocal = errors.New("not a local chart and no exact version to pull")
+
+// chartFiles returns values.yaml and the templates of a chart directory or
+// archive, pulling pinned repository charts into the chart cache.
+func chartFiles(ctx context.Context, chart, version string) (map[string][]byte, error) {
+	return readChartFiles(ctx, chart, []string{"--version", version}, func(name string) bool {
+		return name == "values.yaml" || strings.HasPrefix(name, "templates/")
+	})
+}
+
+// readChartFiles returns the files of a chart directory or archive that
+// wanted picks, by their path in the chart. A pinned repository chart, as
+// args locate it, is pulled into the chart cache and read from there.
+func readChartFiles(ctx context.Context, chart string, args []string, wanted func(name string) bool) (map[string][]byte, error) {
+	path := chart
+	if cached, _, err := cachedChart(ctx, chart, args); err != nil {
+		return nil, err
+	} else if cached != "" {
+		path = cached
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errChartNotLocal
+	}
+	files := map[string][]byte{}
+	if info.IsDir() {
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			if rel = filepath.ToSlash(rel); wanted(rel) {
+				data, err := os.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				files[rel] = data
+			}
+			return nil
+		})
+		return files, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Archive entries are prefixed with the chart name.
+		name := hdr.Name
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[i+1:]
+		}
+		if hdr.Typeflag != tar.TypeReg || !wanted(name) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// chartValuePaths lists the leaf paths of a chart's default values.
+func chartValuePaths(files map[string][]byte) []string {
+	v, err := decodeYAML(string(files["values.yaml"]))
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	var walk func(v interface{}, keys []string)
+	walk = func(v interface{}, keys []string) {
+		m, ok := v.(map[string]interface{})
+		if !ok || len(m) == 0 {
+			if len(keys) > 0 {
+				paths = append(paths, joinFieldPath(keys))
+			}
+			return
+		}
+		for _, k := range sortedKeys(m) {
+			walk(m[k], append(append([]string{}, keys...), k))
+		}
+	}
+	walk(v, nil)
+	return paths
+}
+
+// requiredValues lists the values that templates demand with `required`.
+func requiredValues(files map[string][]byte) []string {
+	seen := map[string]bool{}
+	for name, data := range files {
+		if !strings.HasPrefix(name, "templates/") {
+			continue
+		}
+		for _, m := range requiredValuePattern.FindAllStringSubmatch(string(data), -1) {
+			seen[m[1]] = true
+		}
+	}
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// missingFrom returns the entries of a that are not in b.
+func missingFrom(a, b []string) []string {
+	in := map[string]bool{}
+	for _, s := range b {
+		in[s] = true
+	}
+	out := []string{}
+	for _, s := range a {
+		if !in[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func maskedObjects(manifest string, ignore []string) ([]map[string]interface{}, error) {
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return nil, errors.New("Failed to parse manifest: " + err.Error())
+	}
+	for _, p := range ignore {
+		path, err := parseFieldPath(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			maskField(obj, path)
+		}
+	}
+	return objects, nil
+}
+
+// compareObjects matches objects by kind, namespace and name and reports
+// the added, removed and changed ones, and those whose apiVersion moved.
+func compareObjects(from, to []map[string]interface{}) ([]resourceRef, []resourceRef, []map[string]interface{}, []map[string]interface{}) {
+	key := func(r resourceRef) string { return r.Kind + "/" + r.Namespace + "/" + r.Name }
+	before := map[string]map[string]interface{}{}
+	for _, obj := range from {
+		before[key(refOf(obj))] = obj
+	}
+	added, removed := []resourceRef{}, []resourceRef{}
+	changed, apiChanges := []map[string]interface{}{}, []map[string]interface{}{}
+	matched := map[string]bool{}
+	for _, obj := range to {
+		ref := refOf(obj)
+		old, ok := before[key(ref)]
+		if !ok {
+			added = append(added, ref)
+			continue
+		}
+		matched[key(ref)] = true
+		if oldRef := refOf(old); oldRef.APIVersion != ref.APIVersion {
+			apiChanges = append(apiChanges, map[string]interface{}{
+				"resource": ref,
+				"from":     oldRef.APIVersion,
+				"to":       ref.APIVersion,
+			})
+		}
+		if fields := changedFields(old, obj, nil); len(fields) > 0 {
+			changed = append(changed, map[string]interface{}{
+				"resource": ref,
+				"fields":   fields,
+			})
+		}
+	}
+	for _, obj := range from {
+		if ref := refOf(obj); !matched[key(ref)] {
+			removed = append(removed, ref)
+		}
+	}
+	return added, removed, changed, apiChanges
+}
+
+// changedFields lists the paths at which a and b differ, descending into
+// objects; lists are compared as a whole.
+func changedFields(a, b interface{}, keys []string) []string {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if valuesEqual(a, b) {
+			return nil
+		}
+		return []string{joinFieldPath(keys)}
+	}
+	names := sortedKeys(am)
+	for _, k := range sortedKeys(bm) {
+		if _, ok := am[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var fields []string
+	for _, k := range names {
+		fields = append(fields, changedFields(am[k], bm[k], append(append([]string{}, keys...), k))...)
+	}
+	return fields
+}
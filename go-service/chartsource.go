@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// chartSource says where a chart that is not a local path comes from: a
+// chart name in the repository at RepoURL, an oci:// reference (or a name
+// under an oci:// RepoURL), or a "repo/chart" of a configured repository,
+// at Version. Pinned versions are pulled once into the helm cache, so no
+// repository has to be added beforehand; see cachedChart.
+type chartSource struct {
+	RepoURL string `json:"repoURL"`
+	// Version is an exact version or a constraint; constraints are resolved
+	// by helm on every render.
+	Version string `json:"version"`
+	// Username and Password authenticate to the repository or registry;
+	// CAFile, CertFile and KeyFile configure its TLS.
+	Username              string `json:"username"`
+	Password              string `json:"password"`
+	CAFile                string `json:"caFile"`
+	CertFile              string `json:"certFile"`
+	KeyFile               string `json:"keyFile"`
+	InsecureSkipTLSVerify bool   `json:"insecureSkipTLSVerify"`
+	// PassCredentials sends the credentials to the other domains a
+	// repository index links its charts on.
+	PassCredentials bool `json:"passCredentials"`
+	// SkipDependencies renders a local chart with whatever its charts/
+	// directory holds, instead of resolving its dependencies first.
+	SkipDependencies bool `json:"skipDependencies"`
+}
+
+// chartLocationFlags are the helm flags locating and authenticating a
+// chart, with whether they take a value. They apply to pulling the chart,
+// not to rendering a pulled archive.
+var chartLocationFlags = map[string]bool{
+	"--repo":                     true,
+	"--username":                 true,
+	"--password":                 true,
+	"--ca-file":                  true,
+	"--cert-file":                true,
+	"--key-file":                 true,
+	"--insecure-skip-tls-verify": false,
+	"--pass-credentials":         false,
+}
+
+// resolve returns the chart reference to give helm and the flags locating
+// it. The dependencies of a local chart directory are resolved on the way;
+// see ensureChartDependencies.
+func (s chartSource) resolve(ctx context.Context, chart string) (string, []string, error) {
+	if (s.Username == "") != (s.Password == "") {
+		return "", nil, errors.New("'username' and 'password' must be provided together")
+	}
+	for _, f := range []string{s.CAFile, s.CertFile, s.KeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return "", nil, fmt.Errorf("TLS file: %v", err)
+		}
+	}
+	if info, err := os.Stat(chart); err == nil && info.IsDir() && s.RepoURL == "" && !s.SkipDependencies {
+		if err := ensureChartDependencies(ctx, chart); err != nil {
+			return "", nil, err
+		}
+	}
+	var args []string
+	switch {
+	case s.RepoURL == "":
+	case strings.Contains(chart, "/"):
+		return "", nil, errors.New("'chart' must be a chart name when 'repoURL' is set")
+	case strings.HasPrefix(s.RepoURL, "oci://"):
+		chart = strings.TrimSuffix(s.RepoURL, "/") + "/" + chart
+	case strings.HasPrefix(s.RepoURL, "https://"), strings.HasPrefix(s.RepoURL, "http://"):
+		args = append(args, "--repo", s.RepoURL)
+	default:
+		return "", nil, fmt.Errorf("'repoURL' %s must be an http(s):// or oci:// URL", s.RepoURL)
+	}
+	if s.Version != "" {
+		args = append(args, "--version", s.Version)
+	}
+	if s.Username != "" {
+		args = append(args, "--username", s.Username, "--password", s.Password)
+	}
+	if s.CAFile != "" {
+		args = append(args, "--ca-file", s.CAFile)
+	}
+	if s.CertFile != "" {
+		args = append(args, "--cert-file", s.CertFile)
+	}
+	if s.KeyFile != "" {
+		args = append(args, "--key-file", s.KeyFile)
+	}
+	if s.InsecureSkipTLSVerify {
+		args = append(args, "--insecure-skip-tls-verify")
+	}
+	if s.PassCredentials {
+		args = append(args, "--pass-credentials")
+	}
+	return chart, args, nil
+}
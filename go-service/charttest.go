@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chartTestsFile is where a chart keeps its test-chart cases, and
+// chartSnapshotDir its snapshots, both relative to the chart.
+const (
+	chartTestsFile   = "tests/chart-tests.yaml"
+	chartSnapshotDir = "tests/__snapshot__"
+)
+
+// chartTestRequest is the request body for test-chart.
+type chartTestRequest struct {
+	// Chart is the local chart under test.
+	Chart string `json:"chart"`
+	// Name is the release name (default "release-name").
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Tests are the cases to run. By default they are read from the
+	// chart's tests/chart-tests.yaml, and every ci/*-values.yaml fixture
+	// (as chart-testing names them) that no case uses is a snapshot test
+	// of its own.
+	Tests []chartTest `json:"tests"`
+	// Run only runs tests whose name contains this string.
+	Run string `json:"run"`
+	// UpdateSnapshots writes the snapshots of the tests run instead of
+	// comparing them.
+	UpdateSnapshots bool `json:"updateSnapshots"`
+	// Ignore lists fields masked in every snapshot, as for snapshot.
+	Ignore      []string `json:"ignore"`
+	Parallelism int      `json:"parallelism"`
+}
+
+// chartTest renders the chart with a values fixture and checks the result:
+//
+//	tests:
+//	- name: production
+//	  valuesFiles: [ci/production-values.yaml]
+//	  expect:
+//	  - kind: Deployment
+//	    name: web
+//	    path: spec.replicas
+//	    equals: 3
+//	  - kind: Ingress
+//	    absent: true
+//	- name: requires an image
+//	  values: {image: {repository: ""}}
+//	  fails: image.repository is required
+//
+// Values files are relative to the chart. Every test that renders is
+// compared with its snapshot, tests/__snapshot__/<name>.yaml, unless
+// snapshot is false; one that fails is expected to, with an error that
+// matches fails, a regular expression.
+type chartTest struct {
+	Name        string                 `json:"name"`
+	ValuesFiles []string               `json:"valuesFiles"`
+	Values      map[string]interface{} `json:"values"`
+	Namespace   string                 `json:"namespace"`
+	Expect      []chartExpectation     `json:"expect"`
+	Snapshot    *bool                  `json:"snapshot"`
+	// Ignore adds fields to mask in this test's snapshot.
+	Ignore []string `json:"ignore"`
+	Fails  string   `json:"fails"`
+}
+
+// chartExpectation selects the rendered resources of kind and, when given,
+// name and namespace. Without a path at least one must exist, none with
+// absent, or as many as count. With a path, the field of each must equal
+// equals, match pattern, be unset with absent, or else be set.
+type chartExpectation struct {
+	Kind      string      `json:"kind"`
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace"`
+	Absent    bool        `json:"absent"`
+	Count     *int        `json:"count"`
+	Path      string      `json:"path"`
+	Equals    interface{} `json:"equals"`
+	Pattern   string      `json:"pattern"`
+}
+
+// chartTestResult is the outcome of one test. Snapshot is "matched",
+// "differs", "missing", "updated" or "written", or empty for a test without
+// one.
+type chartTestResult struct {
+	Name       string   `json:"name"`
+	Passed     bool     `json:"passed"`
+	Failures   []string `json:"failures,omitempty"`
+	Snapshot   string   `json:"snapshot,omitempty"`
+	Diff       string   `json:"diff,omitempty"`
+	DurationMs int64    `json:"durationMs"`
+}
+
+var snapshotNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (r *chartTestRequest) check() error {
+	if r.Chart == "" {
+		return errors.New("No chart provided")
+	}
+	if info, err := os.Stat(r.Chart); err != nil || !info.IsDir() {
+		return errors.New("'chart' must be a local chart directory")
+	}
+	if r.Name == "" {
+		r.Name = "release-name"
+	}
+	if r.Parallelism <= 0 {
+		r.Parallelism = runtime.NumCPU()
+	}
+	if len(r.Tests) == 0 {
+		tests, err := chartTests(r.Chart)
+		if err != nil {
+			return err
+		}
+		r.Tests = tests
+	}
+	if len(r.Tests) == 0 {
+		return fmt.Errorf("No tests in %s and no ci/*-values.yaml fixtures", filepath.Join(r.Chart, chartTestsFile))
+	}
+	seen := map[string]string{}
+	for _, t := range r.Tests {
+		if t.Name == "" {
+			return errors.New("Every test needs a 'name'")
+		}
+		file := snapshotNameChars.ReplaceAllString(t.Name, "-")
+		if other, ok := seen[file]; ok {
+			return fmt.Errorf("Tests %q and %q share the snapshot file %s.yaml", other, t.Name, file)
+		}
+		seen[file] = t.Name
+		if _, err := regexp.Compile(t.Fails); err != nil {
+			return fmt.Errorf("test %s: invalid 'fails' pattern: %v", t.Name, err)
+		}
+		for _, e := range t.Expect {
+			if e.Kind == "" {
+				return fmt.Errorf("test %s: every expectation needs a 'kind'", t.Name)
+			}
+			if e.Path != "" {
+				if _, err := parseFieldPath(e.Path); err != nil {
+					return fmt.Errorf("test %s: %v", t.Name, err)
+				}
+			}
+			if _, err := regexp.Compile(e.Pattern); err != nil {
+				return fmt.Errorf("test %s: invalid pattern: %v", t.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// chartTests reads the cases of a chart's tests file, if it has one, and
+// adds a snapshot test for each fixture none of them uses.
+func chartTests(chart string) ([]chartTest, error) {
+	var tests []chartTest
+	file := filepath.Join(chart, chartTestsFile)
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		doc, err := decodeYAML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		var parsed struct {
+			Tests []chartTest `json:"tests"`
+		}
+		if err := decodeInput(asObject(deepCopyJSON(doc)), &parsed); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		tests = parsed.Tests
+	}
+
+	used := map[string]bool{}
+	for _, t := range tests {
+		for _, f := range t.ValuesFiles {
+			used[filepath.Clean(f)] = true
+		}
+	}
+	fixtures, _ := filepath.Glob(filepath.Join(chart, "ci", "*-values.yaml"))
+	sort.Strings(fixtures)
+	for _, f := range fixtures {
+		rel := filepath.Join("ci", filepath.Base(f))
+		if !used[rel] {
+			tests = append(tests, chartTest{
+				Name:        strings.TrimSuffix(filepath.Base(f), "-values.yaml"),
+				ValuesFiles: []string{rel},
+			})
+		}
+	}
+	return tests, nil
+}
+
+// testChart renders a local chart once per test fixture, in parallel, and
+// checks each render against its expectations and snapshot, so chart
+// authors get CI feedback from the renderer production manifests come
+// from. The call succeeds when the tests could be run; "passed" reports
+// whether every one passed.
+func testChart(input map[string]interface{}) map[string]interface{} {
+	var req chartTestRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := req.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	var tests []chartTest
+	for _, t := range req.Tests {
+		if req.Run == "" || strings.Contains(t.Name, req.Run) {
+			tests = append(tests, t)
+		}
+	}
+	if len(tests) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No test name contains " + req.Run,
+		}
+	}
+
+	start := time.Now()
+	results := make([]chartTestResult, len(tests))
+	sem := newSemaphore(req.Parallelism)
+	var wg sync.WaitGroup
+	for i := range tests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer sem.acquire()()
+			results[i] = runChartTest(requestContext(input), req, tests[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var report strings.Builder
+	failed, updated := 0, 0
+	for _, r := range results {
+		if r.Snapshot == "updated" || r.Snapshot == "written" {
+			updated++
+		}
+		if r.Passed {
+			fmt.Fprintf(&report, "✓ %s\n", r.Name)
+			continue
+		}
+		failed++
+		fmt.Fprintf(&report, "✗ %s\n", r.Name)
+		for _, f := range r.Failures {
+			fmt.Fprintf(&report, "    %s\n", f)
+		}
+		for _, line := range splitLines(r.Diff) {
+			fmt.Fprintf(&report, "      %s\n", line)
+		}
+	}
+	fmt.Fprintf(&report, "%d tests, %d passed, %d failed", len(results), len(results)-failed, failed)
+	if req.UpdateSnapshots {
+		fmt.Fprintf(&report, ", %d snapshots written", updated)
+	}
+	report.WriteString("\n")
+	return map[string]interface{}{
+		"success":    true,
+		"passed":     failed == 0,
+		"total":      len(results),
+		"failed":     failed,
+		"tests":      results,
+		"report":     report.String(),
+		"durationMs": time.Since(start).Milliseconds(),
+	}
+}
+
+// runChartTest renders one test's fixture and checks the render.
+func runChartTest(ctx context.Context, req chartTestRequest, t chartTest) (r chartTestResult) {
+	began := time.Now()
+	r.Name = t.Name
+	fail := func(format string, args ...interface{}) {
+		r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+	}
+	defer func() {
+		r.Passed = len(r.Failures) == 0
+		r.DurationMs = time.Since(began).Milliseconds()
+	}()
+
+	var files []string
+	for _, f := range t.ValuesFiles {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(req.Chart, f)
+		}
+		files = append(files, f)
+	}
+	var args []string
+	if namespace := firstNonEmpty(t.Namespace, req.Namespace); namespace != "" {
+		args = append(args, "--namespace", namespace)
+	}
+	values, cleanup, err := helmValues{ValuesFiles: files, Values: t.Values}.renderArgs(ctx, req.Chart, nil)
+	if err != nil {
+		fail("%v", err)
+		return r
+	}
+	defer cleanup()
+	manifest, err := renderChart(ctx, req.Name, req.Chart, append(args, values...)...)
+	if t.Fails != "" {
+		switch {
+		case err == nil:
+			fail("Expected rendering to fail with %q, but it succeeded", t.Fails)
+		case !regexp.MustCompile(t.Fails).MatchString(err.Error()):
+			fail("Expected rendering to fail with %q, got: %s", t.Fails, firstLines(strings.TrimSpace(err.Error()), 3))
+		}
+		return r
+	}
+	if err != nil {
+		fail("Render failed: %s", strings.TrimSpace(err.Error()))
+		return r
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		fail("Failed to parse the render: %v", err)
+		return r
+	}
+	for _, e := range t.Expect {
+		r.Failures = append(r.Failures, e.check(objects)...)
+	}
+	if t.Snapshot == nil || *t.Snapshot {
+		compareChartSnapshot(req, t, manifest, &r)
+	}
+	return r
+}
+
+// check returns why objects do not meet e.
+func (e chartExpectation) check(objects []map[string]interface{}) []string {
+	what := e.Kind
+	if e.Name != "" {
+		what += "/" + e.Name
+	}
+	if e.Namespace != "" {
+		what += " in " + e.Namespace
+	}
+	var selected []map[string]interface{}
+	for _, obj := range objects {
+		ref := refOf(obj)
+		if ref.Kind == e.Kind && (e.Name == "" || ref.Name == e.Name) && (e.Namespace == "" || ref.Namespace == e.Namespace) {
+			selected = append(selected, obj)
+		}
+	}
+	if e.Path == "" {
+		switch {
+		case e.Absent && len(selected) > 0:
+			return []string{fmt.Sprintf("Expected no %s, found %d", what, len(selected))}
+		case e.Count != nil && len(selected) != *e.Count:
+			return []string{fmt.Sprintf("Expected %d %s, found %d", *e.Count, what, len(selected))}
+		case !e.Absent && e.Count == nil && len(selected) == 0:
+			return []string{fmt.Sprintf("Expected %s to exist", what)}
+		}
+		return nil
+	}
+	if len(selected) == 0 {
+		return []string{fmt.Sprintf("Expected %s to exist, to check %s", what, e.Path)}
+	}
+
+	keys, _ := parseFieldPath(e.Path)
+	var failures []string
+	for _, obj := range selected {
+		at := refOf(obj).Kind + "/" + refOf(obj).Name
+		value, found := lookupField(obj, keys)
+		switch {
+		case e.Absent:
+			if found {
+				failures = append(failures, fmt.Sprintf("%s: expected %s to be unset, got %s", at, e.Path, toJSON(value)))
+			}
+		case e.Equals != nil:
+			if !found || !valuesEqual(value, e.Equals) {
+				failures = append(failures, fmt.Sprintf("%s: expected %s to equal %s, got %s", at, e.Path, toJSON(e.Equals), toJSON(value)))
+			}
+		case e.Pattern != "":
+			s, ok := value.(string)
+			if !ok || !regexp.MustCompile(e.Pattern).MatchString(s) {
+				failures = append(failures, fmt.Sprintf("%s: expected %s to match %s, got %s", at, e.Path, e.Pattern, toJSON(value)))
+			}
+		case !found:
+			failures = append(failures, fmt.Sprintf("%s: expected %s to be set", at, e.Path))
+		}
+	}
+	return failures
+}
+
+// compareChartSnapshot compares a test's normalized render with its
+// snapshot or, with updateSnapshots, writes it.
+func compareChartSnapshot(req chartTestRequest, t chartTest, manifest string, r *chartTestResult) {
+	current, err := normalizeManifest(manifest, append(append([]string{}, req.Ignore...), t.Ignore...))
+	if err != nil {
+		r.Failures = append(r.Failures, err.Error())
+		return
+	}
+	rel := filepath.Join(chartSnapshotDir, snapshotNameChars.ReplaceAllString(t.Name, "-")+".yaml")
+	path := filepath.Join(req.Chart, rel)
+	saved, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		r.Failures = append(r.Failures, "Failed to read snapshot: "+err.Error())
+		return
+	}
+	exists := err == nil
+	diff := unifiedDiff(string(saved), current, rel, "rendered")
+	switch {
+	case exists && diff == "":
+		r.Snapshot = "matched"
+	case req.UpdateSnapshots:
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			r.Failures = append(r.Failures, err.Error())
+			return
+		}
+		// Snapshots are committed with the chart, so they get regular
+		// permissions.
+		if err := os.WriteFile(path, []byte(current), 0o644); err != nil {
+			r.Failures = append(r.Failures, "Failed to write snapshot: "+err.Error())
+			return
+		}
+		r.Snapshot = map[bool]string{true: "updated", false: "written"}[exists]
+	case !exists:
+		r.Snapshot = "missing"
+		r.Failures = append(r.Failures, "No snapshot "+rel+"; run with --update-snapshots to write it")
+	default:
+		r.Snapshot = "differs"
+		r.Diff = diff
+		r.Failures = append(r.Failures, "Render differs from "+rel)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// argsInput builds a request from command-line arguments, for commands run
+// by hand or from hooks rather than by the CLI: `--output-dir=out` becomes
+// "outputDir": "out" and a bare `--staged` becomes "staged": true. Values
+// that parse as JSON (numbers, booleans, arrays) keep their type. Positional
+// arguments are collected in "args".
+func argsInput(args []string) (map[string]interface{}, error) {
+	input := map[string]interface{}{}
+	var positional []interface{}
+	for i, arg := range args {
+		if arg == "--" {
+			for _, a := range args[i+1:] {
+				positional = append(positional, a)
+			}
+			break
+		}
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+		key, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if key == "" {
+			return nil, errors.New("invalid argument " + arg)
+		}
+		key = camelCase(key)
+		if !hasValue {
+			input[key] = true
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			v = value
+		}
+		input[key] = v
+	}
+	if len(positional) > 0 {
+		input["args"] = positional
+	}
+	return input, nil
+}
+
+// camelCase turns a kebab-case flag name into a request key.
+func camelCase(s string) string {
+	parts := strings.Split(s, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// cloudAuthSpec describes a managed cluster whose credentials are minted on
+// demand by the provider's exec credential plugin rather than stored in a
+// static kubeconfig that expires.
+type cloudAuthSpec struct {
+	// Provider is eks, gke, aks or exec.
+	Provider    string `json:"provider"`
+	ClusterName string `json:"clusterName"`
+	// Server and CertificateAuthorityData are looked up with the provider
+	// CLI when omitted (eks and gke only).
+	Server                   string `json:"server"`
+	CertificateAuthorityData string `json:"certificateAuthorityData"`
+
+	// EKS
+	Region  string `json:"region"`
+	RoleARN string `json:"roleArn"`
+	Profile string `json:"profile"`
+
+	// GKE
+	Project  string `json:"project"`
+	Location string `json:"location"`
+
+	// AKS: Login is a kubelogin mode (azurecli, msi, workloadidentity, spn).
+	ResourceGroup string `json:"resourceGroup"`
+	Login         string `json:"login"`
+	ClientID      string `json:"clientId"`
+	TenantID      string `json:"tenantId"`
+
+	// Exec configures an arbitrary credential plugin when Provider is exec.
+	Exec struct {
+		Command    string            `json:"command"`
+		Args       []string          `json:"args"`
+		Env        map[string]string `json:"env"`
+		APIVersion string            `json:"apiVersion"`
+	} `json:"exec"`
+}
+
+// aksServerAppID is the fixed AAD application every AKS API server trusts.
+const aksServerAppID = "6dae42f8-4368-4678-94ff-3960e28e3630"
+
+// cloudKubeconfig builds a kubeconfig whose user runs the provider's exec
+// credential plugin, so a fresh token is acquired (via IAM, ADC or Azure
+// identity) every time kubectl needs one.
+func cloudKubeconfig(ctx context.Context, spec cloudAuthSpec) (string, error) {
+	user := map[string]interface{}{
+		"apiVersion":         "client.authentication.k8s.io/v1beta1",
+		"interactiveMode":    "Never",
+		"provideClusterInfo": false,
+	}
+	switch spec.Provider {
+	case "eks":
+		if spec.ClusterName == "" || spec.Region == "" {
+			return "", errors.New("cloudAuth: eks requires clusterName and region")
+		}
+		if spec.Server == "" || spec.CertificateAuthorityData == "" {
+			var cluster struct {
+				Endpoint string `json:"endpoint"`
+				CA       string `json:"ca"`
+			}
+			if err := runCloudCLI(ctx, &cluster, "aws", eksArgs(spec, "eks", "describe-cluster", "--name", spec.ClusterName,
+				"--query", "cluster.{endpoint:endpoint,ca:certificateAuthority.data}", "--output", "json")...); err != nil {
+				return "", err
+			}
+			spec.Server, spec.CertificateAuthorityData = cluster.Endpoint, cluster.CA
+		}
+		args := []string{"eks", "get-token", "--cluster-name", spec.ClusterName}
+		if spec.RoleARN != "" {
+			args = append(args, "--role-arn", spec.RoleARN)
+		}
+		user["command"] = "aws"
+		user["args"] = stringList(eksArgs(spec, args...))
+	case "gke":
+		if spec.ClusterName == "" || spec.Location == "" {
+			return "", errors.New("cloudAuth: gke requires clusterName and location")
+		}
+		if spec.Server == "" || spec.CertificateAuthorityData == "" {
+			var cluster struct {
+				Endpoint   string `json:"endpoint"`
+				MasterAuth struct {
+					ClusterCACertificate string `json:"clusterCaCertificate"`
+				} `json:"masterAuth"`
+			}
+			args := []string{"container", "clusters", "describe", spec.ClusterName, "--location", spec.Location, "--format", "json"}
+			if spec.Project != "" {
+				args = append(args, "--project", spec.Project)
+			}
+			if err := runCloudCLI(ctx, &cluster, "gcloud", args...); err != nil {
+				return "", err
+			}
+			spec.Server = "https://" + cluster.Endpoint
+			spec.CertificateAuthorityData = cluster.MasterAuth.ClusterCACertificate
+		}
+		user["command"] = "gke-gcloud-auth-plugin"
+		user["provideClusterInfo"] = true
+	case "aks":
+		if spec.Server == "" || spec.CertificateAuthorityData == "" {
+			return "", errors.New("cloudAuth: aks requires server and certificateAuthorityData")
+		}
+		login := spec.Login
+		if login == "" {
+			login = "azurecli"
+		}
+		args := []string{"get-token", "--login", login, "--server-id", aksServerAppID}
+		if spec.ClientID != "" {
+			args = append(args, "--client-id", spec.ClientID)
+		}
+		if spec.TenantID != "" {
+			args = append(args, "--tenant-id", spec.TenantID)
+		}
+		user["command"] = "kubelogin"
+		user["args"] = stringList(args)
+	case "exec":
+		if spec.Exec.Command == "" || spec.Server == "" {
+			return "", errors.New("cloudAuth: exec requires exec.command and server")
+		}
+		user["command"] = spec.Exec.Command
+		user["args"] = stringList(spec.Exec.Args)
+		if spec.Exec.APIVersion != "" {
+			user["apiVersion"] = spec.Exec.APIVersion
+		}
+		var env []interface{}
+		for _, k := range sortedKeys(stringMap(spec.Exec.Env)) {
+			env = append(env, map[string]interface{}{"name": k, "value": spec.Exec.Env[k]})
+		}
+		if len(env) > 0 {
+			user["env"] = env
+		}
+	default:
+		return "", errors.New("cloudAuth: unknown provider " + spec.Provider + " (expected eks, gke, aks or exec)")
+	}
+
+	cluster := map[string]interface{}{"server": spec.Server}
+	if spec.CertificateAuthorityData != "" {
+		cluster["certificate-authority-data"] = spec.CertificateAuthorityData
+	}
+	return encodeYAML(map[string]interface{}{
+		"apiVersion":      "v1",
+		"kind":            "Config",
+		"current-context": "cloud",
+		"clusters":        []interface{}{map[string]interface{}{"name": "cloud", "cluster": cluster}},
+		"users":           []interface{}{map[string]interface{}{"name": "cloud", "user": map[string]interface{}{"exec": user}}},
+		"contexts": []interface{}{map[string]interface{}{
+			"name":    "cloud",
+			"context": map[string]interface{}{"cluster": "cloud", "user": "cloud"},
+		}},
+	}), nil
+}
+
+func eksArgs(spec cloudAuthSpec, args ...string) []string {
+	args = append(args, "--region", spec.Region)
+	if spec.Profile != "" {
+		args = append(args, "--profile", spec.Profile)
+	}
+	return args
+}
+
+// runCloudCLI runs a provider CLI and decodes its JSON output into v.
+func runCloudCLI(ctx context.Context, v interface{}, name string, args ...string) error {
+	cmd := toolCommand(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	out, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if err != nil && ctx.Err() != nil {
+		return errors.New("cloudAuth: " + name + " timed out: " + ctx.Err().Error())
+	}
+	if err != nil {
+		return errors.New("cloudAuth: " + name + " failed: " + strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return json.Unmarshal(out, v)
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// commandFlag documents one request key. Name is the kebab-case flag
+// (--output-file sets "outputFile"), Key the request key where camelCase
+// does not produce it; Switch marks flags given bare, File marks paths and
+// Values lists the accepted values, for completion.
+type commandFlag struct {
+	Name   string
+	Key    string
+	Help   string
+	Switch bool
+	File   bool
+	Values []string
+}
+
+// command is one service command. Help, completion, dispatch and the
+// describe schemas are all generated from the commands table. Request lists
+// the typed request structs Run decodes, which versioned requests are
+// checked against, and Requires the keys Run rejects a request without.
+type command struct {
+	Name     string
+	Summary  string
+	Flags    []commandFlag
+	Request  []interface{}
+	Requires []requirement
+	Run      func(map[string]interface{}) map[string]interface{}
+}
+
+// requirement is alternative sets of request keys, of which a request must
+// give every key of at least one.
+type requirement [][]string
+
+// needs is the requirement of all of keys.
+func needs(keys ...string) requirement {
+	return requirement{keys}
+}
+
+// manifestSource is the requirement of commands taking manifestFlags.
+var manifestSource = requirement{{"manifest"}, {"manifestFile"}, {"name", "chart"}}
+
+var (
+	manifestFlags = append([]commandFlag{
+		{Name: "manifest", Help: "Manifest YAML"},
+		{Name: "manifest-file", Help: "Read the manifest from a file", File: true},
+		{Name: "name", Help: "Release name, to render a chart instead"},
+		{Name: "chart", Help: "Chart path or reference", File: true},
+		{Name: "values", Help: "Chart values (JSON object)"},
+		{Name: "values-files", Help: "Chart values files, applied before values (JSON list)"},
+		{Name: "layers", Help: "Values layers, each values files and values, applied in order after values-files (JSON list)"},
+		{Name: "set", Help: "key=value overrides, applied last (JSON list or object)"},
+		{Name: "sops-decrypt", Help: "Decrypt SOPS-encrypted values files for helm, without writing them to disk", Switch: true},
+		{Name: "age-key-file", Help: "age identity for sops-decrypt", File: true},
+		{Name: "gpg-home", Help: "GnuPG home for sops-decrypt", File: true},
+	}, append(valuesSchemaFlags, chartSourceFlags...)...)
+	// valuesSchemaFlags choose what the values are checked against before
+	// rendering.
+	valuesSchemaFlags = []commandFlag{
+		{Name: "values-schema", Help: "JSON Schema the values must match, besides the chart's values.schema.json (JSON object)"},
+		{Name: "values-schema-file", Help: "Read the values-schema from a file", File: true},
+		{Name: "skip-schema-validation", Help: "Render without checking the values against any schema first", Switch: true},
+	}
+	// chartSourceFlags locate a chart in a repository or registry.
+	chartSourceFlags = []commandFlag{
+		{Name: "version", Help: "Chart version or constraint, for a repository or OCI chart"},
+		{Name: "repo-url", Key: "repoURL", Help: "Chart repository (https:// or oci://) to take the chart from by name"},
+		{Name: "username", Help: "Chart repository or registry username"},
+		{Name: "password", Help: "Chart repository or registry password"},
+		{Name: "ca-file", Help: "CA bundle of the chart repository", File: true},
+		{Name: "cert-file", Help: "Client certificate for the chart repository", File: true},
+		{Name: "key-file", Help: "Client key for the chart repository", File: true},
+		{Name: "insecure-skip-tls-verify", Key: "insecureSkipTLSVerify", Help: "Skip TLS verification of the chart repository", Switch: true},
+		{Name: "pass-credentials", Help: "Send the credentials to every domain the repository links charts on", Switch: true},
+		{Name: "skip-dependencies", Help: "Render a local chart without resolving its dependencies into charts/", Switch: true},
+	}
+	clusterFlags = []commandFlag{
+		{Name: "kubeconfig", Help: "Kubeconfig path", File: true},
+		{Name: "kubeconfig-content", Help: "Inline kubeconfig"},
+		{Name: "context", Help: "Kubeconfig context (default: the current one)"},
+		{Name: "in-cluster", Help: "Use the mounted ServiceAccount token", Switch: true},
+		{Name: "cloud-auth", Help: "EKS, GKE or AKS credentials (JSON)"},
+		{Name: "as", Help: "Impersonate a user"},
+		{Name: "as-groups", Help: "Impersonate groups (JSON list)"},
+		{Name: "proxy-url", Key: "proxyURL", Help: "Reach the cluster through a proxy"},
+		{Name: "ssh-tunnel", Help: "Reach the cluster through an SSH tunnel (JSON)"},
+		{Name: "refresh-discovery", Help: "Ignore cached discovery data", Switch: true},
+	}
+	// helmReleaseFlags are the flags of helm-install and helm-upgrade.
+	helmReleaseFlags = flags([]commandFlag{
+		{Name: "name", Help: "Release name"},
+		{Name: "chart", Help: "Chart path or reference", File: true},
+		{Name: "values", Help: "Chart values (JSON object)"},
+		{Name: "values-files", Help: "Chart values files, applied before values (JSON list)"},
+		{Name: "layers", Help: "Values layers, each values files and values, applied in order after values-files (JSON list)"},
+		{Name: "set", Help: "key=value overrides, applied last (JSON list or object)"},
+		{Name: "sops-decrypt", Help: "Decrypt SOPS-encrypted values files for helm, without writing them to disk", Switch: true},
+		{Name: "age-key-file", Help: "age identity for sops-decrypt", File: true},
+		{Name: "gpg-home", Help: "GnuPG home for sops-decrypt", File: true},
+	}, valuesSchemaFlags, chartSourceFlags, []commandFlag{
+		{Name: "namespace", Help: "Release namespace (default: the context's)"},
+		{Name: "create-namespace", Help: "Create the namespace if it does not exist", Switch: true},
+		{Name: "wait", Help: "Wait for the release's workloads to be ready", Switch: true},
+		{Name: "wait-for-jobs", Help: "Also wait for its Jobs to complete", Switch: true},
+		{Name: "atomic", Help: "Undo a release that fails; implies wait", Switch: true},
+		{Name: "timeout", Help: "How long to wait (default 5m)"},
+		{Name: "description", Help: "Description of the revision"},
+	})
+	// globalFlags apply to every command.
+	globalFlags = []commandFlag{
+		{Name: "debug", Help: "Include the helm, kubectl and HTTP calls made, with timings and stderr", Switch: true},
+		{Name: "api-version", Help: "Envelope version (" + apiVersion + "): reject unknown fields, return error codes"},
+		{Name: "timeout-seconds", Help: "Stop the command and its helm and kubectl processes after this long (default INFRAKIT_TIMEOUT or 10m; 0 is none)"},
+		{Name: "log-level", Help: "Lowest level logged to stderr (default INFRAKIT_LOG_LEVEL or info)", Values: []string{"debug", "info", "warn", "error"}},
+		{Name: "log-format", Help: "Log format (default INFRAKIT_LOG_FORMAT or text)", Values: []string{"text", "json"}},
+		{Name: "tools-config", Help: "Tool paths, versions, environment and sandbox (default INFRAKIT_TOOLS_CONFIG)", File: true},
+		{Name: "helm-path", Help: "helm binary to run instead of the one on PATH", File: true},
+		{Name: "kubectl-path", Help: "kubectl binary to run instead of the one on PATH", File: true},
+		{Name: "scrub-env", Help: "Pass tools only the allowlisted environment variables", Switch: true},
+		{Name: "sandbox-tools", Help: "Run tools in a working directory and HOME of their own", Switch: true},
+		{Name: "output", Help: "How the command line prints the result (default: its report, else compact JSON)", Values: outputFormats},
+		{Name: "pretty", Help: "Indent JSON output", Switch: true},
+	}
+)
+
+func flags(groups ...[]commandFlag) []commandFlag {
+	var out []commandFlag
+	for _, g := range groups {
+		out = append(out, g...)
+	}
+	return out
+}
+
+// commands is filled in init, as some commands dispatch others.
+var commands []command
+
+func init() {
+	commands = []command{
+		{Name: "generate-helm", Summary: "Render a chart with helm template", Requires: []requirement{needs("name", "chart")}, Request: []interface{}{helmChartInput{}, transformRequest{}, renderCacheInput{}, renderOutput{}}, Run: generateHelm, Flags: flags([]commandFlag{
+			{Name: "name", Help: "Release name"},
+			{Name: "chart", Help: "Chart path or reference", File: true},
+			{Name: "values", Help: "Chart values (JSON object)"},
+			{Name: "values-files", Help: "Chart values files, applied before values (JSON list)"},
+			{Name: "layers", Help: "Values layers, each values files and values, applied in order after values-files (JSON list)"},
+			{Name: "set", Help: "key=value overrides, applied last (JSON list or object)"},
+			{Name: "sops-decrypt", Help: "Decrypt SOPS-encrypted values files for helm, without writing them to disk", Switch: true},
+			{Name: "age-key-file", Help: "age identity for sops-decrypt", File: true},
+			{Name: "gpg-home", Help: "GnuPG home for sops-decrypt", File: true},
+		}, valuesSchemaFlags, chartSourceFlags, []commandFlag{
+			{Name: "transforms", Help: "Transformations to apply to the manifest, in order (JSON list)"},
+			{Name: "cache", Help: "Reuse identical renders, kept in memory or also on disk (default INFRAKIT_RENDER_CACHE_TTL or 10m)", Values: []string{"memory", "disk"}},
+			{Name: "output", Help: "Return the manifest as one string or as documents with their metadata", Values: []string{"manifest", "structured"}},
+			{Name: "output-file", Help: "Write the manifest to a file", File: true},
+			{Name: "stream", Help: "Stream the manifest as NDJSON chunks", Switch: true},
+		})},
+		{Name: "generate-kustomize", Summary: "Render a kustomization with kustomize build", Requires: []requirement{{{"dir"}, {"resources"}}}, Request: []interface{}{kustomizeRequest{}, renderOutput{}}, Run: generateKustomize, Flags: []commandFlag{
+			{Name: "dir", Help: "Kustomization directory", File: true},
+			{Name: "resources", Help: "Inline manifests (JSON list)"},
+			{Name: "patches", Help: "Inline patches or patches entries (JSON list)"},
+			{Name: "kustomization", Help: "Further kustomization.yaml fields (JSON object)"},
+			{Name: "enable-helm", Help: "Inflate helmCharts with the managed helm", Switch: true},
+			{Name: "output", Help: "Return the manifest as one string or as documents with their metadata", Values: []string{"manifest", "structured"}},
+			{Name: "output-file", Help: "Write the manifest to a file", File: true},
+			{Name: "stream", Help: "Stream the manifest as NDJSON chunks", Switch: true},
+		}},
+		{Name: "decrypt", Summary: "Decrypt a SOPS-encrypted file", Requires: []requirement{{{"file"}, {"content"}}}, Request: []interface{}{decryptRequest{}}, Run: decrypt, Flags: []commandFlag{
+			{Name: "file", Help: "Encrypted file", File: true},
+			{Name: "content", Help: "Encrypted content"},
+			{Name: "format", Help: "File format (default: by extension, else yaml)", Values: []string{"yaml", "json", "dotenv", "ini", "binary"}},
+			{Name: "age-key-file", Help: "age identity file", File: true},
+			{Name: "gpg-home", Help: "GnuPG home directory", File: true},
+		}},
+		{Name: "transform", Summary: "Add labels, annotations, a namespace, image overrides or pull secrets to a manifest", Requires: []requirement{manifestSource, needs("transforms")}, Request: []interface{}{transformRequest{}, manifestInput{}, renderOutput{}}, Run: transform, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "transforms", Help: "Transformations to apply, in order (JSON list of objects with a type: labels, annotations, namespace, images, registry or imagePullSecrets)"},
+			{Name: "output", Help: "Return the manifest as one string or as documents with their metadata", Values: []string{"manifest", "structured"}},
+			{Name: "output-file", Help: "Write the manifest to a file", File: true},
+			{Name: "stream", Help: "Stream the manifest as NDJSON chunks", Switch: true},
+		})},
+		{Name: "resolve-images", Summary: "Pin the images of a manifest to their registry digests", Requires: []requirement{manifestSource}, Request: []interface{}{resolveImagesRequest{}, manifestInput{}, renderOutput{}}, Run: resolveImages, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "keep-tags", Help: "Pin as name:tag@digest, keeping the tag", Switch: true},
+			{Name: "registry-credentials", Help: "Registry logins by host (JSON object of {username, password})"},
+			{Name: "output", Help: "Return the manifest as one string or as documents with their metadata", Values: []string{"manifest", "structured"}},
+			{Name: "output-file", Help: "Write the manifest to a file", File: true},
+			{Name: "stream", Help: "Stream the manifest as NDJSON chunks", Switch: true},
+		})},
+		{Name: "validate-k8s", Summary: "Dry-run a manifest against the cluster", Requires: []requirement{manifestSource}, Request: []interface{}{offlineValidationRequest{}, validationTarget{}, batchInput{}, manifestInput{}, clusterInput{}}, Run: validateK8s, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "namespace", Help: "Namespace for resources that do not set one"},
+			{Name: "create-namespace", Help: "Create the namespace if it does not exist", Switch: true},
+			{Name: "batch-size", Help: "Validate documents in parallel batches of this size"},
+			{Name: "parallelism", Help: "Concurrent batches"},
+			{Name: "offline", Help: "Check against Kubernetes schemas instead of a cluster", Switch: true},
+			{Name: "kubernetes-version", Help: "Schemas to check offline against, e.g. v1.29.2 (default: newest cached)"},
+			{Name: "schema-base-url", Key: "schemaBaseURL", Help: "Where to download schemas from"},
+			{Name: "strict", Help: "Offline, report fields the schemas do not declare", Switch: true},
+			{Name: "crds", Help: "CustomResourceDefinition manifests to validate custom resources against (JSON list)"},
+			{Name: "crd-files", Help: "CRD manifest files or directories (JSON list)"},
+			{Name: "chart-crds", Key: "chartCRDs", Help: "Also validate against the CRDs in the chart's crds/ directories", Switch: true},
+			{Name: "custom-resources", Help: "Dry-run custom resources, or check those with a CRD schema against it here (default server)", Values: []string{"server", "structural"}},
+		}, clusterFlags)},
+		{Name: "check-compatibility", Summary: "Check the API versions of a manifest against the cluster", Requires: []requirement{manifestSource}, Run: checkCompatibility, Flags: flags(manifestFlags, clusterFlags)},
+		{Name: "bootstrap-namespace", Summary: "Generate (and apply) a namespace with quotas, policies and RBAC", Requires: []requirement{needs("namespace")}, Request: []interface{}{namespaceSpec{}, clusterInput{}}, Run: bootstrapNamespace, Flags: flags([]commandFlag{
+			{Name: "namespace", Help: "Namespace name"},
+			{Name: "team", Help: "Owning team"},
+			{Name: "pod-security", Help: "Pod Security level", Values: []string{"privileged", "baseline", "restricted"}},
+			{Name: "apply", Help: "Apply the namespace", Switch: true},
+			{Name: "backup", Help: "Back up the live state before applying", Switch: true},
+		}, clusterFlags)},
+		{Name: "generate-rbac", Summary: "Derive least-privilege RBAC for a ServiceAccount", Requires: []requirement{needs("serviceAccount")}, Request: []interface{}{rbacRequest{}, manifestInput{}}, Run: generateRBAC, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "service-account", Help: "ServiceAccount name and namespace (JSON)"},
+			{Name: "verbs", Help: "Verbs to grant (JSON list)"},
+			{Name: "restrict-names", Help: "Limit verbs to the objects in the manifest", Switch: true},
+			{Name: "audit-log", Help: "Audit events to derive permissions from"},
+		})},
+		{Name: "plan-rollout", Summary: "Plan a multi-cluster rollout in waves", Requires: []requirement{needs("clusters"), manifestSource}, Request: []interface{}{rolloutRequest{}, manifestInput{}}, Run: planRollout, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "clusters", Help: "Clusters in rollout order (JSON)"},
+			{Name: "wave-size", Help: "Clusters per wave after the canary"},
+			{Name: "promotion", Help: "Soak and timeout settings (JSON)"},
+		})},
+		{Name: "generate-progressive", Summary: "Convert Deployments to canary or blue-green resources", Requires: []requirement{manifestSource}, Request: []interface{}{progressiveRequest{}, manifestInput{}}, Run: generateProgressive, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "strategy", Help: "Delivery strategy", Values: []string{"argo-canary", "argo-bluegreen", "flagger", "blue-green"}},
+			{Name: "deployment", Help: "Convert only this Deployment"},
+			{Name: "auto-promote", Help: "Promote without manual approval", Switch: true},
+		})},
+		{Name: "backup", Summary: "Save the live state of a manifest's resources", Requires: []requirement{manifestSource}, Run: backupResources, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "backup-dir", Help: "Archive directory", File: true},
+		}, clusterFlags)},
+		{Name: "restore", Summary: "Re-apply a backup archive", Requires: []requirement{needs("archive")}, Run: restoreBackup, Flags: flags([]commandFlag{
+			{Name: "archive", Help: "Backup archive", File: true},
+			{Name: "delete-created", Help: "Delete resources created since the backup", Switch: true},
+		}, clusterFlags)},
+		{Name: "find-orphans", Summary: "List live resources a release no longer renders", Requires: []requirement{{{"release"}, {"selector"}}}, Run: findOrphans, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "release", Help: "Release whose labels select resources"},
+			{Name: "selector", Help: "Label selector"},
+			{Name: "namespace", Help: "Namespace to search"},
+			{Name: "kinds", Help: "Kinds to search (JSON list)"},
+		}, clusterFlags)},
+		{Name: "diff-k8s", Summary: "Preview what applying a manifest would change in the cluster", Requires: []requirement{manifestSource}, Request: []interface{}{diffK8sRequest{}, manifestInput{}, clusterInput{}}, Run: diffK8s, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "namespace", Help: "Namespace for resources that do not set one"},
+			{Name: "release", Help: "Also report resources with this release's labels that are no longer rendered"},
+			{Name: "selector", Help: "Also report resources matching this label selector that are no longer rendered"},
+			{Name: "ignore", Help: "Field paths to leave out of the comparison (JSON list)"},
+		}, clusterFlags)},
+		{Name: "detect-drift", Summary: "Report resources modified, missing or orphaned in the cluster since they were declared", Requires: []requirement{{{"manifest"}, {"manifestFile"}, {"name", "chart"}, {"release"}}}, Request: []interface{}{driftRequest{}, manifestInput{}, clusterInput{}}, Run: detectDrift, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "namespace", Help: "Namespace for resources that do not set one"},
+			{Name: "release", Help: "Report resources with this release's labels that are not declared; without a manifest, compare the release's own"},
+			{Name: "selector", Help: "Report resources matching this label selector that are not declared"},
+			{Name: "ignore", Help: "Field paths to leave out, or Kind:path for one kind (JSON list)"},
+			{Name: "scaled-replicas", Help: "Compare the replicas of workloads a HorizontalPodAutoscaler scales", Switch: true},
+		}, clusterFlags)},
+		{Name: "apply-k8s", Summary: "Apply a manifest and record it as a release revision", Requires: []requirement{manifestSource}, Request: []interface{}{applyRequest{}, manifestInput{}, clusterInput{}}, Run: applyK8s, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "release", Help: "Release to label the resources with and record revisions for"},
+			{Name: "namespace", Help: "Namespace for resources that do not set one"},
+			{Name: "create-namespace", Help: "Create the namespace if it does not exist", Switch: true},
+			{Name: "server-side", Key: "serverSide", Help: "Use server-side apply", Switch: true},
+			{Name: "field-manager", Key: "fieldManager", Help: "Field manager name (default infrakit with --server-side)"},
+			{Name: "force-conflicts", Key: "forceConflicts", Help: "Take over fields owned by other managers", Switch: true},
+			{Name: "dry-run", Key: "dryRun", Help: "client or server", Values: []string{"client", "server"}},
+			{Name: "wait", Help: "Wait for workloads to roll out and Jobs to complete", Switch: true},
+			{Name: "timeout", Help: "How long to wait (default 5m)"},
+			{Name: "prune", Help: "Delete the release's resources the manifest no longer contains", Switch: true},
+			{Name: "backup", Help: "Back up the live state before applying", Switch: true},
+			{Name: "backup-dir", Help: "Archive directory (default INFRAKIT_BACKUP_DIR)", File: true},
+		}, clusterFlags)},
+		{Name: "rollback", Summary: "Re-apply an earlier revision of a release", Requires: []requirement{needs("release")}, Request: []interface{}{rollbackRequest{}, applyRequest{}, clusterInput{}}, Run: rollbackK8s, Flags: flags([]commandFlag{
+			{Name: "release", Help: "Release to roll back"},
+			{Name: "revision", Help: "Revision to return to (default the previous one)"},
+			{Name: "list", Help: "List the recorded revisions", Switch: true},
+			{Name: "server-side", Key: "serverSide", Help: "Use server-side apply", Switch: true},
+			{Name: "field-manager", Key: "fieldManager", Help: "Field manager name"},
+			{Name: "wait", Help: "Wait for workloads to roll out and Jobs to complete", Switch: true},
+			{Name: "timeout", Help: "How long to wait (default 5m)"},
+		}, clusterFlags)},
+		{Name: "helm-install", Summary: "Install a chart as a helm release", Requires: []requirement{needs("name", "chart")}, Request: []interface{}{helmChartInput{}, helmReleaseOptions{}, clusterInput{}}, Run: helmInstall, Flags: flags(helmReleaseFlags, clusterFlags)},
+		{Name: "helm-upgrade", Summary: "Upgrade a helm release", Requires: []requirement{needs("name", "chart")}, Request: []interface{}{helmChartInput{}, helmReleaseOptions{}, helmUpgradeOptions{}, clusterInput{}}, Run: helmUpgrade, Flags: flags(helmReleaseFlags, []commandFlag{
+			{Name: "install", Help: "Install the release if it does not exist", Switch: true},
+			{Name: "reuse-values", Help: "Merge the values over the last release's", Switch: true},
+			{Name: "reset-values", Help: "Start from the chart's default values", Switch: true},
+			{Name: "cleanup-on-fail", Help: "Delete the objects a failed upgrade created", Switch: true},
+			{Name: "max-history", Help: "Revisions to keep (default 10)"},
+			{Name: "backup", Help: "Back up the release's live state before upgrading", Switch: true},
+			{Name: "backup-dir", Help: "Archive directory (default INFRAKIT_BACKUP_DIR)", File: true},
+		}, clusterFlags)},
+		{Name: "helm-uninstall", Summary: "Uninstall a helm release", Requires: []requirement{needs("name")}, Request: []interface{}{helmUninstallRequest{}, clusterInput{}}, Run: helmUninstall, Flags: flags([]commandFlag{
+			{Name: "name", Help: "Release name"},
+			{Name: "namespace", Help: "Release namespace (default: the context's)"},
+			{Name: "keep-history", Help: "Keep the release's revisions", Switch: true},
+			{Name: "wait", Help: "Wait for the release's objects to be deleted", Switch: true},
+			{Name: "timeout", Help: "How long to wait (default 5m)"},
+		}, clusterFlags)},
+		{Name: "helm-history", Summary: "List the revisions of a helm release", Requires: []requirement{needs("name")}, Request: []interface{}{helmHistoryRequest{}, clusterInput{}}, Run: helmHistory, Flags: flags([]commandFlag{
+			{Name: "name", Help: "Release name"},
+			{Name: "namespace", Help: "Release namespace (default: the context's)"},
+			{Name: "max", Help: "List only the most recent revisions"},
+		}, clusterFlags)},
+		{Name: "diagnose", Summary: "Collect events, pod states and logs for workloads", Requires: []requirement{manifestSource}, Run: diagnose, Flags: flags(manifestFlags, clusterFlags)},
+		{Name: "wait-rollout", Summary: "Wait for workloads to roll out and explain those that do not", Requires: []requirement{{{"workloads"}, {"manifest"}, {"manifestFile"}, {"name", "chart"}}}, Request: []interface{}{rolloutWaitRequest{}, manifestInput{}, clusterInput{}}, Run: waitRollout, Flags: flags([]commandFlag{
+			{Name: "workloads", Help: "Workloads to wait for: kind, name and namespace (JSON list; default: those of the manifest)"},
+			{Name: "namespace", Help: "Namespace of workloads that do not set one"},
+			{Name: "timeout", Help: "How long to wait (Go duration, default 5m)"},
+			{Name: "interval", Help: "How often to read each workload's status (Go duration, default 2s)"},
+		}, manifestFlags, clusterFlags)},
+		{Name: "render-many", Summary: "Render many charts concurrently", Requires: []requirement{needs("charts")}, Request: []interface{}{renderManyRequest{}}, Run: renderMany, Flags: []commandFlag{
+			{Name: "charts", Help: "Charts to render (JSON list)"},
+			{Name: "parallelism", Help: "Concurrent helm processes"},
+			{Name: "output-dir", Help: "Write manifests to this directory", File: true},
+			{Name: "update-repos", Help: "Update repository indexes first", Switch: true},
+			{Name: "incremental", Help: "Skip charts unchanged since the last run", Switch: true},
+			{Name: "state-file", Help: "Incremental state file", File: true},
+		}},
+		{Name: "batch", Summary: "Run many commands in one process with a worker pool", Requires: []requirement{needs("jobs")}, Request: []interface{}{batchRequest{}}, Run: batch, Flags: []commandFlag{
+			{Name: "jobs", Help: "Jobs: id, command and input (JSON list)"},
+			{Name: "defaults", Help: "Input merged into every job (JSON object)"},
+			{Name: "parallelism", Help: "Concurrent jobs (default: CPU count)"},
+			{Name: "fail-fast", Help: "Skip the remaining jobs after a failure", Switch: true},
+		}},
+		{Name: "prune-helm-cache", Summary: "Evict old charts from the helm cache", Run: pruneHelmCache},
+		{Name: "cache-clear", Summary: "Drop the renders generate-helm cached", Run: cacheClear},
+		{Name: "clear-discovery-cache", Summary: "Drop cached cluster discovery data", Run: clearDiscoveryCache, Flags: flags([]commandFlag{
+			{Name: "all", Help: "Clear every cluster", Switch: true},
+		}, clusterFlags)},
+		{Name: "ops", Summary: "List in-flight and recent operations", Run: listOperations, Flags: []commandFlag{
+			{Name: "limit", Help: "Recent operations to list"},
+		}},
+		{Name: "history", Summary: "Query the audit log of past operations", Request: []interface{}{historyRequest{}}, Run: history, Flags: []commandFlag{
+			{Name: "command", Help: "Only runs of this command"},
+			{Name: "status", Help: "Only runs that ended so", Values: []string{"succeeded", "failed"}},
+			{Name: "caller", Help: "Only runs by this user, or caller name or address"},
+			{Name: "cluster", Help: "Only runs against this API server or context"},
+			{Name: "since", Help: "Runs started since a time or duration ago"},
+			{Name: "until", Help: "Runs started until a time or duration ago"},
+			{Name: "limit", Help: "Runs to list (default 50)"},
+			{Name: "sink", Help: "Audit sink to read (jsonl:<path> or sqlite:<path>)"},
+		}},
+		{Name: "bench", Summary: "Benchmark renders and validations", Requires: []requirement{needs("name", "chart")}, Request: []interface{}{benchRequest{}, manifestInput{}, clusterInput{}}, Run: bench, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "operation", Help: "What to benchmark", Values: []string{"render", "validate", "render-validate"}},
+			{Name: "iterations", Help: "Runs"},
+			{Name: "parallelism", Help: "Concurrent runs"},
+		}, clusterFlags)},
+		{Name: "warm", Summary: "Prefetch discovery, schemas and charts", Request: []interface{}{warmRequest{}, clusterInput{}}, Run: warm, Flags: flags([]commandFlag{
+			{Name: "kubernetes-versions", Help: "Versions to fetch schemas for (JSON list)"},
+			{Name: "kubeconfigs", Help: "Additional clusters (JSON list)"},
+			{Name: "schema-base-url", Key: "schemaBaseURL", Help: "JSON schema mirror"},
+			{Name: "charts", Help: "Charts to pull (JSON list)"},
+			{Name: "skip-cluster", Help: "Skip the request's own cluster", Switch: true},
+		}, clusterFlags)},
+		{Name: "replay", Summary: "Run a recorded operation again", Requires: []requirement{needs("id")}, Run: replay, Flags: []commandFlag{
+			{Name: "id", Help: "Operation id, as listed by ops"},
+			{Name: "overrides", Help: "Values merged over the recorded request (JSON)"},
+			{Name: "allow-redacted", Help: "Run with redacted values left in", Switch: true},
+		}},
+		{Name: "snapshot", Summary: "Compare a normalized render with a golden file", Requires: []requirement{needs("golden"), {{"manifest"}, {"name", "chart"}}}, Request: []interface{}{snapshotRequest{}}, Run: snapshot, Flags: []commandFlag{
+			{Name: "name", Help: "Release name"},
+			{Name: "chart", Help: "Chart path or reference", File: true},
+			{Name: "manifest", Help: "Manifest to compare instead of a render"},
+			{Name: "golden", Help: "Golden file", File: true},
+			{Name: "update", Help: "Rewrite the golden file", Switch: true},
+			{Name: "ignore", Help: "Fields to mask (JSON list)"},
+		}},
+		{Name: "unittest-helm", Summary: "Run helm-unittest style suites against a chart", Requires: []requirement{needs("chart")}, Request: []interface{}{unittestRequest{}}, Run: unittestHelm, Flags: []commandFlag{
+			{Name: "chart", Help: "Chart under test", File: true},
+			{Name: "name", Help: "Release name"},
+			{Name: "namespace", Help: "Release namespace"},
+			{Name: "suites", Help: "Suite files (JSON list)"},
+		}},
+		{Name: "test-chart", Summary: "Test a chart's renders of its value fixtures against expectations and snapshots", Requires: []requirement{needs("chart")}, Request: []interface{}{chartTestRequest{}}, Run: testChart, Flags: []commandFlag{
+			{Name: "chart", Help: "Local chart under test", File: true},
+			{Name: "name", Help: "Release name (default release-name)"},
+			{Name: "namespace", Help: "Release namespace"},
+			{Name: "tests", Help: "Test cases, instead of tests/chart-tests.yaml and the ci/*-values.yaml fixtures (JSON list)"},
+			{Name: "run", Help: "Only run tests whose name contains this"},
+			{Name: "update-snapshots", Help: "Write the snapshots of the tests run instead of comparing them", Switch: true},
+			{Name: "ignore", Help: "Fields to mask in every snapshot (JSON list)"},
+			{Name: "parallelism", Help: "Concurrent renders (default: CPU count)"},
+		}},
+		{Name: "render-matrix", Summary: "Render a chart for every combination of values", Requires: []requirement{needs("name", "chart", "dimensions")}, Request: []interface{}{matrixRequest{}, clusterInput{}}, Run: renderMatrix, Flags: flags([]commandFlag{
+			{Name: "name", Help: "Release name"},
+			{Name: "chart", Help: "Chart path or reference", File: true},
+			{Name: "dimensions", Help: "Matrix dimensions and options (JSON)"},
+			{Name: "exclude", Help: "Combinations to skip (JSON)"},
+			{Name: "validate", Help: "Validate every combination", Switch: true},
+			{Name: "parallelism", Help: "Concurrent renders"},
+			{Name: "include-manifests", Help: "Return the rendered manifests", Switch: true},
+		}, clusterFlags)},
+		{Name: "generate-env-matrix", Summary: "Render a chart for each environment over layered values", Requires: []requirement{needs("name", "chart", "environments")}, Request: []interface{}{envMatrixRequest{}}, Run: generateEnvMatrix, Flags: flags([]commandFlag{
+			{Name: "name", Help: "Release name"},
+			{Name: "chart", Help: "Chart path or reference", File: true},
+			{Name: "values", Help: "Base values (JSON object)"},
+			{Name: "values-files", Help: "Base values files, applied before values (JSON list)"},
+			{Name: "layers", Help: "Base values layers, applied after values-files (JSON list)"},
+			{Name: "set", Help: "key=value overrides of every environment, applied before its own (JSON list or object)"},
+			{Name: "environments", Help: "Environments, each a name, namespace, valuesFiles, values and set over the base (JSON list)"},
+			{Name: "parallelism", Help: "Concurrent renders"},
+			{Name: "output-dir", Help: "Write each manifest to <environment>.yaml in this directory", File: true},
+			{Name: "sops-decrypt", Help: "Decrypt SOPS-encrypted values files for helm, without writing them to disk", Switch: true},
+			{Name: "age-key-file", Help: "age identity for sops-decrypt", File: true},
+			{Name: "gpg-home", Help: "GnuPG home for sops-decrypt", File: true},
+		}, valuesSchemaFlags, chartSourceFlags)},
+		{Name: "diff-chart-versions", Summary: "Show what bumping a chart version changes", Requires: []requirement{{{"name", "chart"}, {"name", "fromChart", "toChart"}}}, Request: []interface{}{chartDiffRequest{}}, Run: diffChartVersions, Flags: []commandFlag{
+			{Name: "name", Help: "Release name"},
+			{Name: "chart", Help: "Chart reference", File: true},
+			{Name: "from-version", Help: "Current version"},
+			{Name: "to-version", Help: "New version"},
+			{Name: "from-chart", Help: "Chart for the current side", File: true},
+			{Name: "to-chart", Help: "Chart for the new side", File: true},
+			{Name: "values-files", Help: "Values files (JSON list)"},
+			{Name: "ignore", Help: "Fields to mask (JSON list)"},
+		}},
+		{Name: "hook", Summary: "Check changed charts and manifests before a commit", Request: []interface{}{hookRequest{}, clusterInput{}}, Run: hookCheck, Flags: flags([]commandFlag{
+			{Name: "staged", Help: "Check the git index", Switch: true},
+			{Name: "validate", Help: "Also validate against the cluster", Switch: true},
+		}, clusterFlags)},
+		{Name: "ui", Summary: "Browse a render, its findings and diffs in the terminal", Requires: []requirement{manifestSource}, Run: ui, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "against", Help: "Previous render or golden file to diff against", File: true},
+			{Name: "findings-file", Help: "Saved result with findings", File: true},
+		})},
+		{Name: "validate-versions", Summary: "Validate against several Kubernetes versions' schemas or clusters", Requires: []requirement{{{"kubernetesVersions"}, {"clusters"}}, manifestSource}, Request: []interface{}{versionMatrixRequest{}, manifestInput{}, clusterInput{}}, Run: validateVersions, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "kubernetes-versions", Help: "Versions to check offline (JSON list), e.g. [\"v1.28.0\",\"v1.29.2\"]"},
+			{Name: "clusters", Help: "Clusters to dry-run against (JSON list of {name, kubeconfig})"},
+			{Name: "schema-base-url", Key: "schemaBaseURL", Help: "Where to download schemas from"},
+			{Name: "strict", Help: "Report fields the schemas do not declare", Switch: true},
+			{Name: "crds", Help: "CustomResourceDefinition manifests to validate custom resources against (JSON list)"},
+			{Name: "crd-files", Help: "CRD manifest files or directories (JSON list)"},
+			{Name: "chart-crds", Key: "chartCRDs", Help: "Also validate against the CRDs in the chart's crds/ directories", Switch: true},
+		}, clusterFlags)},
+		{Name: "check-chart-deps", Summary: "Report chart dependencies with newer versions available", Requires: []requirement{needs("chart")}, Request: []interface{}{chartDepsRequest{}}, Run: checkChartDeps, Flags: []commandFlag{
+			{Name: "chart", Help: "Chart directory", File: true},
+			{Name: "include-prerelease", Help: "Count pre-releases as updates", Switch: true},
+			{Name: "fail-on", Help: "Fail when an update of this size exists", Values: []string{"major", "minor", "patch"}},
+		}},
+		{Name: "scan-licenses", Summary: "Check image and chart licenses against an allow/deny policy", Requires: []requirement{{{"manifest"}, {"manifestFile"}, {"name", "chart"}, {"images"}}}, Request: []interface{}{licenseScanRequest{}, manifestInput{}}, Run: scanLicenses, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "images", Help: "Additional images (JSON list)"},
+			{Name: "allow", Help: "Acceptable SPDX license IDs (JSON list)"},
+			{Name: "deny", Help: "Forbidden SPDX license IDs (JSON list)"},
+			{Name: "fail-on-unknown", Help: "Fail for components without license information", Switch: true},
+			{Name: "platform", Help: "Platform of multi-platform images (default linux/amd64)"},
+		})},
+		{Name: "sbom", Summary: "Generate a CycloneDX or SPDX document for the charts and images of a render", Requires: []requirement{manifestSource}, Request: []interface{}{sbomRequest{}, manifestInput{}}, Run: generateSBOM, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "format", Help: "Document format (default cyclonedx)", Values: []string{"cyclonedx", "spdx"}},
+			{Name: "images", Help: "Additional images (JSON list)"},
+			{Name: "resolve-digests", Help: "Look up the digests of images referenced by tag", Switch: true},
+			{Name: "output-file", Help: "Write the document to a file", File: true},
+		})},
+		{Name: "sign-manifest", Summary: "Sign a manifest and its provenance with cosign", Requires: []requirement{manifestSource}, Request: []interface{}{signRequest{}, manifestInput{}}, Run: signManifest, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "key", Help: "cosign private key file or KMS URI (default: keyless)"},
+			{Name: "key-password", Help: "Password of the key"},
+			{Name: "identity-token", Help: "OIDC token for keyless signing"},
+			{Name: "no-tlog", Help: "Do not upload the signature to the transparency log", Switch: true},
+			{Name: "output-dir", Help: "Write the manifest, provenance and signature bundle here", File: true},
+		})},
+		{Name: "verify-manifest", Summary: "Verify a signed manifest bundle and its provenance", Requires: []requirement{{{"dir"}, {"provenanceFile", "bundleFile"}}}, Request: []interface{}{verifyRequest{}, manifestInput{}}, Run: verifyManifest, Flags: []commandFlag{
+			{Name: "dir", Help: "Bundle directory sign-manifest wrote", File: true},
+			{Name: "manifest", Help: "Manifest YAML (default: the bundle's)"},
+			{Name: "manifest-file", Help: "Read the manifest from a file", File: true},
+			{Name: "provenance-file", Help: "Provenance statement (default: the bundle's)", File: true},
+			{Name: "bundle-file", Help: "Sigstore bundle of its signature (default: the bundle's)", File: true},
+			{Name: "key", Help: "cosign public key file or KMS URI"},
+			{Name: "certificate-identity", Help: "Identity a keyless signature must be made by"},
+			{Name: "certificate-oidc-issuer", Key: "certificateOIDCIssuer", Help: "OIDC issuer of that identity"},
+			{Name: "no-tlog", Help: "Do not check the transparency log", Switch: true},
+			{Name: "expect", Help: "Provenance parameters that must match, e.g. {\"chartVersion\":\"1.4.2\"} (JSON)"},
+		}},
+		{Name: "policy-check", Summary: "Check a manifest against Rego, CEL and built-in policies", Requires: []requirement{manifestSource}, Request: []interface{}{policyCheckRequest{}, manifestInput{}}, Run: policyCheck, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "policies", Help: "Policy files or directories (JSON list)"},
+			{Name: "inline", Help: "Rego modules or ValidatingAdmissionPolicies as text (JSON list)"},
+			{Name: "bundles", Help: "Configured policy bundles to include, * for all (JSON list)"},
+			{Name: "builtin", Help: "Add the built-in rules (the default without other policies)", Switch: true},
+			{Name: "skip", Help: "Rule IDs to ignore (JSON list)"},
+			{Name: "fail-on", Key: "failOn", Help: "Lowest severity that fails the check", Values: []string{"error", "warning", "info"}},
+		})},
+		{Name: "lint-k8s", Summary: "Check a manifest against built-in best practices", Requires: []requirement{manifestSource}, Request: []interface{}{lintRequest{}, manifestInput{}}, Run: lintK8s, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "kubernetes-version", Help: "Target Kubernetes version for deprecated APIs, e.g. v1.29"},
+			{Name: "enable", Help: "Run only these checks (JSON list): missing-probes, deprecated-api, missing-labels, host-path, default-namespace"},
+			{Name: "disable", Help: "Checks to leave out (JSON list)"},
+			{Name: "required-labels", Help: "Labels every resource must have (JSON list, default app.kubernetes.io/name)"},
+			{Name: "fail-on", Key: "failOn", Help: "Lowest severity that fails the lint", Values: []string{"error", "warning", "info"}},
+		})},
+		{Name: "check-deprecations", Summary: "Report deprecated and removed APIs for a Kubernetes version", Requires: []requirement{manifestSource}, Request: []interface{}{deprecationRequest{}, manifestInput{}}, Run: checkDeprecations, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "kubernetes-version", Help: "Kubernetes version to upgrade to, e.g. v1.29 (default: report every deprecated API)"},
+			{Name: "fail-on", Key: "failOn", Help: "What fails the check (default removed)", Values: []string{"removed", "deprecated"}},
+		})},
+		{Name: "estimate-resources", Summary: "Sum the CPU, memory and storage a manifest requests", Requires: []requirement{manifestSource}, Request: []interface{}{estimateRequest{}, manifestInput{}}, Run: estimateResources, Flags: flags(manifestFlags, []commandFlag{
+			{Name: "namespace", Help: "Namespace of resources that do not set one"},
+			{Name: "nodes", Help: "Nodes a DaemonSet runs on (default 1)"},
+			{Name: "budget", Help: "Fail when requests at maximum scale exceed {cpu, memory, storage} (JSON)"},
+			{Name: "namespace-budgets", Help: "Budgets by namespace (JSON object)"},
+			{Name: "prices", Help: "Add a monthly cost: {cpuCoreHour, memoryGiBHour, storageGiBMonth, hoursPerMonth} (JSON)"},
+		})},
+		{Name: "terraform-validate", Summary: "Validate a Terraform configuration", Request: []interface{}{terraformRequest{}}, Run: terraformValidate, Flags: []commandFlag{
+			{Name: "dir", Help: "Root module directory", File: true},
+			{Name: "files", Help: "Inline files by name (JSON object)"},
+			{Name: "vars", Help: "Input variables (JSON object)"},
+			{Name: "var-files", Key: "varFiles", Help: "Variable definition files (JSON list)"},
+		}},
+		{Name: "terraform-plan", Summary: "Plan a Terraform configuration and summarize its changes", Request: []interface{}{terraformRequest{}}, Run: terraformPlan, Flags: flags([]commandFlag{
+			{Name: "dir", Help: "Root module directory", File: true},
+			{Name: "files", Help: "Inline files by name (JSON object)"},
+			{Name: "vars", Help: "Input variables (JSON object)"},
+			{Name: "var-files", Key: "varFiles", Help: "Variable definition files (JSON list)"},
+		}, []commandFlag{
+			{Name: "backend-config", Key: "backendConfig", Help: "Backend settings for init (JSON object)"},
+			{Name: "backend", Help: "Use the configured backend (default true)"},
+			{Name: "destroy", Help: "Plan destroying everything in the state", Switch: true},
+		})},
+		{Name: "policy-fetch", Summary: "Fetch pinned policy bundles, or add and pin a new one", Request: []interface{}{policyFetchRequest{}}, Run: policyFetch, Flags: []commandFlag{
+			{Name: "name", Help: "Bundle name"},
+			{Name: "source", Help: "oci://<registry>/<repo>:<tag> or git+https://<repo>.git, to add the bundle"},
+			{Name: "ref", Help: "Git branch, tag or commit (default HEAD)"},
+			{Name: "path", Help: "Directory of the git repository holding the policies"},
+			{Name: "public-key", Help: "Base64 ed25519 key the bundle signature must verify with"},
+		}},
+		{Name: "policy-update", Summary: "Re-pin policy bundles to the latest content of their refs", Request: []interface{}{policyUpdateRequest{}}, Run: policyUpdate, Flags: []commandFlag{
+			{Name: "name", Help: "Only update this bundle"},
+			{Name: "check", Help: "Only report available updates", Switch: true},
+		}},
+		{Name: "policy-list", Summary: "List configured policy bundles and their pins", Run: policyList},
+		{Name: "policy-remove", Summary: "Remove a policy bundle and its cached content", Requires: []requirement{needs("name")}, Run: policyRemove, Flags: []commandFlag{
+			{Name: "name", Help: "Bundle name"},
+		}},
+		{Name: "policy-test", Summary: "Run or scaffold test cases for Rego and CEL policies", Request: []interface{}{policyTestRequest{}}, Run: policyTest, Flags: []commandFlag{
+			{Name: "dir", Help: "Policy directory; tests are read from its tests/ subdirectory (default policies)", File: true},
+			{Name: "run", Help: "Only run cases whose name contains this"},
+			{Name: "init", Help: "Write test skeletons (and an example policy) instead of running", Switch: true},
+		}},
+		{Name: "serve", Summary: "Serve the commands as JSON endpoints over HTTP", Request: []interface{}{serveRequest{}}, Run: serve, Flags: []commandFlag{
+			{Name: "addr", Help: "Listen address (default 127.0.0.1:8080)"},
+			{Name: "timeout", Help: "Longest a request may run, e.g. 2m (default 5m)"},
+			{Name: "shutdown-timeout", Help: "How long a stop waits for requests in flight (default 30s)"},
+			{Name: "max-running", Help: "Cluster-facing requests run at once, 0 for no queue (default 16)"},
+			{Name: "queue-size", Help: "Requests that wait for a run before more are turned away with 429 (default 64)"},
+		}},
+		{Name: "plugins", Summary: "List the plugins found in the plugin directory", Run: listPlugins},
+		{Name: "describe", Summary: "Print the JSON Schema of each command's request and result", Request: []interface{}{describeRequest{}}, Run: describe, Flags: []commandFlag{
+			{Name: "command", Help: "Only describe this command"},
+		}},
+		{Name: "doctor", Summary: "Check tools, cluster access, cache directories and settings", Run: doctor, Flags: clusterFlags},
+		{Name: "install-tools", Summary: "Download pinned helm and kubectl versions", Request: []interface{}{installToolsRequest{}}, Run: installTools, Flags: []commandFlag{
+			{Name: "helm-version", Help: "Helm version, e.g. v3.14.2[@sha256:<digest>]"},
+			{Name: "kubectl-version", Help: "kubectl version, e.g. v1.29.2[@sha256:<digest>]"},
+		}},
+		{Name: "self-update", Summary: "Install the latest signed release of this binary", Request: []interface{}{selfUpdateRequest{}}, Run: selfUpdate, Flags: []commandFlag{
+			{Name: "channel", Help: "Release channel (default stable)"},
+			{Name: "check", Help: "Only report whether an update is available", Switch: true},
+			{Name: "force", Help: "Reinstall even when up to date, or install an older release", Switch: true},
+		}},
+	}
+	commands = append(commands, loadPlugins(commands)...)
+	for i := range commands {
+		for _, g := range globalFlags {
+			commands[i].Flags = addFlag(commands[i].Flags, g)
+		}
+	}
+}
+
+// addFlag appends f to flags, or merges it into a command's flag of the
+// same name: --output is both a command's own key and the output format.
+func addFlag(flags []commandFlag, f commandFlag) []commandFlag {
+	for i, own := range flags {
+		if own.Name == f.Name {
+			flags[i].Values = append(append([]string{}, own.Values...), f.Values...)
+			flags[i].Help = own.Help + "; or " + strings.ToLower(f.Help[:1]) + f.Help[1:]
+			return flags
+		}
+	}
+	return append(flags, f)
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// renameFlagKeys moves flag values whose request key is not the camelCase
+// flag name to that key.
+func renameFlagKeys(c command, input map[string]interface{}) {
+	for _, f := range c.Flags {
+		if v, ok := input[camelCase(f.Name)]; ok && f.Key != "" {
+			delete(input, camelCase(f.Name))
+			input[f.Key] = v
+		}
+	}
+}
+
+// commandList lists the command names as "a, b or c".
+func commandList() string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.Name
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// printUsage writes the overview, or the flags of one command.
+func printUsage(w io.Writer, program, name string) error {
+	if name == "" {
+		fmt.Fprintf(w, "Usage: %s <command> [--flag=value ...] [< request.json]\n\nCommands:\n", program)
+		for _, c := range commands {
+			fmt.Fprintf(w, "  %-24s %s\n", c.Name, c.Summary)
+		}
+		fmt.Fprintf(w, "\nModes:\n")
+		fmt.Fprintf(w, "  %-24s %s\n", "action", "Run the command given by the GitHub Actions 'command' input")
+		fmt.Fprintf(w, "  %-24s %s\n", "completion <shell>", "Print a bash, zsh or fish completion script")
+		fmt.Fprintf(w, "  %-24s %s\n", "help [command]", "Show this help or the flags of a command")
+		fmt.Fprintf(w, "\nWithout flags the request is read as JSON from stdin. Run '%s help <command>' for its flags.\n", program)
+		return nil
+	}
+	c, ok := lookupCommand(name)
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	fmt.Fprintf(w, "Usage: %s %s [--flag=value ...] [< request.json]\n\n%s.\n", program, c.Name, c.Summary)
+	if len(c.Flags) > 0 {
+		fmt.Fprintf(w, "\nFlags:\n")
+		for _, f := range c.Flags {
+			arg := "--" + f.Name + "=<value>"
+			if f.Switch {
+				arg = "--" + f.Name
+			} else if len(f.Values) > 0 {
+				arg = "--" + f.Name + "=" + strings.Join(f.Values, "|")
+			}
+			fmt.Fprintf(w, "  %-34s %s\n", arg, f.Help)
+		}
+	}
+	for _, r := range c.Requires {
+		fmt.Fprintf(w, "\nRequires %s.\n", requirementText(c, r))
+	}
+	fmt.Fprintf(w, "\nA flag sets the request key of the same name in camelCase; values that\nparse as JSON keep their type, and a bare flag is true.\n")
+	return nil
+}
+
+// requirementText spells r out in c's flags: "--manifest, --manifest-file
+// or --name and --chart".
+func requirementText(c command, r requirement) string {
+	sets := make([]string, len(r))
+	for i, keys := range r {
+		names := make([]string, len(keys))
+		for j, key := range keys {
+			names[j] = "--" + key
+			for _, f := range c.Flags {
+				if firstNonEmpty(f.Key, camelCase(f.Name)) == key {
+					names[j] = "--" + f.Name
+				}
+			}
+		}
+		sets[i] = joinWords(names, "and")
+	}
+	return joinWords(sets, "or")
+}
+
+// joinWords joins words as a list in prose: "a, b or c".
+func joinWords(words []string, conj string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " " + conj + " " + words[len(words)-1]
+}
+
+// printCompletion writes a completion script for shell.
+func printCompletion(w io.Writer, program, shell string) error {
+	switch shell {
+	case "bash":
+		bashCompletion(w, program)
+	case "zsh":
+		zshCompletion(w, program)
+	case "fish":
+		fishCompletion(w, program)
+	default:
+		return fmt.Errorf("unsupported shell %q; use bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+func completionNames() []string {
+	names := []string{"action", "completion", "help"}
+	for _, c := range commands {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func shellFunc(program string) string {
+	return "_" + strings.NewReplacer("-", "_", ".", "_").Replace(program)
+}
+
+func bashCompletion(w io.Writer, program string) {
+	fn := shellFunc(program)
+	fmt.Fprintf(w, "# bash completion for %s\n%s() {\n", program, fn)
+	fmt.Fprintf(w, "  local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	fmt.Fprintf(w, "  if [ \"$COMP_CWORD\" -eq 1 ]; then\n    COMPREPLY=($(compgen -W %q -- \"$cur\"))\n    return\n  fi\n", strings.Join(completionNames(), " "))
+	fmt.Fprintf(w, "  local flags= files= \n  case \"${COMP_WORDS[1]}\" in\n")
+	fmt.Fprintf(w, "    completion) COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")); return ;;\n")
+	fmt.Fprintf(w, "    help) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", strings.Join(completionNames(), " "))
+	for _, c := range commands {
+		var names, files []string
+		for _, f := range c.Flags {
+			if f.Switch {
+				names = append(names, "--"+f.Name)
+			} else {
+				names = append(names, "--"+f.Name+"=")
+			}
+			if f.File {
+				files = append(files, "--"+f.Name)
+			}
+		}
+		fmt.Fprintf(w, "    %s) flags=%q files=%q ;;\n", c.Name, strings.Join(names, " ")+" --help", strings.Join(files, " "))
+	}
+	fmt.Fprintf(w, "  esac\n")
+	// COMP_WORDBREAKS splits --flag=value at '=', so the flag is two words back.
+	fmt.Fprintf(w, "  if [ \"$prev\" = \"=\" ]; then\n")
+	fmt.Fprintf(w, "    case \" $files \" in *\" ${COMP_WORDS[COMP_CWORD-2]} \"*) COMPREPLY=($(compgen -f -- \"$cur\")) ;; esac\n    return\n  fi\n")
+	fmt.Fprintf(w, "  compopt -o nospace 2>/dev/null\n  COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n}\n")
+	fmt.Fprintf(w, "complete -F %s %s\n", fn, program)
+}
+
+func zshCompletion(w io.Writer, program string) {
+	fn := shellFunc(program)
+	esc := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+	fmt.Fprintf(w, "#compdef %s\n\n%s() {\n  local -a commands\n  commands=(\n", program, fn)
+	fmt.Fprintf(w, "    'action:Run the command given by the GitHub Actions command input'\n")
+	fmt.Fprintf(w, "    'completion:Print a completion script'\n    'help:Show help'\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "    '%s:%s'\n", c.Name, esc.Replace(c.Summary))
+	}
+	fmt.Fprintf(w, "  )\n  if (( CURRENT == 2 )); then\n    _describe 'command' commands\n    return\n  fi\n  case $words[2] in\n")
+	fmt.Fprintf(w, "    completion) _values 'shell' bash zsh fish ;;\n    help) _describe 'command' commands ;;\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "    %s)\n      _arguments \\\n        '--help[Show help]'", c.Name)
+		for _, f := range c.Flags {
+			action := ""
+			switch {
+			case f.Switch:
+				fmt.Fprintf(w, " \\\n        '--%s[%s]'", f.Name, esc.Replace(f.Help))
+				continue
+			case f.File:
+				action = ":file:_files"
+			case len(f.Values) > 0:
+				action = ":value:(" + strings.Join(f.Values, " ") + ")"
+			default:
+				action = ":value: "
+			}
+			fmt.Fprintf(w, " \\\n        '--%s=[%s]%s'", f.Name, esc.Replace(f.Help), action)
+		}
+		fmt.Fprintf(w, " ;;\n")
+	}
+	fmt.Fprintf(w, "  esac\n}\n\n%s \"$@\"\n", fn)
+}
+
+func fishCompletion(w io.Writer, program string) {
+	esc := strings.NewReplacer("\\", "\\\\", "'", "\\'")
+	fmt.Fprintf(w, "# fish completion for %s\ncomplete -c %s -f\n", program, program)
+	sub := "__fish_use_subcommand"
+	fmt.Fprintf(w, "complete -c %s -n %s -a action -d 'Run the command given by the GitHub Actions command input'\n", program, sub)
+	fmt.Fprintf(w, "complete -c %s -n %s -a completion -d 'Print a completion script'\n", program, sub)
+	fmt.Fprintf(w, "complete -c %s -n %s -a help -d 'Show help'\n", program, sub)
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n", program)
+	for _, c := range commands {
+		fmt.Fprintf(w, "complete -c %s -n %s -a %s -d '%s'\n", program, sub, c.Name, esc.Replace(c.Summary))
+		seen := fmt.Sprintf("'__fish_seen_subcommand_from %s'", c.Name)
+		for _, f := range c.Flags {
+			opts := " -r"
+			if f.Switch {
+				opts = ""
+			} else if f.File {
+				opts = " -r -F"
+			} else if len(f.Values) > 0 {
+				opts = " -r -a '" + strings.Join(f.Values, " ") + "'"
+			}
+			fmt.Fprintf(w, "complete -c %s -n %s -l %s -d '%s'%s\n", program, seen, f.Name, esc.Replace(f.Help), opts)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import "sort"
+
+// clusterFeatures maps optional cluster capabilities to the API group (and,
+// where the group is shared with core APIs, the kind) that signals their use.
+var clusterFeatures = []struct {
+	Name  string
+	Group string
+	Kind  string
+}{
+	{"GatewayAPI", "gateway.networking.k8s.io", ""},
+	{"PodSecurityPolicy", "policy", "PodSecurityPolicy"},
+	{"PodDisruptionBudget", "policy", "PodDisruptionBudget"},
+	{"HorizontalPodAutoscaler", "autoscaling", "HorizontalPodAutoscaler"},
+	{"VerticalPodAutoscaler", "autoscaling.k8s.io", ""},
+	{"VolumeSnapshots", "snapshot.storage.k8s.io", ""},
+	{"PrometheusOperator", "monitoring.coreos.com", ""},
+	{"CertManager", "cert-manager.io", ""},
+	{"Istio", "networking.istio.io", ""},
+	{"ArgoRollouts", "argoproj.io", "Rollout"},
+}
+
+// checkCompatibility renders a chart (or takes input["manifest"]) and checks
+// every apiVersion/kind it uses against what the target cluster serves,
+// returning a go/no-go report. Custom resources whose CRDs ship in the same
+// manifest are treated as available.
+func checkCompatibility(input map[string]interface{}) map[string]interface{} {
+	serverVersion, err := clusterServerVersion(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to query cluster version: " + err.Error(),
+		}
+	}
+	apiVersions, err := clusterAPIVersions(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to discover cluster APIs: " + err.Error(),
+		}
+	}
+
+	// Render against the cluster's real capabilities so templates gated on
+	// .Capabilities produce what an install on this cluster would.
+	served := make([]string, 0, len(apiVersions))
+	for gv := range apiVersions {
+		served = append(served, gv)
+	}
+	sort.Strings(served)
+	args := []string{"--kube-version", serverVersion}
+	for _, gv := range served {
+		args = append(args, "--api-versions", gv)
+	}
+	manifest, err := manifestFromInput(input, args...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	provided := crdProvidedKinds(objects)
+	kindsByGV := map[string]map[string]bool{}
+	servedKinds := func(gv string) (map[string]bool, error) {
+		if kinds, ok := kindsByGV[gv]; ok {
+			return kinds, nil
+		}
+		resources, err := clusterAPIResources(input, gv)
+		if err != nil {
+			return nil, err
+		}
+		kinds := map[string]bool{}
+		for _, r := range resources {
+			kinds[r.Kind] = true
+		}
+		kindsByGV[gv] = kinds
+		return kinds, nil
+	}
+
+	compatible := true
+	var resources []map[string]interface{}
+	featureUse := map[string][2]int{} // feature -> {used, unsupported}
+	for _, obj := range objects {
+		ref := refOf(obj)
+		status, reason := "supported", ""
+		switch {
+		case provided[ref.APIVersion+"/"+ref.Kind]:
+			status = "provided-by-manifest"
+		case !apiVersions[ref.APIVersion]:
+			status, reason = "unsupported", "apiVersion "+ref.APIVersion+" is not served by the cluster"
+		default:
+			kinds, err := servedKinds(ref.APIVersion)
+			if err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"error":   "Failed to discover resources for " + ref.APIVersion + ": " + err.Error(),
+				}
+			}
+			if !kinds[ref.Kind] {
+				status, reason = "unsupported", "kind "+ref.Kind+" is not served under "+ref.APIVersion
+			}
+		}
+		entry := map[string]interface{}{
+			"apiVersion": ref.APIVersion,
+			"kind":       ref.Kind,
+			"name":       ref.Name,
+			"status":     status,
+		}
+		if ref.Namespace != "" {
+			entry["namespace"] = ref.Namespace
+		}
+		if status == "unsupported" {
+			compatible = false
+			entry["reason"] = reason
+			if alts := servedGroupVersions(apiVersions, ref.APIVersion); len(alts) > 0 {
+				entry["alternatives"] = alts
+			}
+		}
+		resources = append(resources, entry)
+
+		group, _ := splitAPIVersion(ref.APIVersion)
+		for _, f := range clusterFeatures {
+			if f.Group == group && (f.Kind == "" || f.Kind == ref.Kind) {
+				use := featureUse[f.Name]
+				use[0]++
+				if status == "unsupported" {
+					use[1]++
+				}
+				featureUse[f.Name] = use
+			}
+		}
+	}
+
+	var features []map[string]interface{}
+	for _, f := range clusterFeatures {
+		use, ok := featureUse[f.Name]
+		if !ok {
+			continue
+		}
+		features = append(features, map[string]interface{}{
+			"name":      f.Name,
+			"resources": use[0],
+			"available": use[1] == 0,
+		})
+	}
+
+	decision := "go"
+	if !compatible {
+		decision = "no-go"
+	}
+	return map[string]interface{}{
+		"success":       true,
+		"compatible":    compatible,
+		"decision":      decision,
+		"serverVersion": serverVersion,
+		"resources":     resources,
+		"features":      features,
+	}
+}
+
+// crdProvidedKinds returns "group/version/Kind" keys for every custom
+// resource defined by a CustomResourceDefinition in objects.
+func crdProvidedKinds(objects []map[string]interface{}) map[string]bool {
+	provided := map[string]bool{}
+	for _, obj := range objects {
+		if nestedString(obj, "kind") != "CustomResourceDefinition" {
+			continue
+		}
+		group := nestedString(obj, "spec", "group")
+		kind := nestedString(obj, "spec", "names", "kind")
+		if v := nestedString(obj, "spec", "version"); v != "" {
+			provided[group+"/"+v+"/"+kind] = true
+		}
+		for _, v := range nestedSlice(obj, "spec", "versions") {
+			if m, ok := v.(map[string]interface{}); ok {
+				if name, _ := m["name"].(string); name != "" {
+					provided[group+"/"+name+"/"+kind] = true
+				}
+			}
+		}
+	}
+	return provided
+}
+
+// servedGroupVersions lists the versions the cluster serves for the group of
+// apiVersion, excluding apiVersion itself.
+func servedGroupVersions(served map[string]bool, apiVersion string) []string {
+	group, _ := splitAPIVersion(apiVersion)
+	var alts []string
+	for gv := range served {
+		if g, _ := splitAPIVersion(gv); g == group && gv != apiVersion {
+			alts = append(alts, gv)
+		}
+	}
+	sort.Strings(alts)
+	return alts
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Concurrency limits, shared by every goroutine of the process:
+//
+//	INFRAKIT_MAX_HELM         simultaneous helm processes (default: CPU count)
+//	INFRAKIT_MAX_KUBECTL      simultaneous kubectl processes (default 16)
+//	INFRAKIT_MAX_PER_CLUSTER  simultaneous kubectl processes per cluster (default 8)
+//	INFRAKIT_COMMAND_LIMITS   simultaneous runs per command, e.g.
+//	                          "render-many=2,validate-k8s=8" (default unlimited)
+//	INFRAKIT_CLUSTER_RATE     kubectl and helm calls per second per cluster,
+//	                          e.g. 0.5 (default unlimited)
+//	INFRAKIT_CLUSTER_BURST    calls a cluster takes at once before its rate
+//	                          applies (default: the rate, at least 1)
+//	INFRAKIT_CLUSTER_RATES    rates of particular clusters by API server, e.g.
+//	                          "https://prod.example.com:6443=5"
+//
+// A limit or rate of 0 disables it. Per-command limits take effect once
+// several requests share a process.
+var (
+	helmSlots    = newSemaphore(envLimit("INFRAKIT_MAX_HELM", runtime.NumCPU()))
+	kubectlSlots = newSemaphore(envLimit("INFRAKIT_MAX_KUBECTL", 16))
+
+	clusterSlots = struct {
+		sync.Mutex
+		m map[string]semaphore
+	}{m: map[string]semaphore{}}
+	commandSlots = map[string]semaphore{}
+
+	clusterRates = struct {
+		sync.Mutex
+		m map[string]*rateLimiter
+	}{m: map[string]*rateLimiter{}}
+	serverRates = map[string]float64{}
+)
+
+func init() {
+	for _, entry := range strings.Split(os.Getenv("INFRAKIT_COMMAND_LIMITS"), ",") {
+		command, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if n, err := strconv.Atoi(limit); ok && err == nil {
+			commandSlots[command] = newSemaphore(n)
+		}
+	}
+	// Server URLs may hold "=", rates do not.
+	for _, entry := range strings.Split(os.Getenv("INFRAKIT_CLUSTER_RATES"), ",") {
+		entry = strings.TrimSpace(entry)
+		i := strings.LastIndex(entry, "=")
+		if r, err := strconv.ParseFloat(entry[i+1:], 64); i > 0 && err == nil {
+			serverRates[strings.TrimSuffix(entry[:i], "/")] = r
+		}
+	}
+}
+
+// semaphore bounds concurrent holders; a nil semaphore is unlimited.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire blocks until a slot is free and returns its release.
+func (s semaphore) acquire() func() {
+	if s == nil {
+		return func() {}
+	}
+	s <- struct{}{}
+	return func() { <-s }
+}
+
+func envLimit(env string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(env)); err == nil {
+		return n
+	}
+	return def
+}
+
+// acquireHelm takes a helm slot.
+func acquireHelm() func() {
+	return helmSlots.acquire()
+}
+
+// acquireKubectl takes a global kubectl slot and one for the target cluster,
+// always in that order.
+func acquireKubectl(input map[string]interface{}) func() {
+	release := kubectlSlots.acquire()
+	limit := envLimit("INFRAKIT_MAX_PER_CLUSTER", 8)
+	cluster, err := clusterCacheKey(input)
+	if limit <= 0 || err != nil {
+		return release
+	}
+	clusterSlots.Lock()
+	slots, ok := clusterSlots.m[cluster]
+	if !ok {
+		slots = newSemaphore(limit)
+		clusterSlots.m[cluster] = slots
+	}
+	clusterSlots.Unlock()
+	releaseCluster := slots.acquire()
+	// kustomize, called without input, does not reach a cluster.
+	if input != nil {
+		waitClusterRate(input)
+	}
+	return func() {
+		releaseCluster()
+		release()
+	}
+}
+
+// waitClusterRate blocks until the rate limit of input's cluster allows
+// another call, or the request is cancelled.
+func waitClusterRate(input map[string]interface{}) {
+	server, err := clusterServer(input)
+	if err != nil {
+		return
+	}
+	clusterRates.Lock()
+	limiter, ok := clusterRates.m[server]
+	if !ok {
+		limiter = newRateLimiter(clusterRate(server), envRate("INFRAKIT_CLUSTER_BURST", 0))
+		clusterRates.m[server] = limiter
+	}
+	clusterRates.Unlock()
+	if waited := limiter.wait(requestContext(input)); waited > 0 {
+		observeThrottle(waited)
+	}
+}
+
+// clusterRate is the calls per second allowed to the cluster at server.
+func clusterRate(server string) float64 {
+	if r, ok := serverRates[strings.TrimSuffix(server, "/")]; ok {
+		return r
+	}
+	return envRate("INFRAKIT_CLUSTER_RATE", 0)
+}
+
+func envRate(env string, def float64) float64 {
+	if r, err := strconv.ParseFloat(os.Getenv(env), 64); err == nil && r >= 0 {
+		return r
+	}
+	return def
+}
+
+// rateLimiter is a token bucket allowing rate calls a second on average
+// and burst at once; a nil rateLimiter is unlimited.
+type rateLimiter struct {
+	sync.Mutex
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	burst = math.Max(1, burst)
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes a token, blocking until one is due or ctx is done, and
+// returns how long it blocked.
+func (l *rateLimiter) wait(ctx context.Context) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	// Callers that find the bucket empty queue up behind each other: each
+	// waits for its own token.
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.Unlock()
+	if delay <= 0 {
+		return 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay
+	case <-ctx.Done():
+		return time.Since(now)
+	}
+}
+
+// acquireCommand takes a slot for a run of command.
+func acquireCommand(command string) func() {
+	return commandSlots[command].acquire()
+}
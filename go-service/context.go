@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// requestContextKey is the input key carrying the request's context, like
+// the kubeconfig prepareClusterAccess leaves there: inputs derived from a
+// request's keep it, so every helm, kubectl and tool process of the request
+// is bound to its deadline.
+const requestContextKey = "$context"
+
+// defaultRequestTimeout bounds a request without timeoutSeconds, unless
+// INFRAKIT_TIMEOUT says otherwise.
+const defaultRequestTimeout = 10 * time.Minute
+
+// requestScope holds a context in an input; it encodes as null, so requests
+// decode and record as before.
+type requestScope struct{ ctx context.Context }
+
+func (requestScope) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// requestContext returns the request's context.
+func requestContext(input map[string]interface{}) context.Context {
+	if s, ok := input[requestContextKey].(requestScope); ok {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// requestTimeout returns how long a request may run: input["timeoutSeconds"],
+// else INFRAKIT_TIMEOUT (a duration), else defaultRequestTimeout. Zero is no
+// limit.
+func requestTimeout(input map[string]interface{}) (time.Duration, error) {
+	switch v := input["timeoutSeconds"].(type) {
+	case nil:
+	case float64:
+		if v < 0 {
+			return 0, errors.New("Invalid timeoutSeconds: must not be negative")
+		}
+		return time.Duration(v * float64(time.Second)), nil
+	default:
+		return 0, fmt.Errorf("Invalid timeoutSeconds: %v is not a number", v)
+	}
+	if env := os.Getenv("INFRAKIT_TIMEOUT"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return 0, errors.New("Invalid INFRAKIT_TIMEOUT: " + err.Error())
+		}
+		return d, nil
+	}
+	return defaultRequestTimeout, nil
+}
+
+// withRequestContext binds input to a context derived from parent and the
+// request's timeout, and returns the timeout in effect: a request derived
+// from another, or served with a deadline, keeps the earlier deadline.
+func withRequestContext(parent context.Context, input map[string]interface{}) (time.Duration, context.CancelFunc, error) {
+	timeout, err := requestTimeout(input)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The request that binds input first gets a workspace (see
+	// requestDir), removed by its cancel; requests derived from it share it.
+	removeWorkspace := func() {}
+	if s, ok := input[requestContextKey].(requestScope); ok {
+		parent = s.ctx
+	} else {
+		parent, removeWorkspace = withRequestWorkspace(parent)
+	}
+	if deadline, ok := parent.Deadline(); ok && (timeout == 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline).Round(time.Second)
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	input[requestContextKey] = requestScope{ctx}
+	return timeout, func() {
+		cancel()
+		removeWorkspace()
+	}, nil
+}
+
+// timedOut returns the result of a command stopped by its deadline, keeping
+// what it reported. Processes killed at the deadline fail in ways of their
+// own ("signal: killed"), so the error says what happened instead.
+func timedOut(cmd string, timeout time.Duration, result map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range result {
+		out[k] = v
+	}
+	out["success"] = false
+	out["timedOut"] = true
+	out["error"] = fmt.Sprintf("%s timed out after %s", cmd, timeout)
+	if cause := strings.TrimSpace(resultError(result)); cause != "" {
+		out["cause"] = cause
+	}
+	return out
+}
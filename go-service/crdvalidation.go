@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// crdValidationRequest holds the keys that give custom resources schemas to
+// be validated against. Schemas are looked up in the CRDs given here, then
+// those of the manifest itself, then those warm cached from a cluster.
+type crdValidationRequest struct {
+	// CRDs are CustomResourceDefinition manifests.
+	CRDs []string `json:"crds"`
+	// CRDFiles are CRD manifests, or directories of them.
+	CRDFiles []string `json:"crdFiles"`
+	// ChartCRDs also takes the CRDs of the chart rendered, which helm
+	// template leaves out, from its crds/ directories.
+	ChartCRDs bool `json:"chartCRDs"`
+	// CustomResources is how a dry run validates custom resources:
+	// "server" (the default) sends them to the cluster, which rejects them
+	// when it lacks their CRD; "structural" checks those with a known
+	// schema against it here and dry-runs the rest.
+	CustomResources string `json:"customResources"`
+}
+
+func (r crdValidationRequest) check() error {
+	switch r.CustomResources {
+	case "", "server", "structural":
+		return nil
+	}
+	return errors.New("'customResources' must be server or structural")
+}
+
+// crdSchema is the schema of one version of a custom resource, and where it
+// was found. A nil Schema is a version its CRD leaves unspecified.
+type crdSchema struct {
+	Schema map[string]interface{}
+	Source string
+}
+
+// crdSchemas are custom resource schemas by "group/version/Kind".
+type crdSchemas map[string]crdSchema
+
+// add records the schema of each version of the CRDs among objects, unless
+// an earlier source gave that version one.
+func (s crdSchemas) add(objects []map[string]interface{}, source string) {
+	for _, obj := range objects {
+		if nestedString(obj, "kind") != "CustomResourceDefinition" {
+			continue
+		}
+		group := nestedString(obj, "spec", "group")
+		kind := nestedString(obj, "spec", "names", "kind")
+		// apiextensions.k8s.io/v1beta1 CRDs may give every version the
+		// same schema.
+		shared := nestedMap(obj, "spec", "validation", "openAPIV3Schema")
+		versions := nestedSlice(obj, "spec", "versions")
+		if v := nestedString(obj, "spec", "version"); v != "" && len(versions) == 0 {
+			versions = []interface{}{map[string]interface{}{"name": v}}
+		}
+		for _, v := range versions {
+			version, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := version["name"].(string)
+			key := group + "/" + name + "/" + kind
+			if name == "" {
+				continue
+			}
+			if _, ok := s[key]; ok {
+				continue
+			}
+			schema := nestedMap(version, "schema", "openAPIV3Schema")
+			if schema == nil {
+				schema = shared
+			}
+			s[key] = crdSchema{schema, source}
+		}
+	}
+}
+
+// lookup returns the schema of apiVersion/kind, falling back to the schemas
+// warm cached.
+func (s crdSchemas) lookup(apiVersion, kind string) (crdSchema, bool) {
+	if schema, ok := s[apiVersion+"/"+kind]; ok {
+		return schema, true
+	}
+	if schema, ok := cachedCRDSchema(apiVersion, kind); ok {
+		return crdSchema{schema, "cache"}, true
+	}
+	return crdSchema{}, false
+}
+
+// validate returns the violations of its schema by custom resource obj.
+func (s crdSchema) validate(obj map[string]interface{}, strict bool) []schemaError {
+	if s.Schema == nil {
+		return nil
+	}
+	return (schemaValidator{Strict: strict}).validate(obj, crdSchemaForObject(s.Schema))
+}
+
+// loadCRDSchemas collects the schemas of req's CRDs and of those defined by
+// objects, the manifest being validated.
+func loadCRDSchemas(input map[string]interface{}, req crdValidationRequest, objects []map[string]interface{}) (crdSchemas, error) {
+	schemas := crdSchemas{}
+	for i, crds := range req.CRDs {
+		parsed, err := parseManifest(crds)
+		if err != nil {
+			return nil, fmt.Errorf("crds[%d]: %v", i, err)
+		}
+		schemas.add(parsed, "request")
+	}
+	for _, path := range req.CRDFiles {
+		files, err := crdManifestFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("CRD file: %v", err)
+		}
+		for _, f := range files {
+			manifest, err := readManifestFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("CRD file: %v", err)
+			}
+			parsed, err := parseManifest(manifest)
+			if err != nil {
+				return nil, fmt.Errorf("CRD file %s: %v", f, err)
+			}
+			schemas.add(parsed, f)
+		}
+	}
+	if req.ChartCRDs {
+		parsed, err := chartCRDs(input)
+		if err != nil {
+			return nil, err
+		}
+		schemas.add(parsed, "chart")
+	}
+	schemas.add(objects, "manifest")
+	return schemas, nil
+}
+
+// crdManifestFiles returns path, or the YAML and JSON files under it when
+// it is a directory.
+func crdManifestFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".yaml", ".yml", ".json":
+			if info.Mode().IsRegular() {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// chartCRDs returns the CRDs of the chart of input's name/chart keys, its
+// dependencies' included, as helm would install them.
+func chartCRDs(input map[string]interface{}) ([]map[string]interface{}, error) {
+	var req helmChartInput
+	if err := decodeInput(input, &req); err != nil {
+		return nil, err
+	}
+	if req.Chart == "" {
+		return nil, errors.New("'chartCRDs' needs a 'chart'")
+	}
+	ctx := requestContext(input)
+	chart, args, err := req.chartSource.resolve(ctx, req.Chart)
+	if err != nil {
+		return nil, err
+	}
+	out, err := runHelm(ctx, append([]string{"show", "crds", chart}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the chart's CRDs: %v", err)
+	}
+	objects, err := parseManifest(string(out))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the chart's CRDs: %v", err)
+	}
+	return objects, nil
+}
+
+// validateCustomResources is validate-k8s with customResources
+// "structural": the custom resources of the manifest that have a schema
+// are checked against it, and the rest of the manifest is dry-run as
+// usual. Resources keep their document numbers in the whole manifest.
+func validateCustomResources(input map[string]interface{}, req offlineValidationRequest) map[string]interface{} {
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	schemas, err := loadCRDSchemas(input, req.crdValidationRequest, objects)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	var checked []validatedResource
+	var rest []string
+	var documents []int // the document number in manifest of each of rest
+	invalid := 0
+	for i, doc := range splitYAMLDocuments(manifest) {
+		v, err := decodeYAML(doc)
+		obj, ok := v.(map[string]interface{})
+		if err != nil || !ok {
+			rest = append(rest, doc)
+			documents = append(documents, i+1)
+			continue
+		}
+		ref := refOf(obj)
+		schema, ok := schemas.lookup(ref.APIVersion, ref.Kind)
+		if !ok {
+			rest = append(rest, doc)
+			documents = append(documents, i+1)
+			continue
+		}
+		r := validatedResource{resourceRef: ref, Document: i + 1, Status: "valid"}
+		if errs := schema.validate(obj, req.Strict); len(errs) > 0 {
+			var msgs []string
+			for _, e := range errs {
+				msgs = append(msgs, e.Path+": "+e.Message)
+			}
+			r.Status = "invalid"
+			r.Error = strings.Join(msgs, "; ")
+			invalid++
+		}
+		checked = append(checked, r)
+	}
+
+	result := map[string]interface{}{
+		"success": true,
+		"message": "Manifest validated successfully",
+	}
+	resources := []validatedResource{}
+	if len(rest) > 0 {
+		dryRun := map[string]interface{}{}
+		for k, v := range input {
+			dryRun[k] = v
+		}
+		delete(dryRun, "manifestFile")
+		dryRun["manifest"] = strings.Join(rest, "\n---\n") + "\n"
+		dryRun["customResources"] = "server"
+		result = validateK8s(dryRun)
+		dryRunResources, _ := result["resources"].([]validatedResource)
+		for _, r := range dryRunResources {
+			if r.Document > 0 && r.Document <= len(documents) {
+				r.Document = documents[r.Document-1]
+			}
+			resources = append(resources, r)
+		}
+	}
+	resources = append(resources, checked...)
+	sort.SliceStable(resources, func(i, j int) bool { return resources[i].Document < resources[j].Document })
+	result["resources"] = resources
+	if invalid > 0 && result["success"] == true {
+		result["success"] = false
+		result["error"] = fmt.Sprintf("%d custom resources failed validation against their CRD schemas", invalid)
+		delete(result, "message")
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugStderrBytes caps the stderr kept per invocation.
+const debugStderrBytes = 64 << 10
+
+// invocation is one helm, kubectl, git or cloud CLI run, or HTTP request,
+// made while serving a request with input["debug"] set.
+type invocation struct {
+	Command []string `json:"command"`
+	// Env lists the variables set for this invocation only, e.g. KUBECONFIG.
+	Env        []string  `json:"env,omitempty"`
+	Dir        string    `json:"dir,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	ExitCode   int       `json:"exitCode"`
+	Stderr     string    `json:"stderr,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// Cached marks discovery answered from the cache without running
+	// Command.
+	Cached bool `json:"cached,omitempty"`
+}
+
+var debugTrace struct {
+	sync.Mutex
+	enabled bool
+	calls   []invocation
+}
+
+// enableDebug starts recording invocations for the response.
+func enableDebug() {
+	debugTrace.Lock()
+	debugTrace.enabled = true
+	debugTrace.Unlock()
+}
+
+func debugInvocations() []invocation {
+	debugTrace.Lock()
+	defer debugTrace.Unlock()
+	return append([]invocation{}, debugTrace.calls...)
+}
+
+func recordInvocation(inv invocation) {
+	debugTrace.Lock()
+	defer debugTrace.Unlock()
+	if debugTrace.enabled {
+		debugTrace.calls = append(debugTrace.calls, inv)
+	}
+}
+
+func debugEnabled() bool {
+	debugTrace.Lock()
+	defer debugTrace.Unlock()
+	return debugTrace.enabled
+}
+
+// traceCommand records a finished subprocess in the metrics, the debug log
+// and, when debugging, the trace. stderr is what the caller captured; without it,
+// the stderr kept by exec.ExitError is used.
+func traceCommand(cmd *exec.Cmd, start time.Time, stderr []byte, err error) {
+	observeSubprocess(cmd.Path, time.Since(start))
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug("subprocess", "command", strings.Join(redactArgs(append([]string{cmd.Path}, cmd.Args[1:]...)), " "), "durationMs", time.Since(start).Milliseconds(), "error", err)
+	}
+	if !debugEnabled() {
+		return
+	}
+	inv := invocation{
+		Command:    redactArgs(append([]string{cmd.Path}, cmd.Args[1:]...)),
+		Env:        redactEnv(cmd.Env),
+		Dir:        cmd.Dir,
+		StartedAt:  start,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		inv.ExitCode = exitErr.ExitCode()
+		if stderr == nil {
+			stderr = exitErr.Stderr
+		}
+	} else if err != nil {
+		inv.ExitCode = -1
+	}
+	if err != nil {
+		inv.Error = err.Error()
+	}
+	if len(stderr) > debugStderrBytes {
+		stderr = append(append([]byte{}, stderr[:debugStderrBytes]...), "\n[truncated]"...)
+	}
+	inv.Stderr = string(stderr)
+	recordInvocation(inv)
+}
+
+// traceCached records a kubectl call answered from the discovery cache.
+func traceCached(args []string) {
+	if debugEnabled() {
+		recordInvocation(invocation{Command: redactArgs(append([]string{"kubectl"}, args...)), StartedAt: time.Now(), Cached: true})
+	}
+}
+
+// traceRequest records an HTTP request.
+func traceRequest(method, url string, start time.Time, status int, err error) {
+	if !debugEnabled() {
+		return
+	}
+	inv := invocation{
+		Command:    []string{method, url},
+		StartedAt:  start,
+		DurationMs: time.Since(start).Milliseconds(),
+		ExitCode:   status,
+	}
+	if err != nil {
+		inv.Error = err.Error()
+	}
+	recordInvocation(inv)
+}
+
+// redactArgs hides the values of sensitive flags such as --token or
+// --password, given as --flag=value or as the next argument.
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 1; i < len(out); i++ {
+		arg := out[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !isSensitiveKey(name) {
+			continue
+		}
+		if hasValue {
+			out[i] = arg[:strings.IndexByte(arg, '=')+1] + redactedValue
+		} else if i+1 < len(out) {
+			out[i+1] = redactedValue
+			i++
+		}
+	}
+	return out
+}
+
+// redactEnv keeps the variables a request sets beyond the inherited
+// environment, hiding sensitive values.
+func redactEnv(env []string) []string {
+	inherited := map[string]bool{}
+	for _, kv := range os.Environ() {
+		inherited[kv] = true
+	}
+	var out []string
+	for _, kv := range env {
+		if inherited[kv] {
+			continue
+		}
+		name, _, _ := strings.Cut(kv, "=")
+		if isSensitiveKey(name) {
+			kv = name + "=" + redactedValue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
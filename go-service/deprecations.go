@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// deprecationRequest is the request body for check-deprecations. The
+// manifest comes from the usual manifest, manifestFile or name/chart keys.
+type deprecationRequest struct {
+	// KubernetesVersion is the version being upgraded to, e.g. "v1.29";
+	// without it every deprecated or removed API is reported.
+	KubernetesVersion string `json:"kubernetesVersion"`
+	// FailOn is what fails the check: "removed" (default) APIs the version
+	// no longer serves, or "deprecated" ones as well.
+	FailOn string `json:"failOn"`
+}
+
+// deprecationFinding is a resource on a deprecated API. Status is
+// "removed" when the target version no longer serves it, else
+// "deprecated".
+type deprecationFinding struct {
+	Resource     string `json:"resource"`
+	Document     int    `json:"document"`
+	APIVersion   string `json:"apiVersion"`
+	Kind         string `json:"kind"`
+	Status       string `json:"status"`
+	DeprecatedIn string `json:"deprecatedIn"`
+	RemovedIn    string `json:"removedIn"`
+	// Replacement is the apiVersion to move to, "" for an API removed
+	// without one (e.g. PodSecurityPolicy).
+	Replacement string `json:"replacement"`
+	// Path is where the apiVersion is written: $.apiVersion, or the
+	// last-applied-configuration annotation of an object read back from a
+	// cluster, which stores it under its current version.
+	Path string `json:"path"`
+}
+
+// lastAppliedAnnotation records what kubectl apply was given.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// checkDeprecations reports the resources of a manifest that use APIs
+// deprecated by, or removed in, input["kubernetesVersion"], with the API
+// to move each to and the version it goes away in, to plan an upgrade.
+func checkDeprecations(input map[string]interface{}) map[string]interface{} {
+	var req deprecationRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	failOn := firstNonEmpty(req.FailOn, "removed")
+	if failOn != "removed" && failOn != "deprecated" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'failOn' must be removed or deprecated",
+		}
+	}
+	var target semver
+	hasTarget := req.KubernetesVersion != ""
+	if hasTarget {
+		var ok bool
+		if target, ok = parseSemver(req.KubernetesVersion); !ok {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Invalid kubernetesVersion " + req.KubernetesVersion,
+			}
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	findings := []deprecationFinding{}
+	summary := map[string]int{"deprecated": 0, "removed": 0}
+	var report strings.Builder
+	for i, obj := range objects {
+		ref := refOf(obj)
+		uses := [][2]string{{ref.APIVersion, "$.apiVersion"}}
+		if applied := nestedString(obj, "metadata", "annotations", lastAppliedAnnotation); applied != "" {
+			var last struct {
+				APIVersion string `json:"apiVersion"`
+			}
+			if json.Unmarshal([]byte(applied), &last) == nil && last.APIVersion != "" && last.APIVersion != ref.APIVersion {
+				uses = append(uses, [2]string{last.APIVersion, "$.metadata.annotations['" + lastAppliedAnnotation + "']"})
+			}
+		}
+		for _, use := range uses {
+			d, ok := deprecationOf(use[0], ref.Kind)
+			if !ok {
+				continue
+			}
+			status := "deprecated"
+			if hasTarget {
+				if status = d.status(target); status == "" {
+					continue
+				}
+			}
+			findings = append(findings, deprecationFinding{
+				Resource:     ref.String(),
+				Document:     i + 1,
+				APIVersion:   use[0],
+				Kind:         ref.Kind,
+				Status:       status,
+				DeprecatedIn: d.DeprecatedIn,
+				RemovedIn:    d.RemovedIn,
+				Replacement:  d.Replacement,
+				Path:         use[1],
+			})
+			summary[status]++
+			instead := "no replacement"
+			if d.Replacement != "" {
+				instead = "use " + d.Replacement
+			}
+			fmt.Fprintf(&report, "%s %s %s: deprecated in %s, removed in %s; %s\n", strings.ToUpper(status), ref.String(), use[0], d.DeprecatedIn, d.RemovedIn, instead)
+		}
+	}
+	fmt.Fprintf(&report, "%d resources checked, %d removed, %d deprecated\n", len(objects), summary["removed"], summary["deprecated"])
+	failing := summary["removed"]
+	if failOn == "deprecated" {
+		failing += summary["deprecated"]
+	}
+	result := map[string]interface{}{
+		"success":  true,
+		"passed":   failing == 0,
+		"findings": findings,
+		"summary":  summary,
+		"report":   report.String(),
+	}
+	if hasTarget {
+		result["kubernetesVersion"] = req.KubernetesVersion
+	}
+	return result
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// describeRequest is the request body for describe.
+type describeRequest struct {
+	// Command limits the catalog to one command.
+	Command string `json:"command"`
+}
+
+// envelopeRequest declares the types of the envelopeKeys a request may
+// set, for the schemas; the keys are read from the input as it is.
+type envelopeRequest struct {
+	APIVersion     string  `json:"apiVersion"`
+	Debug          bool    `json:"debug"`
+	Diagnostics    bool    `json:"diagnostics"`
+	TimeoutSeconds float64 `json:"timeoutSeconds"`
+	LogLevel       string  `json:"logLevel"`
+	LogFormat      string  `json:"logFormat"`
+	ToolsConfig    string  `json:"toolsConfig"`
+	HelmPath       string  `json:"helmPath"`
+	KubectlPath    string  `json:"kubectlPath"`
+	ScrubEnv       bool    `json:"scrubEnv"`
+	SandboxTools   bool    `json:"sandboxTools"`
+}
+
+// envelopeHelp documents the envelopeKeys that are not flags.
+var envelopeHelp = map[string]string{
+	"diagnostics": "Collect the events and pod logs of resources that fail to become ready (default true)",
+}
+
+// flagDefault finds the default a flag's help gives, as in "(default 5m)"
+// or "(JSON list, default app.kubernetes.io/name)"; "(default: ...)"
+// describes one instead.
+var flagDefault = regexp.MustCompile(`\bdefault ([^();]+)[);]`)
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// describe returns the catalog of commands, or of one: the JSON Schema of
+// each command's request and of its result. Request schemas are generated
+// from the commands table, so they are the contract versioned requests are
+// checked against: the keys a command accepts, with their types, help and
+// defaults, and the keys it cannot run without. Unversioned requests ignore
+// keys the schema does not declare.
+func describe(input map[string]interface{}) map[string]interface{} {
+	var req describeRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	return describeCommands(req.Command, nil)
+}
+
+// describeCommands is the describe result for name, or for every command
+// but those excluded.
+func describeCommands(name string, excluded map[string]bool) map[string]interface{} {
+	var list []map[string]interface{}
+	for _, c := range commands {
+		if (name == "" || c.Name == name) && !excluded[c.Name] {
+			list = append(list, map[string]interface{}{
+				"name":     c.Name,
+				"summary":  c.Summary,
+				"request":  requestSchema(c),
+				"response": responseSchema(c),
+			})
+		}
+	}
+	if name != "" && len(list) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No command named " + name,
+		}
+	}
+	return map[string]interface{}{
+		"success":    true,
+		"apiVersion": apiVersion,
+		"commands":   list,
+	}
+}
+
+// serveSchema answers GET /schema with the describe result of the served
+// commands, or of ?command=.
+func serveSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeServeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+			"success": false,
+			"error":   "Use GET",
+		})
+		return
+	}
+	result := describeCommands(r.URL.Query().Get("command"), serveExcluded)
+	status := http.StatusOK
+	if result["success"] != true {
+		status = http.StatusNotFound
+	}
+	writeServeJSON(w, status, result)
+}
+
+// requestSchema is the schema of c's requests: the fields of its Request
+// types or, for commands without any, its flags, and the envelope keys.
+func requestSchema(c command) map[string]interface{} {
+	props := map[string]interface{}{}
+	for _, t := range c.Request {
+		for _, f := range jsonStructFields(reflect.TypeOf(t)) {
+			props[f.Name] = typeSchema(f.Type, map[reflect.Type]bool{})
+		}
+	}
+	for _, f := range jsonStructFields(reflect.TypeOf(envelopeRequest{})) {
+		props[f.Name] = typeSchema(f.Type, map[reflect.Type]bool{})
+	}
+	props["apiVersion"] = map[string]interface{}{"type": "string", "enum": []string{apiVersion}}
+	for key, help := range envelopeHelp {
+		describeKey(props[key].(map[string]interface{}), help, nil)
+	}
+	for _, f := range c.Flags {
+		f, ok := requestFlag(f)
+		if !ok {
+			continue
+		}
+		key := firstNonEmpty(f.Key, camelCase(f.Name))
+		schema, declared := props[key].(map[string]interface{})
+		if !declared {
+			if len(c.Request) > 0 {
+				continue
+			}
+			schema = flagSchema(f)
+			props[key] = schema
+		}
+		describeKey(schema, f.Help, f.Values)
+	}
+
+	schema := map[string]interface{}{
+		"$schema":              jsonSchemaDialect,
+		"title":                c.Name + " request",
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	var required []string
+	var allOf []interface{}
+	for _, r := range c.Requires {
+		if len(r) == 1 {
+			required = append(required, r[0]...)
+			continue
+		}
+		alternatives := make([]interface{}, len(r))
+		for i, keys := range r {
+			alternatives[i] = map[string]interface{}{"required": keys}
+		}
+		allOf = append(allOf, map[string]interface{}{"anyOf": alternatives})
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if len(allOf) > 0 {
+		schema["allOf"] = allOf
+	}
+	return schema
+}
+
+// responseSchema is the schema of c's results. Only the keys every result
+// shares are declared; the rest are the command's own.
+func responseSchema(c command) map[string]interface{} {
+	return map[string]interface{}{
+		"$schema": jsonSchemaDialect,
+		"title":   c.Name + " result",
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"success": map[string]interface{}{"type": "boolean", "description": "Whether the command ran; a check that finds problems still succeeds"},
+			"error": map[string]interface{}{
+				"description": "Why the command failed: a message or, in a versioned result, a code and a message",
+				"oneOf": []interface{}{
+					map[string]interface{}{"type": "string"},
+					map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"code":    map[string]interface{}{"type": "string", "enum": []string{codeUnsupportedAPIVersion, codeUnknownField, codeInvalidField, codeInvalidRequest, codeMissingField, codeInvalidManifest, codeRenderFailed, codeNotFound, codeToolUnavailable, codeClusterUnreachable, codeForbidden, codeTimeout, codeBusy, codeInternal, codeFailed}},
+							"message": map[string]interface{}{"type": "string"},
+						},
+						"required": []string{"code", "message"},
+					},
+				},
+			},
+			"apiVersion": map[string]interface{}{"type": "string", "description": "Set in versioned results", "enum": []string{apiVersion}},
+			"command":    map[string]interface{}{"type": "string", "description": "Set in versioned results", "enum": []string{c.Name}},
+			"passed":     map[string]interface{}{"type": "boolean", "description": "Whether the checks of a check command passed"},
+			"report":     map[string]interface{}{"type": "string", "description": "What the command line prints instead of the result"},
+			"debug":      map[string]interface{}{"type": "object", "description": "The helm, kubectl and HTTP calls made, with debug"},
+			"requestId":  map[string]interface{}{"type": "string", "description": "Set by serve"},
+		},
+		"required":             []string{"success"},
+		"additionalProperties": true,
+	}
+}
+
+// requestFlag returns f as a request key documents it, without what the
+// command line's own output flags add to it; false when f is only one of
+// those.
+func requestFlag(f commandFlag) (commandFlag, bool) {
+	for _, g := range globalFlags {
+		if g.Name != f.Name || envelopeKeys[camelCase(g.Name)] {
+			continue
+		}
+		own, merged := strings.CutSuffix(f.Help, "; or "+strings.ToLower(g.Help[:1])+g.Help[1:])
+		if !merged {
+			return f, false
+		}
+		f.Help = own
+		f.Values = f.Values[:len(f.Values)-len(g.Values)]
+	}
+	return f, true
+}
+
+// typeSchema is the schema of the JSON encoding/json decodes into t.
+func typeSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(helmSetValues{}) {
+		return map[string]interface{}{"type": []string{"string", "array", "object"}, "items": map[string]interface{}{"type": "string"}}
+	}
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		// A type that contains itself is described once.
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		props := map[string]interface{}{}
+		for _, f := range jsonStructFields(t) {
+			props[f.Name] = typeSchema(f.Type, seen)
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]interface{}{}
+}
+
+// flagSchema is the schema of a flag-only request key, from its help.
+func flagSchema(f commandFlag) map[string]interface{} {
+	switch {
+	case f.Switch:
+		return map[string]interface{}{"type": "boolean"}
+	case len(f.Values) > 0:
+		return map[string]interface{}{"type": "string"}
+	case strings.Contains(f.Help, "JSON list or object"):
+		return map[string]interface{}{"type": []string{"array", "object"}}
+	case strings.Contains(f.Help, "(JSON list"):
+		return map[string]interface{}{"type": "array"}
+	case strings.Contains(f.Help, "(JSON"):
+		return map[string]interface{}{"type": "object"}
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+// describeKey adds a key's help, accepted values and default to its schema.
+func describeKey(schema map[string]interface{}, help string, values []string) {
+	schema["description"] = help
+	if len(values) > 0 && schema["type"] == "string" {
+		schema["enum"] = values
+	}
+	// A default outside values, like the TTL of cache=memory, is of
+	// something else.
+	v, ok := helpDefault(help, schema["type"])
+	if s, isString := v.(string); ok && (len(values) == 0 || isString && containsString(values, s)) {
+		schema["default"] = v
+	}
+}
+
+// helpDefault returns the default a help text gives, when it is a value of
+// type typ rather than a description such as "the context's".
+func helpDefault(help string, typ interface{}) (interface{}, bool) {
+	m := flagDefault.FindStringSubmatch(help)
+	if m == nil {
+		return nil, false
+	}
+	text := m[1]
+	// "INFRAKIT_TIMEOUT or 10m": the variable overrides the default.
+	if env, rest, ok := strings.Cut(text, " or "); ok && strings.HasPrefix(env, "INFRAKIT_") {
+		text = rest
+	}
+	if strings.ContainsAny(text, " :") || strings.HasPrefix(text, "INFRAKIT_") {
+		return nil, false
+	}
+	switch typ {
+	case "string":
+		return text, true
+	case "array":
+		return []string{text}, true
+	case "boolean":
+		b, err := strconv.ParseBool(text)
+		return b, err == nil
+	case "integer":
+		n, err := strconv.Atoi(text)
+		return n, err == nil
+	case "number":
+		n, err := strconv.ParseFloat(text, 64)
+		return n, err == nil
+	}
+	return nil, false
+}
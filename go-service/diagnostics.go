@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	diagnosticLogLines  = 50
+	diagnosticMaxEvents = 20
+)
+
+// diagnosticKinds are the workloads whose pods are inspected.
+var diagnosticKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"ReplicaSet":  true,
+	"Job":         true,
+}
+
+// wantDiagnostics reports whether a failure should carry diagnostics;
+// collection is on unless input["diagnostics"] is false.
+func wantDiagnostics(input map[string]interface{}) bool {
+	want, ok := input["diagnostics"].(bool)
+	return !ok || want
+}
+
+// collectDiagnostics gathers what a CI log needs to explain a failed apply or
+// rollout without cluster access: warning events, pod and container states,
+// and recent logs of containers that are not ready. Collection is best
+// effort; anything kubectl cannot read is skipped.
+func collectDiagnostics(input map[string]interface{}, objects []map[string]interface{}) map[string]interface{} {
+	var workloads []map[string]interface{}
+	namespaces := map[string]bool{}
+	for _, obj := range objects {
+		ref := refOf(obj)
+		if !diagnosticKinds[ref.Kind] {
+			continue
+		}
+		namespaces[ref.Namespace] = true
+		workload := map[string]interface{}{"resource": ref}
+		if events := objectEvents(input, ref.Namespace, ref.Name); len(events) > 0 {
+			workload["events"] = events
+		}
+		selector := labelSelector(nestedMap(obj, "spec", "selector", "matchLabels"))
+		if selector != "" {
+			if pods := podDiagnostics(input, ref.Namespace, selector); len(pods) > 0 {
+				workload["pods"] = pods
+			}
+		}
+		workloads = append(workloads, workload)
+	}
+
+	var warnings []interface{}
+	for ns := range namespaces {
+		warnings = append(warnings, listEvents(input, nsArgs(ns, "get", "events", "--field-selector", "type=Warning", "-o", "json")...)...)
+	}
+	if len(warnings) > diagnosticMaxEvents {
+		warnings = warnings[len(warnings)-diagnosticMaxEvents:]
+	}
+	return map[string]interface{}{
+		"workloads":     workloads,
+		"warningEvents": warnings,
+	}
+}
+
+// diagnose collects diagnostics on demand for the workloads in a manifest.
+func diagnose(input map[string]interface{}) map[string]interface{} {
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success":     true,
+		"diagnostics": collectDiagnostics(input, objects),
+	}
+}
+
+func labelSelector(labels map[string]interface{}) string {
+	var parts []string
+	for _, k := range sortedKeys(labels) {
+		if v, ok := labels[k].(string); ok {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func nsArgs(ns string, args ...string) []string {
+	if ns != "" {
+		args = append(args, "-n", ns)
+	}
+	return args
+}
+
+func objectEvents(input map[string]interface{}, ns, name string) []interface{} {
+	return listEvents(input, nsArgs(ns, "get", "events", "--field-selector", "involvedObject.name="+name, "-o", "json")...)
+}
+
+// listEvents returns the most recent events as compact summaries.
+func listEvents(input map[string]interface{}, args ...string) []interface{} {
+	out, err := runKubectl(input, "", args...)
+	if err != nil {
+		return nil
+	}
+	var list struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if json.Unmarshal(out, &list) != nil {
+		return nil
+	}
+	sort.SliceStable(list.Items, func(i, j int) bool {
+		return eventTime(list.Items[i]) < eventTime(list.Items[j])
+	})
+	if len(list.Items) > diagnosticMaxEvents {
+		list.Items = list.Items[len(list.Items)-diagnosticMaxEvents:]
+	}
+	var events []interface{}
+	for _, e := range list.Items {
+		events = append(events, map[string]interface{}{
+			"type":    nestedString(e, "type"),
+			"reason":  nestedString(e, "reason"),
+			"object":  nestedString(e, "involvedObject", "kind") + "/" + nestedString(e, "involvedObject", "name"),
+			"message": nestedString(e, "message"),
+			"count":   nestedValue(e, "count"),
+			"time":    eventTime(e),
+		})
+	}
+	return events
+}
+
+func eventTime(e map[string]interface{}) string {
+	for _, field := range []string{"lastTimestamp", "eventTime", "firstTimestamp"} {
+		if t := nestedString(e, field); t != "" {
+			return t
+		}
+	}
+	return nestedString(e, "metadata", "creationTimestamp")
+}
+
+// podDiagnostics summarizes every pod matching selector and attaches logs
+// for containers that are not ready.
+func podDiagnostics(input map[string]interface{}, ns, selector string) []interface{} {
+	out, err := runKubectl(input, "", nsArgs(ns, "get", "pods", "-l", selector, "-o", "json")...)
+	if err != nil {
+		return nil
+	}
+	var list struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if json.Unmarshal(out, &list) != nil {
+		return nil
+	}
+	var pods []interface{}
+	for _, pod := range list.Items {
+		name := nestedString(pod, "metadata", "name")
+		summary := map[string]interface{}{
+			"name":  name,
+			"phase": nestedString(pod, "status", "phase"),
+		}
+		if reason := nestedString(pod, "status", "reason"); reason != "" {
+			summary["reason"] = reason
+		}
+		var containers []interface{}
+		for _, c := range nestedSlice(pod, "status", "containerStatuses") {
+			cs, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			cname, _ := cs["name"].(string)
+			ready, _ := cs["ready"].(bool)
+			status := map[string]interface{}{
+				"name":         cname,
+				"ready":        ready,
+				"restartCount": cs["restartCount"],
+			}
+			if waiting := nestedMap(cs, "state", "waiting"); waiting != nil {
+				status["waiting"] = waiting
+			}
+			if terminated := nestedMap(cs, "lastState", "terminated"); terminated != nil {
+				status["lastTerminated"] = map[string]interface{}{
+					"reason":   terminated["reason"],
+					"exitCode": terminated["exitCode"],
+					"message":  terminated["message"],
+				}
+			}
+			if !ready {
+				tail := "--tail=" + strconv.Itoa(diagnosticLogLines)
+				if logs, err := runKubectl(input, "", nsArgs(ns, "logs", name, "-c", cname, tail)...); err == nil && len(logs) > 0 {
+					status["logs"] = string(logs)
+				}
+				if restarts, _ := cs["restartCount"].(float64); restarts > 0 {
+					if logs, err := runKubectl(input, "", nsArgs(ns, "logs", name, "-c", cname, tail, "--previous")...); err == nil && len(logs) > 0 {
+						status["previousLogs"] = string(logs)
+					}
+				}
+			}
+			containers = append(containers, status)
+		}
+		if len(containers) > 0 {
+			summary["containers"] = containers
+		}
+		if events := objectEvents(input, ns, name); len(events) > 0 {
+			summary["events"] = events
+		}
+		pods = append(pods, summary)
+	}
+	return pods
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// diffK8sRequest is the request body for diff-k8s. The manifest comes from
+// the usual manifest, manifestFile or name/chart keys.
+type diffK8sRequest struct {
+	Namespace string `json:"namespace"`
+	// Release or Selector also report live resources the manifest no
+	// longer contains as deleted, as find-orphans finds them.
+	Release  string `json:"release"`
+	Selector string `json:"selector"`
+	// Ignore lists further field paths to leave out of the comparison.
+	Ignore []string `json:"ignore"`
+}
+
+// fieldChange is one changed field of a resource. From is absent for
+// added fields and To for removed ones.
+type fieldChange struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// resourceDiff is what applying the manifest would do to one resource.
+type resourceDiff struct {
+	Resource resourceRef `json:"resource"`
+	// Action is "create", "update", "unchanged" or "delete".
+	Action  string        `json:"action"`
+	Changes []fieldChange `json:"changes,omitempty"`
+	Diff    string        `json:"diff,omitempty"`
+}
+
+// diffIgnoredFields are maintained by the API server and would show up
+// in every diff.
+var diffIgnoredFields = [][]string{
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "generation"},
+	{"metadata", "creationTimestamp"},
+	{"metadata", "uid"},
+	{"metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration"},
+	{"status"},
+}
+
+// diffK8s previews what applying a manifest would change in the cluster,
+// like kubectl diff: each resource is server-side dry-run applied, so
+// defaults, admission mutations and merges with the live object are
+// included, and compared with the live object field by field. Secret
+// values are masked.
+func diffK8s(input map[string]interface{}) map[string]interface{} {
+	var req diffK8sRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	var ignore [][]string
+	for _, p := range req.Ignore {
+		path, err := parseFieldPath(p)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Invalid ignore path " + p + ": " + err.Error(),
+			}
+		}
+		ignore = append(ignore, path)
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	if len(objects) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No manifest provided",
+		}
+	}
+	manifest = encodeManifest(objects)
+	var ns []string
+	if req.Namespace != "" {
+		ns = []string{"-n", req.Namespace}
+	}
+
+	diffs, err := liveDiffs(input, manifest, ns, func(resourceRef) [][]string { return ignore })
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	counts := map[string]int{"create": 0, "update": 0, "unchanged": 0, "delete": 0}
+	for _, d := range diffs {
+		counts[d.Action]++
+	}
+
+	if req.Release != "" || req.Selector != "" {
+		orphans, err := renderedOrphans(input, manifest)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		for _, ref := range orphans {
+			diffs = append(diffs, resourceDiff{Resource: ref, Action: "delete"})
+			counts["delete"]++
+		}
+	}
+
+	var report strings.Builder
+	for _, d := range diffs {
+		switch d.Action {
+		case "create":
+			fmt.Fprintf(&report, "+ %s (create)\n", d.Resource)
+		case "update":
+			fmt.Fprintf(&report, "~ %s (update, %d changed)\n", d.Resource, len(d.Changes))
+		case "delete":
+			fmt.Fprintf(&report, "- %s (delete)\n", d.Resource)
+		default:
+			continue
+		}
+		report.WriteString(d.Diff)
+	}
+	fmt.Fprintf(&report, "%d to create, %d to update, %d to delete, %d unchanged\n", counts["create"], counts["update"], counts["delete"], counts["unchanged"])
+	return map[string]interface{}{
+		"success":   true,
+		"changed":   counts["create"]+counts["update"]+counts["delete"] > 0,
+		"summary":   counts,
+		"resources": diffs,
+		"report":    report.String(),
+	}
+}
+
+// liveDiffs compares each resource of manifest, server-side dry-run
+// applied, with its live object, leaving the fields ignore returns for it
+// out. Actions are "create", "update" or "unchanged".
+func liveDiffs(input map[string]interface{}, manifest string, ns []string, ignore func(resourceRef) [][]string) ([]resourceDiff, error) {
+	out, err := runKubectl(input, manifest, append([]string{"get", "-f", "-", "-o", "json", "--ignore-not-found"}, ns...)...)
+	if err != nil {
+		return nil, errors.New("Failed to get live resources: " + err.Error())
+	}
+	live, err := kubectlObjects(out)
+	if err != nil {
+		return nil, errors.New("Failed to decode live resources: " + err.Error())
+	}
+	out, err = runKubectl(input, manifest, append([]string{"apply", "--dry-run=server", "-o", "json", "-f", "-"}, ns...)...)
+	if err != nil {
+		return nil, errors.New("Dry-run apply failed: " + err.Error())
+	}
+	desired, err := kubectlObjects(out)
+	if err != nil {
+		return nil, errors.New("Failed to decode dry-run result: " + err.Error())
+	}
+
+	key := func(r resourceRef) string { return r.Kind + "/" + r.Namespace + "/" + r.Name }
+	before := map[string]map[string]interface{}{}
+	for _, obj := range live {
+		before[key(refOf(obj))] = obj
+	}
+	var diffs []resourceDiff
+	for _, obj := range desired {
+		ref := refOf(obj)
+		to := diffView(obj, ignore(ref))
+		d := resourceDiff{Resource: ref, Action: "create"}
+		old, ok := before[key(ref)]
+		if ok {
+			from := diffView(old, ignore(ref))
+			maskSecretValues(from, to)
+			d.Changes = fieldChanges(from, to, nil)
+			d.Action = "unchanged"
+			if len(d.Changes) > 0 {
+				d.Action = "update"
+				d.Diff = unifiedDiff(encodeYAML(from), encodeYAML(to), "live/"+ref.String(), "merged/"+ref.String())
+			}
+		} else {
+			maskSecretValues(nil, to)
+			d.Diff = unifiedDiff("", encodeYAML(to), "/dev/null", "merged/"+ref.String())
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// kubectlObjects decodes kubectl's JSON output, one object or a List.
+func kubectlObjects(out []byte) ([]map[string]interface{}, error) {
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil, nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(out, &obj); err != nil {
+		return nil, err
+	}
+	if kind, _ := obj["kind"].(string); strings.HasSuffix(kind, "List") && obj["items"] != nil {
+		var objects []map[string]interface{}
+		for _, item := range nestedSlice(obj, "items") {
+			if m, ok := item.(map[string]interface{}); ok {
+				objects = append(objects, m)
+			}
+		}
+		return objects, nil
+	}
+	return []map[string]interface{}{obj}, nil
+}
+
+// diffView is obj as compared, without the fields the server maintains.
+func diffView(obj map[string]interface{}, ignore [][]string) map[string]interface{} {
+	obj = deepCopyObject(obj)
+	for _, path := range diffIgnoredFields {
+		deleteField(obj, path)
+	}
+	for _, path := range ignore {
+		maskField(obj, path)
+	}
+	if annotations, ok := nestedValue(obj, "metadata", "annotations").(map[string]interface{}); ok && len(annotations) == 0 {
+		delete(obj["metadata"].(map[string]interface{}), "annotations")
+	}
+	return obj
+}
+
+// maskSecretValues hides the values of a Secret as kubectl diff does: a
+// value that changes reads "*** (before)" and "*** (after)", others "***".
+func maskSecretValues(from, to map[string]interface{}) {
+	if refOf(to).Kind != "Secret" {
+		return
+	}
+	for _, field := range []string{"data", "stringData"} {
+		before, _ := from[field].(map[string]interface{})
+		after, _ := to[field].(map[string]interface{})
+		for k, v := range after {
+			old, ok := before[k]
+			switch {
+			case !ok:
+				after[k] = "***"
+			case valuesEqual(old, v):
+				before[k], after[k] = "***", "***"
+			default:
+				before[k], after[k] = "*** (before)", "*** (after)"
+			}
+		}
+		for k := range before {
+			if _, ok := after[k]; !ok {
+				before[k] = "***"
+			}
+		}
+	}
+}
+
+func deleteField(obj map[string]interface{}, keys []string) {
+	parent, ok := lookupField(obj, keys[:len(keys)-1])
+	if m, isMap := parent.(map[string]interface{}); ok && isMap {
+		delete(m, keys[len(keys)-1])
+	}
+}
+
+// fieldChanges lists the fields at which a and b differ, with both values,
+// descending into objects; lists are compared as a whole.
+func fieldChanges(a, b interface{}, keys []string) []fieldChange {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if valuesEqual(a, b) {
+			return nil
+		}
+		return []fieldChange{{Path: joinFieldPath(keys), From: a, To: b}}
+	}
+	names := map[string]bool{}
+	for k := range am {
+		names[k] = true
+	}
+	for k := range bm {
+		names[k] = true
+	}
+	var changes []fieldChange
+	for _, k := range sortedSet(names) {
+		changes = append(changes, fieldChanges(am[k], bm[k], append(append([]string{}, keys...), k))...)
+	}
+	return changes
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDiscoveryTTL = 10 * time.Minute
+
+// discoveryCache holds discovery and OpenAPI responses per cluster, in
+// memory for the life of the process and on disk across processes, so
+// repeated checks against one cluster skip the discovery round trips.
+var discoveryCache = struct {
+	sync.Mutex
+	entries map[string]discoveryEntry
+	servers map[string]string
+}{entries: map[string]discoveryEntry{}, servers: map[string]string{}}
+
+type discoveryEntry struct {
+	data    []byte
+	fetched time.Time
+}
+
+func discoveryTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("INFRAKIT_DISCOVERY_TTL")); err == nil {
+		return d
+	}
+	return defaultDiscoveryTTL
+}
+
+// discoveryCacheDir returns where discovery responses are persisted.
+func discoveryCacheDir() string {
+	if dir := os.Getenv("INFRAKIT_DISCOVERY_CACHE"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-discovery")
+	}
+	return filepath.Join(home, ".infrakit", "discovery")
+}
+
+// clusterCacheKey identifies the cluster input points at by its API server
+// URL, which stays the same when the kubeconfig is a fresh temp file.
+func clusterCacheKey(input map[string]interface{}) (string, error) {
+	server, err := clusterServer(input)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(server))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// clusterServer returns the API server URL of the cluster input points at.
+func clusterServer(input map[string]interface{}) (string, error) {
+	kubeconfig := kubeconfigKey(input)
+	discoveryCache.Lock()
+	server, ok := discoveryCache.servers[kubeconfig]
+	discoveryCache.Unlock()
+	if !ok {
+		// Read locally rather than through runKubectl, which needs the key
+		// for its per-cluster limit.
+		cmd := kubectlCommand(input, "config", "view", "--minify", "-o", "jsonpath={.clusters[0].cluster.server}")
+		start := time.Now()
+		out, err := cmd.Output()
+		traceCommand(cmd, start, nil, err)
+		if err != nil {
+			return "", err
+		}
+		server = strings.TrimSpace(string(out))
+		if server == "" {
+			return "", errors.New("kubeconfig has no current cluster")
+		}
+		discoveryCache.Lock()
+		discoveryCache.servers[kubeconfig] = server
+		discoveryCache.Unlock()
+	}
+	return server, nil
+}
+
+// knownClusterServer returns the API server URL of input's cluster when
+// a call to it has looked it up, without looking it up itself.
+func knownClusterServer(input map[string]interface{}) string {
+	discoveryCache.Lock()
+	defer discoveryCache.Unlock()
+	return discoveryCache.servers[kubeconfigKey(input)]
+}
+
+// kubeconfigKey identifies the kubeconfig and context of input.
+func kubeconfigKey(input map[string]interface{}) string {
+	kubeconfig, _ := input["kubeconfig"].(string)
+	if kubeconfig == "" {
+		kubeconfig = os.Getenv("KUBECONFIG")
+	}
+	// Contexts of one kubeconfig may point at different clusters.
+	if context, _ := input["context"].(string); context != "" {
+		kubeconfig += "#" + context
+	}
+	return kubeconfig
+}
+
+// cachedKubectl returns kubectl's output for a read-only discovery call,
+// serving it from the cache while it is fresh. input["refreshDiscovery"]
+// forces a refetch.
+func cachedKubectl(input map[string]interface{}, name string, args ...string) ([]byte, error) {
+	cluster, err := clusterCacheKey(input)
+	if err != nil {
+		// Without a stable identity, caching could mix up clusters.
+		return runKubectl(input, "", args...)
+	}
+	key := cluster + "/" + name
+	path := filepath.Join(discoveryCacheDir(), cluster, strings.NewReplacer("/", "_", ":", "_").Replace(name))
+	ttl := discoveryTTL()
+
+	if refresh, _ := input["refreshDiscovery"].(bool); !refresh {
+		discoveryCache.Lock()
+		entry, ok := discoveryCache.entries[key]
+		discoveryCache.Unlock()
+		if ok && time.Since(entry.fetched) < ttl {
+			traceCached(args)
+			return entry.data, nil
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < ttl {
+			if data, err := os.ReadFile(path); err == nil {
+				discoveryCache.Lock()
+				discoveryCache.entries[key] = discoveryEntry{data, info.ModTime()}
+				discoveryCache.Unlock()
+				traceCached(args)
+				return data, nil
+			}
+		}
+	}
+
+	data, err := runKubectl(input, "", args...)
+	if err != nil {
+		return data, err
+	}
+	discoveryCache.Lock()
+	discoveryCache.entries[key] = discoveryEntry{data, time.Now()}
+	discoveryCache.Unlock()
+	// Persisting is best effort; a failed write only costs a refetch.
+	writeCacheFile(path, data)
+	return data, nil
+}
+
+// clusterOpenAPISchema returns the OpenAPI v3 document for a group/version.
+func clusterOpenAPISchema(input map[string]interface{}, groupVersion string) ([]byte, error) {
+	path := "/openapi/v3/apis/" + groupVersion
+	if groupVersion == "v1" {
+		path = "/openapi/v3/api/v1"
+	}
+	return cachedKubectl(input, "openapi-"+groupVersion, "get", "--raw", path)
+}
+
+// clearDiscoveryCache drops the cached discovery data of the target cluster,
+// or of every cluster with input["all"], e.g. after installing CRDs.
+func clearDiscoveryCache(input map[string]interface{}) map[string]interface{} {
+	dir, prefix := discoveryCacheDir(), ""
+	if all, _ := input["all"].(bool); !all {
+		cluster, err := clusterCacheKey(input)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to identify cluster: " + err.Error(),
+			}
+		}
+		dir, prefix = filepath.Join(dir, cluster), cluster+"/"
+	}
+
+	discoveryCache.Lock()
+	for key := range discoveryCache.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(discoveryCache.entries, key)
+		}
+	}
+	discoveryCache.Unlock()
+	if err := os.RemoveAll(dir); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"cleared": dir,
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// doctorCheck is one diagnostic: Status is "ok", "warn" or "fail", and Fix
+// says what to do about anything but "ok".
+type doctorCheck struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix,omitempty"`
+}
+
+// optionalTools are only needed by some requests.
+var optionalTools = []struct{ Name, UsedFor string }{
+	{"git", "hook"},
+	{"ssh", "sshTunnel"},
+	{"aws", "cloudAuth on EKS"},
+	{"gcloud", "cloudAuth on GKE"},
+	{"az", "cloudAuth on AKS"},
+	{"stty", "ui"},
+	{"terraform", "terraform-validate and terraform-plan"},
+	{"sops", "decrypt and sopsDecrypt"},
+	{"cosign", "sign-manifest and verify-manifest"},
+}
+
+// settings are the INFRAKIT_* variables and the kind of value each takes.
+var settings = map[string]string{
+	"INFRAKIT_AUDIT_SINKS":        "audit",
+	"INFRAKIT_AUDIT_TOKEN":        "string",
+	"INFRAKIT_BACKUP_DIR":         "dir",
+	"INFRAKIT_CLUSTER_BURST":      "rate",
+	"INFRAKIT_CLUSTER_RATE":       "rate",
+	"INFRAKIT_CLUSTER_RATES":      "rates",
+	"INFRAKIT_COMMAND_LIMITS":     "limits",
+	"INFRAKIT_CPU_PROFILE":        "file",
+	"INFRAKIT_DISCOVERY_CACHE":    "dir",
+	"INFRAKIT_DISCOVERY_TTL":      "duration",
+	"INFRAKIT_HEAP_PROFILE":       "file",
+	"INFRAKIT_HELM_CACHE":         "dir",
+	"INFRAKIT_HELM_CACHE_MAX_AGE": "duration",
+	"INFRAKIT_HELM_CACHE_MAX_MB":  "int",
+	"INFRAKIT_HELM_VERSION":       "tool",
+	"INFRAKIT_KUBECTL_VERSION":    "tool",
+	"INFRAKIT_LOG_FORMAT":         "logformat",
+	"INFRAKIT_LOG_LEVEL":          "loglevel",
+	"INFRAKIT_MAX_HELM":           "int",
+	"INFRAKIT_MAX_INPUT_BYTES":    "int",
+	"INFRAKIT_MAX_KUBECTL":        "int",
+	"INFRAKIT_MAX_MANIFEST_BYTES": "int",
+	"INFRAKIT_MAX_OPA":            "int",
+	"INFRAKIT_MAX_PER_CLUSTER":    "int",
+	"INFRAKIT_OPS_DIR":            "dir",
+	"INFRAKIT_PLUGIN_DIR":         "dir",
+	"INFRAKIT_POLICY_CONFIG":      "file",
+	"INFRAKIT_POLICY_DIR":         "dir",
+	"INFRAKIT_POLICY_PUBLIC_KEY":  "string",
+	"INFRAKIT_PPROF_ADDR":         "addr",
+	"INFRAKIT_PPROF_TOKEN":        "string",
+	"INFRAKIT_RECORD_REQUESTS":    "bool",
+	"INFRAKIT_RELEASE_CHANNEL":    "string",
+	"INFRAKIT_RELEASE_URL":        "url",
+	"INFRAKIT_RENDER_CACHE":       "dir",
+	"INFRAKIT_RENDER_CACHE_TTL":   "duration",
+	"INFRAKIT_REVISION_DIR":       "dir",
+	"INFRAKIT_REVISION_HISTORY":   "int",
+	"INFRAKIT_SCHEMA_CACHE":       "dir",
+	"INFRAKIT_SERVE_ADDR":         "addr",
+	"INFRAKIT_SERVE_MAX_RUNNING":  "int",
+	"INFRAKIT_SERVE_QUEUE_SIZE":   "int",
+	"INFRAKIT_SERVE_TIMEOUT":      "duration",
+	"INFRAKIT_SERVE_TOKEN":        "string",
+	"INFRAKIT_TF_PLUGIN_CACHE":    "dir",
+	"INFRAKIT_TIMEOUT":            "duration",
+	"INFRAKIT_TOOLS_CONFIG":       "file",
+	"INFRAKIT_TOOLS_DIR":          "dir",
+	"INFRAKIT_TOOLS_MIRROR":       "url",
+	"INFRAKIT_WORKDIR":            "dir",
+}
+
+var semverPattern = regexp.MustCompile(`v?(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// doctor checks that the tools, clusters, cache directories and settings
+// this service relies on are usable, with a fix for each problem found. It
+// fails (passed: false) only on problems that break commands; warnings
+// cover optional tools and degraded setups.
+func doctor(input map[string]interface{}) map[string]interface{} {
+	var checks []doctorCheck
+	add := func(category, name, status, message, fix string) {
+		checks = append(checks, doctorCheck{category, name, status, message, fix})
+	}
+
+	if out, err := runHelm(requestContext(input), "version", "--short"); err != nil {
+		add("tools", "helm", "fail", "helm is not usable: "+firstLines(err.Error(), 2), "Install Helm 3 (https://helm.sh/docs/intro/install/) and put it on PATH")
+	} else if v := firstLines(string(out), 1); !strings.HasPrefix(v, "v3.") {
+		add("tools", "helm", "fail", "helm "+v+" is not Helm 3", "Upgrade to Helm 3; Helm 2 charts and Tiller are not supported")
+	} else {
+		add("tools", "helm", "ok", "helm "+v+managedNote("helm"), "")
+	}
+
+	kubectlOK, clientVersion := false, ""
+	if out, err := runKubectl(input, "", "version", "--client", "-o", "json"); err != nil {
+		add("tools", "kubectl", "fail", "kubectl is not usable: "+firstLines(err.Error(), 2), "Install kubectl (https://kubernetes.io/docs/tasks/tools/) and put it on PATH")
+	} else {
+		var v struct {
+			ClientVersion struct {
+				GitVersion string `json:"gitVersion"`
+			} `json:"clientVersion"`
+		}
+		json.Unmarshal(out, &v)
+		kubectlOK, clientVersion = true, v.ClientVersion.GitVersion
+		add("tools", "kubectl", "ok", "kubectl "+clientVersion+managedNote("kubectl"), "")
+	}
+
+	for _, tool := range optionalTools {
+		if path, err := exec.LookPath(toolBinary(tool.Name)); err != nil {
+			add("tools", tool.Name, "warn", tool.Name+" not found; needed for "+tool.UsedFor, "Install "+tool.Name+" if you use "+tool.UsedFor)
+		} else {
+			add("tools", tool.Name, "ok", path, "")
+		}
+	}
+
+	if kubectlOK {
+		checks = append(checks, doctorClusters(input, clientVersion)...)
+	}
+	checks = append(checks, doctorDirs(input)...)
+	checks = append(checks, doctorSettings(os.Environ())...)
+
+	var report strings.Builder
+	failed, warnings := 0, 0
+	for _, c := range checks {
+		mark := "✓"
+		switch c.Status {
+		case "fail":
+			mark = "✗"
+			failed++
+		case "warn":
+			mark = "!"
+			warnings++
+		}
+		fmt.Fprintf(&report, "%s %-9s %-28s %s\n", mark, c.Category, c.Name, c.Message)
+		if c.Fix != "" {
+			fmt.Fprintf(&report, "  %-38s fix: %s\n", "", c.Fix)
+		}
+	}
+	fmt.Fprintf(&report, "%d checks, %d failed, %d warnings\n", len(checks), failed, warnings)
+	return map[string]interface{}{
+		"success":  true,
+		"passed":   failed == 0,
+		"failed":   failed,
+		"warnings": warnings,
+		"checks":   checks,
+		"report":   report.String(),
+	}
+}
+
+func managedNote(tool string) string {
+	if configuredTool(tool) {
+		return " (configured, " + toolBinary(tool) + ")"
+	}
+	if path := toolBinary(tool); path != tool {
+		return " (managed, " + path + ")"
+	}
+	return ""
+}
+
+// doctorClusters checks every context of the kubeconfig in parallel, or
+// just input["context"]: that the API server answers and that its version
+// is within kubectl's supported skew of one minor version.
+func doctorClusters(input map[string]interface{}, clientVersion string) []doctorCheck {
+	if context, _ := input["context"].(string); context != "" {
+		return []doctorCheck{doctorCluster(input, context, clientVersion)}
+	}
+	out, err := runKubectl(input, "", "config", "get-contexts", "-o", "name")
+	if err != nil {
+		return []doctorCheck{{"clusters", "kubeconfig", "warn", "Cannot read contexts: " + firstLines(err.Error(), 2), "Set KUBECONFIG or pass --kubeconfig to check cluster access"}}
+	}
+	var contexts []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			contexts = append(contexts, line)
+		}
+	}
+	if len(contexts) == 0 {
+		return []doctorCheck{{"clusters", "kubeconfig", "warn", "No contexts configured", "Add a context to the kubeconfig, e.g. with your cloud CLI's get-credentials command"}}
+	}
+	checks := make([]doctorCheck, len(contexts))
+	var wg sync.WaitGroup
+	for i, name := range contexts {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			checks[i] = doctorCluster(input, name, clientVersion)
+		}(i, name)
+	}
+	wg.Wait()
+	return checks
+}
+
+func doctorCluster(input map[string]interface{}, context, clientVersion string) doctorCheck {
+	out, err := runKubectl(input, "", "--context="+context, "--request-timeout=10s", "version", "-o", "json")
+	if err != nil {
+		msg := firstLines(err.Error(), 2)
+		fix := "Check the context's server address, VPN or proxy, and credentials"
+		switch {
+		case strings.Contains(msg, "Unauthorized") || strings.Contains(msg, "credentials"):
+			fix = "Refresh the context's credentials, e.g. re-run your cloud CLI's get-credentials command"
+		case strings.Contains(msg, "x509"):
+			fix = "The server certificate is not trusted; update certificate-authority-data in the kubeconfig"
+		case strings.Contains(msg, "executable") && strings.Contains(msg, "not found"):
+			fix = "Install the credential plugin named in the kubeconfig's exec section"
+		}
+		return doctorCheck{"clusters", context, "fail", "Unreachable: " + msg, fix}
+	}
+	var v struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	json.Unmarshal(out, &v)
+	server := v.ServerVersion.GitVersion
+	if skew, ok := minorSkew(clientVersion, server); ok && (skew > 1 || skew < -1) {
+		return doctorCheck{"clusters", context, "warn", fmt.Sprintf("Reachable, server %s but kubectl %s", server, clientVersion), "Use a kubectl within one minor version of the server"}
+	}
+	return doctorCheck{"clusters", context, "ok", "Reachable, server " + server, ""}
+}
+
+// minorSkew is the client's minor version minus the server's, when both
+// are Kubernetes 1.x versions.
+func minorSkew(client, server string) (int, bool) {
+	c, s := semverPattern.FindStringSubmatch(client), semverPattern.FindStringSubmatch(server)
+	if c == nil || s == nil || c[1] != s[1] {
+		return 0, false
+	}
+	cm, _ := strconv.Atoi(c[2])
+	sm, _ := strconv.Atoi(s[2])
+	return cm - sm, true
+}
+
+// doctorDirs checks that each cache and state directory is a writable
+// directory, or can be created.
+func doctorDirs(input map[string]interface{}) []doctorCheck {
+	dirs := []struct{ Name, Env, Path string }{
+		{"helm cache", "INFRAKIT_HELM_CACHE", helmCacheDir()},
+		{"discovery cache", "INFRAKIT_DISCOVERY_CACHE", discoveryCacheDir()},
+		{"schema cache", "INFRAKIT_SCHEMA_CACHE", schemaCacheDir()},
+		{"render cache", "INFRAKIT_RENDER_CACHE", renderCacheDir()},
+		{"operations", "INFRAKIT_OPS_DIR", opsDir()},
+		{"backups", "INFRAKIT_BACKUP_DIR", backupDir(input)},
+		{"workspaces", "INFRAKIT_WORKDIR", workspaceRoot()},
+		{"managed tools", "INFRAKIT_TOOLS_DIR", toolsDir()},
+		{"policy bundles", "INFRAKIT_POLICY_DIR", policyDir()},
+		{"terraform providers", "INFRAKIT_TF_PLUGIN_CACHE", terraformPluginCache()},
+	}
+	var checks []doctorCheck
+	for _, d := range dirs {
+		checks = append(checks, doctorDir(d.Name, d.Env, d.Path))
+	}
+	return checks
+}
+
+func doctorDir(name, env, path string) doctorCheck {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(path)
+		for ; parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+			if _, err := os.Stat(parent); err == nil {
+				break
+			}
+		}
+		if !writable(parent) {
+			return doctorCheck{"caches", name, "fail", path + " does not exist and " + parent + " is not writable", "Create " + path + " or set " + env + " to a writable directory"}
+		}
+		return doctorCheck{"caches", name, "ok", path + " (created on first use)", ""}
+	}
+	if err != nil {
+		return doctorCheck{"caches", name, "fail", err.Error(), "Fix the permissions of " + path + " or set " + env}
+	}
+	if !info.IsDir() {
+		return doctorCheck{"caches", name, "fail", path + " is not a directory", "Remove it or set " + env + " to a directory"}
+	}
+	if !writable(path) {
+		return doctorCheck{"caches", name, "fail", path + " is not writable", "Fix its ownership or set " + env + " to a writable directory"}
+	}
+	var size int64
+	var entries int
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+				entries++
+			}
+		}
+		return nil
+	})
+	msg := fmt.Sprintf("%s (%d files, %.1f MB)", path, entries, float64(size)/(1<<20))
+	if info.Mode().Perm()&0o002 != 0 {
+		return doctorCheck{"caches", name, "warn", msg + " is world-writable", "chmod o-w " + path}
+	}
+	return doctorCheck{"caches", name, "ok", msg, ""}
+}
+
+func writable(dir string) bool {
+	f, err := os.CreateTemp(dir, ".infrakit-doctor-")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
+
+// doctorSettings validates the INFRAKIT_* variables that are set, and flags
+// unknown ones, which are usually misspelled and otherwise silently ignored.
+func doctorSettings(environ []string) []doctorCheck {
+	var checks []doctorCheck
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "INFRAKIT_") {
+			continue
+		}
+		kind, known := settings[name]
+		if !known {
+			fix := "Remove it"
+			if match := closestSetting(name); match != "" {
+				fix = "Did you mean " + match + "?"
+			}
+			checks = append(checks, doctorCheck{"settings", name, "warn", "Unknown setting, ignored", fix})
+			continue
+		}
+		if problem := settingProblem(kind, value); problem != "" {
+			checks = append(checks, doctorCheck{"settings", name, "fail", problem + "; the default is used instead", "Set " + name + " to " + settingExample(kind)})
+			continue
+		}
+		shown := value
+		if isSensitiveKey(name) {
+			shown = redactedValue
+		}
+		checks = append(checks, doctorCheck{"settings", name, "ok", shown, ""})
+	}
+	return checks
+}
+
+func settingProblem(kind, value string) string {
+	switch kind {
+	case "int":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Sprintf("%q is not an integer", value)
+		}
+	case "duration":
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Sprintf("%q is not a duration", value)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Sprintf("%q is not true or false", value)
+		}
+	case "limits":
+		for _, entry := range strings.Split(value, ",") {
+			command, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if _, known := lookupCommand(command); !known {
+				return fmt.Sprintf("unknown command %q", command)
+			}
+			if _, err := strconv.Atoi(limit); !ok || err != nil {
+				return fmt.Sprintf("%q is not command=limit", entry)
+			}
+		}
+	case "rate":
+		if r, err := strconv.ParseFloat(value, 64); err != nil || r < 0 {
+			return fmt.Sprintf("%q is not a number of calls per second", value)
+		}
+	case "rates":
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			i := strings.LastIndex(entry, "=")
+			if i <= 0 {
+				return fmt.Sprintf("%q is not server=rate", entry)
+			}
+			if u, err := url.Parse(entry[:i]); err != nil || u.Host == "" {
+				return fmt.Sprintf("%q is not server=rate", entry)
+			}
+			if r, err := strconv.ParseFloat(entry[i+1:], 64); err != nil || r < 0 {
+				return fmt.Sprintf("%q is not server=rate", entry)
+			}
+		}
+	case "audit":
+		if _, err := auditSinks(value); err != nil {
+			return err.Error()
+		}
+	case "tool":
+		version, digest, _ := strings.Cut(value, "@sha256:")
+		if !toolVersionPattern.MatchString("v"+strings.TrimPrefix(version, "v")) || (digest != "" && !toolDigestPattern.MatchString(strings.ToLower(digest))) {
+			return fmt.Sprintf("%q is not a version, optionally with @sha256:<digest>", value)
+		}
+	case "addr":
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return fmt.Sprintf("%q is not host:port", value)
+		}
+	case "url":
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Sprintf("%q is not an http(s) URL", value)
+		}
+	case "loglevel":
+		switch strings.ToLower(value) {
+		case "debug", "info", "warn", "warning", "error":
+		default:
+			return fmt.Sprintf("%q is not a log level", value)
+		}
+	case "logformat":
+		if value != "text" && value != "json" {
+			return fmt.Sprintf("%q is not a log format", value)
+		}
+	case "dir", "file":
+		if !filepath.IsAbs(value) {
+			return fmt.Sprintf("%q is relative, so depends on the working directory", value)
+		}
+	}
+	return ""
+}
+
+func settingExample(kind string) string {
+	switch kind {
+	case "int":
+		return "a whole number, e.g. 8"
+	case "duration":
+		return "a duration, e.g. 10m or 24h"
+	case "bool":
+		return "true or false"
+	case "limits":
+		return "command=limit pairs, e.g. render-many=2,validate-k8s=8"
+	case "rate":
+		return "calls per second, e.g. 5 or 0.5"
+	case "rates":
+		return "server=rate pairs, e.g. https://prod.example.com:6443=5"
+	case "audit":
+		return "sinks such as jsonl:/var/log/infrakit/audit.jsonl,https://audit.example.com/infrakit"
+	case "tool":
+		return "a version such as v1.29.2"
+	case "addr":
+		return "host:port, e.g. 127.0.0.1:6060"
+	case "url":
+		return "an https:// URL"
+	case "loglevel":
+		return "debug, info, warn or error"
+	case "logformat":
+		return "text or json"
+	}
+	return "an absolute path"
+}
+
+// closestSetting returns the known setting within two edits of name.
+func closestSetting(name string) string {
+	best, bestDistance := "", 3
+	for known := range settings {
+		if d := editDistance(name, known); d < bestDistance || (d == bestDistance && known < best) {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// driftRequest is the request body for detect-drift. The declared state
+// comes from the usual manifest, manifestFile or name/chart keys or,
+// without them, from the manifest helm recorded for release.
+type driftRequest struct {
+	Namespace string `json:"namespace"`
+	// Release or Selector also report live resources with the release's
+	// labels, or matching the selector, that are not declared, as
+	// find-orphans finds them.
+	Release  string `json:"release"`
+	Selector string `json:"selector"`
+	// Ignore lists further field paths to leave out of the comparison;
+	// "Kind:path" leaves a path out for one kind only.
+	Ignore []string `json:"ignore"`
+	// ScaledReplicas compares the replicas of workloads a
+	// HorizontalPodAutoscaler scales, which are left out by default.
+	ScaledReplicas bool `json:"scaledReplicas"`
+}
+
+// resourceDrift is how one declared or orphaned resource differs from
+// the cluster.
+type resourceDrift struct {
+	Resource resourceRef `json:"resource"`
+	// Status is "modified", "missing", "orphaned" or "in-sync".
+	Status string       `json:"status"`
+	Fields []fieldDrift `json:"fields,omitempty"`
+	Diff   string       `json:"diff,omitempty"`
+	// Ignored lists the fields left out for this resource alone, such as
+	// the replicas of an autoscaled workload.
+	Ignored []string `json:"ignored,omitempty"`
+}
+
+// fieldDrift is one field whose live value is not the declared one.
+// Declared is absent for fields the manifest removes and Live for fields
+// missing from the cluster.
+type fieldDrift struct {
+	Path     string      `json:"path"`
+	Declared interface{} `json:"declared,omitempty"`
+	Live     interface{} `json:"live,omitempty"`
+}
+
+var kindIgnorePrefix = regexp.MustCompile(`^([A-Z][A-Za-z0-9]*):(.+)$`)
+
+// detectDrift reports how the cluster has drifted from declared manifests:
+// resources modified out of band, field by field, declared resources that
+// are missing and, with a release or selector, live resources with its
+// labels that are no longer declared. Resources are compared as diff-k8s
+// compares them, so only fields the manifest sets (after defaults and
+// admission) count: status, managedFields and other server-maintained
+// fields are left out, as are the replicas of autoscaled workloads unless
+// scaledReplicas is set. "passed" is false when anything drifted.
+func detectDrift(input map[string]interface{}) map[string]interface{} {
+	var req driftRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	var ignore [][]string
+	kindIgnore := map[string][][]string{}
+	for _, p := range req.Ignore {
+		kind := ""
+		if m := kindIgnorePrefix.FindStringSubmatch(p); m != nil {
+			kind, p = m[1], m[2]
+		}
+		path, err := parseFieldPath(p)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Invalid ignore path " + p + ": " + err.Error(),
+			}
+		}
+		if kind != "" {
+			kindIgnore[kind] = append(kindIgnore[kind], path)
+		} else {
+			ignore = append(ignore, path)
+		}
+	}
+
+	manifest, err := declaredManifest(input, req)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	if len(objects) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No manifest provided",
+		}
+	}
+	manifest = encodeManifest(objects)
+	var ns []string
+	if req.Namespace != "" {
+		ns = []string{"-n", req.Namespace}
+	}
+
+	scaled := map[string]bool{}
+	if !req.ScaledReplicas {
+		if scaled, err = autoscaledWorkloads(input, req.Namespace, objects); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+	}
+	autoscaled := func(ref resourceRef) bool {
+		return scaled[scaleKey(ref.Kind, ref.Namespace, ref.Name)] || scaled[scaleKey(ref.Kind, "", ref.Name)]
+	}
+	diffs, err := liveDiffs(input, manifest, ns, func(ref resourceRef) [][]string {
+		paths := append(append([][]string{}, ignore...), kindIgnore[ref.Kind]...)
+		if autoscaled(ref) {
+			paths = append(paths, []string{"spec", "replicas"})
+		}
+		return paths
+	})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+
+	counts := map[string]int{"modified": 0, "missing": 0, "orphaned": 0, "in-sync": 0}
+	var resources []resourceDrift
+	for _, d := range diffs {
+		r := resourceDrift{Resource: d.Resource, Status: "in-sync"}
+		switch d.Action {
+		case "create":
+			r.Status = "missing"
+		case "update":
+			r.Status = "modified"
+			r.Diff = d.Diff
+			for _, c := range d.Changes {
+				r.Fields = append(r.Fields, fieldDrift{Path: c.Path, Declared: c.To, Live: c.From})
+			}
+		}
+		if autoscaled(d.Resource) {
+			r.Ignored = []string{"spec.replicas"}
+		}
+		counts[r.Status]++
+		resources = append(resources, r)
+	}
+	if req.Release != "" || req.Selector != "" {
+		orphans, err := renderedOrphans(input, manifest)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		for _, ref := range orphans {
+			resources = append(resources, resourceDrift{Resource: ref, Status: "orphaned"})
+			counts["orphaned"]++
+		}
+	}
+
+	var report strings.Builder
+	for _, r := range resources {
+		switch r.Status {
+		case "modified":
+			fmt.Fprintf(&report, "~ %s (modified, %d fields)\n", r.Resource, len(r.Fields))
+			report.WriteString(r.Diff)
+		case "missing":
+			fmt.Fprintf(&report, "- %s (missing)\n", r.Resource)
+		case "orphaned":
+			fmt.Fprintf(&report, "+ %s (orphaned)\n", r.Resource)
+		}
+	}
+	fmt.Fprintf(&report, "%d modified, %d missing, %d orphaned, %d in sync\n", counts["modified"], counts["missing"], counts["orphaned"], counts["in-sync"])
+	drifted := counts["modified"]+counts["missing"]+counts["orphaned"] > 0
+	return map[string]interface{}{
+		"success":   true,
+		"passed":    !drifted,
+		"drifted":   drifted,
+		"summary":   counts,
+		"resources": resources,
+		"report":    report.String(),
+	}
+}
+
+// declaredManifest returns the request's manifest or, when it gives none
+// but a release, the manifest of the release's current revision.
+func declaredManifest(input map[string]interface{}, req driftRequest) (string, error) {
+	var src manifestInput
+	if err := decodeInput(input, &src); err != nil {
+		return "", fmt.Errorf("Invalid request: %v", err)
+	}
+	if src.Manifest != "" || src.ManifestFile != "" || src.Chart != "" || req.Release == "" {
+		return manifestFromInput(input)
+	}
+	if !releaseNamePattern.MatchString(req.Release) {
+		return "", errors.New("'release' must be a lowercase DNS name")
+	}
+	args := append([]string{"get", "manifest", req.Release}, helmReleaseOptions{Namespace: req.Namespace}.args()...)
+	out, err := runClusterHelm(input, args...)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the manifest of release %s: %v", req.Release, err)
+	}
+	return string(out), nil
+}
+
+// autoscaledWorkloads returns the scaleKeys of the workloads that the
+// HorizontalPodAutoscalers of objects or of the cluster scale.
+func autoscaledWorkloads(input map[string]interface{}, namespace string, objects []map[string]interface{}) (map[string]bool, error) {
+	args := []string{"get", "horizontalpodautoscalers.autoscaling", "-o", "json"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	} else {
+		args = append(args, "--all-namespaces")
+	}
+	out, err := runKubectl(input, "", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list HorizontalPodAutoscalers: %v", err)
+	}
+	live, err := kubectlObjects(out)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode HorizontalPodAutoscalers: %v", err)
+	}
+	scaled := map[string]bool{}
+	for _, hpa := range append(live, objects...) {
+		if refOf(hpa).Kind != "HorizontalPodAutoscaler" {
+			continue
+		}
+		target := nestedMap(hpa, "spec", "scaleTargetRef")
+		kind, _ := target["kind"].(string)
+		name, _ := target["name"].(string)
+		scaled[scaleKey(kind, firstNonEmpty(refOf(hpa).Namespace, namespace), name)] = true
+	}
+	return scaled, nil
+}
+
+func scaleKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// validationTarget is where validate-k8s dry-runs objects that do not set
+// a namespace: Namespace, else the context's default namespace.
+// CreateNamespace creates Namespace first when it does not exist, since
+// the API server rejects objects for a missing namespace even in a dry run.
+type validationTarget struct {
+	Namespace       string `json:"namespace"`
+	CreateNamespace bool   `json:"createNamespace"`
+}
+
+// validatedResource is the outcome of a server dry run for one object of a
+// manifest. Status is what the API server would have done (created,
+// configured, or valid for an object left unchanged), invalid when it
+// refused the object with Error, or unchecked when kubectl stopped before
+// sending it.
+type validatedResource struct {
+	resourceRef
+	Document int    `json:"document"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	// dryRunApplied is a line kubectl prints for an object it applied, e.g.
+	// "deployment.apps/web created (server dry run)".
+	dryRunApplied = regexp.MustCompile(`^(\S+)/(\S+) (created|configured|unchanged|serverside-applied)\b`)
+	// dryRunErrorStart starts an error kubectl prints, which may run over
+	// several lines.
+	dryRunErrorStart = regexp.MustCompile(`^(Error from server|error: |resource mapping not found|Warning: )`)
+	// The ways an error names its object: the mapping and patch errors
+	// spell out name and namespace, API errors quote the name after the
+	// kind or resource.
+	dryRunErrorName     = regexp.MustCompile(`(?i)\bname: "([^"]*)",? namespace: "([^"]*)"`)
+	dryRunErrorResource = regexp.MustCompile(`([\w-]+)(?:\.[\w.-]+)? "([^"]+)" (?:is invalid|is forbidden|already exists|not found)`)
+)
+
+// dryRunResources lists the objects of a manifest, numbered by document,
+// in the order kubectl applies them.
+func dryRunResources(manifest string) []validatedResource {
+	resources := []validatedResource{}
+	for i, doc := range splitYAMLDocuments(manifest) {
+		resources = appendDryRunResources(resources, doc, i+1)
+	}
+	return resources
+}
+
+// maxDryRunResources is the most objects a manifest file's dry run
+// reports one by one; larger manifests are left to kubectl, as the list
+// would take as much memory as the manifest itself.
+const maxDryRunResources = 10000
+
+// scanDryRunResources lists the objects of the manifest file at path as
+// dryRunResources does, reading it one document at a time, so that only
+// the largest document is ever held in memory. A document over the
+// manifest size limit, or more than maxDryRunResources objects, stops the
+// scan.
+func scanDryRunResources(path string) ([]validatedResource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	limit := maxManifestBytes()
+	resources := []validatedResource{}
+	document := 0
+	var cur strings.Builder
+	flush := func() error {
+		// cur holds at most one separator, at its start, so it splits into
+		// at most one document.
+		for _, doc := range splitYAMLDocuments(cur.String()) {
+			document++
+			resources = appendDryRunResources(resources, doc, document)
+		}
+		cur.Reset()
+		if len(resources) > maxDryRunResources {
+			return fmt.Errorf("%s has more than %d objects", path, maxDryRunResources)
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), int(limit))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t") || line == "..." {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		if int64(cur.Len()+len(line)) > limit {
+			return nil, fmt.Errorf("document %d of %s exceeds the %d byte limit (INFRAKIT_MAX_MANIFEST_BYTES)", document+1, path, limit)
+		}
+		cur.WriteString(line)
+		cur.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("document %d of %s: %v", document+1, path, err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// appendDryRunResources appends the objects of doc, the document-th of its
+// manifest, to resources; a List contributes its items.
+func appendDryRunResources(resources []validatedResource, doc string, document int) []validatedResource {
+	v, err := decodeYAML(doc)
+	if err != nil {
+		return resources
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return resources
+	}
+	if kind, _ := obj["kind"].(string); strings.HasSuffix(kind, "List") && obj["items"] != nil {
+		for _, item := range nestedSlice(obj, "items") {
+			if m, ok := item.(map[string]interface{}); ok {
+				resources = append(resources, validatedResource{resourceRef: refOf(m), Document: document, Status: "unchecked"})
+			}
+		}
+		return resources
+	}
+	return append(resources, validatedResource{resourceRef: refOf(obj), Document: document, Status: "unchecked"})
+}
+
+// dryRunKey is how kubectl names an object in its output: the lower-case
+// kind, qualified by the API group, and the name.
+func dryRunKey(r resourceRef) string {
+	group, _ := splitAPIVersion(r.APIVersion)
+	key := strings.ToLower(r.Kind)
+	if group != "" {
+		key += "." + group
+	}
+	return key + "/" + r.Name
+}
+
+// attributeDryRun fills in the resources' statuses from the output of
+// `kubectl apply --dry-run=server`, and returns the errors that concern no
+// object in particular (a cluster that cannot be reached, say).
+//
+// kubectl applies objects in order and reports each either on stdout or,
+// when it fails, on stderr. Applied objects are matched by kind and name;
+// an error is given to the object it names, or else to the first failed
+// object not yet explained, which is the one kubectl reported it for.
+func attributeDryRun(resources []validatedResource, stdout, stderr string) []string {
+	pending := map[string][]int{}
+	for i, r := range resources {
+		key := dryRunKey(r.resourceRef)
+		pending[key] = append(pending[key], i)
+	}
+	for _, line := range strings.Split(stdout, "\n") {
+		m := dryRunApplied.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		key := m[1] + "/" + m[2]
+		queue := pending[key]
+		if len(queue) == 0 {
+			continue
+		}
+		pending[key] = queue[1:]
+		switch m[3] {
+		case "created", "configured":
+			resources[queue[0]].Status = m[3]
+		default:
+			resources[queue[0]].Status = "valid"
+		}
+	}
+
+	var general []string
+	var unnamed []string
+	for _, msg := range splitDryRunErrors(stderr) {
+		if strings.HasPrefix(msg, "Warning: ") {
+			continue
+		}
+		if i := namedResource(resources, msg); i >= 0 {
+			resources[i].Status = "invalid"
+			resources[i].Error = msg
+			continue
+		}
+		if strings.Contains(msg, "error when ") {
+			unnamed = append(unnamed, msg)
+		} else {
+			general = append(general, msg)
+		}
+	}
+	for i := range resources {
+		if len(unnamed) == 0 {
+			break
+		}
+		if resources[i].Status == "unchecked" {
+			resources[i].Status = "invalid"
+			resources[i].Error = unnamed[0]
+			unnamed = unnamed[1:]
+		}
+	}
+	return append(general, unnamed...)
+}
+
+// splitDryRunErrors splits kubectl's stderr into its messages.
+func splitDryRunErrors(stderr string) []string {
+	var messages []string
+	var cur []string
+	flush := func() {
+		if msg := strings.TrimSpace(strings.Join(cur, "\n")); msg != "" {
+			messages = append(messages, msg)
+		}
+		cur = nil
+	}
+	for _, line := range strings.Split(stderr, "\n") {
+		if dryRunErrorStart.MatchString(line) {
+			flush()
+		}
+		cur = append(cur, line)
+	}
+	flush()
+	return messages
+}
+
+// namedResource returns the index of the first unexplained resource an
+// error message names, or -1.
+func namedResource(resources []validatedResource, msg string) int {
+	if m := dryRunErrorName.FindStringSubmatch(msg); m != nil {
+		for i, r := range resources {
+			if r.Status == "unchecked" && r.Name == m[1] && (m[2] == "" || r.Namespace == "" || r.Namespace == m[2]) {
+				return i
+			}
+		}
+	}
+	for _, m := range dryRunErrorResource.FindAllStringSubmatch(msg, -1) {
+		word := strings.ToLower(m[1])
+		for i, r := range resources {
+			kind := strings.ToLower(r.Kind)
+			if r.Status == "unchecked" && r.Name == m[2] && (word == kind || word == kindToResource(r.Kind)) {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// apiVersion is the current request and result envelope. A request that
+// sets "apiVersion" is decoded strictly against its command's request
+// types, and its result carries the version, the command and, on failure,
+// an error object with a machine-readable code:
+//
+//	{"apiVersion": "infrakit/v1", "command": "apply-k8s", "success": false,
+//	 "error": {"code": "unknown_field", "message": "..."}}
+//
+// Requests without it keep the unversioned behaviour: unknown keys are
+// ignored and errors are strings.
+const apiVersion = "infrakit/v1"
+
+// Error codes of versioned results.
+const (
+	codeUnsupportedAPIVersion = "unsupported_api_version"
+	codeUnknownField          = "unknown_field"
+	codeInvalidField          = "invalid_field"
+	codeInvalidRequest        = "invalid_request"
+	codeMissingField          = "missing_field"
+	codeInvalidManifest       = "invalid_manifest"
+	codeRenderFailed          = "render_failed"
+	codeNotFound              = "not_found"
+	codeToolUnavailable       = "tool_unavailable"
+	codeClusterUnreachable    = "cluster_unreachable"
+	codeForbidden             = "forbidden"
+	codeTimeout               = "timeout"
+	codeBusy                  = "busy"
+	codeInternal              = "internal"
+	codeFailed                = "failed"
+)
+
+// errorCodes classify the error messages of command results, first match
+// wins; anything else is codeFailed.
+var errorCodes = []struct {
+	code    string
+	pattern *regexp.Regexp
+}{
+	{codeInvalidRequest, regexp.MustCompile(`^Invalid `)},
+	{codeMissingField, regexp.MustCompile(`must be provided| requires |^Provide |^Either .* or `)},
+	{codeInvalidManifest, regexp.MustCompile(`^Failed to parse manifest|^No manifest provided`)},
+	{codeToolUnavailable, regexp.MustCompile(`on PATH|executable file not found`)},
+	{codeForbidden, regexp.MustCompile(`(?i)forbidden|unauthorized`)},
+	{codeClusterUnreachable, regexp.MustCompile(`Unable to connect to the server|connection refused|no such host`)},
+	{codeBusy, regexp.MustCompile(`^The request queue is full`)},
+	{codeTimeout, regexp.MustCompile(`did not finish within|timed out|Not ready within|deadline exceeded`)},
+	{codeNotFound, regexp.MustCompile(`no such file or directory|not found|is not recorded|^No .* named`)},
+	{codeInternal, regexp.MustCompile(`panicked`)},
+}
+
+// envelopeKeys are request keys every command accepts.
+var envelopeKeys = map[string]bool{"apiVersion": true, "debug": true, "diagnostics": true, "timeoutSeconds": true, "logLevel": true, "logFormat": true, requestContextKey: true,
+	"toolsConfig": true, "helmPath": true, "kubectlPath": true, "scrubEnv": true, "sandboxTools": true}
+
+// manifestInput is the manifestFlags part of a request.
+type manifestInput struct {
+	Manifest     string `json:"manifest"`
+	ManifestFile string `json:"manifestFile"`
+	helmChartInput
+}
+
+// helmChartInput is a chart to render, where from and its values.
+type helmChartInput struct {
+	Name  string `json:"name"`
+	Chart string `json:"chart"`
+	chartSource
+	helmValues
+}
+
+// clusterInput is the clusterFlags part of a request.
+type clusterInput struct {
+	Kubeconfig        string         `json:"kubeconfig"`
+	KubeconfigContent string         `json:"kubeconfigContent"`
+	Context           string         `json:"context"`
+	InCluster         *bool          `json:"inCluster"`
+	CloudAuth         *cloudAuthSpec `json:"cloudAuth"`
+	As                string         `json:"as"`
+	AsGroups          []string       `json:"asGroups"`
+	ProxyURL          string         `json:"proxyURL"`
+	SSHTunnel         *sshTunnelSpec `json:"sshTunnel"`
+	RefreshDiscovery  bool           `json:"refreshDiscovery"`
+}
+
+// apiError is the error of a versioned result.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// openEnvelope removes a request's "apiVersion" and, when it was set,
+// checks the request against the command: every key must be declared by
+// one of c.Request's types (or, for commands without any, documented as a
+// flag), with a value of the declared type. It reports whether the
+// result is to be versioned.
+func openEnvelope(c command, input map[string]interface{}) (bool, *apiError) {
+	v, ok := input["apiVersion"]
+	if !ok {
+		return false, nil
+	}
+	delete(input, "apiVersion")
+	if v != apiVersion {
+		return true, &apiError{codeUnsupportedAPIVersion, fmt.Sprintf("apiVersion %v is not supported; use %s", v, apiVersion)}
+	}
+
+	known := map[string]bool{}
+	for _, t := range c.Request {
+		for _, name := range jsonFields(reflect.TypeOf(t)) {
+			known[name] = true
+		}
+	}
+	if len(c.Request) == 0 {
+		for _, f := range c.Flags {
+			known[firstNonEmpty(f.Key, camelCase(f.Name))] = true
+		}
+	}
+	var unknown []string
+	for key := range input {
+		if !known[key] && !envelopeKeys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		for key := range envelopeKeys {
+			delete(known, key)
+		}
+		accepted := sortedSet(known)
+		return true, &apiError{codeUnknownField, fmt.Sprintf("%s does not accept %s; it accepts %s", c.Name, quoteList(unknown), quoteList(accepted))}
+	}
+
+	for _, t := range c.Request {
+		// Each type is given the keys it declares, so that DisallowUnknownFields
+		// catches unknown keys in nested objects too.
+		typ := reflect.TypeOf(t)
+		part := map[string]interface{}{}
+		for _, name := range jsonFields(typ) {
+			if v, ok := input[name]; ok {
+				part[name] = v
+			}
+		}
+		data, err := json.Marshal(part)
+		if err != nil {
+			return true, &apiError{codeInvalidRequest, err.Error()}
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(reflect.New(typ).Interface()); err != nil {
+			if e, ok := err.(*json.UnmarshalTypeError); ok {
+				return true, &apiError{codeInvalidField, fmt.Sprintf("'%s' must be %s, not %s", e.Field, jsonTypeName(e.Type), e.Value)}
+			}
+			if strings.HasPrefix(err.Error(), "json: unknown field ") {
+				return true, &apiError{codeUnknownField, strings.TrimPrefix(err.Error(), "json: ")}
+			}
+			return true, &apiError{codeInvalidField, strings.TrimPrefix(err.Error(), "json: ")}
+		}
+	}
+	return true, nil
+}
+
+// precheckEnvelope checks a versioned request before cluster access is set
+// up from its fields, returning the result to answer a rejected request
+// with, or nil.
+func precheckEnvelope(cmd string, input map[string]interface{}) map[string]interface{} {
+	c, ok := lookupCommand(cmd)
+	if !ok || input["apiVersion"] == nil {
+		return nil
+	}
+	if _, failure := openEnvelope(c, deepCopyObject(input)); failure != nil {
+		return sealEnvelope(cmd, nil, failure)
+	}
+	return nil
+}
+
+// failureResult is the result of a request that failed before its command
+// ran, in the request's envelope.
+func failureResult(cmd string, input map[string]interface{}, err error) map[string]interface{} {
+	result := map[string]interface{}{
+		"success": false,
+		"error":   err.Error(),
+	}
+	if input["apiVersion"] != nil {
+		result = sealEnvelope(cmd, result, nil)
+	}
+	return result
+}
+
+// sealEnvelope turns a command result into a versioned one.
+func sealEnvelope(cmd string, result map[string]interface{}, failure *apiError) map[string]interface{} {
+	sealed := map[string]interface{}{}
+	for k, v := range result {
+		sealed[k] = v
+	}
+	sealed["apiVersion"] = apiVersion
+	sealed["command"] = cmd
+	if failure != nil {
+		sealed["success"] = false
+		sealed["error"] = failure
+		return sealed
+	}
+	if msg, ok := result["error"].(string); ok && (msg != "" || result["success"] != true) {
+		sealed["error"] = apiError{errorCode(result, msg), msg}
+	}
+	return sealed
+}
+
+// errorCode classifies a failed result's error message.
+func errorCode(result map[string]interface{}, msg string) string {
+	if result["renderErrors"] != nil {
+		return codeRenderFailed
+	}
+	if result["timedOut"] == true {
+		return codeTimeout
+	}
+	for _, c := range errorCodes {
+		if c.pattern.MatchString(msg) {
+			return c.code
+		}
+	}
+	return codeFailed
+}
+
+// resultError returns the message of a result's error, versioned or not.
+func resultError(result map[string]interface{}) string {
+	switch e := result["error"].(type) {
+	case string:
+		return e
+	case apiError:
+		return e.Message
+	case *apiError:
+		return e.Message
+	}
+	return ""
+}
+
+// jsonFields returns the keys encoding/json decodes into struct type t,
+// including those of embedded structs.
+func jsonFields(t reflect.Type) []string {
+	var names []string
+	for _, f := range jsonStructFields(t) {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// jsonStructFields returns the fields of jsonFields, each Name set to its
+// key.
+func jsonStructFields(t reflect.Type) []reflect.StructField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			fields = append(fields, jsonStructFields(f.Type)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		f.Name = firstNonEmpty(name, f.Name)
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Interface:
+		return "a value"
+	}
+	return "a number"
+}
+
+func quoteList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = "'" + n + "'"
+	}
+	return strings.Join(quoted, ", ")
+}
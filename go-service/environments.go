@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// valuesLayer is one of the layers key of a render request: values files
+// and values helm applies, in order, over the layers before it, e.g. base
+// values then an environment's overrides.
+type valuesLayer struct {
+	Name        string                 `json:"name"`
+	ValuesFiles []string               `json:"valuesFiles"`
+	Values      map[string]interface{} `json:"values"`
+}
+
+// envMatrixRequest is the request body for generate-env-matrix. The
+// embedded chart and values are the base layer of every environment.
+type envMatrixRequest struct {
+	helmChartInput
+	Environments []environmentProfile `json:"environments"`
+	Parallelism  int                  `json:"parallelism"`
+	// OutputDir, when set, receives each manifest as <environment>.yaml
+	// instead of the result.
+	OutputDir string `json:"outputDir"`
+}
+
+// environmentProfile is an environment's overrides of the base values, and
+// the namespace it renders into.
+type environmentProfile struct {
+	Name        string                 `json:"name"`
+	Namespace   string                 `json:"namespace"`
+	ValuesFiles []string               `json:"valuesFiles"`
+	Values      map[string]interface{} `json:"values"`
+	Set         helmSetValues          `json:"set"`
+}
+
+func (r envMatrixRequest) check() error {
+	if r.Name == "" || r.Chart == "" {
+		return errors.New("Both 'name' and 'chart' must be provided")
+	}
+	if len(r.Environments) == 0 {
+		return errors.New("No environments provided")
+	}
+	seen := map[string]bool{}
+	for _, env := range r.Environments {
+		if env.Name == "" {
+			return errors.New("Every environment needs a 'name'")
+		}
+		if strings.ContainsAny(env.Name, `/\`) {
+			return fmt.Errorf("Environment name %q must not contain a path separator", env.Name)
+		}
+		if seen[env.Name] {
+			return fmt.Errorf("Environment %q is listed twice", env.Name)
+		}
+		seen[env.Name] = true
+	}
+	return nil
+}
+
+// values returns the helm values of env: the base layers, then env's files
+// and values over them, then the base set and env's set.
+func (r envMatrixRequest) values(env environmentProfile) helmValues {
+	v := r.helmValues
+	v.Layers = append(append([]valuesLayer{}, r.Layers...),
+		valuesLayer{Name: "values", Values: r.Values},
+		valuesLayer{Name: env.Name, ValuesFiles: env.ValuesFiles, Values: env.Values})
+	v.Values = nil
+	v.Set = append(append(helmSetValues{}, r.Set...), env.Set...)
+	return v
+}
+
+// generateEnvMatrix renders one chart for each of input["environments"],
+// layering each environment's values over the base values, and returns
+// every environment's manifest with the values it was rendered with. The
+// chart is resolved once for all of them.
+func generateEnvMatrix(input map[string]interface{}) map[string]interface{} {
+	var req envMatrixRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := req.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	ctx := requestContext(input)
+	chart, args, err := req.chartSource.resolve(ctx, req.Chart)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	parallelism := req.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	results := make([]map[string]interface{}, len(req.Environments))
+	sem := newSemaphore(parallelism)
+	var wg sync.WaitGroup
+	for i, env := range req.Environments {
+		wg.Add(1)
+		go func(i int, env environmentProfile) {
+			defer wg.Done()
+			defer sem.acquire()()
+			results[i] = renderEnvironment(ctx, req, chart, args, env)
+		}(i, env)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r["success"] != true {
+			failed++
+		}
+	}
+	return map[string]interface{}{
+		"success":      true,
+		"passed":       failed == 0,
+		"failed":       failed,
+		"environments": results,
+		"durationMs":   time.Since(start).Milliseconds(),
+	}
+}
+
+// renderEnvironment renders chart, as resolved with args, for env.
+func renderEnvironment(ctx context.Context, req envMatrixRequest, chart string, args []string, env environmentProfile) map[string]interface{} {
+	began := time.Now()
+	result := map[string]interface{}{"environment": env.Name}
+	fail := func(err error) map[string]interface{} {
+		result["success"] = false
+		result["error"] = err.Error()
+		if errs, ok := valuesErrorsOf(err); ok {
+			result["valuesErrors"] = errs
+		}
+		result["durationMs"] = time.Since(began).Milliseconds()
+		return result
+	}
+	values := req.values(env)
+	effective, err := values.effective(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	result["values"] = effective
+	valueArgs, cleanup, err := values.renderArgs(ctx, chart, args)
+	if err != nil {
+		return fail(err)
+	}
+	defer cleanup()
+	args = append(append([]string{}, args...), valueArgs...)
+	if env.Namespace != "" {
+		args = append(args, "--namespace", env.Namespace)
+	}
+	render := func(w io.Writer) (int64, error) {
+		return streamChart(ctx, w, req.Name, chart, args...)
+	}
+
+	var manifest string
+	if req.OutputDir != "" {
+		path := filepath.Join(req.OutputDir, env.Name+".yaml")
+		size, digest, err := writeManifestFile(path, render)
+		if err != nil {
+			return fail(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fail(err)
+		}
+		manifest = string(data)
+		result["outputFile"] = path
+		result["bytes"] = size
+		result["sha256"] = digest
+	} else {
+		var b strings.Builder
+		if _, err := render(&b); err != nil {
+			return fail(err)
+		}
+		manifest = b.String()
+		result["manifest"] = manifest
+	}
+	if objects, err := parseManifest(manifest); err == nil {
+		result["documents"] = len(objects)
+	}
+	result["success"] = true
+	result["durationMs"] = time.Since(began).Milliseconds()
+	return result
+}
+
+// effective returns the values v overrides the chart's defaults with, merged
+// the way helm merges them: maps key by key, with null deleting a key, and
+// anything else replaced whole. set is applied as helm parses simple
+// key=value entries; list indexes and escapes beyond \, are not followed.
+func (v helmValues) effective(ctx context.Context) (map[string]interface{}, error) {
+	merged := map[string]interface{}{}
+	for _, layer := range v.layers() {
+		for _, f := range layer.ValuesFiles {
+			values, err := v.readValuesFile(ctx, f)
+			if err != nil {
+				return nil, err
+			}
+			mergeValues(merged, values)
+		}
+		mergeValues(merged, deepCopyObject(layer.Values))
+	}
+	for _, s := range v.Set {
+		for _, kv := range splitSetEntry(s) {
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("'set' entry %q is not key=value", s)
+			}
+			setValue(merged, strings.Split(key, "."), resolveScalar(value))
+		}
+	}
+	return merged, nil
+}
+
+// readValuesFile decodes values file f, decrypting it as args does.
+func (v helmValues) readValuesFile(ctx context.Context, f string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("values file: %v", err)
+	}
+	if v.SopsDecrypt {
+		encrypted, err := sopsEncrypted(f)
+		if err != nil {
+			return nil, fmt.Errorf("values file: %v", err)
+		}
+		if encrypted {
+			if data, err = v.sopsOptions.decrypt(ctx, f, nil, sopsFormat(f)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	doc, err := decodeYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("values file %s: %v", f, err)
+	}
+	if doc == nil {
+		return map[string]interface{}{}, nil
+	}
+	values, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("values file %s is not a map", f)
+	}
+	return values, nil
+}
+
+// mergeValues merges src into dst as helm merges values files: maps are
+// merged key by key, a null deletes the key and other values replace it.
+func mergeValues(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		if sm, ok := v.(map[string]interface{}); ok {
+			dm, ok := dst[k].(map[string]interface{})
+			if !ok {
+				dm = map[string]interface{}{}
+				dst[k] = dm
+			}
+			mergeValues(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// splitSetEntry splits a --set entry at its unescaped commas.
+func splitSetEntry(s string) []string {
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == ',':
+			b.WriteByte(',')
+			i++
+		case s[i] == ',':
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return append(parts, b.String())
+}
+
+// setValue sets the value at path in m, creating maps along it.
+func setValue(m map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[key] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = value
+}
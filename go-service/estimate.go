@@ -0,0 +1,551 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// estimateRequest is the request body for estimate-resources. The manifest
+// comes from the usual manifest, manifestFile or name/chart keys.
+type estimateRequest struct {
+	// Namespace is that of resources that do not set one.
+	Namespace string `json:"namespace"`
+	// Nodes is how many nodes a DaemonSet runs on (default 1).
+	Nodes int `json:"nodes"`
+	// Budget fails the estimate when the requests at maximum scale exceed
+	// it; NamespaceBudgets do the same per namespace.
+	Budget           resourceBudget            `json:"budget"`
+	NamespaceBudgets map[string]resourceBudget `json:"namespaceBudgets"`
+	// Prices, when set, add a monthly cost of the requests.
+	Prices *resourcePrices `json:"prices"`
+}
+
+// resourceBudget caps requests, as Kubernetes quantities ("8", "16Gi").
+type resourceBudget struct {
+	CPU     string `json:"cpu"`
+	Memory  string `json:"memory"`
+	Storage string `json:"storage"`
+}
+
+// resourcePrices price requests by the hour (compute) or month (storage).
+type resourcePrices struct {
+	CPUCoreHour     float64 `json:"cpuCoreHour"`
+	MemoryGiBHour   float64 `json:"memoryGiBHour"`
+	StorageGiBMonth float64 `json:"storageGiBMonth"`
+	// HoursPerMonth defaults to 730.
+	HoursPerMonth float64 `json:"hoursPerMonth"`
+}
+
+// resourceAmounts are CPU in cores and memory and storage in bytes.
+type resourceAmounts struct {
+	CPURequests    float64 `json:"cpuRequests"`
+	CPULimits      float64 `json:"cpuLimits"`
+	MemoryRequests int64   `json:"memoryRequests"`
+	MemoryLimits   int64   `json:"memoryLimits"`
+	Storage        int64   `json:"storage"`
+}
+
+func (a *resourceAmounts) add(b resourceAmounts, n int) {
+	a.CPURequests += b.CPURequests * float64(n)
+	a.CPULimits += b.CPULimits * float64(n)
+	a.MemoryRequests += b.MemoryRequests * int64(n)
+	a.MemoryLimits += b.MemoryLimits * int64(n)
+	a.Storage += b.Storage * int64(n)
+}
+
+// workloadEstimate is what one workload asks for. Total is at Replicas and
+// Max at MaxReplicas, which differ when an HPA scales the workload.
+type workloadEstimate struct {
+	Resource    string          `json:"resource"`
+	Document    int             `json:"document"`
+	Namespace   string          `json:"namespace"`
+	Replicas    int             `json:"replicas"`
+	MaxReplicas int             `json:"maxReplicas"`
+	Autoscaler  string          `json:"autoscaler,omitempty"`
+	PerReplica  resourceAmounts `json:"perReplica"`
+	Total       resourceAmounts `json:"total"`
+	Max         resourceAmounts `json:"max"`
+	// Unlimited lists the containers without a CPU or memory limit, which
+	// the limit totals leave out.
+	Unlimited []string `json:"unlimited,omitempty"`
+}
+
+// namespaceEstimate sums the workloads and claims of a namespace.
+type namespaceEstimate struct {
+	Namespace string          `json:"namespace"`
+	Workloads int             `json:"workloads"`
+	Total     resourceAmounts `json:"total"`
+	Max       resourceAmounts `json:"max"`
+	Cost      *resourceCost   `json:"cost,omitempty"`
+}
+
+// resourceCost is the monthly cost of the requests at Total and at Max.
+type resourceCost struct {
+	Monthly    float64 `json:"monthly"`
+	MonthlyMax float64 `json:"monthlyMax"`
+}
+
+func (r estimateRequest) check() error {
+	if r.Nodes < 0 {
+		return errors.New("'nodes' must not be negative")
+	}
+	budgets := map[string]resourceBudget{"budget": r.Budget}
+	for ns, b := range r.NamespaceBudgets {
+		budgets["namespaceBudgets."+ns] = b
+	}
+	for key, b := range budgets {
+		for field, q := range map[string]string{"cpu": b.CPU, "memory": b.Memory, "storage": b.Storage} {
+			if q == "" {
+				continue
+			}
+			if _, err := parseQuantity(q); err != nil {
+				return fmt.Errorf("'%s.%s': %v", key, field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// estimateResources sums the CPU, memory and storage a manifest requests
+// and is limited to: per workload (pod templates times replicas, or the
+// HPA's minimum and maximum), per namespace and overall, with the storage
+// of its claims. With a budget it is a gate: it fails when the requests at
+// maximum scale exceed the budget.
+func estimateResources(input map[string]interface{}) map[string]interface{} {
+	var req estimateRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := req.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	nodes := req.Nodes
+	if nodes == 0 {
+		nodes = 1
+	}
+	namespaceOf := func(obj map[string]interface{}) string {
+		return firstNonEmpty(nestedString(obj, "metadata", "namespace"), req.Namespace, "default")
+	}
+
+	// Autoscalers by the namespace, kind and name of their target.
+	type autoscaler struct {
+		name     string
+		min, max int
+	}
+	autoscalers := map[string]autoscaler{}
+	for _, obj := range objects {
+		if nestedString(obj, "kind") != "HorizontalPodAutoscaler" {
+			continue
+		}
+		target := namespaceOf(obj) + "/" + nestedString(obj, "spec", "scaleTargetRef", "kind") + "/" + nestedString(obj, "spec", "scaleTargetRef", "name")
+		min, ok := intValue(nestedValue(obj, "spec", "minReplicas"))
+		if !ok {
+			min = 1
+		}
+		max, _ := intValue(nestedValue(obj, "spec", "maxReplicas"))
+		autoscalers[target] = autoscaler{nestedString(obj, "metadata", "name"), min, max}
+	}
+
+	workloads := []workloadEstimate{}
+	namespaces := map[string]*namespaceEstimate{}
+	var total, max resourceAmounts
+	var errs []string
+	count := func(ns string, t, m resourceAmounts, workload bool) {
+		e, ok := namespaces[ns]
+		if !ok {
+			e = &namespaceEstimate{Namespace: ns}
+			namespaces[ns] = e
+		}
+		if workload {
+			e.Workloads++
+		}
+		e.Total.add(t, 1)
+		e.Max.add(m, 1)
+		total.add(t, 1)
+		max.add(m, 1)
+	}
+	for i, obj := range objects {
+		ref := refOf(obj)
+		ns := namespaceOf(obj)
+		if ref.Kind == "PersistentVolumeClaim" {
+			size, err := quantityBytes(nestedValue(obj, "spec", "resources", "requests", "storage"))
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: storage: %v", ref, err))
+				continue
+			}
+			claim := resourceAmounts{Storage: size}
+			count(ns, claim, claim, false)
+			continue
+		}
+		replicas, ok := workloadReplicas(obj, nodes)
+		if !ok {
+			continue
+		}
+		specs := podSpecs(obj)
+		if len(specs) == 0 {
+			continue
+		}
+		w := workloadEstimate{Resource: ref.String(), Document: i + 1, Namespace: ns, Replicas: replicas, MaxReplicas: replicas}
+		if a, ok := autoscalers[ns+"/"+ref.Kind+"/"+ref.Name]; ok {
+			w.Autoscaler = a.name
+			w.Replicas, w.MaxReplicas = a.min, a.max
+			if w.MaxReplicas < w.Replicas {
+				w.MaxReplicas = w.Replicas
+			}
+		}
+		for _, spec := range specs {
+			pod, unlimited, err := podResources(spec.m)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", ref, err))
+			}
+			w.PerReplica.add(pod, 1)
+			w.Unlimited = append(w.Unlimited, unlimited...)
+		}
+		// A StatefulSet's claims are made per replica.
+		for _, t := range nestedSlice(obj, "spec", "volumeClaimTemplates") {
+			size, err := quantityBytes(nestedValue(asObject(t), "spec", "resources", "requests", "storage"))
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: volumeClaimTemplates: %v", ref, err))
+				continue
+			}
+			w.PerReplica.Storage += size
+		}
+		w.Total.add(w.PerReplica, w.Replicas)
+		w.Max.add(w.PerReplica, w.MaxReplicas)
+		count(ns, w.Total, w.Max, true)
+		workloads = append(workloads, w)
+	}
+	if len(errs) > 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid resource quantities: " + strings.Join(errs, "; "),
+		}
+	}
+
+	names := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	byNamespace := []namespaceEstimate{}
+	for _, ns := range names {
+		e := namespaces[ns]
+		if req.Prices != nil {
+			e.Cost = req.Prices.cost(e.Total, e.Max)
+		}
+		byNamespace = append(byNamespace, *e)
+	}
+	exceeded := append([]string{}, overBudget("", req.Budget, max)...)
+	budgeted := make([]string, 0, len(req.NamespaceBudgets))
+	for ns := range req.NamespaceBudgets {
+		budgeted = append(budgeted, ns)
+	}
+	sort.Strings(budgeted)
+	for _, ns := range budgeted {
+		var amounts resourceAmounts
+		if e, ok := namespaces[ns]; ok {
+			amounts = e.Max
+		}
+		exceeded = append(exceeded, overBudget(ns, req.NamespaceBudgets[ns], amounts)...)
+	}
+
+	var report strings.Builder
+	for _, w := range workloads {
+		fmt.Fprintf(&report, "%s x%d: requests cpu %s memory %s, storage %s", w.Resource, w.Replicas, formatCPU(w.Total.CPURequests), formatBytes(w.Total.MemoryRequests), formatBytes(w.Total.Storage))
+		if w.MaxReplicas != w.Replicas {
+			fmt.Fprintf(&report, " (x%d: cpu %s memory %s, storage %s)", w.MaxReplicas, formatCPU(w.Max.CPURequests), formatBytes(w.Max.MemoryRequests), formatBytes(w.Max.Storage))
+		}
+		report.WriteString("\n")
+	}
+	fmt.Fprintf(&report, "Total requests: cpu %s memory %s, storage %s (at maximum scale: cpu %s memory %s, storage %s)\n",
+		formatCPU(total.CPURequests), formatBytes(total.MemoryRequests), formatBytes(total.Storage),
+		formatCPU(max.CPURequests), formatBytes(max.MemoryRequests), formatBytes(max.Storage))
+	for _, e := range exceeded {
+		fmt.Fprintf(&report, "OVER BUDGET %s\n", e)
+	}
+
+	result := map[string]interface{}{
+		"success":    true,
+		"passed":     len(exceeded) == 0,
+		"workloads":  workloads,
+		"namespaces": byNamespace,
+		"total":      total,
+		"max":        max,
+		"exceeded":   exceeded,
+		"report":     report.String(),
+	}
+	if req.Prices != nil {
+		result["cost"] = req.Prices.cost(total, max)
+	}
+	return result
+}
+
+// workloadReplicas returns how many pods a workload runs, and false for
+// objects that run none of their own.
+func workloadReplicas(obj map[string]interface{}, nodes int) (int, bool) {
+	switch nestedString(obj, "kind") {
+	case "Deployment", "StatefulSet", "ReplicaSet", "ReplicationController":
+		if n, ok := intValue(nestedValue(obj, "spec", "replicas")); ok {
+			return n, true
+		}
+		return 1, true
+	case "DaemonSet":
+		return nodes, true
+	case "Job":
+		if n, ok := intValue(nestedValue(obj, "spec", "parallelism")); ok {
+			return n, true
+		}
+		return 1, true
+	case "CronJob":
+		if n, ok := intValue(nestedValue(obj, "spec", "jobTemplate", "spec", "parallelism")); ok {
+			return n, true
+		}
+		return 1, true
+	case "Pod":
+		return 1, true
+	}
+	return 0, false
+}
+
+// podResources returns what a pod spec asks for the way the scheduler
+// counts it: the sum over its containers, or its largest init container
+// if that is more, plus the pod overhead. A container's request defaults
+// to its limit. Generic ephemeral volumes add their storage.
+func podResources(spec map[string]interface{}) (resourceAmounts, []string, error) {
+	var pod, init resourceAmounts
+	var unlimited []string
+	for _, c := range nestedSlice(spec, "containers") {
+		amounts, missing, err := containerResources(asObject(c))
+		if err != nil {
+			return pod, nil, err
+		}
+		pod.add(amounts, 1)
+		unlimited = append(unlimited, missing...)
+	}
+	for _, c := range nestedSlice(spec, "initContainers") {
+		amounts, _, err := containerResources(asObject(c))
+		if err != nil {
+			return pod, nil, err
+		}
+		init.CPURequests = math.Max(init.CPURequests, amounts.CPURequests)
+		init.CPULimits = math.Max(init.CPULimits, amounts.CPULimits)
+		if amounts.MemoryRequests > init.MemoryRequests {
+			init.MemoryRequests = amounts.MemoryRequests
+		}
+		if amounts.MemoryLimits > init.MemoryLimits {
+			init.MemoryLimits = amounts.MemoryLimits
+		}
+	}
+	pod.CPURequests = math.Max(pod.CPURequests, init.CPURequests)
+	pod.CPULimits = math.Max(pod.CPULimits, init.CPULimits)
+	if init.MemoryRequests > pod.MemoryRequests {
+		pod.MemoryRequests = init.MemoryRequests
+	}
+	if init.MemoryLimits > pod.MemoryLimits {
+		pod.MemoryLimits = init.MemoryLimits
+	}
+	if overhead := nestedMap(spec, "overhead"); overhead != nil {
+		cpu, err := quantityCores(overhead["cpu"])
+		if err != nil {
+			return pod, nil, fmt.Errorf("overhead cpu: %v", err)
+		}
+		memory, err := quantityBytes(overhead["memory"])
+		if err != nil {
+			return pod, nil, fmt.Errorf("overhead memory: %v", err)
+		}
+		pod.add(resourceAmounts{CPURequests: cpu, CPULimits: cpu, MemoryRequests: memory, MemoryLimits: memory}, 1)
+	}
+	for _, v := range nestedSlice(spec, "volumes") {
+		size, err := quantityBytes(nestedValue(asObject(v), "ephemeral", "volumeClaimTemplate", "spec", "resources", "requests", "storage"))
+		if err != nil {
+			return pod, nil, fmt.Errorf("volume %s: %v", nestedString(asObject(v), "name"), err)
+		}
+		pod.Storage += size
+	}
+	return pod, unlimited, nil
+}
+
+// containerResources returns a container's requests and limits, and which
+// of cpu and memory it sets no limit for.
+func containerResources(c map[string]interface{}) (resourceAmounts, []string, error) {
+	var a resourceAmounts
+	var unlimited []string
+	name := nestedString(c, "name")
+	requests := nestedMap(c, "resources", "requests")
+	limits := nestedMap(c, "resources", "limits")
+	var err error
+	if a.CPULimits, err = quantityCores(limits["cpu"]); err != nil {
+		return a, nil, fmt.Errorf("container %s cpu limit: %v", name, err)
+	}
+	if a.CPURequests, err = quantityCores(requests["cpu"]); err != nil {
+		return a, nil, fmt.Errorf("container %s cpu request: %v", name, err)
+	}
+	if a.MemoryLimits, err = quantityBytes(limits["memory"]); err != nil {
+		return a, nil, fmt.Errorf("container %s memory limit: %v", name, err)
+	}
+	if a.MemoryRequests, err = quantityBytes(requests["memory"]); err != nil {
+		return a, nil, fmt.Errorf("container %s memory request: %v", name, err)
+	}
+	if requests["cpu"] == nil {
+		a.CPURequests = a.CPULimits
+	}
+	if requests["memory"] == nil {
+		a.MemoryRequests = a.MemoryLimits
+	}
+	if limits["cpu"] == nil {
+		unlimited = append(unlimited, name+" (cpu)")
+	}
+	if limits["memory"] == nil {
+		unlimited = append(unlimited, name+" (memory)")
+	}
+	return a, unlimited, nil
+}
+
+// overBudget lists what amounts exceeds of budget, for namespace ns or,
+// with "", overall.
+func overBudget(ns string, budget resourceBudget, amounts resourceAmounts) []string {
+	scope := "overall"
+	if ns != "" {
+		scope = "namespace " + ns
+	}
+	var out []string
+	if budget.CPU != "" {
+		if limit, _ := quantityCores(budget.CPU); amounts.CPURequests > limit+1e-9 {
+			out = append(out, fmt.Sprintf("%s: cpu requests %s exceed %s", scope, formatCPU(amounts.CPURequests), budget.CPU))
+		}
+	}
+	if budget.Memory != "" {
+		if limit, _ := quantityBytes(budget.Memory); amounts.MemoryRequests > limit {
+			out = append(out, fmt.Sprintf("%s: memory requests %s exceed %s", scope, formatBytes(amounts.MemoryRequests), budget.Memory))
+		}
+	}
+	if budget.Storage != "" {
+		if limit, _ := quantityBytes(budget.Storage); amounts.Storage > limit {
+			out = append(out, fmt.Sprintf("%s: storage %s exceeds %s", scope, formatBytes(amounts.Storage), budget.Storage))
+		}
+	}
+	return out
+}
+
+const defaultHoursPerMonth = 730
+
+// cost prices the requests of total and max.
+func (p resourcePrices) cost(total, max resourceAmounts) *resourceCost {
+	hours := p.HoursPerMonth
+	if hours <= 0 {
+		hours = defaultHoursPerMonth
+	}
+	monthly := func(a resourceAmounts) float64 {
+		gib := func(b int64) float64 { return float64(b) / (1 << 30) }
+		c := a.CPURequests*p.CPUCoreHour*hours + gib(a.MemoryRequests)*p.MemoryGiBHour*hours + gib(a.Storage)*p.StorageGiBMonth
+		return math.Round(c*100) / 100
+	}
+	return &resourceCost{Monthly: monthly(total), MonthlyMax: monthly(max)}
+}
+
+// quantitySuffixes are the multipliers of Kubernetes quantity suffixes.
+var quantitySuffixes = map[string]float64{
+	"n": 1e-9, "u": 1e-6, "m": 1e-3, "": 1,
+	"k": 1e3, "M": 1e6, "G": 1e9, "T": 1e12, "P": 1e15, "E": 1e18,
+	"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40, "Pi": 1 << 50, "Ei": 1 << 60,
+}
+
+// parseQuantity returns the value of a Kubernetes quantity such as "250m",
+// "1.5Gi" or "1e3".
+func parseQuantity(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') && s[i-1] != '.' {
+		i--
+	}
+	number, suffix := s[:i], s[i:]
+	mult, ok := quantitySuffixes[suffix]
+	if !ok {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return n * mult, nil
+}
+
+// quantityValue returns the value of a quantity as decoded, a string or a
+// number, and 0 for none.
+func quantityValue(v interface{}) (float64, error) {
+	switch q := v.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return parseQuantity(q)
+	case int:
+		return float64(q), nil
+	case float64:
+		return q, nil
+	}
+	return 0, fmt.Errorf("invalid quantity %v", v)
+}
+
+func quantityCores(v interface{}) (float64, error) {
+	return quantityValue(v)
+}
+
+func quantityBytes(v interface{}) (int64, error) {
+	n, err := quantityValue(v)
+	return int64(math.Ceil(n)), err
+}
+
+// intValue returns v as an int, as decodeYAML or encoding/json decode it.
+func intValue(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		return int(n), n == math.Trunc(n)
+	}
+	return 0, false
+}
+
+// formatCPU renders cores as Kubernetes would: "2", "1.5" or "250m".
+func formatCPU(cores float64) string {
+	milli := math.Round(cores * 1000)
+	if math.Mod(milli, 1000) == 0 {
+		return strconv.FormatFloat(milli/1000, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(milli, 'f', -1, 64) + "m"
+}
+
+// formatBytes renders bytes with the largest binary suffix they fill, to
+// two decimals.
+func formatBytes(b int64) string {
+	for _, s := range []string{"Ei", "Pi", "Ti", "Gi", "Mi", "Ki"} {
+		if m := quantitySuffixes[s]; float64(b) >= m {
+			return strconv.FormatFloat(math.Round(float64(b)/m*100)/100, 'f', -1, 64) + s
+		}
+	}
+	return strconv.FormatInt(b, 10)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// parseFieldPath splits a field path such as
+// `spec.containers[0].image` or `metadata.labels["helm.sh/chart"]` into
+// its keys; list indexes are kept as decimal strings.
+func parseFieldPath(path string) ([]string, error) {
+	var keys []string
+	for rest := path; rest != ""; {
+		if strings.HasPrefix(rest, "[\"") {
+			end := strings.Index(rest, "\"]")
+			if end < 0 {
+				return nil, errors.New("invalid field path " + path)
+			}
+			keys = append(keys, rest[2:end])
+			rest = strings.TrimPrefix(rest[end+2:], ".")
+			continue
+		}
+		if strings.HasPrefix(rest, "[") {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New("invalid field path " + path)
+			}
+			if _, err := strconv.Atoi(rest[1:end]); err != nil {
+				return nil, errors.New("invalid list index in field path " + path)
+			}
+			keys = append(keys, rest[1:end])
+			rest = strings.TrimPrefix(rest[end+1:], ".")
+			continue
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, errors.New("invalid field path " + path)
+		}
+		keys = append(keys, rest[:end])
+		rest = strings.TrimPrefix(rest[end:], ".")
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("empty field path")
+	}
+	return keys, nil
+}
+
+// lookupField resolves keys from parseFieldPath against a decoded object.
+func lookupField(v interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			next, ok := t[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// maskField replaces the value at keys, if present, with a placeholder.
+func maskField(obj map[string]interface{}, keys []string) {
+	parent, ok := lookupField(obj, keys[:len(keys)-1])
+	if !ok {
+		return
+	}
+	last := keys[len(keys)-1]
+	switch t := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := t[last]; ok {
+			t[last] = "<ignored>"
+		}
+	case []interface{}:
+		if i, err := strconv.Atoi(last); err == nil && i >= 0 && i < len(t) {
+			t[i] = "<ignored>"
+		}
+	}
+}
+
+// joinFieldPath is the inverse of parseFieldPath for map keys.
+func joinFieldPath(keys []string) string {
+	var b strings.Builder
+	for _, k := range keys {
+		if strings.ContainsAny(k, ".[]\"") || k == "" {
+			b.WriteString(`["` + k + `"]`)
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(k)
+	}
+	return b.String()
+}
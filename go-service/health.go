@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// readinessTTL is how long a readiness result is reused, so that frequent
+// probes do not each reach the cluster.
+const readinessTTL = 10 * time.Second
+
+// healthCheck is one check of /healthz or /readyz. Status is "ok", "fail",
+// or "skipped" for a cluster check without a kubeconfig.
+type healthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+var readiness struct {
+	sync.Mutex
+	checked time.Time
+	checks  []healthCheck
+}
+
+// toolChecks checks that helm and kubectl can be run.
+func toolChecks() []healthCheck {
+	var checks []healthCheck
+	for _, tool := range []string{"helm", "kubectl"} {
+		if path, err := exec.LookPath(toolBinary(tool)); err != nil {
+			checks = append(checks, healthCheck{tool, "fail", err.Error()})
+		} else {
+			checks = append(checks, healthCheck{tool, "ok", path})
+		}
+	}
+	return checks
+}
+
+// clusterCheck checks that the service's own cluster, from KUBECONFIG or
+// the mounted ServiceAccount, answers.
+func clusterCheck(ctx context.Context) healthCheck {
+	input := map[string]interface{}{}
+	cleanup, err := prepareClusterAccess(ctx, input)
+	if err != nil {
+		return healthCheck{"cluster", "fail", err.Error()}
+	}
+	defer cleanup()
+	if _, err := runKubectl(input, "", "config", "current-context"); err != nil {
+		return healthCheck{"cluster", "skipped", "no kubeconfig context"}
+	}
+	out, err := runKubectl(input, "", "version", "--request-timeout=5s", "-o", "json")
+	if err != nil {
+		return healthCheck{"cluster", "fail", firstLines(err.Error(), 2)}
+	}
+	var v struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	json.Unmarshal(out, &v)
+	return healthCheck{"cluster", "ok", v.ServerVersion.GitVersion}
+}
+
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status, code := "ok", http.StatusOK
+	for _, c := range checks {
+		if c.Status == "fail" {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+	writeServeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+// serveHealthz answers liveness probes: the process serves and can run its
+// tools.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, toolChecks())
+}
+
+// serveReadyz answers readiness probes: the tools, and the cluster when the
+// service has one configured.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness.Lock()
+	defer readiness.Unlock()
+	if time.Since(readiness.checked) > readinessTTL {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		readiness.checks = append(toolChecks(), clusterCheck(ctx))
+		readiness.checked = time.Now()
+	}
+	writeHealth(w, readiness.checks)
+}
+
+// serveMetrics exposes serviceMetrics in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeServeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+			"success": false,
+			"error":   "Use GET",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
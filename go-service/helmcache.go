@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultHelmCacheMaxAge = 30 * 24 * time.Hour
+	defaultHelmCacheMaxMB  = 2048
+)
+
+// cacheableChartRef matches "repo/chart" references; local paths and URLs
+// other than oci:// are rendered as given.
+var cacheableChartRef = regexp.MustCompile(`^(oci://[^\s]+|\w[\w.-]*/[\w.-]+)$`)
+
+// chartNamePattern matches a chart name within a repository.
+var chartNamePattern = regexp.MustCompile(`^\w[\w.-]*$`)
+
+// exactChartVersion matches pinned versions; ranges are resolved by helm on
+// every render since their result changes as charts are published.
+var exactChartVersion = regexp.MustCompile(`^v?\d+\.\d+\.\d+([-+][\w.+-]*)?$`)
+
+// helmCacheDir returns the persistent cache shared by every helm call:
+// repository indexes under repository/ and pinned chart downloads under
+// charts/.
+func helmCacheDir() string {
+	if dir := os.Getenv("INFRAKIT_HELM_CACHE"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-helm-cache")
+	}
+	return filepath.Join(home, ".infrakit", "helm-cache")
+}
+
+// helmCommand runs helm against the shared cache, until ctx is done.
+func helmCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := toolCommand(ctx, "helm", args...)
+	cmd.Env = append(cmd.Env, helmCacheEnv()...)
+	return cmd
+}
+
+// helmCacheEnv points helm at the shared cache.
+func helmCacheEnv() []string {
+	dir := helmCacheDir()
+	return []string{
+		"HELM_CACHE_HOME=" + dir,
+		"HELM_REPOSITORY_CACHE=" + filepath.Join(dir, "repository"),
+	}
+}
+
+// lockHelmCache takes an advisory lock on the shared cache, so that parallel
+// runs (in this process or others) never read an index or chart while it is
+// being written. Renders take it shared; updates and eviction exclusive.
+func lockHelmCache(exclusive bool) (func(), error) {
+	dir := helmCacheDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, errors.New("failed to lock helm cache: " + err.Error())
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// runHelm runs a helm command and returns stdout; the error carries stderr.
+func runHelm(ctx context.Context, args ...string) ([]byte, error) {
+	defer acquireHelm()()
+	cmd := helmCommand(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	output, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if err != nil {
+		return output, errors.New(stderr.String() + string(output) + "\n" + err.Error())
+	}
+	return output, nil
+}
+
+// ensureHelmRepositories seeds the repository indexes the first time the
+// shared cache is used, so repo charts resolve without a manual update.
+func ensureHelmRepositories(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(helmCacheDir(), "repository")); err == nil {
+		return nil
+	}
+	unlock, err := lockHelmCache(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(filepath.Join(helmCacheDir(), "repository")); err == nil {
+		return nil
+	}
+	// Without any repositories configured there is nothing to seed.
+	runHelm(ctx, "repo", "update")
+	return os.MkdirAll(filepath.Join(helmCacheDir(), "repository"), 0o700)
+}
+
+// cachedChart resolves a pinned repository or OCI chart to a downloaded
+// archive in the cache, pulling it on first use. It returns "" for charts
+// that are not cached (local paths, unpinned versions), and otherwise the
+// archive path plus args without the now redundant --version and
+// chartLocationFlags. A chart name with --repo is pulled from that
+// repository without it being configured.
+func cachedChart(ctx context.Context, chart string, args []string) (string, []string, error) {
+	version, repo := "", ""
+	var pull []string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		takesValue, located := chartLocationFlags[args[i]]
+		switch {
+		case args[i] == "--version" && i+1 < len(args):
+			version = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--version="):
+			version = strings.TrimPrefix(args[i], "--version=")
+		case located && takesValue && i+1 < len(args):
+			if args[i] == "--repo" {
+				repo = args[i+1]
+			}
+			pull = append(pull, args[i], args[i+1])
+			i++
+		case located:
+			pull = append(pull, args[i])
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if repo != "" {
+		if !chartNamePattern.MatchString(chart) {
+			return "", args, nil
+		}
+	} else if !cacheableChartRef.MatchString(chart) {
+		return "", args, nil
+	} else if _, err := os.Stat(chart); err == nil {
+		return "", args, nil
+	}
+	if !exactChartVersion.MatchString(version) {
+		return "", args, nil
+	}
+	if repo == "" && !strings.HasPrefix(chart, "oci://") {
+		if err := ensureHelmRepositories(ctx); err != nil {
+			return "", args, err
+		}
+	}
+
+	key := strings.NewReplacer("oci://", "oci/", ":", "_").Replace(chart)
+	if repo != "" {
+		key = "repo/" + strings.NewReplacer("://", "/", ":", "_").Replace(strings.TrimSuffix(repo, "/")) + "/" + chart
+	}
+	path := filepath.Join(helmCacheDir(), "charts", filepath.FromSlash(key)+"-"+version+".tgz")
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return path, rest, nil
+	}
+
+	unlock, err := lockHelmCache(true)
+	if err != nil {
+		return "", args, err
+	}
+	defer unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path, rest, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", args, err
+	}
+	// Pull into a scratch directory and rename, so a crashed pull never
+	// leaves a truncated archive behind.
+	tmp, err := os.MkdirTemp(filepath.Dir(path), ".pull-")
+	if err != nil {
+		return "", args, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := pullChart(chart, version, tmp, pull); err != nil {
+		return "", args, errors.New("failed to pull " + chart + " " + version + ": " + err.Error())
+	}
+	pulled, _ := filepath.Glob(filepath.Join(tmp, "*.tgz"))
+	if len(pulled) != 1 {
+		return "", args, errors.New("unexpected helm pull output for " + chart)
+	}
+	if err := os.Rename(pulled[0], path); err != nil {
+		return "", args, err
+	}
+	evictHelmCache()
+	return path, rest, nil
+}
+
+// evictHelmCache removes cached charts unused for longer than
+// INFRAKIT_HELM_CACHE_MAX_AGE, then the least recently used ones until the
+// cache is under INFRAKIT_HELM_CACHE_MAX_MB. The caller holds the exclusive
+// lock.
+func evictHelmCache() ([]string, int64) {
+	maxAge := defaultHelmCacheMaxAge
+	if d, err := time.ParseDuration(os.Getenv("INFRAKIT_HELM_CACHE_MAX_AGE")); err == nil {
+		maxAge = d
+	}
+	maxBytes := int64(defaultHelmCacheMaxMB) << 20
+	if mb, err := strconv.ParseInt(os.Getenv("INFRAKIT_HELM_CACHE_MAX_MB"), 10, 64); err == nil {
+		maxBytes = mb << 20
+	}
+
+	type entry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var total int64
+	filepath.Walk(filepath.Join(helmCacheDir(), "charts"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && strings.HasSuffix(path, ".tgz") {
+			entries = append(entries, entry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	var removed []string
+	var freed int64
+	for _, e := range entries {
+		if time.Since(e.used) <= maxAge && total <= maxBytes {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			removed = append(removed, e.path)
+			freed += e.size
+			total -= e.size
+		}
+	}
+	return removed, freed
+}
+
+// pruneHelmCache runs cache eviction on demand.
+func pruneHelmCache(input map[string]interface{}) map[string]interface{} {
+	unlock, err := lockHelmCache(true)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	defer unlock()
+	removed, freed := evictHelmCache()
+	return map[string]interface{}{
+		"success":    true,
+		"cacheDir":   helmCacheDir(),
+		"removed":    removed,
+		"freedBytes": freed,
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Releases are managed with the helm binary, though charts are rendered
+// with the Helm SDK (see renderTemplate): helm keeps their state in the
+// cluster (Secrets in the release namespace), so revisions made here and by
+// hand are the same history.
+
+// helmReleaseOptions are the keys helm-install and helm-upgrade share. The
+// chart comes from name, chart and the chartSource and helmValues keys, as
+// for generate-helm.
+type helmReleaseOptions struct {
+	Namespace string `json:"namespace"`
+	// CreateNamespace creates Namespace when it does not exist.
+	CreateNamespace bool `json:"createNamespace"`
+	// Wait waits up to Timeout for the release's workloads to be ready,
+	// WaitForJobs for its Jobs to complete too.
+	Wait        bool `json:"wait"`
+	WaitForJobs bool `json:"waitForJobs"`
+	// Atomic undoes a failed release (uninstalling a new one, rolling an
+	// upgrade back), and implies Wait.
+	Atomic bool `json:"atomic"`
+	// Timeout is a Go duration (helm's default is 5m).
+	Timeout     string `json:"timeout"`
+	Description string `json:"description"`
+}
+
+// helmUpgradeOptions are the further keys of helm-upgrade.
+type helmUpgradeOptions struct {
+	// Install installs the release when it does not exist yet.
+	Install bool `json:"install"`
+	// ReuseValues merges the request's values over the last release's;
+	// ResetValues starts from the chart's defaults.
+	ReuseValues   bool `json:"reuseValues"`
+	ResetValues   bool `json:"resetValues"`
+	CleanupOnFail bool `json:"cleanupOnFail"`
+	// MaxHistory caps the revisions kept (helm's default is 10).
+	MaxHistory int `json:"maxHistory"`
+	// Backup saves the live state of the release's objects, in BackupDir,
+	// before upgrading.
+	Backup    bool   `json:"backup"`
+	BackupDir string `json:"backupDir"`
+}
+
+// helmUninstallRequest is the request body for helm-uninstall.
+type helmUninstallRequest struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// KeepHistory keeps the release's revisions, so that it can be rolled
+	// back to.
+	KeepHistory bool   `json:"keepHistory"`
+	Wait        bool   `json:"wait"`
+	Timeout     string `json:"timeout"`
+}
+
+// helmHistoryRequest is the request body for helm-history.
+type helmHistoryRequest struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Max limits the revisions listed to the most recent ones.
+	Max int `json:"max"`
+}
+
+// helmRelease is the status of a release, as helm reports it.
+type helmRelease struct {
+	Name          string        `json:"name"`
+	Namespace     string        `json:"namespace"`
+	Revision      int           `json:"revision"`
+	Status        string        `json:"status"`
+	Chart         string        `json:"chart"`
+	ChartVersion  string        `json:"chartVersion"`
+	AppVersion    string        `json:"appVersion,omitempty"`
+	Description   string        `json:"description,omitempty"`
+	FirstDeployed string        `json:"firstDeployed,omitempty"`
+	LastDeployed  string        `json:"lastDeployed,omitempty"`
+	Notes         string        `json:"notes,omitempty"`
+	Resources     []resourceRef `json:"resources"`
+}
+
+// helmRevision is one entry of a release's history.
+type helmRevision struct {
+	Revision    int    `json:"revision"`
+	Updated     string `json:"updated"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	AppVersion  string `json:"appVersion,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func (o helmReleaseOptions) check() error {
+	if o.Timeout != "" {
+		if _, err := time.ParseDuration(o.Timeout); err != nil {
+			return errors.New("Invalid timeout: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (o helmReleaseOptions) args() []string {
+	var args []string
+	if o.Namespace != "" {
+		args = append(args, "--namespace", o.Namespace)
+	}
+	if o.CreateNamespace {
+		args = append(args, "--create-namespace")
+	}
+	if o.Wait {
+		args = append(args, "--wait")
+	}
+	if o.WaitForJobs {
+		args = append(args, "--wait-for-jobs")
+	}
+	if o.Atomic {
+		args = append(args, "--atomic")
+	}
+	if o.Timeout != "" {
+		args = append(args, "--timeout", o.Timeout)
+	}
+	if o.Description != "" {
+		args = append(args, "--description", o.Description)
+	}
+	return args
+}
+
+// helmInstall installs a chart as a new release and returns its status.
+func helmInstall(input map[string]interface{}) map[string]interface{} {
+	return deployHelmRelease(input, "install")
+}
+
+// helmUpgrade upgrades a release to a chart and its values, installing it
+// first with input["install"], and returns its status.
+func helmUpgrade(input map[string]interface{}) map[string]interface{} {
+	return deployHelmRelease(input, "upgrade")
+}
+
+// deployHelmRelease runs `helm install` or `helm upgrade`. A failed release
+// is reported with the status helm left it in, when it still exists.
+func deployHelmRelease(input map[string]interface{}, action string) map[string]interface{} {
+	var req helmChartInput
+	var opts helmReleaseOptions
+	var upgrade helmUpgradeOptions
+	for _, v := range []interface{}{&req, &opts, &upgrade} {
+		if err := decodeInput(input, v); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Invalid request: " + err.Error(),
+			}
+		}
+	}
+	if !releaseNamePattern.MatchString(req.Name) || req.Chart == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Both 'name' (a lowercase DNS name) and 'chart' must be provided",
+		}
+	}
+	if err := opts.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	if upgrade.ReuseValues && upgrade.ResetValues {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'reuseValues' and 'resetValues' cannot be combined",
+		}
+	}
+	ctx := requestContext(input)
+	chart, args, err := req.chartSource.resolve(ctx, req.Chart)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	valueArgs, cleanup, err := req.helmValues.renderArgs(ctx, chart, args)
+	if err != nil {
+		return renderFailure(err)
+	}
+	defer cleanup()
+	args = append(args, valueArgs...)
+	// cachedChart takes the cache lock exclusively to pull, so it runs
+	// before the shared lock is held, as in streamChart.
+	if cached, rest, err := cachedChart(ctx, chart, args); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	} else if cached != "" {
+		chart, args = cached, rest
+	}
+	var archive string
+	if action == "upgrade" && upgrade.Backup {
+		if archive, err = backupRelease(input, req.Name, opts.Namespace); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Pre-upgrade backup failed: " + err.Error(),
+			}
+		}
+	}
+	unlock, err := lockHelmCache(false)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	defer unlock()
+
+	args = append(append([]string{action, req.Name, chart}, args...), opts.args()...)
+	if action == "upgrade" {
+		if upgrade.Install {
+			args = append(args, "--install")
+		}
+		if upgrade.ReuseValues {
+			args = append(args, "--reuse-values")
+		}
+		if upgrade.ResetValues {
+			args = append(args, "--reset-values")
+		}
+		if upgrade.CleanupOnFail {
+			args = append(args, "--cleanup-on-fail")
+		}
+		if upgrade.MaxHistory > 0 {
+			args = append(args, "--history-max", fmt.Sprint(upgrade.MaxHistory))
+		}
+	}
+	out, err := runClusterHelm(input, append(args, "--output", "json")...)
+	if err != nil {
+		result := map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+		if rel, serr := helmReleaseStatus(input, req.Name, opts.Namespace); serr == nil {
+			result["release"] = rel
+		}
+		if archive != "" {
+			result["backup"] = archive
+		}
+		return result
+	}
+	rel, err := parseHelmRelease(out)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read the release helm returned: " + err.Error(),
+		}
+	}
+	result := map[string]interface{}{
+		"success": true,
+		"release": rel,
+	}
+	if archive != "" {
+		result["backup"] = archive
+	}
+	return result
+}
+
+// backupRelease backs up the live state of the objects of release name's
+// current revision, which an upgrade changes or removes. A release yet to
+// be installed has nothing to back up, and returns "".
+func backupRelease(input map[string]interface{}, name, namespace string) (string, error) {
+	args := append([]string{"get", "manifest", name}, helmReleaseOptions{Namespace: namespace}.args()...)
+	out, err := runClusterHelm(input, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "release: not found") {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get the manifest of release %s: %v", name, err)
+	}
+	objects, err := parseManifest(string(out))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the manifest of release %s: %v", name, err)
+	}
+	path, _, err := backupLive(input, inNamespace(objects, namespace))
+	return path, err
+}
+
+// helmUninstall removes a release and the objects it created.
+func helmUninstall(input map[string]interface{}) map[string]interface{} {
+	var req helmUninstallRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if !releaseNamePattern.MatchString(req.Name) {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'name' must be provided as a lowercase DNS name",
+		}
+	}
+	if err := (helmReleaseOptions{Timeout: req.Timeout}).check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	args := append([]string{"uninstall", req.Name}, helmReleaseOptions{Namespace: req.Namespace, Wait: req.Wait, Timeout: req.Timeout}.args()...)
+	if req.KeepHistory {
+		args = append(args, "--keep-history")
+	}
+	if _, err := runClusterHelm(input, args...); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	result := map[string]interface{}{
+		"success":     true,
+		"name":        req.Name,
+		"uninstalled": true,
+	}
+	if req.KeepHistory {
+		if rel, err := helmReleaseStatus(input, req.Name, req.Namespace); err == nil {
+			result["release"] = rel
+		}
+	}
+	return result
+}
+
+// helmHistory lists the revisions of a release, oldest first.
+func helmHistory(input map[string]interface{}) map[string]interface{} {
+	var req helmHistoryRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if !releaseNamePattern.MatchString(req.Name) {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'name' must be provided as a lowercase DNS name",
+		}
+	}
+	args := append([]string{"history", req.Name, "--output", "json"}, helmReleaseOptions{Namespace: req.Namespace}.args()...)
+	if req.Max > 0 {
+		args = append(args, "--max", fmt.Sprint(req.Max))
+	}
+	out, err := runClusterHelm(input, args...)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	var raw []struct {
+		helmRevision
+		AppVersion string `json:"app_version"`
+	}
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read the history helm returned: " + err.Error(),
+		}
+	}
+	revisions := make([]helmRevision, len(raw))
+	for i, r := range raw {
+		revisions[i] = r.helmRevision
+		revisions[i].AppVersion = r.AppVersion
+	}
+	result := map[string]interface{}{
+		"success":   true,
+		"name":      req.Name,
+		"revisions": revisions,
+	}
+	if rel, err := helmReleaseStatus(input, req.Name, req.Namespace); err == nil {
+		result["release"] = rel
+	}
+	return result
+}
+
+// helmReleaseStatus returns the current status of a release.
+func helmReleaseStatus(input map[string]interface{}, name, namespace string) (helmRelease, error) {
+	args := append([]string{"status", name, "--output", "json"}, helmReleaseOptions{Namespace: namespace}.args()...)
+	out, err := runClusterHelm(input, args...)
+	if err != nil {
+		return helmRelease{}, err
+	}
+	return parseHelmRelease(out)
+}
+
+// parseHelmRelease reads a release as `helm status -o json` and the
+// install and upgrade commands print it.
+func parseHelmRelease(data []byte) (helmRelease, error) {
+	var raw struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		Version   int    `json:"version"`
+		Manifest  string `json:"manifest"`
+		Info      struct {
+			Status        string `json:"status"`
+			Description   string `json:"description"`
+			FirstDeployed string `json:"first_deployed"`
+			LastDeployed  string `json:"last_deployed"`
+			Notes         string `json:"notes"`
+		} `json:"info"`
+		Chart struct {
+			Metadata struct {
+				Name       string `json:"name"`
+				Version    string `json:"version"`
+				AppVersion string `json:"appVersion"`
+			} `json:"metadata"`
+		} `json:"chart"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return helmRelease{}, err
+	}
+	rel := helmRelease{
+		Name:          raw.Name,
+		Namespace:     raw.Namespace,
+		Revision:      raw.Version,
+		Status:        raw.Info.Status,
+		Chart:         raw.Chart.Metadata.Name,
+		ChartVersion:  raw.Chart.Metadata.Version,
+		AppVersion:    raw.Chart.Metadata.AppVersion,
+		Description:   raw.Info.Description,
+		FirstDeployed: raw.Info.FirstDeployed,
+		LastDeployed:  raw.Info.LastDeployed,
+		Notes:         raw.Info.Notes,
+		Resources:     []resourceRef{},
+	}
+	// A release's manifest is what helm rendered; status leaves it out.
+	if objects, err := parseManifest(raw.Manifest); err == nil {
+		for _, obj := range objects {
+			rel.Resources = append(rel.Resources, refOf(obj))
+		}
+	}
+	return rel, nil
+}
+
+// runClusterHelm runs helm against the request's cluster and returns its
+// stdout. On failure the error carries helm's stderr.
+func runClusterHelm(input map[string]interface{}, args ...string) ([]byte, error) {
+	defer acquireHelm()()
+	waitClusterRate(input)
+	cmd := helmClusterCommand(input, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	out, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if err != nil {
+		return out, errors.New(strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return out, nil
+}
+
+// helmClusterCommand is helmCommand targeting the cluster of the request's
+// connection fields, as kubectlCommand does for kubectl.
+func helmClusterCommand(input map[string]interface{}, args ...string) *exec.Cmd {
+	var global []string
+	if context, ok := input["context"].(string); ok && context != "" {
+		global = append(global, "--kube-context="+context)
+	}
+	if as, ok := input["as"].(string); ok && as != "" {
+		global = append(global, "--kube-as-user="+as)
+	}
+	if groups, ok := input["asGroups"].([]interface{}); ok {
+		for _, g := range groups {
+			if group, ok := g.(string); ok && group != "" {
+				global = append(global, "--kube-as-group="+group)
+			}
+		}
+	}
+	cmd := helmCommand(requestContext(input), append(global, args...)...)
+	cmd.Env = append(clusterEnv(input), helmCacheEnv()...)
+	return cmd
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+)
+
+// helmTemplateFlags are the `helm template` flags renderTemplate takes
+// besides chartLocationFlags, with whether they take a value.
+var helmTemplateFlags = map[string]bool{
+	"--values":       true,
+	"-f":             true,
+	"--set":          true,
+	"--set-string":   true,
+	"--set-file":     true,
+	"--namespace":    true,
+	"-n":             true,
+	"--version":      true,
+	"--kube-version": true,
+	"--api-versions": true,
+	"-a":             true,
+	"--show-only":    true,
+	"-s":             true,
+	"--include-crds": false,
+	"--skip-tests":   false,
+	"--is-upgrade":   false,
+}
+
+// templateSourcePattern picks the chart path out of a manifest's
+// "# Source:" comment, as helm template matches --show-only against it.
+var templateSourcePattern = regexp.MustCompile("# Source: [^/]+/(.+)")
+
+// helmSettings returns the helm environment, with the repository cache in
+// the shared helm cache as helmCacheEnv gives the helm binary.
+func helmSettings() *cli.EnvSettings {
+	settings := cli.New()
+	settings.RepositoryCache = filepath.Join(helmCacheDir(), "repository")
+	return settings
+}
+
+// renderTemplate renders chart as release name in process with the Helm
+// SDK, taking the `helm template` flags in args, and writes what helm
+// template would print to w. Repository and OCI charts are located as
+// helm does, through the repository configuration and registry logins.
+func renderTemplate(ctx context.Context, w io.Writer, name, chart string, args []string) error {
+	settings := helmSettings()
+	cfg := &action.Configuration{Log: func(string, ...interface{}) {}}
+	client := action.NewInstall(cfg)
+	client.DryRun = true
+	client.DryRunOption = "true"
+	client.ClientOnly = true
+	client.Replace = true
+	client.ReleaseName = name
+	var opts values.Options
+	var showOnly, apiVersions []string
+	var skipTests bool
+	for i := 0; i < len(args); i++ {
+		flag, value, inline := strings.Cut(args[i], "=")
+		takesValue, ok := helmTemplateFlags[flag]
+		if !ok {
+			takesValue, ok = chartLocationFlags[flag]
+		}
+		if !ok || inline && !takesValue {
+			return fmt.Errorf("unsupported helm template flag %s", args[i])
+		}
+		if takesValue && !inline {
+			if i+1 == len(args) {
+				return fmt.Errorf("flag %s needs a value", flag)
+			}
+			i++
+			value = args[i]
+		}
+		switch flag {
+		case "--values", "-f":
+			opts.ValueFiles = append(opts.ValueFiles, value)
+		case "--set":
+			opts.Values = append(opts.Values, value)
+		case "--set-string":
+			opts.StringValues = append(opts.StringValues, value)
+		case "--set-file":
+			opts.FileValues = append(opts.FileValues, value)
+		case "--namespace", "-n":
+			settings.SetNamespace(value)
+		case "--kube-version":
+			v, err := chartutil.ParseKubeVersion(value)
+			if err != nil {
+				return fmt.Errorf("invalid kube version '%s': %s", value, err)
+			}
+			client.KubeVersion = v
+		case "--api-versions", "-a":
+			apiVersions = append(apiVersions, strings.Split(value, ",")...)
+		case "--show-only", "-s":
+			showOnly = append(showOnly, value)
+		case "--include-crds":
+			client.IncludeCRDs = true
+		case "--skip-tests":
+			skipTests = true
+		case "--is-upgrade":
+			client.IsUpgrade = true
+		default:
+			setChartPathOption(&client.ChartPathOptions, flag, value)
+		}
+	}
+	client.APIVersions = chartutil.VersionSet(apiVersions)
+	client.Namespace = settings.Namespace()
+	rc, err := chartRegistryClient(settings, client.ChartPathOptions)
+	if err != nil {
+		return err
+	}
+	client.SetRegistryClient(rc)
+
+	path, err := client.ChartPathOptions.LocateChart(chart, settings)
+	if err != nil {
+		return err
+	}
+	vals, err := opts.MergeValues(getter.All(settings))
+	if err != nil {
+		return err
+	}
+	loaded, err := loader.Load(path)
+	if err != nil {
+		return err
+	}
+	if t := loaded.Metadata.Type; t != "" && t != "application" {
+		return fmt.Errorf("%s charts are not installable", t)
+	}
+	if deps := loaded.Metadata.Dependencies; deps != nil {
+		if err := action.CheckDependencies(loaded, deps); err != nil {
+			return fmt.Errorf("An error occurred while checking for chart dependencies. You may need to run `helm dependency build` to fetch missing dependencies: %v", err)
+		}
+	}
+	rel, err := client.RunWithContext(ctx, loaded, vals)
+	if err != nil {
+		return err
+	}
+
+	var manifests bytes.Buffer
+	fmt.Fprintln(&manifests, strings.TrimSpace(rel.Manifest))
+	for _, h := range rel.Hooks {
+		if skipTests && isTestHook(h) {
+			continue
+		}
+		fmt.Fprintf(&manifests, "---\n# Source: %s\n%s\n", h.Path, h.Manifest)
+	}
+	if len(showOnly) == 0 {
+		_, err := manifests.WriteTo(w)
+		return err
+	}
+	split := releaseutil.SplitManifests(manifests.String())
+	keys := make([]string, 0, len(split))
+	for k := range split {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+	var shown bytes.Buffer
+	for _, pattern := range showOnly {
+		pattern = filepath.ToSlash(pattern)
+		missing := true
+		for _, k := range keys {
+			m := templateSourcePattern.FindStringSubmatch(split[k])
+			if m == nil {
+				continue
+			}
+			if ok, _ := filepath.Match(pattern, m[1]); ok {
+				fmt.Fprintf(&shown, "---\n%s\n", split[k])
+				missing = false
+			}
+		}
+		if missing {
+			return fmt.Errorf("could not find template %s in chart", pattern)
+		}
+	}
+	_, err = shown.WriteTo(w)
+	return err
+}
+
+func isTestHook(h *release.Hook) bool {
+	for _, e := range h.Events {
+		if e == release.HookTest {
+			return true
+		}
+	}
+	return false
+}
+
+// setChartPathOption applies one of chartLocationFlags, or --version, to o.
+func setChartPathOption(o *action.ChartPathOptions, flag, value string) {
+	switch flag {
+	case "--repo":
+		o.RepoURL = value
+	case "--version":
+		o.Version = value
+	case "--username":
+		o.Username = value
+	case "--password":
+		o.Password = value
+	case "--ca-file":
+		o.CaFile = value
+	case "--cert-file":
+		o.CertFile = value
+	case "--key-file":
+		o.KeyFile = value
+	case "--insecure-skip-tls-verify":
+		o.InsecureSkipTLSverify = true
+	case "--pass-credentials":
+		o.PassCredentialsAll = true
+	}
+}
+
+// chartRegistryClient returns the client for OCI charts, with the registry
+// logins of settings and the credentials and TLS files of o.
+func chartRegistryClient(settings *cli.EnvSettings, o action.ChartPathOptions) (*registry.Client, error) {
+	opts := []registry.ClientOption{
+		registry.ClientOptEnableCache(true),
+		registry.ClientOptWriter(io.Discard),
+		registry.ClientOptCredentialsFile(settings.RegistryConfig),
+		registry.ClientOptBasicAuth(o.Username, o.Password),
+	}
+	if o.CertFile != "" && o.KeyFile != "" || o.CaFile != "" || o.InsecureSkipTLSverify {
+		config := &tls.Config{InsecureSkipVerify: o.InsecureSkipTLSverify}
+		if o.CertFile != "" && o.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("TLS file: %v", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		if o.CaFile != "" {
+			pem, err := os.ReadFile(o.CaFile)
+			if err != nil {
+				return nil, fmt.Errorf("TLS file: %v", err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("TLS file: no certificates in " + o.CaFile)
+			}
+		}
+		opts = append(opts, registry.ClientOptHTTPClient(&http.Client{
+			Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+		}))
+	}
+	return registry.NewClient(opts...)
+}
+
+// pullChart downloads chart at version into dir with the Helm SDK, as
+// `helm pull` does, located by the chartLocationFlags in args.
+func pullChart(chart, version, dir string, args []string) error {
+	settings := helmSettings()
+	cfg := &action.Configuration{Log: func(string, ...interface{}) {}}
+	pull := action.NewPullWithOpts(action.WithConfig(cfg))
+	pull.Settings = settings
+	pull.DestDir = dir
+	for i := 0; i < len(args); i++ {
+		value := ""
+		if chartLocationFlags[args[i]] && i+1 < len(args) {
+			value = args[i+1]
+		}
+		setChartPathOption(&pull.ChartPathOptions, args[i], value)
+		if value != "" {
+			i++
+		}
+	}
+	pull.Version = version
+	rc, err := chartRegistryClient(settings, pull.ChartPathOptions)
+	if err != nil {
+		return err
+	}
+	pull.SetRegistryClient(rc)
+	_, err = pull.Run(chart)
+	return err
+}
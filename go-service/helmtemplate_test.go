@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeChart writes a chart named web with the given templates into a
+// temporary directory and returns its path.
+func writeChart(t *testing.T, templates map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "web")
+	files := map[string]string{
+		"Chart.yaml":  "apiVersion: v2\nname: web\nversion: 0.1.0\n",
+		"values.yaml": "replicas: 1\nimage:\n  repository: nginx\n",
+	}
+	for name, body := range templates {
+		files["templates/"+name] = body
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const deploymentTemplate = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Release.Name }}
+  namespace: {{ .Release.Namespace }}
+spec:
+  replicas: {{ .Values.replicas }}
+  template:
+    spec:
+      containers:
+        - name: web
+          image: "{{ .Values.image.repository }}:{{ required "image.tag is required" .Values.image.tag }}"
+`
+
+// Rendering runs in process, so it needs no helm binary on PATH.
+func TestStreamChart(t *testing.T) {
+	t.Setenv("PATH", "")
+	t.Setenv("INFRAKIT_HELM_CACHE", t.TempDir())
+	chart := writeChart(t, map[string]string{
+		"deployment.yaml": deploymentTemplate,
+		"service.yaml":    "apiVersion: v1\nkind: Service\nmetadata:\n  name: {{ .Release.Name }}\n",
+		"job.yaml":        "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: migrate\n  annotations:\n    helm.sh/hook: pre-install\n",
+		"NOTES.txt":       "Installed {{ .Release.Name }}\n",
+	})
+	values := filepath.Join(t.TempDir(), "values.yaml")
+	if err := os.WriteFile(values, []byte("replicas: 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	n, err := streamChart(context.Background(), &out, "shop", chart,
+		"--values", values, "--set", "image.tag=1.25", "--namespace", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("streamChart returned %d bytes, wrote %d", n, out.Len())
+	}
+	manifest := out.String()
+	for _, want := range []string{
+		"# Source: web/templates/service.yaml\n",
+		"# Source: web/templates/deployment.yaml\n",
+		"# Source: web/templates/job.yaml\n",
+		"  name: shop\n",
+		"  namespace: prod\n",
+		"  replicas: 3\n",
+		`image: "nginx:1.25"`,
+	} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest is missing %q:\n%s", want, manifest)
+		}
+	}
+	if strings.Contains(manifest, "Installed") {
+		t.Errorf("manifest includes NOTES.txt:\n%s", manifest)
+	}
+	// Services install before Deployments, and hooks come last.
+	svc := strings.Index(manifest, "kind: Service")
+	deploy := strings.Index(manifest, "kind: Deployment")
+	job := strings.Index(manifest, "kind: Job")
+	if !(svc < deploy && deploy < job) {
+		t.Errorf("manifest is not in install order:\n%s", manifest)
+	}
+
+	out.Reset()
+	if _, err := streamChart(context.Background(), &out, "shop", chart,
+		"--set", "image.tag=1.25", "--show-only", "templates/service.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); !strings.HasPrefix(got, "---\n# Source: web/templates/service.yaml\n") || strings.Contains(got, "Deployment") {
+		t.Errorf("--show-only rendered:\n%s", got)
+	}
+}
+
+func TestStreamChartErrors(t *testing.T) {
+	t.Setenv("PATH", "")
+	t.Setenv("INFRAKIT_HELM_CACHE", t.TempDir())
+	chart := writeChart(t, map[string]string{"deployment.yaml": deploymentTemplate})
+
+	tests := []struct {
+		name string
+		args []string
+		want helmTemplateError
+	}{
+		{
+			name: "required value",
+			want: helmTemplateError{File: "web/templates/deployment.yaml", Line: 12, Column: 52, Kind: "execution", Message: "image.tag is required"},
+		},
+		{
+			name: "unsupported flag",
+			args: []string{"--post-renderer", "kustomize"},
+			want: helmTemplateError{Kind: "other", Message: "unsupported helm template flag --post-renderer"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := streamChart(context.Background(), &bytes.Buffer{}, "shop", chart, tt.args...)
+			var rerr *helmRenderError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("streamChart returned %v, want a helmRenderError", err)
+			}
+			if len(rerr.Errors) != 1 || rerr.Errors[0] != tt.want {
+				t.Errorf("Errors = %+v, want [%+v]", rerr.Errors, tt.want)
+			}
+		})
+	}
+}
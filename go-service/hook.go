@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hookRequest is the request body for hook, usually given as flags:
+//
+//	infrakit-go-service hook --staged [--validate --kubeconfig=...] [files...]
+type hookRequest struct {
+	// Staged checks the files in the git index, as a pre-commit hook sees
+	// the commit; otherwise files changed against HEAD are checked.
+	Staged bool `json:"staged"`
+	// Args are files to check instead of asking git, as passed by the
+	// pre-commit framework.
+	Args []string `json:"args"`
+	// Validate also dry-runs rendered manifests against the cluster.
+	Validate bool `json:"validate"`
+}
+
+// manifestPattern tells Kubernetes manifests from other YAML and JSON files.
+var manifestPattern = regexp.MustCompile(`(?m)^\s*"?apiVersion"?\s*:`)
+
+// hookTarget is a chart, kustomization or manifest affected by a change.
+type hookTarget struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// hookCheck runs the render/lint/validate pipeline matching each chart,
+// kustomization and manifest touched by the change. Its result carries a
+// one-line-per-target "report", printed instead of JSON when the command
+// runs from the command line, and fails when any target fails, so that a
+// failing check blocks the commit.
+func hookCheck(input map[string]interface{}) map[string]interface{} {
+	var req hookRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+			"report":  "infrakit: invalid request: " + err.Error() + "\n",
+		}
+	}
+	root, err := gitOutput(requestContext(input), "", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Not in a git repository: " + err.Error(),
+			"report":  "infrakit: not in a git repository\n",
+		}
+	}
+	root = strings.TrimSpace(root)
+
+	files := req.Args
+	if len(files) == 0 {
+		diff := []string{"diff", "--name-only", "-z", "--diff-filter=ACMRD", "HEAD"}
+		if req.Staged {
+			diff = []string{"diff", "--cached", "--name-only", "-z", "--diff-filter=ACMRD"}
+		}
+		out, err := gitOutput(requestContext(input), root, diff...)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to list changed files: " + err.Error(),
+				"report":  "infrakit: failed to list changed files\n",
+			}
+		}
+		for _, f := range strings.Split(out, "\x00") {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+	}
+	targets := hookTargets(root, files)
+	if len(targets) == 0 {
+		return map[string]interface{}{
+			"success": true,
+			"checked": []interface{}{},
+			"report":  "",
+		}
+	}
+
+	// Staged checks run against the index, so that unstaged edits neither
+	// hide nor cause failures.
+	base := root
+	if req.Staged && len(req.Args) == 0 {
+		dir, err := requestDir(requestContext(input))
+		if err == nil {
+			base = filepath.Join(dir, "index") + string(filepath.Separator)
+			_, err = gitOutput(requestContext(input), root, "checkout-index", "--all", "--prefix="+base)
+		}
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to export the index: " + err.Error(),
+				"report":  "infrakit: failed to export the index\n",
+			}
+		}
+	}
+
+	var report strings.Builder
+	var checked []map[string]interface{}
+	failed := 0
+	for _, t := range targets {
+		began := time.Now()
+		err := runHookTarget(input, req, filepath.Join(base, t.Path), t)
+		entry := map[string]interface{}{
+			"kind":       t.Kind,
+			"path":       t.Path,
+			"success":    err == nil,
+			"durationMs": time.Since(began).Milliseconds(),
+		}
+		if err != nil {
+			failed++
+			entry["error"] = err.Error()
+			fmt.Fprintf(&report, "✗ %s %s: %s\n", t.Kind, t.Path, firstLines(err.Error(), 3))
+		} else {
+			fmt.Fprintf(&report, "✓ %s %s\n", t.Kind, t.Path)
+		}
+		checked = append(checked, entry)
+	}
+	result := map[string]interface{}{
+		"success": failed == 0,
+		"checked": checked,
+		"failed":  failed,
+	}
+	if failed > 0 {
+		result["error"] = fmt.Sprintf("%d of %d checks failed", failed, len(targets))
+		fmt.Fprintf(&report, "infrakit: %d of %d checks failed\n", failed, len(targets))
+	}
+	result["report"] = report.String()
+	return result
+}
+
+// hookTargets maps changed files to what has to be checked: the chart or
+// kustomization containing them, if any, and otherwise the file itself when
+// it is a Kubernetes manifest that still exists; other YAML and JSON files
+// (CI configs, docs) are not checked.
+func hookTargets(root string, files []string) []hookTarget {
+	seen := map[hookTarget]bool{}
+	var targets []hookTarget
+	for _, f := range files {
+		rel := f
+		if filepath.IsAbs(f) {
+			if r, err := filepath.Rel(root, f); err == nil {
+				rel = r
+			}
+		}
+		rel = filepath.Clean(rel)
+		var t hookTarget
+		if dir, ok := enclosingDir(root, rel, "Chart.yaml"); ok {
+			t = hookTarget{Kind: "chart", Path: dir}
+		} else if dir, ok := enclosingDir(root, rel, "kustomization.yaml", "kustomization.yml", "Kustomization"); ok {
+			t = hookTarget{Kind: "kustomization", Path: dir}
+		} else {
+			switch strings.ToLower(filepath.Ext(rel)) {
+			case ".yaml", ".yml", ".json":
+			default:
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(root, rel))
+			if err != nil || !manifestPattern.Match(data) {
+				continue
+			}
+			t = hookTarget{Kind: "manifest", Path: rel}
+		}
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Path < targets[j].Path })
+	return targets
+}
+
+// enclosingDir finds the closest directory of rel, up to the repository
+// root, that contains one of the marker files.
+func enclosingDir(root, rel string, markers ...string) (string, bool) {
+	for dir := filepath.Dir(rel); ; dir = filepath.Dir(dir) {
+		for _, m := range markers {
+			if _, err := os.Stat(filepath.Join(root, dir, m)); err == nil {
+				return dir, true
+			}
+		}
+		if dir == "." || dir == string(filepath.Separator) {
+			return "", false
+		}
+	}
+}
+
+// runHookTarget lints and renders a chart (running its unit tests when it
+// has any), builds a kustomization or parses a manifest, then validates the
+// result when requested.
+func runHookTarget(input map[string]interface{}, req hookRequest, path string, t hookTarget) error {
+	var manifest string
+	switch t.Kind {
+	case "chart":
+		if out, err := runHelm(requestContext(input), "lint", path); err != nil {
+			return errors.New("helm lint: " + hookLintErrors(string(out), err))
+		}
+		rendered, err := renderChart(requestContext(input), "release-name", path)
+		if err != nil {
+			return errors.New("render: " + strings.TrimSpace(err.Error()))
+		}
+		manifest = rendered
+		if suites, _ := filepath.Glob(filepath.Join(path, "tests", "*_test.yaml")); len(suites) > 0 {
+			result := unittestHelm(map[string]interface{}{"chart": path, requestContextKey: input[requestContextKey]})
+			if result["success"] != true {
+				return errors.New("unit tests: " + fmt.Sprint(result["error"]))
+			}
+			if result["passed"] != true {
+				return fmt.Errorf("unit tests: %v of %v failed", result["failed"], result["total"])
+			}
+		}
+	case "kustomization":
+		out, err := runKubectl(input, "", "kustomize", path)
+		if err != nil {
+			return errors.New("kustomize: " + strings.TrimSpace(err.Error()))
+		}
+		manifest = string(out)
+	default:
+		data, err := readManifestFile(path)
+		if err != nil {
+			return err
+		}
+		manifest = data
+	}
+
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return err
+	}
+	for i, obj := range objects {
+		if ref := refOf(obj); ref.APIVersion == "" || ref.Kind == "" {
+			return fmt.Errorf("document %d: missing apiVersion or kind", i+1)
+		}
+	}
+	if req.Validate {
+		vin := map[string]interface{}{}
+		for k, v := range input {
+			vin[k] = v
+		}
+		delete(vin, "manifestFile")
+		vin["manifest"] = manifest
+		if result := validateK8s(vin); result["success"] != true {
+			return errors.New("validation: " + strings.TrimSpace(fmt.Sprint(result["error"])))
+		}
+	}
+	return nil
+}
+
+// hookLintErrors keeps the [ERROR] lines of helm lint output.
+func hookLintErrors(out string, err error) string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "[ERROR]") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	if len(lines) == 0 {
+		return strings.TrimSpace(err.Error())
+	}
+	return strings.Join(lines, "; ")
+}
+
+// firstLines shortens s to its first n non-empty lines.
+func firstLines(s string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+			if len(lines) == n {
+				break
+			}
+		}
+	}
+	return strings.Join(lines, " / ")
+}
+
+func gitOutput(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	out, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if err != nil {
+		return "", errors.New(strings.TrimSpace(stderr.String()) + ": " + err.Error())
+	}
+	return string(out), nil
+}
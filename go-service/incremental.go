@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// renderDigest fingerprints everything a render of c depends on: its
+// settings, values, values files and, for a local chart, every file of the chart
+// (templates, values, Chart.yaml and vendored dependencies). It returns ""
+// when the inputs cannot be pinned down, e.g. for a repository chart without
+// an exact version, so that the chart is always rendered.
+func renderDigest(c renderJobSpec) string {
+	h := sha256.New()
+	values, err := json.Marshal(c.Values)
+	if err != nil {
+		return ""
+	}
+	fmt.Fprintf(h, "%q %q %q %q %s\n", c.Name, c.Chart, c.Version, c.Namespace, values)
+	for _, f := range c.ValuesFiles {
+		if digestFile(h, f, f) != nil {
+			return ""
+		}
+	}
+
+	info, err := os.Stat(c.Chart)
+	switch {
+	case err != nil:
+		if !exactChartVersion.MatchString(c.Version) {
+			return ""
+		}
+	case !info.IsDir():
+		if digestFile(h, c.Chart, filepath.Base(c.Chart)) != nil {
+			return ""
+		}
+	default:
+		err := filepath.Walk(c.Chart, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(c.Chart, path)
+			if err != nil {
+				return err
+			}
+			return digestFile(h, path, rel)
+		})
+		if err != nil {
+			return ""
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func digestFile(h io.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fh := sha256.New()
+	if _, err := io.Copy(fh, f); err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "%q %x\n", filepath.ToSlash(name), fh.Sum(nil))
+	return nil
+}
+
+// loadRenderState reads the digests of the last incremental run; a missing
+// or unreadable state renders everything.
+func loadRenderState(path string) map[string]string {
+	state := map[string]string{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+func saveRenderState(path string, state map[string]string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeCacheFile(path, data)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// kubectlCommand builds a kubectl invocation that targets the cluster
+// described by the request's connection fields. input["as"] and
+// input["asGroups"] impersonate another user or service account, so admins
+// can check what a team's credentials would be allowed to do.
+func kubectlCommand(input map[string]interface{}, args ...string) *exec.Cmd {
+	var global []string
+	if context, ok := input["context"].(string); ok && context != "" {
+		global = append(global, "--context="+context)
+	}
+	if as, ok := input["as"].(string); ok && as != "" {
+		global = append(global, "--as="+as)
+	}
+	if groups, ok := input["asGroups"].([]interface{}); ok {
+		for _, g := range groups {
+			if group, ok := g.(string); ok && group != "" {
+				global = append(global, "--as-group="+group)
+			}
+		}
+	}
+	cmd := toolCommand(requestContext(input), "kubectl", append(global, args...)...)
+	cmd.Env = clusterEnv(input)
+	return cmd
+}
+
+// clusterEnv returns the environment for tools talking to the request's
+// cluster: toolEnviron's, with the request's kubeconfig and proxy.
+func clusterEnv(input map[string]interface{}) []string {
+	var env []string
+	if kubeconfig, ok := input["kubeconfig"].(string); ok && kubeconfig != "" {
+		env = append(env, "KUBECONFIG="+kubeconfig)
+	}
+	// client-go honours the standard proxy variables, including socks5://.
+	if proxy, ok := input["proxyURL"].(string); ok && proxy != "" {
+		env = append(env, "HTTPS_PROXY="+proxy, "HTTP_PROXY="+proxy)
+	}
+	return append(toolEnviron(), env...)
+}
+
+// prepareClusterAccess sets up everything a request needs to reach its
+// cluster (kubeconfig files, tunnels) and returns a cleanup that undoes it.
+// It binds input to its request context first, so that the request's
+// timeout bounds the cloud CLIs and ssh this runs as well as the command.
+func prepareClusterAccess(parent context.Context, input map[string]interface{}) (func(), error) {
+	_, cancel, err := withRequestContext(parent, input)
+	if err != nil {
+		return nil, err
+	}
+	removeKubeconfig, err := materializeKubeconfig(input)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := checkKubeContext(input); err != nil {
+		removeKubeconfig()
+		cancel()
+		return nil, err
+	}
+	closeTunnel, err := openTunnel(input)
+	if err != nil {
+		removeKubeconfig()
+		cancel()
+		return nil, err
+	}
+	return func() {
+		closeTunnel()
+		removeKubeconfig()
+		cancel()
+	}, nil
+}
+
+// checkKubeContext fails a request whose input["context"] is not a context
+// of its kubeconfig, naming the ones there are, before kubectl fails it in
+// a less helpful way.
+func checkKubeContext(input map[string]interface{}) error {
+	context, _ := input["context"].(string)
+	if context == "" {
+		return nil
+	}
+	// Listed without --context, which kubectl would already reject.
+	cmd := toolCommand(requestContext(input), "kubectl", "config", "get-contexts", "-o", "name")
+	cmd.Env = clusterEnv(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	out, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if errors.Is(err, exec.ErrNotFound) {
+		// Left to the command itself to report.
+		return nil
+	}
+	if err != nil {
+		return errors.New("Failed to read kubeconfig contexts: " + strings.TrimSpace(stderr.String()))
+	}
+	var contexts []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line == context {
+			return nil
+		} else if line != "" {
+			contexts = append(contexts, line)
+		}
+	}
+	if len(contexts) == 0 {
+		return fmt.Errorf("Context %q not found: the kubeconfig has no contexts", context)
+	}
+	return fmt.Errorf("Context %q not found in the kubeconfig (contexts: %s)", context, strings.Join(contexts, ", "))
+}
+
+// materializeKubeconfig writes input["kubeconfigContent"] (YAML or base64
+// encoded YAML) to a temp file readable only by this user and points
+// input["kubeconfig"] at it, so callers holding credentials in a secret store
+// don't need a file on this host. input["cloudAuth"] does the same with a
+// generated kubeconfig for a managed EKS/GKE/AKS cluster. The returned
+// cleanup removes the file.
+//
+// With none of these set, a process running in a pod authenticates with its
+// mounted ServiceAccount token instead, unless input["inCluster"] is false.
+func materializeKubeconfig(input map[string]interface{}) (func(), error) {
+	noop := func() {}
+	path, _ := input["kubeconfig"].(string)
+	content, _ := input["kubeconfigContent"].(string)
+	switch {
+	case strings.TrimSpace(content) != "":
+		if path != "" {
+			return noop, errors.New("Only one of 'kubeconfig' and 'kubeconfigContent' may be provided")
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content)); err == nil {
+			content = string(decoded)
+		}
+		if !strings.Contains(content, "clusters") {
+			return noop, errors.New("kubeconfigContent is not a kubeconfig")
+		}
+	case input["cloudAuth"] != nil:
+		if path != "" {
+			return noop, errors.New("Only one of 'kubeconfig' and 'cloudAuth' may be provided")
+		}
+		m, ok := input["cloudAuth"].(map[string]interface{})
+		if !ok {
+			return noop, errors.New("cloudAuth must be an object")
+		}
+		var spec cloudAuthSpec
+		if err := decodeInput(m, &spec); err != nil {
+			return noop, errors.New("Invalid cloudAuth: " + err.Error())
+		}
+		var err error
+		if content, err = cloudKubeconfig(requestContext(input), spec); err != nil {
+			return noop, err
+		}
+	case path == "":
+		// Without an explicit request, defer to a KUBECONFIG the service
+		// itself was started with.
+		inCluster, explicit := input["inCluster"].(bool)
+		if explicit && !inCluster || !explicit && os.Getenv("KUBECONFIG") != "" {
+			return noop, nil
+		}
+		var ok bool
+		if content, ok = inClusterKubeconfig(); !ok {
+			if inCluster {
+				return noop, errors.New("inCluster requested but no ServiceAccount token is mounted")
+			}
+			return noop, nil
+		}
+	default:
+		return noop, nil
+	}
+
+	tmpfile, err := createTemp(requestContext(input), "kubeconfig-")
+	if err != nil {
+		return noop, errors.New("Failed to create temp file: " + err.Error())
+	}
+	cleanup := func() { os.Remove(tmpfile.Name()) }
+	if err := tmpfile.Chmod(0o600); err != nil {
+		tmpfile.Close()
+		cleanup()
+		return noop, errors.New("Failed to secure kubeconfig: " + err.Error())
+	}
+	if _, err := tmpfile.WriteString(content); err != nil {
+		tmpfile.Close()
+		cleanup()
+		return noop, errors.New("Failed to write kubeconfig: " + err.Error())
+	}
+	if err := tmpfile.Close(); err != nil {
+		cleanup()
+		return noop, errors.New("Failed to close temp file: " + err.Error())
+	}
+	input["kubeconfig"] = tmpfile.Name()
+	return cleanup, nil
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// inClusterKubeconfig builds a kubeconfig for the pod's ServiceAccount. The
+// token is referenced by path so kubectl picks up projected token rotation.
+func inClusterKubeconfig() (string, bool) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", false
+	}
+	if _, err := os.Stat(serviceAccountDir + "/token"); err != nil {
+		return "", false
+	}
+	context := map[string]interface{}{"cluster": "in-cluster", "user": "service-account"}
+	if ns, err := os.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+		context["namespace"] = strings.TrimSpace(string(ns))
+	}
+	return encodeYAML(map[string]interface{}{
+		"apiVersion":      "v1",
+		"kind":            "Config",
+		"current-context": "in-cluster",
+		"clusters": []interface{}{map[string]interface{}{
+			"name": "in-cluster",
+			"cluster": map[string]interface{}{
+				"server":                "https://" + net.JoinHostPort(host, port),
+				"certificate-authority": serviceAccountDir + "/ca.crt",
+			},
+		}},
+		"users": []interface{}{map[string]interface{}{
+			"name": "service-account",
+			"user": map[string]interface{}{"tokenFile": serviceAccountDir + "/token"},
+		}},
+		"contexts": []interface{}{map[string]interface{}{
+			"name":    "in-cluster",
+			"context": context,
+		}},
+	}), true
+}
+
+// runKubectl runs kubectl and returns its stdout. On failure the error
+// carries kubectl's stderr so callers can surface it verbatim.
+func runKubectl(input map[string]interface{}, stdin string, args ...string) ([]byte, error) {
+	defer acquireKubectl(input)()
+	cmd := kubectlCommand(input, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	out, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if err != nil {
+		return out, errors.New(strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return out, nil
+}
+
+// ensureNamespace creates namespace unless it exists, and reports whether
+// it did.
+func ensureNamespace(input map[string]interface{}, namespace string) (bool, error) {
+	out, err := runKubectl(input, "", "get", "namespace", namespace, "--ignore-not-found", "-o", "name")
+	if err != nil {
+		return false, fmt.Errorf("Failed to look up namespace %s: %v", namespace, err)
+	}
+	if strings.TrimSpace(string(out)) != "" {
+		return false, nil
+	}
+	if _, err := runKubectl(input, "", "create", "namespace", namespace); err != nil {
+		return false, fmt.Errorf("Failed to create namespace %s: %v", namespace, err)
+	}
+	return true, nil
+}
+
+// clusterServerVersion returns the API server's gitVersion, e.g. "v1.29.2".
+func clusterServerVersion(input map[string]interface{}) (string, error) {
+	out, err := cachedKubectl(input, "version", "version", "-o", "json")
+	if err != nil {
+		return "", err
+	}
+	var v struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err := json.Unmarshal(out, &v); err != nil {
+		return "", err
+	}
+	return v.ServerVersion.GitVersion, nil
+}
+
+// clusterAPIVersions returns the set of group/versions served by the cluster.
+func clusterAPIVersions(input map[string]interface{}) (map[string]bool, error) {
+	out, err := cachedKubectl(input, "api-versions", "api-versions")
+	if err != nil {
+		return nil, err
+	}
+	versions := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			versions[line] = true
+		}
+	}
+	return versions, nil
+}
+
+// apiResource is one entry of a discovery APIResourceList.
+type apiResource struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Namespaced bool   `json:"namespaced"`
+}
+
+// clusterAPIResources returns the top-level resources served for a group/version.
+func clusterAPIResources(input map[string]interface{}, groupVersion string) ([]apiResource, error) {
+	path := "/apis/" + groupVersion
+	if groupVersion == "v1" {
+		path = "/api/v1"
+	}
+	out, err := cachedKubectl(input, "resources-"+groupVersion, "get", "--raw", path)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Resources []apiResource `json:"resources"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, err
+	}
+	var resources []apiResource
+	for _, r := range list.Resources {
+		if !strings.Contains(r.Name, "/") {
+			resources = append(resources, r)
+		}
+	}
+	return resources, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// versionMatrixRequest is the request body for validate-versions. The
+// manifest or chart comes from the usual manifest, manifestFile or
+// name/chart keys.
+type versionMatrixRequest struct {
+	// KubernetesVersions are checked offline against the built-in schemas
+	// of each version, e.g. "v1.29.2", downloaded into the schema cache
+	// unless warm already put them there.
+	KubernetesVersions []string `json:"kubernetesVersions"`
+	// Clusters are checked with a server-side dry run each.
+	Clusters      []versionMatrixCluster `json:"clusters"`
+	SchemaBaseURL string                 `json:"schemaBaseURL"`
+	// Strict reports fields the schemas do not declare.
+	Strict bool `json:"strict"`
+	crdValidationRequest
+}
+
+type versionMatrixCluster struct {
+	Name       string `json:"name"`
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+// versionFinding is a resource that is invalid on a version, or could not
+// be checked there.
+type versionFinding struct {
+	Resource string `json:"resource"`
+	Document int    `json:"document"`
+	// Status is "unavailable" (the version does not serve the apiVersion
+	// and kind), "invalid" or "unchecked" (a custom resource without a
+	// cached schema).
+	Status string        `json:"status"`
+	Errors []schemaError `json:"errors,omitempty"`
+	// Schema is where the schema of an invalid custom resource came from:
+	// "request", a CRD file, "chart", "manifest" or "cache".
+	Schema string `json:"schema,omitempty"`
+	// Alternatives are apiVersions that do serve the kind on this version.
+	Alternatives []string `json:"alternatives,omitempty"`
+}
+
+type versionResult struct {
+	Version    string           `json:"version"`
+	Cluster    string           `json:"cluster,omitempty"`
+	Source     string           `json:"source"`
+	Passed     bool             `json:"passed"`
+	Error      string           `json:"error,omitempty"`
+	Findings   []versionFinding `json:"findings,omitempty"`
+	DurationMs int64            `json:"durationMs"`
+}
+
+// validateVersions checks one manifest or chart against several Kubernetes
+// versions in a single run, offline against each version's schemas and
+// online against each listed cluster, and reports the versions it breaks
+// on. Charts are rendered once per version with --kube-version, so
+// templates that switch APIs on .Capabilities are checked as installed.
+func validateVersions(input map[string]interface{}) map[string]interface{} {
+	var req versionMatrixRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if len(req.KubernetesVersions) == 0 && len(req.Clusters) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Provide 'kubernetesVersions', 'clusters' or both",
+		}
+	}
+
+	start := time.Now()
+	results := make([]versionResult, len(req.KubernetesVersions)+len(req.Clusters))
+	var wg sync.WaitGroup
+	for i, v := range req.KubernetesVersions {
+		wg.Add(1)
+		go func(i int, version string) {
+			defer wg.Done()
+			results[i] = validateOnSchemas(input, req, version)
+		}(i, v)
+	}
+	for i, c := range req.Clusters {
+		wg.Add(1)
+		go func(i int, c versionMatrixCluster) {
+			defer wg.Done()
+			results[i] = validateOnCluster(input, c)
+		}(len(req.KubernetesVersions)+i, c)
+	}
+	wg.Wait()
+
+	brokenOn := []string{}
+	for _, r := range results {
+		if !r.Passed {
+			name := r.Version
+			if r.Cluster != "" {
+				name = r.Cluster
+			}
+			brokenOn = append(brokenOn, name)
+		}
+	}
+	return map[string]interface{}{
+		"success":    true,
+		"passed":     len(brokenOn) == 0,
+		"brokenOn":   brokenOn,
+		"results":    results,
+		"durationMs": time.Since(start).Milliseconds(),
+	}
+}
+
+func validateOnSchemas(input map[string]interface{}, req versionMatrixRequest, version string) (result versionResult) {
+	began := time.Now()
+	result = versionResult{Version: version, Source: "schemas"}
+	defer func() { result.DurationMs = time.Since(began).Milliseconds() }()
+	schemas, err := loadBuiltinSchemas(req.SchemaBaseURL, version)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	manifest, err := manifestFromInput(input, "--kube-version", version)
+	if err != nil {
+		result.Error = "render: " + err.Error()
+		return result
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		result.Error = "Failed to parse manifest: " + err.Error()
+		return result
+	}
+
+	crds, err := loadCRDSchemas(input, req.crdValidationRequest, objects)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	validator := schemaValidator{Definitions: schemas.Definitions, Strict: req.Strict}
+	result.Passed = true
+	for i, obj := range objects {
+		ref := refOf(obj)
+		finding := versionFinding{Resource: ref.String(), Document: i + 1}
+		schema, ok := schemas.schemaFor(ref.APIVersion, ref.Kind)
+		switch {
+		case ok:
+			finding.Status = "invalid"
+			finding.Errors = validator.validate(obj, schema)
+			if len(finding.Errors) == 0 {
+				continue
+			}
+		case schemas.builtinGroup(ref.APIVersion) || len(schemas.apiVersionsOf(ref.Kind)) > 0:
+			if _, ok := crds.lookup(ref.APIVersion, ref.Kind); ok {
+				// A CRD of the manifest or request serves it after all.
+				continue
+			}
+			finding.Status = "unavailable"
+			finding.Alternatives = schemas.apiVersionsOf(ref.Kind)
+		default:
+			// Not a built-in kind on any API: a custom resource.
+			crd, ok := crds.lookup(ref.APIVersion, ref.Kind)
+			if !ok {
+				finding.Status = "unchecked"
+				result.Findings = append(result.Findings, finding)
+				continue
+			}
+			finding.Status = "invalid"
+			finding.Schema = crd.Source
+			finding.Errors = crd.validate(obj, req.Strict)
+			if len(finding.Errors) == 0 {
+				continue
+			}
+		}
+		result.Passed = false
+		result.Findings = append(result.Findings, finding)
+	}
+	return result
+}
+
+// offlineValidationRequest holds the validate-k8s keys of an offline run.
+type offlineValidationRequest struct {
+	Offline bool `json:"offline"`
+	// KubernetesVersion selects the schemas, e.g. "v1.29.2"; it defaults to
+	// the newest version in the schema cache.
+	KubernetesVersion string `json:"kubernetesVersion"`
+	SchemaBaseURL     string `json:"schemaBaseURL"`
+	Strict            bool   `json:"strict"`
+	crdValidationRequest
+}
+
+// validateOffline is validate-k8s without a cluster: documents are checked
+// against one Kubernetes version's schemas (and cached CRD schemas), with
+// an error per offending field. As with a dry run, invalid manifests fail
+// the request.
+func validateOffline(input map[string]interface{}, req offlineValidationRequest) map[string]interface{} {
+	version := req.KubernetesVersion
+	if version == "" {
+		version = newestCachedSchemaVersion()
+	}
+	if version == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No schemas in " + schemaCacheDir() + "; pass 'kubernetesVersion' or run warm first",
+		}
+	}
+	r := validateOnSchemas(input, versionMatrixRequest{SchemaBaseURL: req.SchemaBaseURL, Strict: req.Strict, crdValidationRequest: req.crdValidationRequest}, version)
+	if r.Error != "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   r.Error,
+		}
+	}
+	if r.Findings == nil {
+		r.Findings = []versionFinding{}
+	}
+	result := map[string]interface{}{
+		"success":           r.Passed,
+		"offline":           true,
+		"kubernetesVersion": version,
+		"findings":          r.Findings,
+	}
+	if r.Passed {
+		result["message"] = "Manifest validated successfully against " + version + " schemas"
+	} else {
+		invalid := 0
+		for _, f := range r.Findings {
+			if f.Status != "unchecked" {
+				invalid++
+			}
+		}
+		result["error"] = fmt.Sprintf("%d documents failed validation against %s schemas", invalid, version)
+	}
+	return result
+}
+
+// newestCachedSchemaVersion returns the highest Kubernetes version whose
+// built-in schemas are cached, or "".
+func newestCachedSchemaVersion() string {
+	entries, _ := os.ReadDir(schemaCacheDir())
+	var newest string
+	var best semver
+	for _, e := range entries {
+		v, ok := parseSemver(e.Name())
+		if !ok || !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(schemaCacheDir(), e.Name(), "_definitions.json")); err != nil {
+			continue
+		}
+		if newest == "" || compareSemver(v, best) > 0 {
+			newest, best = e.Name(), v
+		}
+	}
+	return newest
+}
+
+// crdSchemaForObject lets a CRD's openAPIV3Schema, which usually leaves
+// out apiVersion, kind and metadata, validate a whole object.
+func crdSchemaForObject(schema map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{
+		"apiVersion": map[string]interface{}{"type": "string"},
+		"kind":       map[string]interface{}{"type": "string"},
+		"metadata":   map[string]interface{}{"type": "object"},
+	}
+	if p, ok := schema["properties"].(map[string]interface{}); ok {
+		for k, v := range p {
+			properties[k] = v
+		}
+	}
+	out := map[string]interface{}{}
+	for k, v := range schema {
+		out[k] = v
+	}
+	out["properties"] = properties
+	return out
+}
+
+func validateOnCluster(input map[string]interface{}, c versionMatrixCluster) (result versionResult) {
+	began := time.Now()
+	name := c.Name
+	if name == "" {
+		name = c.Kubeconfig
+	}
+	result = versionResult{Cluster: name, Source: "cluster"}
+	defer func() { result.DurationMs = time.Since(began).Milliseconds() }()
+	cluster := map[string]interface{}{}
+	for k, v := range input {
+		cluster[k] = v
+	}
+	if c.Kubeconfig != "" {
+		cluster["kubeconfig"] = c.Kubeconfig
+	}
+	version, err := clusterServerVersion(cluster)
+	if err != nil {
+		result.Error = "Failed to query cluster version: " + err.Error()
+		return result
+	}
+	result.Version = version
+	manifest, err := manifestFromInput(cluster, "--kube-version", version)
+	if err != nil {
+		result.Error = "render: " + err.Error()
+		return result
+	}
+	delete(cluster, "manifestFile")
+	cluster["manifest"] = manifest
+	if validation := validateK8s(cluster); validation["success"] != true {
+		result.Error, _ = validation["error"].(string)
+		return result
+	}
+	result.Passed = true
+	return result
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// kustomizeRequest is the request body for generate-kustomize.
+type kustomizeRequest struct {
+	// Dir is a kustomization directory (overlay or base).
+	Dir string `json:"dir"`
+	// Resources are inline manifests, added to Dir when both are given.
+	Resources []string `json:"resources"`
+	// Patches are applied on top: a string is an inline patch (strategic
+	// merge or JSON 6902 list), an object a kustomize patches entry such as
+	// {"patch": "...", "target": {"kind": "Deployment"}}; a "path" there is
+	// relative to the working directory.
+	Patches []interface{} `json:"patches"`
+	// Kustomization holds further kustomization.yaml fields for the inline
+	// overlay, e.g. namespace, namePrefix, images or labels.
+	Kustomization map[string]interface{} `json:"kustomization"`
+	// EnableHelm lets the kustomization inflate helmCharts with the managed
+	// helm.
+	EnableHelm bool `json:"enableHelm"`
+}
+
+// generateKustomize runs a kustomize build of input["dir"] or of inline
+// resources and patches and returns the manifest the way generate-helm
+// does: inline, in input["outputFile"] or streamed.
+func generateKustomize(input map[string]interface{}) map[string]interface{} {
+	var req kustomizeRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Dir == "" && len(req.Resources) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Provide 'dir', 'resources' or both",
+		}
+	}
+	root := req.Dir
+	if len(req.Resources) > 0 || len(req.Patches) > 0 || len(req.Kustomization) > 0 {
+		overlay, err := writeKustomizeOverlay(requestContext(input), req)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		defer os.RemoveAll(overlay)
+		root = overlay
+	} else if _, err := os.Stat(root); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	return renderResult(input, func(w io.Writer) (int64, error) {
+		return streamKustomize(requestContext(input), w, root, req.EnableHelm)
+	})
+}
+
+// writeKustomizeOverlay writes the inline parts of req as a kustomization
+// in a temp dir of the request's workspace, layered over req.Dir if given.
+func writeKustomizeOverlay(ctx context.Context, req kustomizeRequest) (string, error) {
+	workspace, err := requestDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(workspace, "kustomize-")
+	if err != nil {
+		return "", err
+	}
+	k := map[string]interface{}{}
+	for key, v := range req.Kustomization {
+		k[key] = v
+	}
+	for _, key := range []string{"resources", "patches"} {
+		if _, ok := k[key]; ok {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("set %s with the '%s' key, not in 'kustomization'", key, key)
+		}
+	}
+	k["apiVersion"] = "kustomize.config.k8s.io/v1beta1"
+	k["kind"] = "Kustomization"
+	var resources, patches []interface{}
+	if req.Dir != "" {
+		base, err := filepath.Abs(req.Dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		resources = append(resources, base)
+	}
+	for i, r := range req.Resources {
+		name := fmt.Sprintf("resource-%d.yaml", i+1)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(r), 0o600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		resources = append(resources, name)
+	}
+	for i, p := range req.Patches {
+		switch p := p.(type) {
+		case string:
+			patches = append(patches, map[string]interface{}{"patch": p})
+		case map[string]interface{}:
+			// Patch files are read here: kustomize would resolve them
+			// against the temp dir, and refuses files outside it.
+			if path, ok := p["path"].(string); ok {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					os.RemoveAll(dir)
+					return "", err
+				}
+				p = deepCopyObject(p)
+				delete(p, "path")
+				p["patch"] = string(data)
+			}
+			patches = append(patches, p)
+		default:
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("patch %d must be a string or an object", i+1)
+		}
+	}
+	k["resources"] = resources
+	if len(patches) > 0 {
+		k["patches"] = patches
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(encodeYAML(k)), 0o600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// streamKustomize runs `kubectl kustomize` (the kustomize built into the
+// managed kubectl) and copies the manifest to w as it is produced.
+func streamKustomize(ctx context.Context, w io.Writer, dir string, enableHelm bool) (int64, error) {
+	args := []string{"kustomize", dir}
+	if enableHelm {
+		args = append(args, "--enable-helm", "--helm-command", toolBinary("helm"))
+	}
+	defer acquireKubectl(nil)()
+	cw := &countingWriter{w: w}
+	// Only the request context: kustomize does not talk to a cluster.
+	cmd := kubectlCommand(map[string]interface{}{requestContextKey: requestScope{ctx}}, args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = cw
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	err := cmd.Run()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if err != nil {
+		return cw.n, errors.New(stderr.String() + "\n" + err.Error())
+	}
+	return cw.n, nil
+}
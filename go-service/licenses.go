@@ -0,0 +1,556 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// licenseScanRequest is the request body for scan-licenses. Images come
+// from the manifest or rendered chart (manifest, manifestFile or
+// name/chart) plus Images; chart licenses from Chart, when it is a local
+// directory or archive.
+type licenseScanRequest struct {
+	Chart  string   `json:"chart"`
+	Images []string `json:"images"`
+	// Allow, if set, is the complete list of acceptable SPDX license IDs;
+	// Deny lists forbidden ones. Entries ending in * match prefixes
+	// ("GPL-*").
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// FailOnUnknown fails the check for components without license
+	// information.
+	FailOnUnknown bool `json:"failOnUnknown"`
+	// Platform picks the image of multi-platform indexes (default
+	// linux/amd64).
+	Platform string `json:"platform"`
+}
+
+// licenseComponent is one image or chart and its licenses.
+type licenseComponent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// Licenses are SPDX expressions; Source says where they were found:
+	// "label", "sbom", "chart-annotation" or "license-file".
+	Licenses []string `json:"licenses,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	// Status is "allowed", "denied", "not-allowed" (missing from the allow
+	// list), "unknown" or "error".
+	Status    string   `json:"status"`
+	Error     string   `json:"error,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+	// Packages counts the packages of an image's SBOM by license, and
+	// Violations are the package licenses that fail the policy.
+	Packages   map[string]int     `json:"packages,omitempty"`
+	Violations []licenseViolation `json:"violations,omitempty"`
+}
+
+type licenseViolation struct {
+	License  string `json:"license"`
+	Packages int    `json:"packages"`
+	Status   string `json:"status"`
+}
+
+// scanLicenses collects the licenses of the images a manifest or chart
+// references and of a chart and its dependencies, and checks them against
+// an allow/deny policy. Image licenses come from the
+// org.opencontainers.image.licenses label and from SPDX or CycloneDX SBOM
+// attestations attached to the image; chart licenses from the "licenses"
+// or artifacthub.io/license annotations, or else the chart's LICENSE file.
+func scanLicenses(input map[string]interface{}) map[string]interface{} {
+	var req licenseScanRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Platform == "" {
+		req.Platform = "linux/amd64"
+	}
+
+	var components []licenseComponent
+	if req.Chart != "" {
+		charts, err := chartLicenses(requestContext(input), req.Chart)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to read chart: " + err.Error(),
+			}
+		}
+		components = append(components, charts...)
+	}
+
+	var images []imageUse
+	if _, hasManifest := input["manifest"]; hasManifest || input["manifestFile"] != nil || input["name"] != nil {
+		manifest, err := manifestFromInput(input)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		objects, err := parseManifest(manifest)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to parse manifest: " + err.Error(),
+			}
+		}
+		images = manifestImages(objects)
+	}
+	for _, image := range req.Images {
+		images = append(images, imageUse{Image: image})
+	}
+	if len(components) == 0 && len(images) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Provide a manifest or chart to scan, or 'images'",
+		}
+	}
+
+	client := newRegistryClient()
+	scanned := make([]licenseComponent, len(images))
+	sem := newSemaphore(8)
+	var wg sync.WaitGroup
+	for i, use := range images {
+		wg.Add(1)
+		go func(i int, use imageUse) {
+			defer wg.Done()
+			defer sem.acquire()()
+			scanned[i] = imageLicenses(client, use, req.Platform)
+		}(i, use)
+	}
+	wg.Wait()
+	components = append(components, scanned...)
+
+	counts := map[string]int{}
+	var report strings.Builder
+	passed := true
+	for i := range components {
+		c := &components[i]
+		if c.Status != "error" {
+			c.Status = licensePolicyStatus(c.Licenses, req.Allow, req.Deny)
+			for _, license := range sortedIntKeys(c.Packages) {
+				if s := licensePolicyStatus([]string{license}, req.Allow, req.Deny); s == "denied" || s == "not-allowed" {
+					c.Violations = append(c.Violations, licenseViolation{License: license, Packages: c.Packages[license], Status: s})
+				}
+			}
+			// A denied package taints an image whose own label is fine.
+			if len(c.Violations) > 0 && (c.Status == "allowed" || c.Status == "unknown") {
+				c.Status = c.Violations[0].Status
+			}
+		}
+		counts[c.Status]++
+		mark := "✓"
+		switch c.Status {
+		case "denied", "not-allowed", "error":
+			mark = "✗"
+			passed = false
+		case "unknown":
+			mark = "?"
+			if req.FailOnUnknown {
+				mark = "✗"
+				passed = false
+			}
+		}
+		name := c.Name
+		if c.Version != "" {
+			name += " " + c.Version
+		}
+		detail := strings.Join(c.Licenses, ", ")
+		if c.Error != "" {
+			detail = firstLines(c.Error, 1)
+		} else if detail == "" {
+			detail = "no license information"
+		}
+		fmt.Fprintf(&report, "%s %s %s: %s (%s)\n", mark, c.Type, name, detail, c.Status)
+		for _, v := range c.Violations {
+			fmt.Fprintf(&report, "    %d packages under %s (%s)\n", v.Packages, v.License, v.Status)
+		}
+	}
+	fmt.Fprintf(&report, "%d components: %d allowed, %d denied, %d not allowed, %d unknown, %d errors\n",
+		len(components), counts["allowed"], counts["denied"], counts["not-allowed"], counts["unknown"], counts["error"])
+	return map[string]interface{}{
+		"success":    true,
+		"passed":     passed,
+		"components": components,
+		"summary":    counts,
+		"report":     report.String(),
+	}
+}
+
+func sortedIntKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// imageLicenses reads an image's license label and SBOM attestations from
+// its registry.
+func imageLicenses(client *registryClient, use imageUse, platform string) licenseComponent {
+	c := licenseComponent{Type: "image", Name: use.Image, Resources: use.Resources}
+	ref, err := parseImageRef(use.Image)
+	if err != nil {
+		c.Status, c.Error = "error", err.Error()
+		return c
+	}
+	manifest, digest, index, err := client.platformManifest(ref, platform)
+	if err != nil {
+		c.Status, c.Error = "error", err.Error()
+		return c
+	}
+	c.Version = digest
+	config, err := client.imageConfig(ref, manifest)
+	if err != nil {
+		c.Status, c.Error = "error", err.Error()
+		return c
+	}
+	if license := imageLabels(config)["org.opencontainers.image.licenses"]; license != "" {
+		c.Licenses, c.Source = []string{license}, "label"
+	}
+	attestations, err := client.imageAttestations(ref, index, digest)
+	if err != nil {
+		c.Status, c.Error = "error", "reading attestations: "+err.Error()
+		return c
+	}
+	for predicate, data := range attestations {
+		packages := sbomPackageLicenses(predicate, data)
+		if packages == nil {
+			continue
+		}
+		c.Packages = packages
+		if c.Source == "" {
+			c.Source = "sbom"
+		}
+	}
+	return c
+}
+
+// sbomPackageLicenses counts the packages of an in-toto SBOM statement by
+// declared license, or returns nil for other predicates.
+func sbomPackageLicenses(predicateType string, statement []byte) map[string]int {
+	var doc struct {
+		Predicate struct {
+			// SPDX
+			Packages []struct {
+				LicenseDeclared  string `json:"licenseDeclared"`
+				LicenseConcluded string `json:"licenseConcluded"`
+			} `json:"packages"`
+			// CycloneDX
+			Components []struct {
+				Licenses []struct {
+					Expression string `json:"expression"`
+					License    struct {
+						ID   string `json:"id"`
+						Name string `json:"name"`
+					} `json:"license"`
+				} `json:"licenses"`
+			} `json:"components"`
+		} `json:"predicate"`
+	}
+	if json.Unmarshal(statement, &doc) != nil {
+		return nil
+	}
+	counts := map[string]int{}
+	add := func(license string) {
+		if license == "" || license == "NOASSERTION" || license == "NONE" {
+			license = "unknown"
+		}
+		counts[license]++
+	}
+	switch {
+	case strings.HasPrefix(predicateType, "https://spdx.dev/Document"):
+		for _, p := range doc.Predicate.Packages {
+			license := p.LicenseConcluded
+			if license == "" || license == "NOASSERTION" {
+				license = p.LicenseDeclared
+			}
+			add(license)
+		}
+	case strings.HasPrefix(predicateType, "https://cyclonedx.org/bom"):
+		for _, comp := range doc.Predicate.Components {
+			var ids []string
+			for _, l := range comp.Licenses {
+				ids = append(ids, firstNonEmpty(l.Expression, l.License.ID, l.License.Name))
+			}
+			add(strings.Join(ids, " AND "))
+		}
+	default:
+		return nil
+	}
+	// Unknown package licenses are reported but do not fail the policy.
+	delete(counts, "unknown")
+	return counts
+}
+
+// licensePolicyStatus checks SPDX expressions against the policy. Each
+// expression is read as alternatives joined by OR, each a set of licenses
+// joined by AND (parentheses are ignored, "WITH" exceptions dropped); an
+// expression passes when one alternative has only acceptable licenses.
+func licensePolicyStatus(licenses, allow, deny []string) string {
+	if len(licenses) == 0 {
+		return "unknown"
+	}
+	status := "allowed"
+	rank := map[string]int{"allowed": 0, "not-allowed": 1, "denied": 2}
+	for _, expr := range licenses {
+		best := "denied"
+		expr = strings.NewReplacer("(", " ", ")", " ").Replace(expr)
+		for _, alt := range splitLicenseOperator(expr, "OR") {
+			altStatus := "allowed"
+			for _, id := range splitLicenseOperator(alt, "AND") {
+				id, _, _ = strings.Cut(strings.TrimSpace(id), " WITH ")
+				switch {
+				case licenseMatches(id, deny):
+					altStatus = "denied"
+				case len(allow) > 0 && !licenseMatches(id, allow) && altStatus == "allowed":
+					altStatus = "not-allowed"
+				}
+			}
+			if rank[altStatus] < rank[best] {
+				best = altStatus
+			}
+		}
+		if rank[best] > rank[status] {
+			status = best
+		}
+	}
+	return status
+}
+
+var licenseOperators = map[string]*regexp.Regexp{
+	"OR":  regexp.MustCompile(`(?i)\s+OR\s+`),
+	"AND": regexp.MustCompile(`(?i)\s+AND\s+`),
+}
+
+func splitLicenseOperator(expr, op string) []string {
+	return licenseOperators[op].Split(strings.TrimSpace(expr), -1)
+}
+
+func licenseMatches(id string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(strings.ToLower(id), strings.ToLower(strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+		if strings.EqualFold(id, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// chartLicenses reads the licenses of a chart directory or archive and of
+// the subcharts it bundles in charts/. Dependencies of a directory that are
+// not bundled are pulled into the chart cache when Chart.lock pins them.
+func chartLicenses(ctx context.Context, chart string) ([]licenseComponent, error) {
+	info, err := os.Stat(chart)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{}
+	if info.IsDir() {
+		root := filepath.Base(filepath.Clean(chart))
+		err = filepath.Walk(chart, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(chart, p)
+			if err != nil {
+				return err
+			}
+			rel = path.Join(root, filepath.ToSlash(rel))
+			if licenseScanFile(rel) {
+				data, err := os.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				files[rel] = data
+			}
+			return nil
+		})
+	} else {
+		var data []byte
+		if data, err = os.ReadFile(chart); err == nil {
+			files, err = chartArchiveFiles(data)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	components := chartComponents(files)
+	if !info.IsDir() {
+		return components, nil
+	}
+
+	bundled := map[string]bool{}
+	for _, c := range components {
+		bundled[c.Name] = true
+	}
+	deps, _ := readChartDependencies(filepath.Join(chart, "Chart.lock"))
+	for _, d := range deps {
+		if bundled[d.Name] || d.Repository == "" || strings.HasPrefix(d.Repository, "file://") {
+			continue
+		}
+		c := licenseComponent{Type: "chart", Name: d.Name, Version: d.Version}
+		ref := strings.TrimSuffix(d.Repository, "/") + "/" + d.Name
+		if strings.HasPrefix(d.Repository, "@") || strings.HasPrefix(d.Repository, "alias:") {
+			ref = strings.TrimPrefix(strings.TrimPrefix(d.Repository, "@"), "alias:") + "/" + d.Name
+		}
+		archive, _, err := cachedChart(ctx, ref, []string{"--version", d.Version})
+		if err == nil && archive == "" {
+			err = fmt.Errorf("not bundled; run helm dependency build")
+		}
+		var data []byte
+		if err == nil {
+			data, err = os.ReadFile(archive)
+		}
+		var pulled map[string][]byte
+		if err == nil {
+			pulled, err = chartArchiveFiles(data)
+		}
+		if err != nil {
+			c.Status, c.Error = "error", err.Error()
+			components = append(components, c)
+			continue
+		}
+		components = append(components, chartComponents(pulled)...)
+	}
+	return components, nil
+}
+
+// licenseScanFile tells which chart files license scanning reads.
+func licenseScanFile(name string) bool {
+	base := strings.ToUpper(path.Base(name))
+	return path.Base(name) == "Chart.yaml" || strings.HasPrefix(base, "LICENSE") || strings.HasPrefix(base, "LICENCE") ||
+		strings.HasPrefix(base, "COPYING") || (strings.HasSuffix(name, ".tgz") && path.Base(path.Dir(name)) == "charts")
+}
+
+// chartArchiveFiles reads the files license scanning needs from a chart
+// archive.
+func chartArchiveFiles(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !licenseScanFile(hdr.Name) {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, 64<<20))
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(hdr.Name)] = data
+	}
+}
+
+// chartComponents turns the files of a chart tree into one component per
+// Chart.yaml, descending into bundled subchart archives.
+func chartComponents(files map[string][]byte) []licenseComponent {
+	var components []licenseComponent
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasSuffix(name, ".tgz") {
+			nested, err := chartArchiveFiles(files[name])
+			if err != nil {
+				components = append(components, licenseComponent{Type: "chart", Name: name, Status: "error", Error: err.Error()})
+				continue
+			}
+			components = append(components, chartComponents(nested)...)
+			continue
+		}
+		if path.Base(name) != "Chart.yaml" {
+			continue
+		}
+		root := path.Dir(name)
+		doc, err := decodeYAML(string(files[name]))
+		if err != nil {
+			components = append(components, licenseComponent{Type: "chart", Name: root, Status: "error", Error: err.Error()})
+			continue
+		}
+		meta := asObject(doc)
+		c := licenseComponent{Type: "chart", Name: nestedString(meta, "name"), Version: fmt.Sprint(meta["version"])}
+		annotations := nestedMap(meta, "annotations")
+		for _, key := range []string{"licenses", "artifacthub.io/license"} {
+			if s, ok := annotations[key].(string); ok && strings.TrimSpace(s) != "" {
+				for _, l := range strings.Split(s, ",") {
+					c.Licenses = append(c.Licenses, strings.TrimSpace(l))
+				}
+				c.Source = "chart-annotation"
+				break
+			}
+		}
+		if c.Source == "" {
+			for _, other := range names {
+				if path.Dir(other) != root || other == name || strings.HasSuffix(other, ".tgz") {
+					continue
+				}
+				if id := detectLicense(files[other]); id != "" {
+					c.Licenses, c.Source = []string{id}, "license-file"
+					break
+				}
+			}
+		}
+		components = append(components, c)
+	}
+	return components
+}
+
+// licenseTexts identify common licenses from the text of a LICENSE file,
+// most specific first.
+var licenseTexts = []struct {
+	id      string
+	pattern *regexp.Regexp
+}{
+	{"AGPL-3.0", regexp.MustCompile(`(?i)GNU AFFERO GENERAL PUBLIC LICENSE\s+Version 3`)},
+	{"LGPL-3.0", regexp.MustCompile(`(?i)GNU LESSER GENERAL PUBLIC LICENSE\s+Version 3`)},
+	{"LGPL-2.1", regexp.MustCompile(`(?i)GNU LESSER GENERAL PUBLIC LICENSE\s+Version 2\.1`)},
+	{"GPL-3.0", regexp.MustCompile(`(?i)GNU GENERAL PUBLIC LICENSE\s+Version 3`)},
+	{"GPL-2.0", regexp.MustCompile(`(?i)GNU GENERAL PUBLIC LICENSE\s+Version 2`)},
+	{"SSPL-1.0", regexp.MustCompile(`(?i)Server Side Public License`)},
+	{"BUSL-1.1", regexp.MustCompile(`(?i)Business Source License 1\.1`)},
+	{"MPL-2.0", regexp.MustCompile(`(?i)Mozilla Public License,?\s+(Version|v\.)\s*2\.0`)},
+	{"Apache-2.0", regexp.MustCompile(`(?i)Apache License,?\s+Version 2\.0`)},
+	{"BSD-3-Clause", regexp.MustCompile(`(?is)Redistribution and use in source and binary forms.*Neither the name`)},
+	{"BSD-2-Clause", regexp.MustCompile(`(?i)Redistribution and use in source and binary forms`)},
+	{"ISC", regexp.MustCompile(`(?i)Permission to use, copy, modify, and(/or)? distribute this software for any purpose`)},
+	{"MIT", regexp.MustCompile(`(?i)Permission is hereby granted, free of charge`)},
+}
+
+func detectLicense(text []byte) string {
+	for _, l := range licenseTexts {
+		if l.pattern.Match(text) {
+			return l.id
+		}
+	}
+	return ""
+}
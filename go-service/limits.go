@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultMaxInputBytes    = 64 << 20
+	defaultMaxManifestBytes = 64 << 20
+)
+
+// maxInputBytes bounds the JSON request read from stdin. Larger manifests
+// belong in a file passed as input["manifestFile"].
+func maxInputBytes() int64 {
+	return byteLimit("INFRAKIT_MAX_INPUT_BYTES", defaultMaxInputBytes)
+}
+
+// maxManifestBytes bounds manifests read from input["manifestFile"] into
+// memory, and each document of the manifest files validate-k8s dry-runs,
+// which are otherwise only streamed.
+func maxManifestBytes() int64 {
+	return byteLimit("INFRAKIT_MAX_MANIFEST_BYTES", defaultMaxManifestBytes)
+}
+
+func byteLimit(env string, def int64) int64 {
+	if n, err := strconv.ParseInt(os.Getenv(env), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// readInput decodes the JSON request from r, failing with a clear error
+// instead of buffering without bound when the request is too large.
+func readInput(r io.Reader) (map[string]interface{}, error) {
+	limit := maxInputBytes()
+	cr := &countingReader{r: io.LimitReader(r, limit+1)}
+	var input map[string]interface{}
+	if err := json.NewDecoder(cr).Decode(&input); err != nil {
+		if cr.n > limit {
+			return nil, fmt.Errorf("request exceeds %d bytes (INFRAKIT_MAX_INPUT_BYTES); pass large manifests as 'manifestFile'", limit)
+		}
+		return nil, err
+	}
+	return input, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readManifestFile reads a manifest referenced by path, refusing files over
+// the manifest size limit before reading them.
+func readManifestFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	limit := maxManifestBytes()
+	if info.Size() > limit {
+		return "", fmt.Errorf("manifest file %s is %d bytes, over the %d byte limit (INFRAKIT_MAX_MANIFEST_BYTES)", path, info.Size(), limit)
+	}
+	// The size is checked again while reading, in case the file grows.
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > limit {
+		return "", fmt.Errorf("manifest file %s exceeds the %d byte limit (INFRAKIT_MAX_MANIFEST_BYTES)", path, limit)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// lintRequest is the request body for lint-k8s. The manifest comes from
+// the usual manifest, manifestFile or name/chart keys.
+type lintRequest struct {
+	// KubernetesVersion is the version deprecated-api checks against, e.g.
+	// "v1.29"; without it every deprecated or removed API is reported as a
+	// warning.
+	KubernetesVersion string `json:"kubernetesVersion"`
+	// Enable runs only the listed checks; Disable leaves checks out.
+	Enable  []string `json:"enable"`
+	Disable []string `json:"disable"`
+	// RequiredLabels are the labels missing-labels expects on every
+	// resource (default: app.kubernetes.io/name).
+	RequiredLabels []string `json:"requiredLabels"`
+	// FailOn is the lowest severity that fails the lint: "error" (default),
+	// "warning" or "info".
+	FailOn string `json:"failOn"`
+}
+
+// lintFinding is one problem a check found. Path is a JSONPath into the
+// resource, e.g. $.spec.template.spec.containers[0].readinessProbe.
+type lintFinding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Resource string `json:"resource"`
+	Document int    `json:"document"`
+	Path     string `json:"path"`
+}
+
+// lintRun is what one lint applies its checks with.
+type lintRun struct {
+	target         semver
+	hasTarget      bool
+	requiredLabels []string
+}
+
+// lintCheck is a built-in check: it returns the findings for one object,
+// without Check, Resource and Document, which the caller fills in.
+type lintCheck struct {
+	ID  string
+	run func(r *lintRun, obj map[string]interface{}) []lintFinding
+}
+
+// lintChecks are the checks lint-k8s runs, in report order: containers of
+// long-running workloads without probes, APIs deprecated or removed in the
+// target version, resources without the required labels, pods mounting
+// hostPath volumes and resources placed in the default namespace.
+var lintChecks = []lintCheck{
+	{"missing-probes", lintMissingProbes},
+	{"deprecated-api", lintDeprecatedAPI},
+	{"missing-labels", lintMissingLabels},
+	{"host-path", lintHostPath},
+	{"default-namespace", lintDefaultNamespace},
+}
+
+// deprecatedAPI is a built-in API Kubernetes deprecated and removed; an
+// empty Kind covers every kind of the group version.
+type deprecatedAPI struct {
+	APIVersion, Kind        string
+	DeprecatedIn, RemovedIn string
+	Replacement             string
+}
+
+// deprecatedAPIs are the deprecated APIs, the kinds of a group version
+// ahead of the whole group version.
+var deprecatedAPIs = []deprecatedAPI{
+	{"extensions/v1beta1", "Deployment", "1.8", "1.16", "apps/v1"},
+	{"extensions/v1beta1", "DaemonSet", "1.8", "1.16", "apps/v1"},
+	{"extensions/v1beta1", "ReplicaSet", "1.8", "1.16", "apps/v1"},
+	{"extensions/v1beta1", "NetworkPolicy", "1.9", "1.16", "networking.k8s.io/v1"},
+	{"extensions/v1beta1", "PodSecurityPolicy", "1.10", "1.16", "policy/v1beta1"},
+	{"extensions/v1beta1", "Ingress", "1.14", "1.22", "networking.k8s.io/v1"},
+	{"apps/v1beta1", "", "1.9", "1.16", "apps/v1"},
+	{"apps/v1beta2", "", "1.9", "1.16", "apps/v1"},
+	{"networking.k8s.io/v1beta1", "", "1.19", "1.22", "networking.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", "", "1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+	{"apiextensions.k8s.io/v1beta1", "", "1.16", "1.22", "apiextensions.k8s.io/v1"},
+	{"admissionregistration.k8s.io/v1beta1", "", "1.16", "1.22", "admissionregistration.k8s.io/v1"},
+	{"scheduling.k8s.io/v1beta1", "", "1.14", "1.22", "scheduling.k8s.io/v1"},
+	{"certificates.k8s.io/v1beta1", "", "1.19", "1.22", "certificates.k8s.io/v1"},
+	{"coordination.k8s.io/v1beta1", "", "1.19", "1.22", "coordination.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", "CSIStorageCapacity", "1.24", "1.27", "storage.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", "", "1.19", "1.22", "storage.k8s.io/v1"},
+	{"batch/v1beta1", "CronJob", "1.21", "1.25", "batch/v1"},
+	{"policy/v1beta1", "PodDisruptionBudget", "1.21", "1.25", "policy/v1"},
+	{"policy/v1beta1", "PodSecurityPolicy", "1.21", "1.25", ""},
+	{"discovery.k8s.io/v1beta1", "", "1.21", "1.25", "discovery.k8s.io/v1"},
+	{"events.k8s.io/v1beta1", "", "1.19", "1.25", "events.k8s.io/v1"},
+	{"node.k8s.io/v1beta1", "", "1.20", "1.25", "node.k8s.io/v1"},
+	{"autoscaling/v2beta1", "", "1.22", "1.25", "autoscaling/v2"},
+	{"autoscaling/v2beta2", "", "1.23", "1.26", "autoscaling/v2"},
+	{"flowcontrol.apiserver.k8s.io/v1beta1", "", "1.23", "1.26", "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta2", "", "1.26", "1.29", "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta3", "", "1.29", "1.32", "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+// lintK8s runs the built-in best-practice checks on a rendered manifest and
+// lists the findings with their severity, resource and JSONPath. It passes
+// when no finding reaches input["failOn"].
+func lintK8s(input map[string]interface{}) map[string]interface{} {
+	var req lintRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	failOn := firstNonEmpty(req.FailOn, "error")
+	if policySeverityRank[failOn] == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'failOn' must be error, warning or info",
+		}
+	}
+	run := &lintRun{requiredLabels: req.RequiredLabels}
+	if len(run.requiredLabels) == 0 {
+		run.requiredLabels = []string{"app.kubernetes.io/name"}
+	}
+	if req.KubernetesVersion != "" {
+		if run.target, run.hasTarget = parseSemver(req.KubernetesVersion); !run.hasTarget {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Invalid kubernetesVersion " + req.KubernetesVersion,
+			}
+		}
+	}
+	checks, err := selectLintChecks(req.Enable, req.Disable)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	findings := []lintFinding{}
+	summary := map[string]int{"error": 0, "warning": 0, "info": 0}
+	failing := 0
+	var report strings.Builder
+	for i, obj := range objects {
+		resource := refOf(obj).String()
+		for _, c := range checks {
+			for _, f := range c.run(run, obj) {
+				f.Check, f.Resource, f.Document = c.ID, resource, i+1
+				findings = append(findings, f)
+				summary[f.Severity]++
+				if policySeverityRank[f.Severity] >= policySeverityRank[failOn] {
+					failing++
+				}
+				fmt.Fprintf(&report, "%s %s %s (%s): %s\n", strings.ToUpper(f.Severity), resource, f.Check, f.Path, f.Message)
+			}
+		}
+	}
+	ids := make([]string, len(checks))
+	for i, c := range checks {
+		ids[i] = c.ID
+	}
+	fmt.Fprintf(&report, "%d resources linted, %d errors, %d warnings, %d info\n", len(objects), summary["error"], summary["warning"], summary["info"])
+	return map[string]interface{}{
+		"success":  true,
+		"passed":   failing == 0,
+		"findings": findings,
+		"summary":  summary,
+		"checks":   ids,
+		"report":   report.String(),
+	}
+}
+
+// selectLintChecks returns the checks to run: those enabled (all by
+// default) minus those disabled.
+func selectLintChecks(enable, disable []string) ([]lintCheck, error) {
+	known := map[string]bool{}
+	for _, c := range lintChecks {
+		known[c.ID] = true
+	}
+	for _, id := range append(append([]string{}, enable...), disable...) {
+		if !known[id] {
+			return nil, fmt.Errorf("Unknown check %q; checks are %s", id, strings.Join(sortedSet(known), ", "))
+		}
+	}
+	enabled := map[string]bool{}
+	for _, id := range enable {
+		enabled[id] = true
+	}
+	disabled := map[string]bool{}
+	for _, id := range disable {
+		disabled[id] = true
+	}
+	var checks []lintCheck
+	for _, c := range lintChecks {
+		if (len(enable) == 0 || enabled[c.ID]) && !disabled[c.ID] {
+			checks = append(checks, c)
+		}
+	}
+	return checks, nil
+}
+
+// lintPodSpec returns the pod spec of a pod or workload and its JSONPath, or
+// nil.
+func lintPodSpec(obj map[string]interface{}) (map[string]interface{}, string) {
+	switch nestedString(obj, "kind") {
+	case "Pod":
+		return nestedMap(obj, "spec"), "$.spec"
+	case "CronJob":
+		return nestedMap(obj, "spec", "jobTemplate", "spec", "template", "spec"), "$.spec.jobTemplate.spec.template.spec"
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job", "Rollout":
+		return nestedMap(obj, "spec", "template", "spec"), "$.spec.template.spec"
+	}
+	return nil, ""
+}
+
+func lintMissingProbes(r *lintRun, obj map[string]interface{}) []lintFinding {
+	// Jobs run to completion; probes do not apply.
+	if kind := nestedString(obj, "kind"); kind == "Job" || kind == "CronJob" {
+		return nil
+	}
+	spec, path := lintPodSpec(obj)
+	if spec == nil {
+		return nil
+	}
+	var findings []lintFinding
+	for i, c := range nestedSlice(spec, "containers") {
+		container := asObject(c)
+		for _, probe := range []string{"readinessProbe", "livenessProbe"} {
+			if container[probe] == nil {
+				findings = append(findings, lintFinding{
+					Severity: "warning",
+					Message:  fmt.Sprintf("container %s has no %s", nestedString(container, "name"), probe),
+					Path:     fmt.Sprintf("%s.containers[%d].%s", path, i, probe),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// deprecationOf returns the deprecated API apiVersion and kind are served
+// by, if any.
+func deprecationOf(apiVersion, kind string) (deprecatedAPI, bool) {
+	for _, d := range deprecatedAPIs {
+		if d.APIVersion == apiVersion && (d.Kind == "" || d.Kind == kind) {
+			return d, true
+		}
+	}
+	return deprecatedAPI{}, false
+}
+
+// status is "removed" or "deprecated" for an API on target, or "" while
+// it is neither yet.
+func (d deprecatedAPI) status(target semver) string {
+	removed, _ := parseSemver(d.RemovedIn)
+	deprecated, _ := parseSemver(d.DeprecatedIn)
+	switch {
+	case compareSemver(target, removed) >= 0:
+		return "removed"
+	case compareSemver(target, deprecated) >= 0:
+		return "deprecated"
+	}
+	return ""
+}
+
+func lintDeprecatedAPI(r *lintRun, obj map[string]interface{}) []lintFinding {
+	apiVersion, kind := nestedString(obj, "apiVersion"), nestedString(obj, "kind")
+	d, ok := deprecationOf(apiVersion, kind)
+	if !ok {
+		return nil
+	}
+	instead := "; it has no replacement"
+	if d.Replacement != "" {
+		instead = "; use " + d.Replacement
+	}
+	f := lintFinding{Severity: "warning", Path: "$.apiVersion"}
+	status := "deprecated"
+	if r.hasTarget {
+		status = d.status(r.target)
+	}
+	switch status {
+	case "removed":
+		f.Severity = "error"
+		f.Message = fmt.Sprintf("%s %s was removed in %s%s", apiVersion, kind, d.RemovedIn, instead)
+	case "deprecated":
+		f.Message = fmt.Sprintf("%s %s is deprecated since %s and removed in %s%s", apiVersion, kind, d.DeprecatedIn, d.RemovedIn, instead)
+	default:
+		return nil
+	}
+	return []lintFinding{f}
+}
+
+func lintMissingLabels(r *lintRun, obj map[string]interface{}) []lintFinding {
+	labels := nestedMap(obj, "metadata", "labels")
+	var missing []string
+	for _, l := range r.requiredLabels {
+		if _, ok := labels[l]; !ok {
+			missing = append(missing, l)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return []lintFinding{{
+		Severity: "warning",
+		Message:  "missing labels " + strings.Join(missing, ", "),
+		Path:     "$.metadata.labels",
+	}}
+}
+
+func lintHostPath(r *lintRun, obj map[string]interface{}) []lintFinding {
+	spec, path := lintPodSpec(obj)
+	if spec == nil {
+		return nil
+	}
+	var findings []lintFinding
+	for i, v := range nestedSlice(spec, "volumes") {
+		volume := asObject(v)
+		if volume["hostPath"] == nil {
+			continue
+		}
+		findings = append(findings, lintFinding{
+			Severity: "error",
+			Message:  fmt.Sprintf("volume %s mounts host path %s", nestedString(volume, "name"), nestedString(volume, "hostPath", "path")),
+			Path:     fmt.Sprintf("%s.volumes[%d].hostPath", path, i),
+		})
+	}
+	return findings
+}
+
+func lintDefaultNamespace(r *lintRun, obj map[string]interface{}) []lintFinding {
+	if nestedString(obj, "metadata", "namespace") != "default" {
+		return nil
+	}
+	return []lintFinding{{
+		Severity: "warning",
+		Message:  "resource is placed in the default namespace",
+		Path:     "$.metadata.namespace",
+	}}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Logs go to stderr, configured by the --log-level and --log-format flags
+// or, failing those:
+//
+//	INFRAKIT_LOG_LEVEL   debug, info (default), warn or error; debug logs
+//	                     every helm, kubectl and tool process
+//	INFRAKIT_LOG_FORMAT  text (default) or json
+//
+// Records of a request carry its requestId, which serve also returns in
+// the X-Request-ID header and the result.
+
+// requestIDPattern is what a caller's X-Request-ID may be to be kept.
+var requestIDPattern = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// setupLogging installs the default logger for level and format, each
+// falling back to its environment variable.
+func setupLogging(level, format string) error {
+	var l slog.Level
+	switch strings.ToLower(firstNonEmpty(level, os.Getenv("INFRAKIT_LOG_LEVEL"), "info")) {
+	case "debug":
+		l = slog.LevelDebug
+	case "info":
+		l = slog.LevelInfo
+	case "warn", "warning":
+		l = slog.LevelWarn
+	case "error":
+		l = slog.LevelError
+	default:
+		return fmt.Errorf("Invalid log level %q: use debug, info, warn or error", firstNonEmpty(level, os.Getenv("INFRAKIT_LOG_LEVEL")))
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler
+	switch f := strings.ToLower(firstNonEmpty(format, os.Getenv("INFRAKIT_LOG_FORMAT"), "text")); f {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("Invalid log format %q: use text or json", f)
+	}
+	// What still logs through the log package, net/http's errors among
+	// it, goes through the same handler.
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withRequestID returns ctx carrying a request ID: id when it is usable,
+// else a new one.
+func withRequestID(ctx context.Context, id string) (context.Context, string) {
+	if !requestIDPattern.MatchString(id) {
+		id = newRequestID()
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// requestID returns the ID of the request ctx belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the default logger, with the request's ID when ctx
+// has one.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return slog.Default().With("requestId", id)
+	}
+	return slog.Default()
+}
+
+// fatal logs err and exits, for what stops the process before any request
+// is read.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,39 +1,248 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	if err := setupLogging("", ""); err != nil {
+		slog.Warn(err.Error() + "; using the defaults")
+	}
 	if len(os.Args) < 2 {
-		log.Fatal("Command required: generate-helm or validate-k8s")
+		fatal("Command required: " + commandList() + "; run with help for details")
 	}
 
 	cmd := os.Args[1]
+	program := filepath.Base(os.Args[0])
+	switch cmd {
+	case "help", "--help", "-h":
+		topic := ""
+		if len(os.Args) > 2 {
+			topic = os.Args[2]
+		}
+		if err := printUsage(os.Stdout, program, topic); err != nil {
+			fatal(err.Error())
+		}
+		return
+	case "completion":
+		if len(os.Args) < 3 {
+			fatal("Shell required: bash, zsh or fish")
+		}
+		if err := printCompletion(os.Stdout, program, os.Args[2]); err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
+	// Arguments after the command replace the JSON request on stdin, for
+	// runs by hand and from git hooks; in GitHub Actions the command and
+	// request come from the step inputs.
+	actionMode := cmd == "action"
+	cliMode := len(os.Args) > 2 || actionMode
 	var input map[string]interface{}
+	var err error
+	if actionMode {
+		cmd, input, err = actionInput(os.Environ())
+	} else if cliMode {
+		input, err = argsInput(os.Args[2:])
+	} else {
+		input, err = readInput(os.Stdin)
+	}
+	// A request that cannot be read is answered like any failed one.
+	if err != nil {
+		outputOptions{CLI: cliMode}.write(map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		})
+		os.Exit(1)
+	}
+	logLevel, _ := input["logLevel"].(string)
+	logFormat, _ := input["logFormat"].(string)
+	// Without flags, logging is already set up from the environment.
+	if logLevel != "" || logFormat != "" {
+		if err := setupLogging(logLevel, logFormat); err != nil {
+			outputOptions{CLI: cliMode}.write(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			os.Exit(1)
+		}
+	}
+	// Requests on stdin are answered with one compact JSON line.
+	out := outputOptions{CLI: cliMode}
+	if c, ok := lookupCommand(cmd); ok && cliMode {
+		if input["help"] == true {
+			printUsage(os.Stdout, program, cmd)
+			return
+		}
+		if out, err = takeOutputOptions(c, input); err != nil {
+			out.write(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			os.Exit(1)
+		}
+		renameFlagKeys(c, input)
+	}
+	// Recorded before cluster access rewrites it, so replay sees the
+	// request as it was sent.
+	request := deepCopyObject(input)
+	stopProfiling := startProfiling()
+	defer stopProfiling()
+	// Failures before the command runs; from the command line they exit 1.
+	fail := func(result map[string]interface{}) {
+		out.write(result)
+		if cliMode {
+			stopProfiling()
+			closeWorkspace()
+			os.Exit(1)
+		}
+	}
 
-	if err := json.NewDecoder(os.Stdin).Decode(&input); err != nil {
-		log.Fatal(err)
+	if input["debug"] == true {
+		enableDebug()
+	}
+	if err := configureTools(input); err != nil {
+		fail(map[string]interface{}{
+			"success": false,
+			"error":   "Invalid tools config: " + err.Error(),
+		})
+		return
+	}
+	// install-tools reports its own downloads.
+	if cmd != "install-tools" {
+		if err := ensureTools(); err != nil {
+			fail(map[string]interface{}{
+				"success": false,
+				"error":   "Failed to install pinned tools: " + err.Error(),
+			})
+			return
+		}
+		if err := checkToolVersions(); err != nil {
+			fail(map[string]interface{}{
+				"success": false,
+				"error":   "Unsupported tool version: " + err.Error(),
+			})
+			return
+		}
 	}
 
-	switch cmd {
-	case "generate-helm":
-		result := generateHelm(input)
-		fmt.Println(toJSON(result))
-	case "validate-k8s":
-		result := validateK8s(input)
-		fmt.Println(toJSON(result))
-	default:
-		log.Fatal("Unknown command")
+	if rejected := precheckEnvelope(cmd, input); rejected != nil {
+		fail(rejected)
+		return
+	}
+	ctx, _ := withRequestID(context.Background(), "")
+	// Inline kubeconfigs and tunnels live for the duration of the command;
+	// every kubectl call then goes through them.
+	cleanup, err := prepareClusterAccess(ctx, input)
+	if err != nil {
+		fail(failureResult(cmd, input, err))
+		return
+	}
+	defer cleanup()
+	defer closeWorkspace()
+	op := startOperation(ctx, cmd, request, input)
+	// Temp files can hold credentials; remove them when the run is stopped
+	// too. Runs killed outright are swept by the next run. serve instead
+	// shuts down gracefully, letting requests in flight finish.
+	if cmd != "serve" {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			op.finish(map[string]interface{}{"success": false, "error": "interrupted by " + sig.String()})
+			cleanup()
+			closeWorkspace()
+			os.Exit(1)
+		}()
+	}
+
+	result, ok := dispatch(ctx, cmd, input)
+	if !ok {
+		result = map[string]interface{}{
+			"success": false,
+			"error":   "Unknown command " + cmd + ": use " + commandList(),
+		}
+		op.finish(result)
+		out.write(result)
+		cleanup()
+		closeWorkspace()
+		os.Exit(1)
+	}
+	requestLogger(ctx).Debug("command finished", "command", cmd, "success", result["success"] == true, "durationMs", time.Since(op.started).Milliseconds())
+	if input["debug"] == true {
+		result["debug"] = map[string]interface{}{"invocations": debugInvocations()}
+	}
+	op.finish(result)
+	if actionMode {
+		if err := writeActionResult(os.Stdout, cmd, result); err != nil {
+			slog.Error("Failed to write action outputs", "error", err)
+		}
+	} else {
+		result = out.fit(result)
+		out.write(result)
+	}
+	// From the command line the exit status is the result, as hooks,
+	// scripts and CI steps expect; failed checks count as failure.
+	if cliMode && (result["success"] != true || result["passed"] == false) {
+		stopProfiling()
+		cleanup()
+		closeWorkspace()
+		os.Exit(1)
 	}
 }
 
-// generateHelm runs `helm template` to render a chart as Kubernetes manifests.
-// Expects input["name"] (release name) and input["chart"] (chart path or name).
+// dispatch runs command with input, within its per-command concurrency
+// limit, checking and answering versioned requests in their envelope. It
+// reports false for an unknown command.
+func dispatch(parent context.Context, cmd string, input map[string]interface{}) (map[string]interface{}, bool) {
+	c, ok := lookupCommand(cmd)
+	if !ok {
+		return nil, false
+	}
+	versioned, failure := openEnvelope(c, input)
+	if failure != nil {
+		return sealEnvelope(cmd, nil, failure), true
+	}
+	timeout, cancel, err := withRequestContext(parent, input)
+	if err != nil {
+		result := map[string]interface{}{"success": false, "error": err.Error()}
+		if versioned {
+			result = sealEnvelope(cmd, result, nil)
+		}
+		return result, true
+	}
+	defer cancel()
+	defer acquireCommand(cmd)()
+	result := c.Run(input)
+	if requestContext(input).Err() == context.DeadlineExceeded {
+		result = timedOut(cmd, timeout, result)
+	}
+	if versioned {
+		result = sealEnvelope(cmd, result, nil)
+	}
+	return result, true
+}
+
+// generateHelm renders a chart as Kubernetes manifests with the Helm SDK.
+// Expects input["name"] (release name) and input["chart"] (chart path or name),
+// with optional input["valuesFiles"], input["values"] and input["set"], and
+// for remote charts input["version"], input["repoURL"] and credentials (see
+// chartSource). The manifest is returned inline unless input["outputFile"] or input["stream"]
+// is set. input["transforms"] post-renders it (see transform), reporting the
+// "changes" made. With input["cache"], identical renders are served from the
+// render cache, "cache" telling whether this one was.
 func generateHelm(input map[string]interface{}) map[string]interface{} {
 	name, nameOk := input["name"].(string)
 	chart, chartOk := input["chart"].(string)
@@ -43,25 +252,425 @@ func generateHelm(input map[string]interface{}) map[string]interface{} {
 			"error":   "Both 'name' and 'chart' must be provided",
 		}
 	}
+	var req helmChartInput
+	var post transformRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := decodeInput(input, &post); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := checkTransforms(post.Transforms); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	var cache renderCacheInput
+	if err := decodeInput(input, &cache); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := cache.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	chart, args, err := req.chartSource.resolve(requestContext(input), chart)
+	if err != nil {
+		result := map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+		var lerr *chartLockError
+		if errors.As(err, &lerr) {
+			result["lockMismatches"] = lerr.Mismatches
+		}
+		return result
+	}
+	valueArgs, cleanup, err := req.helmValues.renderArgs(requestContext(input), chart, args)
+	if err != nil {
+		return renderFailure(err)
+	}
+	defer cleanup()
+	args = append(args, valueArgs...)
+
+	render := func(w io.Writer) (int64, error) {
+		return streamChart(requestContext(input), w, name, chart, args...)
+	}
+	var cacheStatus string
+	if cache.Cache != "" {
+		render = cachedRender(cache.Cache, renderCacheKey(req, chart), render, &cacheStatus)
+	}
+	changes := []transformChange{}
+	if len(post.Transforms) > 0 {
+		render = transformedRender(render, post.Transforms, &changes)
+	}
+	result := renderResult(input, render)
+	if result["success"] == true && len(post.Transforms) > 0 {
+		result["changes"] = changes
+	}
+	if cacheStatus != "" {
+		result["cache"] = cacheStatus
+	}
+	return result
+}
 
-	cmd := exec.Command("helm", "template", name, chart)
+// renderOutput are the request keys renderResult reads.
+type renderOutput struct {
+	Output     string `json:"output"`
+	OutputFile string `json:"outputFile"`
+	Stream     bool   `json:"stream"`
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
+// renderResult runs a render into the response. Large renders can bypass
+// the JSON result: input["outputFile"] writes the manifest to a file,
+// input["stream"] emits it as chunk lines first. With input["output"] set
+// to "structured", the manifest is returned as its documents instead.
+func renderResult(input map[string]interface{}, render func(io.Writer) (int64, error)) map[string]interface{} {
+	output, _ := input["output"].(string)
+	switch output {
+	case "", "manifest":
+	case "structured":
+		if input["outputFile"] != nil || input["stream"] == true {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "'output' structured returns the documents inline; it cannot be combined with 'outputFile' or 'stream'",
+			}
+		}
+	default:
 		return map[string]interface{}{
 			"success": false,
-			"error":   string(output) + "\n" + err.Error(),
+			"error":   "'output' must be manifest or structured",
+		}
+	}
+	if path, _ := input["outputFile"].(string); path != "" {
+		size, digest, err := writeManifestFile(path, render)
+		if err != nil {
+			return renderFailure(err)
+		}
+		return map[string]interface{}{
+			"success":    true,
+			"outputFile": path,
+			"bytes":      size,
+			"sha256":     digest,
+		}
+	}
+	if stream, _ := input["stream"].(bool); stream {
+		cw := &chunkWriter{out: os.Stdout}
+		size, err := render(cw)
+		if err == nil {
+			err = cw.Flush()
+		}
+		if err != nil {
+			return renderFailure(err)
+		}
+		return map[string]interface{}{
+			"success":  true,
+			"streamed": true,
+			"bytes":    size,
+		}
+	}
+
+	var b strings.Builder
+	if _, err := render(&b); err != nil {
+		return renderFailure(err)
+	}
+	if output == "structured" {
+		docs, err := manifestDocuments(b.String())
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to parse manifest: " + err.Error(),
+			}
+		}
+		return map[string]interface{}{
+			"success":   true,
+			"documents": docs,
 		}
 	}
 	return map[string]interface{}{
 		"success":  true,
-		"manifest": string(output),
+		"manifest": b.String(),
+	}
+}
+
+// renderFailure is the result of a failed render, with the positions of
+// template errors under "renderErrors" when helm reported them and the
+// values a values schema rejected under "valuesErrors".
+func renderFailure(err error) map[string]interface{} {
+	result := map[string]interface{}{
+		"success": false,
+		"error":   err.Error(),
+	}
+	var herr *helmRenderError
+	if errors.As(err, &herr) && len(herr.Errors) > 0 {
+		result["renderErrors"] = herr.Errors
+	}
+	if errs, ok := valuesErrorsOf(err); ok {
+		result["valuesErrors"] = errs
+	}
+	return result
+}
+
+// renderChart renders a chart as streamChart does and returns the
+// manifest. Extra arguments are `helm template` flags (see renderTemplate).
+// Pinned repository charts are rendered from the shared chart cache.
+func renderChart(ctx context.Context, name, chart string, args ...string) (string, error) {
+	var b strings.Builder
+	if _, err := streamChart(ctx, &b, name, chart, args...); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// helmValues are the values keys of a render request: valuesFiles are
+// passed to helm in order, then the files and values of each of layers,
+// then values (as a temporary values file), then the key=value overrides
+// of set, as with helm's own flags. With sopsDecrypt, SOPS-encrypted values
+// files are decrypted for helm. The values are checked against the chart's
+// values.schema.json and valuesSchema or valuesSchemaFile (see checkSchema)
+// unless skipSchemaValidation is set.
+type helmValues struct {
+	ValuesFiles          []string               `json:"valuesFiles"`
+	Layers               []valuesLayer          `json:"layers"`
+	Values               map[string]interface{} `json:"values"`
+	Set                  helmSetValues          `json:"set"`
+	SopsDecrypt          bool                   `json:"sopsDecrypt"`
+	ValuesSchema         map[string]interface{} `json:"valuesSchema"`
+	ValuesSchemaFile     string                 `json:"valuesSchemaFile"`
+	SkipSchemaValidation bool                   `json:"skipSchemaValidation"`
+	sopsOptions
+}
+
+// helmSetValues accepts "a=1,b=2", ["a=1", "b=2"] or {"a": 1, "b": 2}.
+type helmSetValues []string
+
+func (s *helmSetValues) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+		*s = nil
+	case string:
+		*s = helmSetValues{v}
+	case []interface{}:
+		*s = nil
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("'set' entries must be key=value strings, got %v", item)
+			}
+			*s = append(*s, str)
+		}
+	case map[string]interface{}:
+		*s = nil
+		for _, k := range sortedKeys(v) {
+			*s = append(*s, k+"="+fmt.Sprint(v[k]))
+		}
+	default:
+		return fmt.Errorf("'set' must be a string, list or object")
 	}
+	return nil
+}
+
+// args returns the helm flags for v. Values are written to temporary
+// files and decrypted values files served through pipes (see
+// servePlaintext), which cleanup removes.
+func (v helmValues) args(ctx context.Context) ([]string, func(), error) {
+	var args []string
+	var cleanups []func()
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	for _, layer := range v.layers() {
+		for _, f := range layer.ValuesFiles {
+			path, stop, err := v.valuesFile(ctx, f)
+			if err != nil {
+				cleanup()
+				return nil, func() {}, err
+			}
+			cleanups = append(cleanups, stop)
+			args = append(args, "--values", path)
+		}
+		if len(layer.Values) == 0 {
+			continue
+		}
+		f, err := createTemp(ctx, "values-*.yaml")
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		cleanups = append(cleanups, func() { os.Remove(f.Name()) })
+		_, err = f.WriteString(encodeYAML(layer.Values))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		args = append(args, "--values", f.Name())
+	}
+	for _, s := range v.Set {
+		if !strings.Contains(s, "=") {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("'set' entry %q is not key=value", s)
+		}
+		args = append(args, "--set", s)
+	}
+	return args, cleanup, nil
+}
+
+// layers returns v's values files and values as the layers helm applies,
+// in order, before set.
+func (v helmValues) layers() []valuesLayer {
+	layers := []valuesLayer{{Name: "valuesFiles", ValuesFiles: v.ValuesFiles}}
+	layers = append(layers, v.Layers...)
+	return append(layers, valuesLayer{Name: "values", Values: v.Values})
+}
+
+// valuesFile returns the path helm is to read values file f from: f itself,
+// or a pipe serving it decrypted when it is SOPS-encrypted and v decrypts.
+func (v helmValues) valuesFile(ctx context.Context, f string) (string, func(), error) {
+	if _, err := os.Stat(f); err != nil {
+		return "", nil, fmt.Errorf("values file: %v", err)
+	}
+	if !v.SopsDecrypt {
+		return f, func() {}, nil
+	}
+	encrypted, err := sopsEncrypted(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("values file: %v", err)
+	}
+	if !encrypted {
+		return f, func() {}, nil
+	}
+	plaintext, err := v.sopsOptions.decrypt(ctx, f, nil, sopsFormat(f))
+	if err != nil {
+		return "", nil, err
+	}
+	return servePlaintext(ctx, plaintext)
+}
+
+// manifestFromInput returns input["manifest"] (or the contents of
+// input["manifestFile"]) when present, otherwise renders input["chart"] as
+// release input["name"] from the request's chartSource with its
+// helmValues. Extra arguments go to helm.
+func manifestFromInput(input map[string]interface{}, args ...string) (string, error) {
+	if manifest, ok := input["manifest"].(string); ok && manifest != "" {
+		return manifest, nil
+	}
+	if path, ok := input["manifestFile"].(string); ok && path != "" {
+		return readManifestFile(path)
+	}
+	name, _ := input["name"].(string)
+	chart, _ := input["chart"].(string)
+	if name == "" || chart == "" {
+		return "", errors.New("Either 'manifest', 'manifestFile' or both 'name' and 'chart' must be provided")
+	}
+	var req helmChartInput
+	if err := decodeInput(input, &req); err != nil {
+		return "", errors.New("Invalid request: " + err.Error())
+	}
+	chart, sourceArgs, err := req.chartSource.resolve(requestContext(input), chart)
+	if err != nil {
+		return "", err
+	}
+	valueArgs, cleanup, err := req.helmValues.renderArgs(requestContext(input), chart, sourceArgs)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	return renderChart(requestContext(input), name, chart, append(append(sourceArgs, valueArgs...), args...)...)
 }
 
 // validateK8s writes a manifest to a temp file and runs `kubectl apply --dry-run=server` to validate it.
-// Optionally uses input["kubeconfig"] for cluster context.
-func validateK8s(input map[string]interface{}) map[string]interface{} {
+// Optionally uses input["kubeconfig"] for cluster context and input["as"] /
+// input["asGroups"] to validate as an impersonated identity. A manifest in
+// input["manifestFile"] is handed to kubectl as is, without being loaded.
+// With input["batchSize"], documents are validated in parallel batches; with
+// input["offline"], against Kubernetes schemas instead (see validateOffline).
+// Dry runs report every object's outcome under "resources". Objects without
+// a namespace go to input["namespace"], which input["createNamespace"]
+// creates when missing.
+func validateK8s(input map[string]interface{}) (result map[string]interface{}) {
+	var offline offlineValidationRequest
+	if err := decodeInput(input, &offline); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := offline.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	if offline.Offline {
+		return validateOffline(input, offline)
+	}
+	if offline.CustomResources == "structural" {
+		return validateCustomResources(input, offline)
+	}
+	var target validationTarget
+	if err := decodeInput(input, &target); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if target.CreateNamespace {
+		if target.Namespace == "" {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "'createNamespace' needs a 'namespace'",
+			}
+		}
+		created, err := ensureNamespace(input, target.Namespace)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		if created {
+			defer func() { result["namespaceCreated"] = target.Namespace }()
+		}
+	}
+	if batchSize, ok := input["batchSize"].(float64); ok && batchSize > 0 {
+		manifest, err := manifestFromInput(input)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		return validateInBatches(input, manifest, int(batchSize))
+	}
+	if path, ok := input["manifestFile"].(string); ok && path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to read manifest file: " + err.Error(),
+			}
+		}
+		return runValidation(input, path)
+	}
 	manifest, ok := input["manifest"].(string)
 	if !ok || manifest == "" {
 		return map[string]interface{}{
@@ -70,7 +679,7 @@ func validateK8s(input map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	tmpfile, err := os.CreateTemp("", "k8s-validate-")
+	tmpfile, err := createTemp(requestContext(input), "k8s-validate-")
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -93,23 +702,78 @@ func validateK8s(input map[string]interface{}) map[string]interface{} {
 		}
 	}
 
-	cmd := exec.Command("kubectl", "apply", "--dry-run=server", "-f", tmpfile.Name())
-	if kubeconfig, ok := input["kubeconfig"].(string); ok && kubeconfig != "" {
-		cmd.Env = append(os.Environ(), "KUBECONFIG="+kubeconfig)
+	return runValidation(input, tmpfile.Name())
+}
+
+// runValidation dry-runs the manifest at path against the cluster, with
+// the outcome for each of its objects under "resources", or why they are
+// not reported one by one under "resourcesSkipped".
+func runValidation(input map[string]interface{}, path string) map[string]interface{} {
+	namespace, _ := input["namespace"].(string)
+	resources := []validatedResource{}
+	// kubectl reads the file itself; it is only scanned here, a document
+	// at a time, to attribute its results.
+	scanned, scanErr := scanDryRunResources(path)
+	if scanErr == nil {
+		resources = scanned
+	}
+	args := []string{"apply", "--dry-run=server", "-f", path}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+		for i, r := range resources {
+			if r.Namespace == "" && isNamespaced(r.Kind, nil) {
+				resources[i].Namespace = namespace
+			}
+		}
 	}
+	defer acquireKubectl(input)()
+	cmd := kubectlCommand(input, args...)
+	var stdout, stderr bytes.Buffer
+	// kubectl prints a line per object, only needed to attribute them.
+	if scanErr == nil {
+		cmd.Stdout = &stdout
+	}
+	cmd.Stderr = &stderr
 
-	output, err := cmd.CombinedOutput()
+	start := time.Now()
+	defer trackSubprocess(start)
+	err := cmd.Run()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	general := attributeDryRun(resources, stdout.String(), stderr.String())
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   string(output) + "\n" + err.Error(),
+		result := map[string]interface{}{
+			"success":   false,
+			"error":     stderr.String() + "\n" + err.Error(),
+			"resources": resources,
 		}
+		if len(general) > 0 {
+			result["errors"] = general
+		}
+		if scanErr != nil {
+			result["resourcesSkipped"] = scanErr.Error()
+		}
+		return result
 	}
 
-	return map[string]interface{}{
-		"success": true,
-		"message": "Manifest validated successfully",
+	result := map[string]interface{}{
+		"success":   true,
+		"message":   "Manifest validated successfully",
+		"resources": resources,
+	}
+	if scanErr != nil {
+		result["resourcesSkipped"] = scanErr.Error()
+	}
+	return result
+}
+
+// decodeInput converts the generic request into a typed struct, for commands
+// whose input is too nested to pick apart with type assertions.
+func decodeInput(input map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
 	}
+	return json.Unmarshal(data, v)
 }
 
 // toJSON marshals a Go value to JSON string, returning an error JSON if marshaling fails.
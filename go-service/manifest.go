@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resourceRef identifies a single object in a manifest.
+type resourceRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+func (r resourceRef) String() string {
+	s := r.Kind + "/" + r.Name
+	if r.Namespace != "" {
+		s = r.Namespace + "/" + s
+	}
+	return s
+}
+
+// parseManifest decodes a multi-document manifest into Kubernetes objects.
+// Items of v1 List objects are flattened into the result.
+func parseManifest(manifest string) ([]map[string]interface{}, error) {
+	var objects []map[string]interface{}
+	for i, doc := range splitYAMLDocuments(manifest) {
+		v, err := decodeYAML(doc)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		if v == nil {
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("document %d: expected a mapping, got %T", i+1, v)
+		}
+		if kind, _ := obj["kind"].(string); strings.HasSuffix(kind, "List") && obj["items"] != nil {
+			for _, item := range nestedSlice(obj, "items") {
+				if m, ok := item.(map[string]interface{}); ok {
+					objects = append(objects, m)
+				}
+			}
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// manifestDocument is one document of a manifest with its identifying
+// metadata, for callers routing or filtering resources without a YAML
+// parser. Source is the template helm rendered it from.
+type manifestDocument struct {
+	resourceRef
+	Index  int    `json:"index"`
+	Source string `json:"source,omitempty"`
+	YAML   string `json:"yaml"`
+}
+
+// manifestDocuments splits a manifest into its documents, keeping each
+// one's YAML as written. Items of List objects become documents of their
+// own, re-encoded.
+func manifestDocuments(manifest string) ([]manifestDocument, error) {
+	docs := []manifestDocument{}
+	for i, raw := range splitYAMLDocuments(manifest) {
+		v, err := decodeYAML(raw)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		if v == nil {
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("document %d: expected a mapping, got %T", i+1, v)
+		}
+		var source string
+		for _, line := range strings.Split(raw, "\n") {
+			if rest := strings.TrimPrefix(line, "# Source: "); rest != line {
+				source = rest
+				break
+			}
+		}
+		if kind, _ := obj["kind"].(string); strings.HasSuffix(kind, "List") && obj["items"] != nil {
+			for _, item := range nestedSlice(obj, "items") {
+				if m, ok := item.(map[string]interface{}); ok {
+					docs = append(docs, manifestDocument{resourceRef: refOf(m), Index: len(docs), Source: source, YAML: encodeYAML(m)})
+				}
+			}
+			continue
+		}
+		docs = append(docs, manifestDocument{resourceRef: refOf(obj), Index: len(docs), Source: source, YAML: strings.Trim(raw, "\n") + "\n"})
+	}
+	return docs, nil
+}
+
+// encodeManifest renders objects back into a multi-document manifest.
+func encodeManifest(objects []map[string]interface{}) string {
+	var b strings.Builder
+	for _, obj := range objects {
+		b.WriteString("---\n")
+		b.WriteString(encodeYAML(obj))
+	}
+	return b.String()
+}
+
+func refOf(obj map[string]interface{}) resourceRef {
+	return resourceRef{
+		APIVersion: nestedString(obj, "apiVersion"),
+		Kind:       nestedString(obj, "kind"),
+		Name:       nestedString(obj, "metadata", "name"),
+		Namespace:  nestedString(obj, "metadata", "namespace"),
+	}
+}
+
+// splitAPIVersion splits "group/version" into its parts; the core group is "".
+func splitAPIVersion(apiVersion string) (string, string) {
+	if i := strings.Index(apiVersion, "/"); i >= 0 {
+		return apiVersion[:i], apiVersion[i+1:]
+	}
+	return "", apiVersion
+}
+
+func nestedValue(obj map[string]interface{}, path ...string) interface{} {
+	var cur interface{} = obj
+	for _, key := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[key]
+	}
+	return cur
+}
+
+func nestedString(obj map[string]interface{}, path ...string) string {
+	s, _ := nestedValue(obj, path...).(string)
+	return s
+}
+
+func nestedMap(obj map[string]interface{}, path ...string) map[string]interface{} {
+	m, _ := nestedValue(obj, path...).(map[string]interface{})
+	return m
+}
+
+func nestedSlice(obj map[string]interface{}, path ...string) []interface{} {
+	s, _ := nestedValue(obj, path...).([]interface{})
+	return s
+}
+
+// clusterScopedKinds lists built-in kinds that are not namespaced.
+var clusterScopedKinds = map[string]bool{
+	"APIService":                       true,
+	"CertificateSigningRequest":        true,
+	"ClusterRole":                      true,
+	"ClusterRoleBinding":               true,
+	"ComponentStatus":                  true,
+	"CSIDriver":                        true,
+	"CSINode":                          true,
+	"CustomResourceDefinition":         true,
+	"FlowSchema":                       true,
+	"IngressClass":                     true,
+	"MutatingWebhookConfiguration":     true,
+	"Namespace":                        true,
+	"Node":                             true,
+	"PersistentVolume":                 true,
+	"PodSecurityPolicy":                true,
+	"PriorityClass":                    true,
+	"PriorityLevelConfiguration":       true,
+	"RuntimeClass":                     true,
+	"StorageClass":                     true,
+	"ValidatingAdmissionPolicy":        true,
+	"ValidatingAdmissionPolicyBinding": true,
+	"ValidatingWebhookConfiguration":   true,
+	"VolumeAttachment":                 true,
+}
+
+// isNamespaced reports whether objects of kind live in a namespace. Custom
+// kinds take their scope from a CRD in objects when one is present.
+func isNamespaced(kind string, objects []map[string]interface{}) bool {
+	if clusterScopedKinds[kind] {
+		return false
+	}
+	for _, obj := range objects {
+		if nestedString(obj, "kind") == "CustomResourceDefinition" && nestedString(obj, "spec", "names", "kind") == kind {
+			return nestedString(obj, "spec", "scope") != "Cluster"
+		}
+	}
+	return true
+}
+
+// kindToResource derives the plural resource name the API uses for kind,
+// following the same English rules as kubectl's RESTMapper.
+func kindToResource(kind string) string {
+	r := strings.ToLower(kind)
+	switch {
+	case r == "endpoints":
+		return r
+	case strings.HasSuffix(r, "s") || strings.HasSuffix(r, "x") || strings.HasSuffix(r, "z") ||
+		strings.HasSuffix(r, "ch") || strings.HasSuffix(r, "sh"):
+		return r + "es"
+	case strings.HasSuffix(r, "y") && len(r) > 1 && !strings.ContainsAny(r[len(r)-2:len(r)-1], "aeiou"):
+		return r[:len(r)-1] + "ies"
+	}
+	return r + "s"
+}
+
+// deepCopy returns a copy of a decoded YAML/JSON value that shares no maps
+// or slices with the original.
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = deepCopy(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, val := range t {
+			s[i] = deepCopy(val)
+		}
+		return s
+	}
+	return v
+}
+
+func deepCopyObject(obj map[string]interface{}) map[string]interface{} {
+	return deepCopy(obj).(map[string]interface{})
+}
+
+// imageUse is a container image and the resources referencing it.
+type imageUse struct {
+	Image     string   `json:"image"`
+	Resources []string `json:"resources"`
+}
+
+// manifestImages lists the images of every container, init container and
+// ephemeral container in objects, wherever the pod spec is nested
+// (workload templates, CronJob job templates, custom resources embedding
+// pod specs), in order of first use.
+func manifestImages(objects []map[string]interface{}) []imageUse {
+	var uses []imageUse
+	index := map[string]int{}
+	for _, obj := range objects {
+		resource := refOf(obj).String()
+		var walk func(v interface{})
+		walk = func(v interface{}) {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				for _, key := range sortedKeys(t) {
+					if key == "containers" || key == "initContainers" || key == "ephemeralContainers" {
+						for _, c := range nestedSlice(t, key) {
+							image := nestedString(asObject(c), "image")
+							if image == "" {
+								continue
+							}
+							i, ok := index[image]
+							if !ok {
+								i = len(uses)
+								index[image] = i
+								uses = append(uses, imageUse{Image: image})
+							}
+							if r := uses[i].Resources; len(r) == 0 || r[len(r)-1] != resource {
+								uses[i].Resources = append(uses[i].Resources, resource)
+							}
+						}
+						continue
+					}
+					walk(t[key])
+				}
+			case []interface{}:
+				for _, item := range t {
+					walk(item)
+				}
+			}
+		}
+		walk(obj)
+	}
+	return uses
+}
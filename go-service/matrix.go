@@ -0,0 +1,203 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// matrixRequest is the request body for render-matrix. The embedded chart
+// settings, values files and values are the base of every combination.
+type matrixRequest struct {
+	renderJobSpec
+	Dimensions []matrixDimension `json:"dimensions"`
+	// Exclude lists combinations to skip, as dimension name to option name;
+	// an entry matches every combination that agrees with all its pairs.
+	Exclude []map[string]string `json:"exclude"`
+	// Validate dry-runs every rendered combination against the cluster.
+	Validate    bool `json:"validate"`
+	Parallelism int  `json:"parallelism"`
+	// IncludeManifests returns the rendered manifest of each combination.
+	IncludeManifests bool `json:"includeManifests"`
+}
+
+// matrixDimension is one axis of the matrix, e.g. environment or size tier.
+type matrixDimension struct {
+	Name    string         `json:"name"`
+	Options []matrixOption `json:"options"`
+}
+
+type matrixOption struct {
+	Name        string                 `json:"name"`
+	ValuesFiles []string               `json:"valuesFiles"`
+	Values      map[string]interface{} `json:"values"`
+}
+
+// renderMatrix renders a chart once per combination of the options of
+// input["dimensions"] (e.g. environment × size tier) and reports which
+// combinations fail to render or, with input["validate"], fail validation.
+// Options are layered in dimension order over the base values, so a later
+// dimension overrides an earlier one.
+func renderMatrix(input map[string]interface{}) map[string]interface{} {
+	var req matrixRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Name == "" || req.Chart == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Both 'name' and 'chart' must be provided",
+		}
+	}
+	if len(req.Dimensions) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No dimensions provided",
+		}
+	}
+	for _, d := range req.Dimensions {
+		if d.Name == "" || len(d.Options) == 0 {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Every dimension needs a 'name' and at least one option",
+			}
+		}
+	}
+
+	combos := matrixCombinations(req.Dimensions, req.Exclude)
+	if len(combos) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Every combination is excluded",
+		}
+	}
+	parallelism := req.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	results := make([]map[string]interface{}, len(combos))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := range combos {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = renderCombination(input, req, combos[i])
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r["success"] != true {
+			failed++
+		}
+	}
+	return map[string]interface{}{
+		"success":      true,
+		"passed":       failed == 0,
+		"combinations": len(results),
+		"failed":       failed,
+		"results":      results,
+		"durationMs":   time.Since(start).Milliseconds(),
+	}
+}
+
+// matrixCombinations returns the excluded-filtered cartesian product of the
+// dimensions' options, one option index per dimension.
+func matrixCombinations(dims []matrixDimension, exclude []map[string]string) [][]int {
+	combos := [][]int{{}}
+	for _, d := range dims {
+		var next [][]int
+		for _, c := range combos {
+			for o := range d.Options {
+				next = append(next, append(append([]int{}, c...), o))
+			}
+		}
+		combos = next
+	}
+	var kept [][]int
+	for _, c := range combos {
+		excluded := false
+		for _, ex := range exclude {
+			matches := len(ex) > 0
+			for i, d := range dims {
+				if want, ok := ex[d.Name]; ok && want != d.Options[c[i]].Name {
+					matches = false
+				}
+			}
+			if matches {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// renderCombination renders and optionally validates one combination.
+func renderCombination(input map[string]interface{}, req matrixRequest, combo []int) map[string]interface{} {
+	job := req.renderJobSpec
+	job.ValuesFiles = append([]string{}, req.ValuesFiles...)
+	job.Values = map[string]interface{}{}
+	mergeOverrides(job.Values, deepCopyObject(req.Values))
+	options := map[string]interface{}{}
+	var id []string
+	for i, d := range req.Dimensions {
+		o := d.Options[combo[i]]
+		options[d.Name] = o.Name
+		id = append(id, d.Name+"="+o.Name)
+		job.ValuesFiles = append(job.ValuesFiles, o.ValuesFiles...)
+		mergeOverrides(job.Values, deepCopyObject(o.Values))
+	}
+
+	began := time.Now()
+	result := map[string]interface{}{
+		"id":      strings.Join(id, ","),
+		"options": options,
+	}
+	var b strings.Builder
+	_, err := renderJob(requestContext(input), &b, job)
+	if err != nil {
+		result["success"] = false
+		result["stage"] = "render"
+		result["error"] = err.Error()
+		result["durationMs"] = time.Since(began).Milliseconds()
+		return result
+	}
+	manifest := b.String()
+	if objects, err := parseManifest(manifest); err == nil {
+		result["documents"] = len(objects)
+	}
+	if req.IncludeManifests {
+		result["manifest"] = manifest
+	}
+	result["success"] = true
+	if req.Validate {
+		vin := map[string]interface{}{}
+		for k, v := range input {
+			vin[k] = v
+		}
+		delete(vin, "manifestFile")
+		vin["manifest"] = manifest
+		validation := validateK8s(vin)
+		if validation["success"] != true {
+			result["success"] = false
+			result["stage"] = "validate"
+			result["error"] = validation["error"]
+		}
+	}
+	result["durationMs"] = time.Since(began).Milliseconds()
+	return result
+}
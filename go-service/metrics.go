@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the duration
+// histograms: renders take tens of milliseconds, applies with a wait
+// minutes.
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// serviceMetrics are what serve exposes at /metrics, in the Prometheus
+// text format: requests, failures and durations per command, the time
+// spent in each tool's processes, the work queue and rate limiting.
+var serviceMetrics = struct {
+	sync.Mutex
+	requests     map[string]uint64
+	failures     map[[2]string]uint64 // command, error code
+	durations    map[string]*histogram
+	subprocesses map[string]*histogram
+	inFlight     int64
+	queued       map[string]int64 // by priority
+	rejected     map[string]uint64
+	throttled    float64
+}{
+	requests:     map[string]uint64{},
+	failures:     map[[2]string]uint64{},
+	durations:    map[string]*histogram{},
+	subprocesses: map[string]*histogram{},
+	queued:       map[string]int64{},
+	rejected:     map[string]uint64{},
+}
+
+// startRequestMetrics counts a request of cmd as in flight; the returned
+// func records its result.
+func startRequestMetrics(cmd string) func(result map[string]interface{}) {
+	start := time.Now()
+	serviceMetrics.Lock()
+	serviceMetrics.inFlight++
+	serviceMetrics.Unlock()
+	return func(result map[string]interface{}) {
+		serviceMetrics.Lock()
+		defer serviceMetrics.Unlock()
+		serviceMetrics.inFlight--
+		serviceMetrics.requests[cmd]++
+		if result["success"] != true {
+			serviceMetrics.failures[[2]string{cmd, resultCode(result)}]++
+		}
+		h := serviceMetrics.durations[cmd]
+		if h == nil {
+			h = &histogram{}
+			serviceMetrics.durations[cmd] = h
+		}
+		h.observe(time.Since(start).Seconds())
+	}
+}
+
+// resultCode is the error code of a failed result, versioned or not.
+func resultCode(result map[string]interface{}) string {
+	switch e := result["error"].(type) {
+	case apiError:
+		return e.Code
+	case *apiError:
+		return e.Code
+	}
+	return errorCode(result, resultError(result))
+}
+
+// observeSubprocess records a finished helm, kubectl or other tool process.
+func observeSubprocess(path string, d time.Duration) {
+	tool := filepath.Base(path)
+	serviceMetrics.Lock()
+	defer serviceMetrics.Unlock()
+	h := serviceMetrics.subprocesses[tool]
+	if h == nil {
+		h = &histogram{}
+		serviceMetrics.subprocesses[tool] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// observeThrottle records a call held back by a cluster's rate limit.
+func observeThrottle(d time.Duration) {
+	serviceMetrics.Lock()
+	defer serviceMetrics.Unlock()
+	serviceMetrics.throttled += d.Seconds()
+}
+
+func writeMetrics(w io.Writer) {
+	serviceMetrics.Lock()
+	defer serviceMetrics.Unlock()
+	fmt.Fprintf(w, "# HELP infrakit_requests_total Requests served, by command.\n# TYPE infrakit_requests_total counter\n")
+	names := make([]string, 0, len(serviceMetrics.requests))
+	for cmd := range serviceMetrics.requests {
+		names = append(names, cmd)
+	}
+	sort.Strings(names)
+	for _, cmd := range names {
+		fmt.Fprintf(w, "infrakit_requests_total{command=%q} %d\n", cmd, serviceMetrics.requests[cmd])
+	}
+	fmt.Fprintf(w, "# HELP infrakit_request_failures_total Requests that failed, by command and error code.\n# TYPE infrakit_request_failures_total counter\n")
+	var failures [][2]string
+	for k := range serviceMetrics.failures {
+		failures = append(failures, k)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i][0] < failures[j][0] || failures[i][0] == failures[j][0] && failures[i][1] < failures[j][1]
+	})
+	for _, k := range failures {
+		fmt.Fprintf(w, "infrakit_request_failures_total{command=%q,code=%q} %d\n", k[0], k[1], serviceMetrics.failures[k])
+	}
+	fmt.Fprintf(w, "# HELP infrakit_requests_in_flight Requests being served.\n# TYPE infrakit_requests_in_flight gauge\n")
+	fmt.Fprintf(w, "infrakit_requests_in_flight %d\n", serviceMetrics.inFlight)
+	fmt.Fprintf(w, "# HELP infrakit_requests_queued Requests waiting in the work queue, by priority.\n# TYPE infrakit_requests_queued gauge\n")
+	for _, p := range requestPriorities {
+		fmt.Fprintf(w, "infrakit_requests_queued{priority=%q} %d\n", p, serviceMetrics.queued[p])
+	}
+	fmt.Fprintf(w, "# HELP infrakit_requests_rejected_total Requests turned away because the work queue was full, by priority.\n# TYPE infrakit_requests_rejected_total counter\n")
+	for _, p := range requestPriorities {
+		fmt.Fprintf(w, "infrakit_requests_rejected_total{priority=%q} %d\n", p, serviceMetrics.rejected[p])
+	}
+	fmt.Fprintf(w, "# HELP infrakit_cluster_throttled_seconds_total Time kubectl and helm calls waited for a cluster's rate limit.\n# TYPE infrakit_cluster_throttled_seconds_total counter\n")
+	fmt.Fprintf(w, "infrakit_cluster_throttled_seconds_total %g\n", serviceMetrics.throttled)
+	writeHistograms(w, "infrakit_request_duration_seconds", "Request duration, by command.", "command", serviceMetrics.durations)
+	writeHistograms(w, "infrakit_subprocess_duration_seconds", "Time spent in helm, kubectl and other tool processes, by tool.", "tool", serviceMetrics.subprocesses)
+}
+
+func writeHistograms(w io.Writer, name, help, label string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(histograms))
+	for k := range histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := histograms[k]
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, label, k, fmt.Sprint(le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, k, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, label, k, h.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, k, h.count)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import "fmt"
+
+// namespaceSpec is the request body for bootstrap-namespace.
+type namespaceSpec struct {
+	Namespace   string            `json:"namespace"`
+	Team        string            `json:"team"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	// PodSecurity is the Pod Security Admission level to enforce.
+	PodSecurity string `json:"podSecurity"`
+	// Quota is the ResourceQuota "hard" list. Omitted means the standard
+	// quota; an empty object disables the quota.
+	Quota map[string]string `json:"quota"`
+	// Limits configures the container LimitRange. Omitted means the
+	// standard defaults; an empty object disables the LimitRange.
+	Limits          map[string]map[string]string `json:"limits"`
+	NetworkPolicies struct {
+		DefaultDeny        *bool `json:"defaultDeny"`
+		AllowSameNamespace *bool `json:"allowSameNamespace"`
+		DenyEgress         bool  `json:"denyEgress"`
+	} `json:"networkPolicies"`
+	RoleBindings []struct {
+		// Name of the RoleBinding, by default <clusterRole>-<index>.
+		Name string `json:"name"`
+		// ClusterRole to bind, e.g. admin, edit or view.
+		ClusterRole string `json:"clusterRole"`
+		Subjects    []struct {
+			Kind      string `json:"kind"`
+			Name      string `json:"name"`
+			Namespace string `json:"namespace,omitempty"`
+		} `json:"subjects"`
+	} `json:"roleBindings"`
+	Apply bool `json:"apply"`
+	// Backup saves the live state of the affected resources, in BackupDir,
+	// before applying.
+	Backup    bool   `json:"backup"`
+	BackupDir string `json:"backupDir"`
+}
+
+var defaultNamespaceQuota = map[string]string{
+	"requests.cpu":           "4",
+	"requests.memory":        "8Gi",
+	"limits.cpu":             "8",
+	"limits.memory":          "16Gi",
+	"pods":                   "50",
+	"persistentvolumeclaims": "10",
+	"services.loadbalancers": "0",
+}
+
+var defaultNamespaceLimits = map[string]map[string]string{
+	"defaultRequest": {"cpu": "100m", "memory": "128Mi"},
+	"default":        {"cpu": "500m", "memory": "512Mi"},
+}
+
+// bootstrapNamespace generates a namespace with the standard quota, limit
+// range, network policies, RBAC bindings and labels every new team needs,
+// and applies it when input["apply"] is true (after saving the live state
+// of the affected resources when input["backup"] is true).
+func bootstrapNamespace(input map[string]interface{}) map[string]interface{} {
+	var spec namespaceSpec
+	if err := decodeInput(input, &spec); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid namespace spec: " + err.Error(),
+		}
+	}
+	if spec.Namespace == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No namespace provided",
+		}
+	}
+	// Bindings of one namespace share a name space: a duplicate would
+	// silently replace the binding before it on apply.
+	bindings := map[string]bool{}
+	for i, rb := range spec.RoleBindings {
+		if rb.ClusterRole == "" {
+			return map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("roleBindings[%d].clusterRole must be provided", i),
+			}
+		}
+		name := roleBindingName(rb.Name, rb.ClusterRole, i)
+		if bindings[name] {
+			return map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid roleBindings[%d]: a binding named %s is already defined", i, name),
+			}
+		}
+		bindings[name] = true
+	}
+
+	objects := namespaceObjects(spec)
+	manifest := encodeManifest(objects)
+	var refs []resourceRef
+	for _, obj := range objects {
+		refs = append(refs, refOf(obj))
+	}
+	result := map[string]interface{}{
+		"success":   true,
+		"manifest":  manifest,
+		"resources": refs,
+		"applied":   false,
+	}
+	if !spec.Apply {
+		return result
+	}
+
+	if spec.Backup {
+		archive, _, err := backupLive(input, objects)
+		if err != nil {
+			return map[string]interface{}{
+				"success":  false,
+				"manifest": manifest,
+				"error":    "Pre-apply backup failed: " + err.Error(),
+			}
+		}
+		result["backup"] = archive
+	}
+
+	output, err := runKubectl(input, manifest, "apply", "-f", "-")
+	if err != nil {
+		failure := map[string]interface{}{
+			"success":  false,
+			"manifest": manifest,
+			"error":    string(output) + err.Error(),
+		}
+		if wantDiagnostics(input) {
+			failure["diagnostics"] = collectDiagnostics(input, objects)
+		}
+		return failure
+	}
+	result["applied"] = true
+	result["applyOutput"] = string(output)
+	return result
+}
+
+func namespaceObjects(spec namespaceSpec) []map[string]interface{} {
+	ns := spec.Namespace
+	labels := map[string]interface{}{
+		"kubernetes.io/metadata.name":  ns,
+		"app.kubernetes.io/managed-by": "infrakit",
+	}
+	if spec.Team != "" {
+		labels["team"] = spec.Team
+	}
+	level := spec.PodSecurity
+	if level == "" {
+		level = "baseline"
+	}
+	labels["pod-security.kubernetes.io/enforce"] = level
+	labels["pod-security.kubernetes.io/warn"] = "restricted"
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	meta := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":      name,
+			"namespace": ns,
+			"labels":    map[string]interface{}{"app.kubernetes.io/managed-by": "infrakit"},
+		}
+	}
+
+	nsMeta := map[string]interface{}{"name": ns, "labels": labels}
+	if len(spec.Annotations) > 0 {
+		nsMeta["annotations"] = stringMap(spec.Annotations)
+	}
+	objects := []map[string]interface{}{{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   nsMeta,
+	}}
+
+	quota := spec.Quota
+	if quota == nil {
+		quota = defaultNamespaceQuota
+	}
+	if len(quota) > 0 {
+		objects = append(objects, map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ResourceQuota",
+			"metadata":   meta("default-quota"),
+			"spec":       map[string]interface{}{"hard": stringMap(quota)},
+		})
+	}
+
+	limits := spec.Limits
+	if limits == nil {
+		limits = defaultNamespaceLimits
+	}
+	if len(limits) > 0 {
+		limit := map[string]interface{}{"type": "Container"}
+		for field, values := range limits {
+			limit[field] = stringMap(values)
+		}
+		objects = append(objects, map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "LimitRange",
+			"metadata":   meta("default-limits"),
+			"spec":       map[string]interface{}{"limits": []interface{}{limit}},
+		})
+	}
+
+	np := spec.NetworkPolicies
+	if np.DefaultDeny == nil || *np.DefaultDeny {
+		types := []interface{}{"Ingress"}
+		if np.DenyEgress {
+			types = append(types, "Egress")
+		}
+		objects = append(objects, networkPolicy(meta("default-deny"), map[string]interface{}{
+			"podSelector": map[string]interface{}{},
+			"policyTypes": types,
+		}))
+	}
+	if np.AllowSameNamespace == nil || *np.AllowSameNamespace {
+		objects = append(objects, networkPolicy(meta("allow-same-namespace"), map[string]interface{}{
+			"podSelector": map[string]interface{}{},
+			"policyTypes": []interface{}{"Ingress"},
+			"ingress": []interface{}{map[string]interface{}{
+				"from": []interface{}{map[string]interface{}{"podSelector": map[string]interface{}{}}},
+			}},
+		}))
+	}
+	if np.DenyEgress {
+		// With egress denied, pods still need cluster DNS to resolve anything.
+		objects = append(objects, networkPolicy(meta("allow-dns"), map[string]interface{}{
+			"podSelector": map[string]interface{}{},
+			"policyTypes": []interface{}{"Egress"},
+			"egress": []interface{}{map[string]interface{}{
+				"to": []interface{}{map[string]interface{}{
+					"namespaceSelector": map[string]interface{}{
+						"matchLabels": map[string]interface{}{"kubernetes.io/metadata.name": "kube-system"},
+					},
+				}},
+				"ports": []interface{}{
+					map[string]interface{}{"protocol": "UDP", "port": 53},
+					map[string]interface{}{"protocol": "TCP", "port": 53},
+				},
+			}},
+		}))
+	}
+
+	for i, rb := range spec.RoleBindings {
+		var subjects []interface{}
+		for _, s := range rb.Subjects {
+			subject := map[string]interface{}{"kind": s.Kind, "name": s.Name}
+			if s.Kind == "ServiceAccount" {
+				subject["namespace"] = ns
+				if s.Namespace != "" {
+					subject["namespace"] = s.Namespace
+				}
+			} else {
+				subject["apiGroup"] = "rbac.authorization.k8s.io"
+			}
+			subjects = append(subjects, subject)
+		}
+		objects = append(objects, map[string]interface{}{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "RoleBinding",
+			"metadata":   meta(roleBindingName(rb.Name, rb.ClusterRole, i)),
+			"roleRef": map[string]interface{}{
+				"apiGroup": "rbac.authorization.k8s.io",
+				"kind":     "ClusterRole",
+				"name":     rb.ClusterRole,
+			},
+			"subjects": subjects,
+		})
+	}
+	return objects
+}
+
+// roleBindingName is the name of the index'th binding of clusterRole, name
+// unless it is empty.
+func roleBindingName(name, clusterRole string, index int) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", clusterRole, index)
+}
+
+func networkPolicy(meta, spec map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "NetworkPolicy",
+		"metadata":   meta,
+		"spec":       spec,
+	}
+}
+
+func stringMap(m map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
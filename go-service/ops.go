@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// opsHistoryLimit is how many finished operations history.jsonl keeps.
+const opsHistoryLimit = 1000
+
+// operation is one command run, recorded while it is in flight and appended
+// to the history once it has finished.
+type operation struct {
+	ID         string `json:"id"`
+	RequestID  string `json:"requestId,omitempty"`
+	Command    string `json:"command"`
+	PID        int    `json:"pid"`
+	StartedAt  string `json:"startedAt"`
+	FinishedAt string `json:"finishedAt,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	// Status is running, succeeded, failed or abandoned (the process died
+	// before finishing).
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	started time.Time
+	input   map[string]interface{}
+	audit   auditRecord
+}
+
+// opsMu serializes bookkeeping between goroutines of this process; the
+// history file is additionally locked against other processes.
+var opsMu sync.Mutex
+
+// opsDir returns where in-flight and finished operations are recorded.
+func opsDir() string {
+	if dir := os.Getenv("INFRAKIT_OPS_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-ops")
+	}
+	return filepath.Join(home, ".infrakit", "ops")
+}
+
+// startOperation records command as in flight, with the request ID its logs
+// carry in ctx, and its request (with credentials redacted) for replay
+// unless INFRAKIT_RECORD_REQUESTS is "false". input is the request as the
+// command runs it, for the cluster of its audit record. Bookkeeping never
+// fails a command, so errors only mean the operation is missing from `ops`
+// or the audit log.
+func startOperation(ctx context.Context, command string, request, input map[string]interface{}) *operation {
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := time.Now()
+	op := &operation{
+		ID:        hex.EncodeToString(id),
+		RequestID: requestID(ctx),
+		Command:   command,
+		PID:       os.Getpid(),
+		StartedAt: now.UTC().Format(time.RFC3339Nano),
+		Status:    "running",
+		started:   now,
+		input:     input,
+	}
+	op.audit = newAuditRecord(ctx, op, request)
+	dir := filepath.Join(opsDir(), "running")
+	if os.MkdirAll(dir, 0o700) == nil {
+		if data, err := json.Marshal(op); err == nil {
+			os.WriteFile(filepath.Join(dir, op.ID+".json"), data, 0o600)
+		}
+	}
+	if os.Getenv("INFRAKIT_RECORD_REQUESTS") != "false" {
+		recordRequest(op, request)
+	}
+	return op
+}
+
+// finish moves the operation from in flight to the history, with its status
+// taken from the command result, and writes its audit record.
+func (op *operation) finish(result map[string]interface{}) {
+	opsMu.Lock()
+	// A signal can race the normal end of a command; record whichever
+	// comes first.
+	if op.FinishedAt != "" {
+		opsMu.Unlock()
+		return
+	}
+	now := time.Now()
+	op.FinishedAt = now.UTC().Format(time.RFC3339Nano)
+	op.DurationMs = now.Sub(op.started).Milliseconds()
+	op.Status = "succeeded"
+	if success, _ := result["success"].(bool); !success {
+		op.Status = "failed"
+		op.Error, _ = result["error"].(string)
+	}
+	os.Remove(filepath.Join(opsDir(), "running", op.ID+".json"))
+	appendHistory(op)
+	opsMu.Unlock()
+	// Webhooks can be slow; other operations need not wait on them.
+	recordAudit(op, result)
+}
+
+func appendHistory(op *operation) {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(opsDir(), "history.jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if syscall.Flock(int(f.Fd()), syscall.LOCK_EX) != nil {
+		return
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Write(append(data, '\n'))
+
+	// Trim once the history has grown well past the limit, so the rewrite
+	// is rare, along with the recorded requests of dropped operations.
+	lines := readHistory(path)
+	if len(lines) > 2*opsHistoryLimit {
+		keep := strings.Join(lines[len(lines)-opsHistoryLimit:], "\n") + "\n"
+		if f.Truncate(0) == nil {
+			f.Write([]byte(keep))
+		}
+		for _, line := range lines[:len(lines)-opsHistoryLimit] {
+			var dropped operation
+			if json.Unmarshal([]byte(line), &dropped) == nil && dropped.ID != "" {
+				os.Remove(requestPath(dropped.ID))
+			}
+		}
+	}
+}
+
+func readHistory(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// listOperations lists in-flight operations and the most recent finished
+// ones (input["limit"], default 20), newest first.
+func listOperations(input map[string]interface{}) map[string]interface{} {
+	limit := 20
+	if n, ok := input["limit"].(float64); ok && n > 0 {
+		limit = int(n)
+	}
+
+	running := []operation{}
+	files, _ := filepath.Glob(filepath.Join(opsDir(), "running", "*.json"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var op operation
+		if json.Unmarshal(data, &op) != nil {
+			continue
+		}
+		if started, err := time.Parse(time.RFC3339Nano, op.StartedAt); err == nil {
+			op.DurationMs = time.Since(started).Milliseconds()
+		}
+		// A process that was killed never finishes its operation; move it to
+		// the history so it is reported once.
+		if syscall.Kill(op.PID, 0) == syscall.ESRCH {
+			op.Status = "abandoned"
+			opsMu.Lock()
+			os.Remove(file)
+			appendHistory(&op)
+			opsMu.Unlock()
+			continue
+		}
+		running = append(running, op)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].StartedAt > running[j].StartedAt })
+
+	opsMu.Lock()
+	lines := readHistory(filepath.Join(opsDir(), "history.jsonl"))
+	opsMu.Unlock()
+	recent := []operation{}
+	for i := len(lines) - 1; i >= 0 && len(recent) < limit; i-- {
+		var op operation
+		if json.Unmarshal([]byte(lines[i]), &op) == nil {
+			recent = append(recent, op)
+		}
+	}
+	return map[string]interface{}{
+		"success":  true,
+		"inFlight": running,
+		"recent":   recent,
+	}
+}
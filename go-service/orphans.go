@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// orphanScanKinds are always searched for leftovers, in addition to every
+// kind that appears in the rendered manifest.
+var orphanScanKinds = []string{
+	"deployments.apps", "statefulsets.apps", "daemonsets.apps",
+	"services", "configmaps", "secrets", "serviceaccounts", "persistentvolumeclaims",
+	"jobs.batch", "cronjobs.batch",
+	"ingresses.networking.k8s.io", "networkpolicies.networking.k8s.io",
+	"roles.rbac.authorization.k8s.io", "rolebindings.rbac.authorization.k8s.io",
+	"horizontalpodautoscalers.autoscaling", "poddisruptionbudgets.policy",
+}
+
+// findOrphans lists live resources that carry a release's labels (or match
+// input["selector"]) but are no longer produced by the rendered manifest,
+// e.g. leftovers from renamed or removed templates.
+func findOrphans(input map[string]interface{}) map[string]interface{} {
+	selector, _ := input["selector"].(string)
+	if release, _ := input["release"].(string); selector == "" && release != "" {
+		selector = "app.kubernetes.io/instance=" + release
+	}
+	if selector == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Either 'release' or 'selector' must be provided",
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	// Objects are compared by group, kind, namespace and name so that a
+	// version bump of the same resource is not reported as an orphan.
+	declared := map[string]bool{}
+	kinds := map[string]bool{}
+	for _, k := range orphanScanKinds {
+		kinds[k] = true
+	}
+	for _, obj := range objects {
+		ref := refOf(obj)
+		declared[orphanKey(ref)] = true
+		if group, _ := splitAPIVersion(ref.APIVersion); group != "" {
+			kinds[kindToResource(ref.Kind)+"."+group] = true
+		} else {
+			kinds[kindToResource(ref.Kind)] = true
+		}
+	}
+	if extra, ok := input["kinds"].([]interface{}); ok {
+		for _, k := range extra {
+			if s, ok := k.(string); ok && s != "" {
+				kinds[s] = true
+			}
+		}
+	}
+	kindList := make([]string, 0, len(kinds))
+	for k := range kinds {
+		kindList = append(kindList, k)
+	}
+	sort.Strings(kindList)
+
+	// Each kind is listed on its own: one the cluster does not serve, such
+	// as a custom resource whose CRD is gone, is skipped rather than
+	// failing the whole search.
+	var items []map[string]interface{}
+	var skipped []string
+	for _, kind := range kindList {
+		args := []string{"get", kind, "-l", selector, "-o", "json", "--ignore-not-found"}
+		if ns, _ := input["namespace"].(string); ns != "" {
+			args = append(args, "-n", ns)
+		} else {
+			args = append(args, "--all-namespaces")
+		}
+		out, err := runKubectl(input, "", args...)
+		if err != nil {
+			if kindNotServed(err) {
+				skipped = append(skipped, kind)
+				continue
+			}
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to list live " + kind + ": " + err.Error(),
+			}
+		}
+		var live struct {
+			Items []map[string]interface{} `json:"items"`
+		}
+		if len(strings.TrimSpace(string(out))) > 0 {
+			if err := json.Unmarshal(out, &live); err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"error":   "Failed to decode live " + kind + ": " + err.Error(),
+				}
+			}
+		}
+		items = append(items, live.Items...)
+	}
+
+	orphans := []map[string]interface{}{}
+	for _, obj := range items {
+		// Objects owned by another object (ReplicaSets, Jobs from CronJobs,
+		// ...) are cleaned up with their owner.
+		if len(nestedSlice(obj, "metadata", "ownerReferences")) > 0 {
+			continue
+		}
+		// Rendered objects often leave the namespace to the install, so
+		// also match ignoring it.
+		ref := refOf(obj)
+		if declared[orphanKey(ref)] || declared[orphanKey(resourceRef{APIVersion: ref.APIVersion, Kind: ref.Kind, Name: ref.Name})] {
+			continue
+		}
+		orphans = append(orphans, map[string]interface{}{
+			"resource":          ref,
+			"creationTimestamp": nestedString(obj, "metadata", "creationTimestamp"),
+		})
+	}
+	result := map[string]interface{}{
+		"success":  true,
+		"selector": selector,
+		"checked":  len(items),
+		"orphans":  orphans,
+	}
+	if len(skipped) > 0 {
+		result["skippedKinds"] = skipped
+	}
+	return result
+}
+
+// kindNotServed reports whether a kubectl get failed because the cluster
+// does not serve the resource type.
+func kindNotServed(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "the server doesn't have a resource type") ||
+		strings.Contains(msg, "the server could not find the requested resource") ||
+		strings.Contains(msg, "no matches for kind")
+}
+
+// renderedOrphans runs findOrphans on an already rendered manifest, so
+// that a chart renders once.
+func renderedOrphans(input map[string]interface{}, manifest string) ([]resourceRef, error) {
+	orphanInput := map[string]interface{}{}
+	for k, v := range input {
+		orphanInput[k] = v
+	}
+	delete(orphanInput, "manifestFile")
+	orphanInput["manifest"] = manifest
+	result := findOrphans(orphanInput)
+	if result["success"] != true {
+		msg, _ := result["error"].(string)
+		return nil, errors.New(msg)
+	}
+	var refs []resourceRef
+	for _, o := range result["orphans"].([]map[string]interface{}) {
+		refs = append(refs, o["resource"].(resourceRef))
+	}
+	return refs, nil
+}
+
+func orphanKey(ref resourceRef) string {
+	group, _ := splitAPIVersion(ref.APIVersion)
+	return group + "/" + ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+}
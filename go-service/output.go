@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// outputFormats are the values of --output that choose how the command
+// line prints a result, rather than a command's own "output" key.
+var outputFormats = []string{"json", "yaml", "table", "raw-manifest"}
+
+// tableColumns come first in a table, in this order; other columns follow
+// sorted.
+var tableColumns = []string{"name", "resource", "kind", "namespace", "status", "ready"}
+
+const tableCellWidth = 48
+
+// outputOptions are how a result is printed. The zero value is what
+// machine callers rely on: one compact JSON line on stdout.
+type outputOptions struct {
+	// Format is one of outputFormats, or "" for the command line's default:
+	// the result's report when it has one, JSON otherwise.
+	Format string
+	Pretty bool
+	// CLI sends failures to stderr, where a person running the tool sees
+	// them apart from the output.
+	CLI bool
+}
+
+// takeOutputOptions removes the output flags of a command-line request
+// from input. An --output value that is not an output format is left for
+// commands with an "output" key of their own.
+func takeOutputOptions(c command, input map[string]interface{}) (outputOptions, error) {
+	o := outputOptions{CLI: true}
+	if input["pretty"] == true {
+		o.Pretty = true
+		delete(input, "pretty")
+	}
+	v, ok := input["output"]
+	if !ok {
+		return o, nil
+	}
+	s, _ := v.(string)
+	for _, f := range outputFormats {
+		if s == f {
+			o.Format = f
+			delete(input, "output")
+			return o, nil
+		}
+	}
+	for _, f := range c.Flags {
+		if f.Name != "output" {
+			continue
+		}
+		for _, allowed := range f.Values {
+			if s == allowed {
+				return o, nil
+			}
+		}
+		return o, fmt.Errorf("--output must be %s", strings.Join(f.Values, ", "))
+	}
+	return o, nil
+}
+
+// fit returns result, or the failure of an output format that cannot
+// show it.
+func (o outputOptions) fit(result map[string]interface{}) map[string]interface{} {
+	if _, ok := result["manifest"].(string); o.Format == "raw-manifest" && result["success"] == true && !ok {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "The result has no manifest to print; use another --output",
+		}
+	}
+	return result
+}
+
+// write prints result: failures from the command line to stderr, anything
+// else to stdout.
+func (o outputOptions) write(result map[string]interface{}) {
+	w := io.Writer(os.Stdout)
+	if o.CLI && result["success"] != true {
+		w = os.Stderr
+	}
+	text, replaced := o.render(result)
+	fmt.Fprint(w, text)
+	// Output that is not the whole result leaves debug output to stderr.
+	if debug, ok := result["debug"]; ok && replaced {
+		fmt.Fprintln(os.Stderr, toJSON(debug))
+	}
+}
+
+// render formats result, reporting whether the text leaves part of the
+// result out (a report, a table or a manifest).
+func (o outputOptions) render(result map[string]interface{}) (string, bool) {
+	report, hasReport := result["report"].(string)
+	errText := ""
+	if result["success"] != true {
+		msg, _ := result["error"].(string)
+		errText = "Error: " + firstNonEmpty(msg, "command failed") + "\n"
+	}
+	switch o.Format {
+	case "json":
+		return o.json(result), false
+	case "yaml":
+		return encodeYAML(plainValue(result)), false
+	case "table":
+		if hasReport {
+			return report + errText, true
+		}
+		if errText != "" {
+			return errText, true
+		}
+		return renderTable(plainValue(result)), true
+	case "raw-manifest":
+		if errText != "" {
+			return errText, true
+		}
+		manifest, _ := result["manifest"].(string)
+		if manifest != "" && !strings.HasSuffix(manifest, "\n") {
+			manifest += "\n"
+		}
+		return manifest, true
+	}
+	if o.CLI && hasReport {
+		return report, true
+	}
+	return o.json(result), false
+}
+
+func (o outputOptions) json(result map[string]interface{}) string {
+	if !o.Pretty {
+		return toJSON(result) + "\n"
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return toJSON(result) + "\n"
+	}
+	return string(data) + "\n"
+}
+
+// plainValue returns v as encoding/json would decode it, so that results
+// holding structs render like those holding maps.
+func plainValue(v interface{}) map[string]interface{} {
+	var out map[string]interface{}
+	data, err := json.Marshal(v)
+	if err != nil || json.Unmarshal(data, &out) != nil {
+		return map[string]interface{}{}
+	}
+	return out
+}
+
+// renderTable prints a result's scalar fields as "key: value" lines, then
+// each list of objects in it as a table with a column per field.
+func renderTable(result map[string]interface{}) string {
+	var b strings.Builder
+	var lists []string
+	for _, k := range sortedKeys(result) {
+		if k == "success" {
+			continue
+		}
+		if rows, ok := objectRows(result[k]); ok {
+			if len(rows) > 0 {
+				lists = append(lists, k)
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\n", k, tableCell(result[k], 2*tableCellWidth))
+	}
+	for _, k := range lists {
+		rows, _ := objectRows(result[k])
+		seen := map[string]bool{}
+		for _, row := range rows {
+			for c := range row {
+				seen[c] = true
+			}
+		}
+		var columns []string
+		for _, c := range tableColumns {
+			if seen[c] {
+				columns = append(columns, c)
+				delete(seen, c)
+			}
+		}
+		rest := make([]string, 0, len(seen))
+		for c := range seen {
+			rest = append(rest, c)
+		}
+		sort.Strings(rest)
+		columns = append(columns, rest...)
+
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s:\n", k)
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		header := make([]string, len(columns))
+		for i, c := range columns {
+			header[i] = strings.ToUpper(c)
+		}
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, row := range rows {
+			cells := make([]string, len(columns))
+			for i, c := range columns {
+				cells[i] = tableCell(row[c], tableCellWidth)
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+		tw.Flush()
+	}
+	return b.String()
+}
+
+// objectRows returns v as table rows when it is a list of objects.
+func objectRows(v interface{}) ([]map[string]interface{}, bool) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	rows := make([]map[string]interface{}, 0, len(list))
+	for _, item := range list {
+		row, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		rows = append(rows, row)
+	}
+	return rows, true
+}
+
+// tableCell renders v on one line of at most max characters: scalars as
+// they are, lists of scalars comma separated, anything else as JSON.
+func tableCell(v interface{}, max int) string {
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case map[string]interface{}:
+		s = toJSON(t)
+	case []interface{}:
+		s = toJSON(t)
+		if parts, ok := scalarCells(t, max); ok {
+			s = strings.Join(parts, ", ")
+		}
+	case nil:
+	default:
+		s = yamlScalar(t)
+	}
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > max {
+		s = string(r[:max-1]) + "…"
+	}
+	return s
+}
+
+// scalarCells renders the items of list, when none is a map or list.
+func scalarCells(list []interface{}, max int) ([]string, bool) {
+	parts := make([]string, 0, len(list))
+	for _, item := range list {
+		switch item.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, false
+		}
+		parts = append(parts, tableCell(item, max))
+	}
+	return parts, true
+}
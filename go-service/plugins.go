@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pluginManifest is a plugin's plugin.yaml. A plugin is a directory of the
+// plugin directory holding the manifest and the executable it names, which
+// speaks the protocol of this binary: it reads a JSON request on stdin and
+// writes a JSON result, with "success" and "error", to stdout. Validators
+// add "passed" and a "report", as the built-in checks do.
+type pluginManifest struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary"`
+	// Command is the executable, relative to the plugin's directory.
+	Command string `json:"command"`
+	Flags   []struct {
+		Name   string   `json:"name"`
+		Help   string   `json:"help"`
+		Switch bool     `json:"switch"`
+		File   bool     `json:"file"`
+		Values []string `json:"values"`
+	} `json:"flags"`
+	// Cluster gives the command the cluster flags; the request then
+	// carries a kubeconfig, also exported as KUBECONFIG.
+	Cluster bool `json:"cluster"`
+}
+
+// pluginInfo is what the plugins command reports about a plugin, including
+// those that could not be loaded.
+type pluginInfo struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary,omitempty"`
+	Dir     string `json:"dir"`
+	Command string `json:"command,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// plugins are the plugins found at startup, loaded or not.
+var plugins []pluginInfo
+
+// pluginNamePattern is what a plugin may be called, like the built-in
+// commands.
+var pluginNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// pluginDir returns where plugins are installed.
+func pluginDir() string {
+	if dir := os.Getenv("INFRAKIT_PLUGIN_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-plugins")
+	}
+	return filepath.Join(home, ".infrakit", "plugins")
+}
+
+// loadPlugins turns the plugins of pluginDir into commands, recording in
+// plugins why any could not be. Plugins cannot replace built-in commands.
+func loadPlugins(builtin []command) []command {
+	entries, _ := os.ReadDir(pluginDir())
+	taken := map[string]bool{"action": true, "completion": true, "help": true}
+	for _, c := range builtin {
+		taken[c.Name] = true
+	}
+	var loaded []command
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(pluginDir(), e.Name())
+		c, info := loadPlugin(dir)
+		if info.Error == "" && taken[c.Name] {
+			info.Error = "command " + c.Name + " already exists"
+		}
+		if info.Error == "" {
+			taken[c.Name] = true
+			loaded = append(loaded, c)
+		}
+		plugins = append(plugins, info)
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return loaded
+}
+
+func loadPlugin(dir string) (command, pluginInfo) {
+	info := pluginInfo{Name: filepath.Base(dir), Dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, "plugin.yaml"))
+	if err != nil {
+		info.Error = err.Error()
+		return command{}, info
+	}
+	doc, err := decodeYAML(string(data))
+	var m pluginManifest
+	if err == nil {
+		err = decodeInput(asObject(deepCopyJSON(doc)), &m)
+	}
+	if err != nil {
+		info.Error = "plugin.yaml: " + err.Error()
+		return command{}, info
+	}
+	info.Name = firstNonEmpty(m.Name, info.Name)
+	info.Summary = m.Summary
+	if !pluginNamePattern.MatchString(info.Name) {
+		info.Error = "plugin.yaml: name must be lower-case letters, digits and dashes"
+		return command{}, info
+	}
+	if m.Command == "" {
+		info.Error = "plugin.yaml: no command"
+		return command{}, info
+	}
+	info.Command = m.Command
+	if !filepath.IsAbs(info.Command) {
+		info.Command = filepath.Join(dir, m.Command)
+	}
+	if st, err := os.Stat(info.Command); err != nil {
+		info.Error = err.Error()
+		return command{}, info
+	} else if st.Mode()&0o111 == 0 {
+		info.Error = info.Command + " is not executable"
+		return command{}, info
+	}
+
+	c := command{Name: info.Name, Summary: firstNonEmpty(m.Summary, "Plugin in "+dir), Run: runPlugin(info.Name, info.Command)}
+	for _, f := range m.Flags {
+		c.Flags = append(c.Flags, commandFlag{Name: f.Name, Help: f.Help, Switch: f.Switch, File: f.File, Values: f.Values})
+	}
+	if m.Cluster {
+		c.Flags = append(c.Flags, clusterFlags...)
+	}
+	return c, info
+}
+
+// runPlugin returns the Run of a plugin command: the request goes to the
+// plugin's stdin and its stdout is the result.
+func runPlugin(name, path string) func(map[string]interface{}) map[string]interface{} {
+	return func(input map[string]interface{}) map[string]interface{} {
+		request := map[string]interface{}{}
+		for k, v := range input {
+			if k != requestContextKey {
+				request[k] = v
+			}
+		}
+		data, err := json.Marshal(request)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Invalid request: " + err.Error(),
+			}
+		}
+		cmd := exec.CommandContext(requestContext(input), path)
+		cmd.Env = clusterEnv(input)
+		cmd.Stdin = bytes.NewReader(data)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		start := time.Now()
+		defer trackSubprocess(start)
+		err = cmd.Run()
+		traceCommand(cmd, start, stderr.Bytes(), err)
+		var result map[string]interface{}
+		if jerr := json.Unmarshal(stdout.Bytes(), &result); jerr != nil || result == nil {
+			msg := fmt.Sprintf("Plugin %s returned no JSON result", name)
+			if err != nil {
+				msg = fmt.Sprintf("Plugin %s failed: %s\n%v", name, strings.TrimSpace(stderr.String()), err)
+			}
+			return map[string]interface{}{
+				"success": false,
+				"error":   msg,
+			}
+		}
+		// A result is what the plugin says, but a plugin that failed
+		// cannot have succeeded.
+		if err != nil && result["success"] == true {
+			result["success"] = false
+			if resultError(result) == "" {
+				result["error"] = fmt.Sprintf("Plugin %s failed: %v", name, err)
+			}
+		}
+		return result
+	}
+}
+
+// listPlugins reports the plugins found in the plugin directory, with the
+// error of each that was not loaded.
+func listPlugins(input map[string]interface{}) map[string]interface{} {
+	list := plugins
+	if list == nil {
+		list = []pluginInfo{}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"dir":     pluginDir(),
+		"plugins": list,
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// policyBundle is a pinned source of policy files. Bundles are OCI
+// artifacts ("oci://ghcr.io/org/policies:v2", layers that are tar.gz
+// archives or ORAS-style files) or git repositories
+// ("git+https://github.com/org/policies.git", at Ref, optionally only the
+// Path subdirectory).
+type policyBundle struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Ref    string `json:"ref,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// Digest pins the source: the OCI manifest digest or the git commit.
+	Digest string `json:"digest,omitempty"`
+	// ContentDigest is the sha256 of the bundle's files, checked on every
+	// fetch and signed by the publisher.
+	ContentDigest string `json:"contentDigest,omitempty"`
+	// PublicKey is the base64 ed25519 key the bundle's .signature must
+	// verify with; INFRAKIT_POLICY_PUBLIC_KEY applies to bundles without one.
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// policyConfig is the bundle configuration, kept in policyConfigPath. It
+// is meant to be committed or distributed, like a lock file.
+type policyConfig struct {
+	Bundles []policyBundle `json:"bundles"`
+}
+
+// policySignatureFile is the bundle file holding the base64 ed25519
+// signature of the content digest ("sha256:<hex>"). It is not part of the
+// content digest.
+const policySignatureFile = ".signature"
+
+var policyNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+func policyConfigPath() string {
+	if path := os.Getenv("INFRAKIT_POLICY_CONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "infrakit-policies.yaml"
+	}
+	return filepath.Join(home, ".infrakit", "policies.yaml")
+}
+
+// policyDir returns where fetched bundles are kept, as
+// <name>/<content digest>/.
+func policyDir() string {
+	if dir := os.Getenv("INFRAKIT_POLICY_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-policies")
+	}
+	return filepath.Join(home, ".infrakit", "policies")
+}
+
+func loadPolicyConfig() (policyConfig, error) {
+	var config policyConfig
+	data, err := os.ReadFile(policyConfigPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	doc, err := decodeYAML(string(data))
+	if err != nil {
+		return config, fmt.Errorf("%s: %v", policyConfigPath(), err)
+	}
+	if err := decodeInput(asObject(deepCopyJSON(doc)), &config); err != nil {
+		return config, fmt.Errorf("%s: %v", policyConfigPath(), err)
+	}
+	return config, nil
+}
+
+func savePolicyConfig(config policyConfig) error {
+	sort.Slice(config.Bundles, func(i, j int) bool { return config.Bundles[i].Name < config.Bundles[j].Name })
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return writeCacheFile(policyConfigPath(), []byte(encodeYAML(doc)))
+}
+
+func (c *policyConfig) bundle(name string) *policyBundle {
+	for i := range c.Bundles {
+		if c.Bundles[i].Name == name {
+			return &c.Bundles[i]
+		}
+	}
+	return nil
+}
+
+// dir is where the pinned content of the bundle is cached; "" until it
+// has been fetched once.
+func (b policyBundle) dir() string {
+	if b.ContentDigest == "" {
+		return ""
+	}
+	return filepath.Join(policyDir(), b.Name, strings.TrimPrefix(b.ContentDigest, "sha256:"))
+}
+
+func (b policyBundle) cached() bool {
+	dir := b.dir()
+	if dir == "" {
+		return false
+	}
+	_, err := os.Stat(dir)
+	return err == nil
+}
+
+// fetchPolicyBundle downloads a bundle into the cache. With resolve, the
+// source's Ref (or OCI tag) is looked up again and the bundle is re-pinned
+// to what it points at now; otherwise the pinned Digest is fetched and
+// must reproduce the pinned ContentDigest. The returned bundle carries the
+// pins of what was fetched, and verified says whether its signature was
+// checked.
+func fetchPolicyBundle(ctx context.Context, b policyBundle, resolve bool) (fetched policyBundle, verified bool, err error) {
+	if !policyNamePattern.MatchString(b.Name) {
+		return b, false, fmt.Errorf("invalid bundle name %q", b.Name)
+	}
+	if !resolve && b.Digest == "" {
+		return b, false, errors.New(b.Name + " is not pinned; run policy-update")
+	}
+	root := filepath.Join(policyDir(), b.Name)
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return b, false, err
+	}
+	tmp, err := os.MkdirTemp(root, ".fetch-")
+	if err != nil {
+		return b, false, err
+	}
+	defer os.RemoveAll(tmp)
+
+	fetched = b
+	var content string
+	switch {
+	case strings.HasPrefix(b.Source, "oci://"):
+		content = filepath.Join(tmp, "bundle")
+		fetched.Digest, err = pullPolicyArtifact(b, resolve, content)
+	case strings.HasPrefix(b.Source, "git+"):
+		content, fetched.Digest, err = checkoutPolicyRepository(ctx, b, resolve, tmp)
+	default:
+		err = fmt.Errorf("unsupported source %q: use oci://... or git+https://...", b.Source)
+	}
+	if err != nil {
+		return b, false, err
+	}
+
+	fetched.ContentDigest, err = policyContentDigest(content)
+	if err != nil {
+		return b, false, err
+	}
+	if !resolve && b.ContentDigest != "" && fetched.ContentDigest != b.ContentDigest {
+		return b, false, fmt.Errorf("%s at %s has content %s, but %s is pinned", b.Name, b.Digest, fetched.ContentDigest, b.ContentDigest)
+	}
+	key := firstNonEmpty(b.PublicKey, os.Getenv("INFRAKIT_POLICY_PUBLIC_KEY"))
+	if key != "" {
+		if err := verifyPolicySignature(content, fetched.ContentDigest, key); err != nil {
+			return b, false, fmt.Errorf("%s: %v", b.Name, err)
+		}
+		verified = true
+	}
+	if fetched.cached() {
+		return fetched, verified, nil
+	}
+	if err := os.Rename(content, fetched.dir()); err != nil && !fetched.cached() {
+		return b, false, err
+	}
+	return fetched, verified, nil
+}
+
+func verifyPolicySignature(dir, contentDigest, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid public key: expected a base64 ed25519 key")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, policySignatureFile))
+	if err != nil {
+		return errors.New("bundle is not signed (no " + policySignatureFile + ")")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), []byte(contentDigest), sig) {
+		return errors.New("bundle signature does not verify")
+	}
+	return nil
+}
+
+// policyContentDigest hashes the sorted list of file digests and paths of
+// dir, so the result depends on content only, not on archive layout or
+// timestamps.
+func policyContentDigest(dir string) (string, error) {
+	var lines []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == policySignatureFile || !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		lines = append(lines, hex.EncodeToString(sum[:])+"  "+filepath.ToSlash(rel)+"\n")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(lines) == 0 {
+		return "", errors.New("bundle has no files")
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "")))
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// pullPolicyArtifact downloads an OCI bundle into dir and returns its
+// manifest digest.
+func pullPolicyArtifact(b policyBundle, resolve bool, dir string) (string, error) {
+	ref, err := parseImageRef(strings.TrimPrefix(b.Source, "oci://"))
+	if err != nil {
+		return "", err
+	}
+	reference := b.Digest
+	if resolve {
+		reference = ref.reference()
+	}
+	client := newRegistryClient()
+	manifest, digest, err := client.manifest(ref, reference)
+	if err != nil {
+		return "", err
+	}
+	if manifest.isIndex() {
+		return "", errors.New(b.Source + " is an image index, not a policy bundle")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	for _, layer := range manifest.Layers {
+		data, err := client.blob(ref, layer.Digest)
+		if err != nil {
+			return "", err
+		}
+		if sum := sha256.Sum256(data); "sha256:"+hex.EncodeToString(sum[:]) != layer.Digest {
+			return "", fmt.Errorf("layer %s does not match its digest", layer.Digest)
+		}
+		if title := layer.Annotations["org.opencontainers.image.title"]; title != "" && !strings.Contains(layer.MediaType, "tar") {
+			path, err := bundlePath(dir, title)
+			if err != nil {
+				return "", err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := extractTarGz(bytes.NewReader(data), dir); err != nil {
+			return "", fmt.Errorf("layer %s: %v", layer.Digest, err)
+		}
+	}
+	return digest, nil
+}
+
+// bundlePath joins an archive entry name to dir, refusing names that would
+// land outside it.
+func bundlePath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unsafe path %q in bundle", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// extractTarGz extracts the regular files and directories of an archive.
+func extractTarGz(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path, err := bundlePath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0o700)
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+				var f *os.File
+				if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600); err == nil {
+					_, err = io.Copy(f, io.LimitReader(tr, 256<<20))
+					if cerr := f.Close(); err == nil {
+						err = cerr
+					}
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// checkoutPolicyRepository fetches one commit of a git bundle into tmp and
+// returns the bundle directory and the commit.
+func checkoutPolicyRepository(ctx context.Context, b policyBundle, resolve bool, tmp string) (string, string, error) {
+	url := strings.TrimPrefix(b.Source, "git+")
+	commit := b.Digest
+	if resolve {
+		ref := firstNonEmpty(b.Ref, "HEAD")
+		commit = ""
+		if commitPattern.MatchString(ref) {
+			commit = ref
+		} else {
+			out, err := gitOutput(ctx, "", "ls-remote", url, ref, ref+"^{}")
+			if err != nil {
+				return "", "", err
+			}
+			// A peeled annotated tag (ref^{}) names the commit; prefer it.
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) == 2 && (commit == "" || strings.HasSuffix(fields[1], "^{}")) {
+					commit = fields[0]
+				}
+			}
+			if commit == "" {
+				return "", "", fmt.Errorf("%s has no ref %s", url, ref)
+			}
+		}
+	}
+	repo := filepath.Join(tmp, "repo")
+	for _, args := range [][]string{
+		{"init", "--quiet", repo},
+		{"-C", repo, "fetch", "--quiet", "--depth", "1", url, commit},
+		{"-C", repo, "-c", "advice.detachedHead=false", "checkout", "--quiet", "FETCH_HEAD"},
+	} {
+		if _, err := gitOutput(ctx, "", args...); err != nil {
+			return "", "", err
+		}
+	}
+	os.RemoveAll(filepath.Join(repo, ".git"))
+	content := repo
+	if b.Path != "" {
+		var err error
+		if content, err = bundlePath(repo, b.Path); err != nil {
+			return "", "", err
+		}
+		if info, err := os.Stat(content); err != nil || !info.IsDir() {
+			return "", "", fmt.Errorf("%s has no directory %s at %s", url, b.Path, commit)
+		}
+	}
+	return content, commit, nil
+}
+
+// policyBundleDirs returns the cached directory of every configured
+// bundle, fetching pinned content that is not cached yet.
+func policyBundleDirs(ctx context.Context) (map[string]string, error) {
+	config, err := loadPolicyConfig()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]string{}
+	for _, b := range config.Bundles {
+		if !b.cached() {
+			if b, _, err = fetchPolicyBundle(ctx, b, false); err != nil {
+				return nil, err
+			}
+		}
+		dirs[b.Name] = b.dir()
+	}
+	return dirs, nil
+}
+
+// policyFetchRequest is the request body for policy-fetch.
+type policyFetchRequest struct {
+	// Name selects one bundle; with Source, the bundle is added (or its
+	// source replaced) and pinned to what Source and Ref point at now.
+	Name      string `json:"name"`
+	Source    string `json:"source"`
+	Ref       string `json:"ref"`
+	Path      string `json:"path"`
+	PublicKey string `json:"publicKey"`
+}
+
+// policyFetch downloads policy bundles at their pinned digests, e.g. to
+// restore the cache from a distributed config, or adds a new bundle.
+func policyFetch(input map[string]interface{}) map[string]interface{} {
+	var req policyFetchRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	config, err := loadPolicyConfig()
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read policy config: " + err.Error(),
+		}
+	}
+
+	if req.Source != "" {
+		if !policyNamePattern.MatchString(req.Name) {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "'name' must be lowercase letters, digits, '.', '_' or '-'",
+			}
+		}
+		b := policyBundle{Name: req.Name, Source: req.Source, Ref: req.Ref, Path: req.Path, PublicKey: req.PublicKey}
+		fetched, verified, err := fetchPolicyBundle(requestContext(input), b, true)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to fetch " + req.Name + ": " + err.Error(),
+			}
+		}
+		if existing := config.bundle(req.Name); existing != nil {
+			*existing = fetched
+		} else {
+			config.Bundles = append(config.Bundles, fetched)
+		}
+		if err := savePolicyConfig(config); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to save policy config: " + err.Error(),
+			}
+		}
+		return map[string]interface{}{
+			"success":  true,
+			"bundles":  []interface{}{policyBundleStatus(fetched, verified, "")},
+			"config":   policyConfigPath(),
+			"verified": verified,
+		}
+	}
+
+	var bundles []interface{}
+	failed := 0
+	for _, b := range config.Bundles {
+		if req.Name != "" && b.Name != req.Name {
+			continue
+		}
+		fetched, verified, err := fetchPolicyBundle(requestContext(input), b, false)
+		message := ""
+		if err != nil {
+			message = err.Error()
+			failed++
+		}
+		bundles = append(bundles, policyBundleStatus(fetched, verified, message))
+	}
+	if req.Name != "" && len(bundles) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No bundle named " + req.Name + " in " + policyConfigPath(),
+		}
+	}
+	result := map[string]interface{}{
+		"success": failed == 0,
+		"bundles": bundles,
+		"config":  policyConfigPath(),
+	}
+	if failed > 0 {
+		result["error"] = fmt.Sprintf("%d of %d bundles failed to fetch", failed, len(bundles))
+	}
+	return result
+}
+
+func policyBundleStatus(b policyBundle, verified bool, err string) map[string]interface{} {
+	status := map[string]interface{}{
+		"name":          b.Name,
+		"source":        b.Source,
+		"digest":        b.Digest,
+		"contentDigest": b.ContentDigest,
+		"verified":      verified,
+		"cached":        b.cached(),
+	}
+	if b.Ref != "" {
+		status["ref"] = b.Ref
+	}
+	if b.cached() {
+		status["dir"] = b.dir()
+	}
+	if err != "" {
+		status["error"] = err
+	}
+	return status
+}
+
+// policyUpdateRequest is the request body for policy-update.
+type policyUpdateRequest struct {
+	// Name limits the update to one bundle.
+	Name string `json:"name"`
+	// Check reports available updates without fetching them or changing
+	// the config.
+	Check bool `json:"check"`
+}
+
+// policyUpdate re-resolves each bundle's ref or tag and re-pins bundles
+// whose content changed, after verifying them.
+func policyUpdate(input map[string]interface{}) map[string]interface{} {
+	var req policyUpdateRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	config, err := loadPolicyConfig()
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read policy config: " + err.Error(),
+		}
+	}
+	var updates []interface{}
+	var report strings.Builder
+	changed, failed := 0, 0
+	for i, b := range config.Bundles {
+		if req.Name != "" && b.Name != req.Name {
+			continue
+		}
+		entry := map[string]interface{}{"name": b.Name, "from": b.Digest}
+		updates = append(updates, entry)
+		fetched, verified, err := fetchPolicyBundle(requestContext(input), b, true)
+		if err != nil {
+			entry["error"] = err.Error()
+			failed++
+			fmt.Fprintf(&report, "✗ %s: %s\n", b.Name, firstLines(err.Error(), 1))
+			continue
+		}
+		entry["to"] = fetched.Digest
+		entry["verified"] = verified
+		entry["updated"] = fetched.ContentDigest != b.ContentDigest || fetched.Digest != b.Digest
+		if entry["updated"] != true {
+			fmt.Fprintf(&report, "✓ %s is up to date\n", b.Name)
+			continue
+		}
+		changed++
+		fmt.Fprintf(&report, "! %s %s -> %s\n", b.Name, shortDigest(b.Digest), shortDigest(fetched.Digest))
+		if !req.Check {
+			config.Bundles[i] = fetched
+		}
+	}
+	if req.Name != "" && len(updates) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No bundle named " + req.Name + " in " + policyConfigPath(),
+		}
+	}
+	if changed > 0 && !req.Check {
+		if err := savePolicyConfig(config); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to save policy config: " + err.Error(),
+			}
+		}
+	}
+	return map[string]interface{}{
+		"success": failed == 0,
+		"updates": updates,
+		"changed": changed,
+		"config":  policyConfigPath(),
+		"report":  report.String(),
+	}
+}
+
+func shortDigest(digest string) string {
+	d := strings.TrimPrefix(digest, "sha256:")
+	if len(d) > 12 {
+		d = d[:12]
+	}
+	if d == "" {
+		return "(unpinned)"
+	}
+	return d
+}
+
+// policyList shows the configured bundles and whether their pinned
+// content is cached.
+func policyList(input map[string]interface{}) map[string]interface{} {
+	config, err := loadPolicyConfig()
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read policy config: " + err.Error(),
+		}
+	}
+	bundles := []interface{}{}
+	for _, b := range config.Bundles {
+		status := policyBundleStatus(b, false, "")
+		delete(status, "verified")
+		status["signed"] = b.PublicKey != "" || os.Getenv("INFRAKIT_POLICY_PUBLIC_KEY") != ""
+		bundles = append(bundles, status)
+	}
+	return map[string]interface{}{
+		"success":  true,
+		"bundles":  bundles,
+		"config":   policyConfigPath(),
+		"cacheDir": policyDir(),
+	}
+}
+
+// policyRemove drops a bundle from the config, and its cached content.
+func policyRemove(input map[string]interface{}) map[string]interface{} {
+	name, _ := input["name"].(string)
+	config, err := loadPolicyConfig()
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read policy config: " + err.Error(),
+		}
+	}
+	if config.bundle(name) == nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No bundle named " + name + " in " + policyConfigPath(),
+		}
+	}
+	kept := config.Bundles[:0]
+	for _, b := range config.Bundles {
+		if b.Name != name {
+			kept = append(kept, b)
+		}
+	}
+	config.Bundles = kept
+	if err := savePolicyConfig(config); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to save policy config: " + err.Error(),
+		}
+	}
+	os.RemoveAll(filepath.Join(policyDir(), name))
+	return map[string]interface{}{
+		"success": true,
+		"removed": name,
+	}
+}
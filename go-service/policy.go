@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policySet is the policies evaluated against manifests: Rego files, run
+// with the opa CLI in the conftest style (deny, violation and warn rules
+// over one resource as input), and ValidatingAdmissionPolicy CEL
+// validations, evaluated in process.
+type policySet struct {
+	Rego []string
+	CEL  []*celPolicy
+}
+
+// celPolicy is a ValidatingAdmissionPolicy.
+type celPolicy struct {
+	Name          string
+	File          string
+	Severity      string
+	FailurePolicy string
+	Rules         []policyResourceRule
+	Conditions    []celNamedExpr
+	Variables     []celNamedExpr
+	Validations   []celValidation
+}
+
+type policyResourceRule struct {
+	APIGroups, APIVersions, Resources []string
+}
+
+type celNamedExpr struct {
+	Name    string
+	Program *celProgram
+}
+
+type celValidation struct {
+	Program           *celProgram
+	Message           string
+	MessageExpression *celProgram
+	Reason            string
+}
+
+// policyViolation is one rule a resource breaks. Severity is "error" for
+// deny rules and Deny validations, "warning" for warn rules, or what the
+// rule itself says.
+type policyViolation struct {
+	RuleID   string `json:"ruleId"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Resource string `json:"resource"`
+	Document int    `json:"document"`
+	Policy   string `json:"policy"`
+}
+
+// policySeverityAnnotation sets the severity of a ValidatingAdmissionPolicy's
+// violations ("error", "warning" or "info").
+const policySeverityAnnotation = "infrakit.io/severity"
+
+// loadPolicies reads the policies in the given files and directories.
+// Directories are searched recursively; YAML files other than
+// ValidatingAdmissionPolicies (policy tests, bindings) are ignored.
+func loadPolicies(paths []string) (policySet, error) {
+	var set policySet
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".rego":
+				set.Rego = append(set.Rego, path)
+			case ".yaml", ".yml", ".json":
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				policies, err := parseCELPolicies(path, string(data))
+				if err != nil {
+					return err
+				}
+				set.CEL = append(set.CEL, policies...)
+			}
+			return nil
+		})
+		if err != nil {
+			return set, err
+		}
+	}
+	return set, nil
+}
+
+// parseCELPolicies compiles the ValidatingAdmissionPolicies of a file.
+func parseCELPolicies(file, data string) ([]*celPolicy, error) {
+	if !strings.Contains(data, "ValidatingAdmissionPolicy") {
+		return nil, nil
+	}
+	objects, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	var out []*celPolicy
+	for _, obj := range objects {
+		if nestedString(obj, "kind") != "ValidatingAdmissionPolicy" {
+			continue
+		}
+		p := &celPolicy{
+			Name:          nestedString(obj, "metadata", "name"),
+			File:          file,
+			Severity:      firstNonEmpty(nestedString(obj, "metadata", "annotations", policySeverityAnnotation), "error"),
+			FailurePolicy: firstNonEmpty(nestedString(obj, "spec", "failurePolicy"), "Fail"),
+		}
+		fail := func(what string, err error) error {
+			return fmt.Errorf("%s: policy %s: %s: %v", file, p.Name, what, err)
+		}
+		for _, item := range nestedSlice(obj, "spec", "matchConstraints", "resourceRules") {
+			m := asObject(item)
+			p.Rules = append(p.Rules, policyResourceRule{schemaStrings(m["apiGroups"]), schemaStrings(m["apiVersions"]), schemaStrings(m["resources"])})
+		}
+		for key, dst := range map[string]*[]celNamedExpr{"matchConditions": &p.Conditions, "variables": &p.Variables} {
+			for _, item := range nestedSlice(obj, "spec", key) {
+				m := asObject(item)
+				prog, err := compileCEL(nestedString(m, "expression"))
+				if err != nil {
+					return nil, fail(key+" "+nestedString(m, "name"), err)
+				}
+				*dst = append(*dst, celNamedExpr{nestedString(m, "name"), prog})
+			}
+		}
+		for i, item := range nestedSlice(obj, "spec", "validations") {
+			m := asObject(item)
+			prog, err := compileCEL(nestedString(m, "expression"))
+			if err != nil {
+				return nil, fail(fmt.Sprintf("validations[%d]", i), err)
+			}
+			v := celValidation{Program: prog, Message: nestedString(m, "message"), Reason: nestedString(m, "reason")}
+			if expr := nestedString(m, "messageExpression"); expr != "" {
+				if v.MessageExpression, err = compileCEL(expr); err != nil {
+					return nil, fail(fmt.Sprintf("validations[%d].messageExpression", i), err)
+				}
+			}
+			if v.Message == "" {
+				v.Message = "failed expression: " + nestedString(m, "expression")
+			}
+			p.Validations = append(p.Validations, v)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// evaluate checks every object against the set.
+func (s policySet) evaluate(ctx context.Context, objects []map[string]interface{}) ([]policyViolation, error) {
+	var violations []policyViolation
+	for i, obj := range objects {
+		for _, p := range s.CEL {
+			violations = append(violations, p.evaluate(obj, i+1)...)
+		}
+	}
+	if len(s.Rego) > 0 {
+		found, err := evaluateRego(ctx, s.Rego, objects)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, found...)
+	}
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Document < violations[j].Document })
+	return violations, nil
+}
+
+func (p *celPolicy) matches(obj map[string]interface{}) bool {
+	if len(p.Rules) == 0 {
+		return true
+	}
+	group, version := splitAPIVersion(nestedString(obj, "apiVersion"))
+	resource := kindToResource(nestedString(obj, "kind"))
+	listed := func(list []string, v string) bool {
+		for _, item := range list {
+			if item == "*" || item == v {
+				return true
+			}
+		}
+		return false
+	}
+	for _, r := range p.Rules {
+		if listed(r.APIGroups, group) && listed(r.APIVersions, version) && listed(r.Resources, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *celPolicy) evaluate(obj map[string]interface{}, document int) []policyViolation {
+	if !p.matches(obj) {
+		return nil
+	}
+	ref := refOf(obj)
+	violation := func(ruleID, message string) policyViolation {
+		return policyViolation{RuleID: ruleID, Severity: p.Severity, Message: message, Resource: ref.String(), Document: document, Policy: p.File}
+	}
+	// An error evaluating the policy blocks the resource only with
+	// failurePolicy Fail, as in the API server.
+	failed := func(ruleID string, err error) []policyViolation {
+		if p.FailurePolicy == "Ignore" {
+			return nil
+		}
+		return []policyViolation{violation(ruleID, "expression error: "+err.Error())}
+	}
+	vars := map[string]interface{}{
+		"object":    celValue(obj),
+		"oldObject": nil,
+		"params":    nil,
+		"request": map[string]interface{}{
+			"operation": "CREATE",
+			"name":      ref.Name,
+			"namespace": ref.Namespace,
+			"kind":      map[string]interface{}{"kind": ref.Kind},
+		},
+	}
+	for _, c := range p.Conditions {
+		v, err := c.Program.eval(vars)
+		if err != nil {
+			return failed(p.Name+"/"+c.Name, err)
+		}
+		if v != true {
+			return nil
+		}
+	}
+	variables := map[string]interface{}{}
+	vars["variables"] = variables
+	for _, v := range p.Variables {
+		// A variable that fails to evaluate is left undefined, so only the
+		// validations using it fail.
+		if value, err := v.Program.eval(vars); err == nil {
+			variables[v.Name] = value
+		}
+	}
+	var out []policyViolation
+	for i, v := range p.Validations {
+		ruleID := fmt.Sprintf("%s/%d", p.Name, i)
+		if v.Reason != "" {
+			ruleID = p.Name + "/" + v.Reason
+		}
+		result, err := v.Program.eval(vars)
+		if err != nil {
+			out = append(out, failed(ruleID, err)...)
+			continue
+		}
+		if result == true {
+			continue
+		}
+		message := v.Message
+		if v.MessageExpression != nil {
+			if m, err := v.MessageExpression.eval(vars); err == nil {
+				if s, ok := m.(string); ok && s != "" {
+					message = s
+				}
+			}
+		}
+		out = append(out, violation(ruleID, message))
+	}
+	return out
+}
+
+// regoRuleSeverity maps conftest rule names to severities.
+var regoRuleSeverity = map[string]string{"deny": "error", "violation": "error", "warn": "warning"}
+
+// evaluateRego runs `opa eval` once per object, with the object as input,
+// and collects the deny, violation and warn rules of every package. Rule
+// results may be messages or objects with msg (or message), id and
+// severity.
+func evaluateRego(ctx context.Context, files []string, objects []map[string]interface{}) ([]policyViolation, error) {
+	args := []string{"eval", "--format", "json", "--stdin-input"}
+	for _, f := range files {
+		args = append(args, "--data", f)
+	}
+	args = append(args, "data")
+
+	results := make([][]policyViolation, len(objects))
+	errs := make([]error, len(objects))
+	sem := newSemaphore(envLimit("INFRAKIT_MAX_OPA", 4))
+	var wg sync.WaitGroup
+	for i, obj := range objects {
+		wg.Add(1)
+		go func(i int, obj map[string]interface{}) {
+			defer wg.Done()
+			defer sem.acquire()()
+			input, err := json.Marshal(obj)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			out, err := runOPA(ctx, args, input)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			var doc struct {
+				Result []struct {
+					Expressions []struct {
+						Value interface{} `json:"value"`
+					} `json:"expressions"`
+				} `json:"result"`
+			}
+			if err := json.Unmarshal(out, &doc); err != nil {
+				errs[i] = fmt.Errorf("unexpected opa output: %v", err)
+				return
+			}
+			ref := refOf(obj).String()
+			for _, r := range doc.Result {
+				for _, e := range r.Expressions {
+					collectRegoResults(e.Value, nil, func(pkg, rule string, item interface{}) {
+						results[i] = append(results[i], regoViolation(pkg, rule, item, ref, i+1))
+					}, 0)
+				}
+			}
+		}(i, obj)
+	}
+	wg.Wait()
+	var out []policyViolation
+	for i := range objects {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		out = append(out, results[i]...)
+	}
+	return out, nil
+}
+
+func runOPA(ctx context.Context, args []string, input []byte) ([]byte, error) {
+	cmd := toolCommand(ctx, "opa", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	out, err := cmd.Output()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("Rego policies need the opa CLI on PATH (https://www.openpolicyagent.org/docs/latest/#running-opa)")
+	}
+	if err != nil {
+		return nil, errors.New(strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return out, nil
+}
+
+// collectRegoResults walks the data document for conftest-style rules.
+func collectRegoResults(v interface{}, pkg []string, found func(pkg, rule string, item interface{}), depth int) {
+	m, ok := v.(map[string]interface{})
+	if !ok || depth > 32 {
+		return
+	}
+	for _, key := range sortedKeys(m) {
+		if _, isRule := regoRuleSeverity[key]; isRule {
+			if items, ok := m[key].([]interface{}); ok {
+				for _, item := range items {
+					found(strings.Join(pkg, "."), key, item)
+				}
+				continue
+			}
+		}
+		collectRegoResults(m[key], append(append([]string{}, pkg...), key), found, depth+1)
+	}
+}
+
+func regoViolation(pkg, rule string, item interface{}, resource string, document int) policyViolation {
+	v := policyViolation{RuleID: pkg + "." + rule, Severity: regoRuleSeverity[rule], Resource: resource, Document: document, Policy: pkg}
+	switch t := item.(type) {
+	case string:
+		v.Message = t
+	case map[string]interface{}:
+		v.Message = firstNonEmpty(nestedString(t, "msg"), nestedString(t, "message"))
+		if id := firstNonEmpty(nestedString(t, "id"), nestedString(t, "ruleId"), nestedString(t, "rule")); id != "" {
+			v.RuleID = id
+		}
+		if s := nestedString(t, "severity"); s != "" {
+			v.Severity = s
+		}
+		if v.Message == "" {
+			data, _ := json.Marshal(t)
+			v.Message = string(data)
+		}
+	default:
+		data, _ := json.Marshal(t)
+		v.Message = string(data)
+	}
+	return v
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// policyCheckRequest is the request body for policy-check. The manifest
+// comes from the usual manifest, manifestFile or name/chart keys.
+type policyCheckRequest struct {
+	// Policies are Rego files, ValidatingAdmissionPolicy YAML files or
+	// directories of them.
+	Policies []string `json:"policies"`
+	// Inline are policies given as text: Rego modules or
+	// ValidatingAdmissionPolicy YAML.
+	Inline []string `json:"inline"`
+	// Bundles names configured policy bundles to include; "*" is all.
+	Bundles []string `json:"bundles"`
+	// Builtin adds infrakit's own rules; they are used on their own when
+	// no other policies are given.
+	Builtin bool `json:"builtin"`
+	// Skip lists rule IDs to leave out of the result.
+	Skip []string `json:"skip"`
+	// FailOn is the lowest severity that fails the check: "error"
+	// (default), "warning" or "info".
+	FailOn string `json:"failOn"`
+}
+
+// policySeverityRank orders severities for FailOn.
+var policySeverityRank = map[string]int{"info": 1, "warning": 2, "error": 3}
+
+// builtinPolicies are the rules policy-check applies without any policy
+// files, by rule ID.
+var builtinPolicies = map[string]func(container map[string]interface{}, key string) string{
+	"builtin/no-latest-tag": func(c map[string]interface{}, key string) string {
+		ref, err := parseImageRef(nestedString(c, "image"))
+		if err != nil || ref.Digest != "" || ref.Tag != "latest" {
+			return ""
+		}
+		return fmt.Sprintf("container %s uses image %s, which is not pinned to a tag or digest", nestedString(c, "name"), nestedString(c, "image"))
+	},
+	"builtin/require-resource-limits": func(c map[string]interface{}, key string) string {
+		if key == "ephemeralContainers" {
+			return ""
+		}
+		var missing []string
+		for _, r := range []string{"cpu", "memory"} {
+			if nestedValue(c, "resources", "limits", r) == nil {
+				missing = append(missing, r)
+			}
+		}
+		if len(missing) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("container %s has no %s limit", nestedString(c, "name"), strings.Join(missing, " or "))
+	},
+	"builtin/no-privileged": func(c map[string]interface{}, key string) string {
+		if nestedValue(c, "securityContext", "privileged") != true {
+			return ""
+		}
+		return fmt.Sprintf("container %s runs privileged", nestedString(c, "name"))
+	},
+}
+
+// policyCheck evaluates a rendered manifest against Rego and
+// ValidatingAdmissionPolicy policies from files, inline text, policy
+// bundles and the built-in rules, and lists the violations with their
+// severity, resource and rule ID. It passes when no violation reaches
+// input["failOn"].
+func policyCheck(input map[string]interface{}) map[string]interface{} {
+	var req policyCheckRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	failOn := firstNonEmpty(req.FailOn, "error")
+	if policySeverityRank[failOn] == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'failOn' must be error, warning or info",
+		}
+	}
+	if len(req.Policies) == 0 && len(req.Inline) == 0 && len(req.Bundles) == 0 {
+		req.Builtin = true
+	}
+
+	paths := append([]string{}, req.Policies...)
+	if len(req.Bundles) > 0 {
+		dirs, err := policyBundleDirs(requestContext(input))
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to load policy bundles: " + err.Error(),
+			}
+		}
+		for _, name := range req.Bundles {
+			if name == "*" {
+				names := make([]string, 0, len(dirs))
+				for n := range dirs {
+					names = append(names, n)
+				}
+				sort.Strings(names)
+				for _, n := range names {
+					paths = append(paths, dirs[n])
+				}
+				continue
+			}
+			dir, ok := dirs[name]
+			if !ok {
+				return map[string]interface{}{
+					"success": false,
+					"error":   "No policy bundle named " + name + "; see policy-list",
+				}
+			}
+			paths = append(paths, dir)
+		}
+	}
+	set, err := loadPolicies(paths)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to load policies: " + err.Error(),
+		}
+	}
+	for i, text := range req.Inline {
+		if err := set.addInline(requestContext(input), text, i+1); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+	}
+
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	violations, err := set.evaluate(requestContext(input), objects)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to evaluate policies: " + err.Error(),
+		}
+	}
+	if req.Builtin {
+		violations = append(violations, evaluateBuiltinPolicies(objects)...)
+		sort.SliceStable(violations, func(i, j int) bool { return violations[i].Document < violations[j].Document })
+	}
+
+	skip := map[string]bool{}
+	for _, id := range req.Skip {
+		skip[id] = true
+	}
+	kept := []policyViolation{}
+	summary := map[string]int{"error": 0, "warning": 0, "info": 0}
+	failing := 0
+	var report strings.Builder
+	for _, v := range violations {
+		if skip[v.RuleID] {
+			continue
+		}
+		kept = append(kept, v)
+		summary[v.Severity]++
+		if policySeverityRank[v.Severity] >= policySeverityRank[failOn] {
+			failing++
+		}
+		fmt.Fprintf(&report, "%s %s %s: %s\n", strings.ToUpper(v.Severity), v.Resource, v.RuleID, v.Message)
+	}
+	fmt.Fprintf(&report, "%d resources checked, %d errors, %d warnings, %d info\n", len(objects), summary["error"], summary["warning"], summary["info"])
+	return map[string]interface{}{
+		"success":    true,
+		"passed":     failing == 0,
+		"violations": kept,
+		"summary":    summary,
+		"report":     report.String(),
+	}
+}
+
+// addInline adds a policy given as text: a Rego module, which opa needs as
+// a file in the request's workspace, or ValidatingAdmissionPolicy YAML.
+func (s *policySet) addInline(ctx context.Context, text string, n int) error {
+	if regoPackage.MatchString(text) {
+		f, err := createTemp(ctx, "policy-*.rego")
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString(text)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		s.Rego = append(s.Rego, f.Name())
+		return nil
+	}
+	policies, err := parseCELPolicies(fmt.Sprintf("inline policy %d", n), text)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return fmt.Errorf("inline policy %d is neither a Rego module nor a ValidatingAdmissionPolicy", n)
+	}
+	s.CEL = append(s.CEL, policies...)
+	return nil
+}
+
+// evaluateBuiltinPolicies applies builtinPolicies to every container, init
+// container and ephemeral container, wherever the pod spec is nested.
+func evaluateBuiltinPolicies(objects []map[string]interface{}) []policyViolation {
+	var violations []policyViolation
+	ids := make([]string, 0, len(builtinPolicies))
+	for id := range builtinPolicies {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i, obj := range objects {
+		resource := refOf(obj).String()
+		var walk func(v interface{})
+		walk = func(v interface{}) {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				for _, key := range sortedKeys(t) {
+					if key == "containers" || key == "initContainers" || key == "ephemeralContainers" {
+						for _, c := range nestedSlice(t, key) {
+							for _, id := range ids {
+								if msg := builtinPolicies[id](asObject(c), key); msg != "" {
+									violations = append(violations, policyViolation{RuleID: id, Severity: "error", Message: msg, Resource: resource, Document: i + 1, Policy: "builtin"})
+								}
+							}
+						}
+						continue
+					}
+					walk(t[key])
+				}
+			case []interface{}:
+				for _, item := range t {
+					walk(item)
+				}
+			}
+		}
+		walk(obj)
+	}
+	return violations
+}
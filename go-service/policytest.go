@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// policyTestRequest is the request body for policy-test.
+type policyTestRequest struct {
+	// Dir holds the policies (default "policies"); test files are the YAML
+	// files under Dir/tests.
+	Dir string `json:"dir"`
+	// Init writes a test file skeleton for every policy without one (and
+	// an example policy when Dir has none) instead of running the tests.
+	Init bool `json:"init"`
+	// Run only runs cases whose name contains this string.
+	Run string `json:"run"`
+}
+
+// policyTestCase is one case of a test file:
+//
+//	cases:
+//	- name: rejects images tagged latest
+//	  manifest: |
+//	    apiVersion: v1
+//	    kind: Pod
+//	    ...
+//	  expect: deny
+//	  rules: [no-latest-tag/Invalid]
+//	  messages: ["latest"]
+//
+// Expect is "deny" (some error-severity violation) or "allow" (none).
+// Rules and Messages, when given, must each match a violation: rule IDs
+// exactly, messages as substrings. manifestFile is resolved relative to
+// the test file.
+type policyTestCase struct {
+	Name         string   `json:"name"`
+	Manifest     string   `json:"manifest"`
+	ManifestFile string   `json:"manifestFile"`
+	Expect       string   `json:"expect"`
+	Rules        []string `json:"rules"`
+	Messages     []string `json:"messages"`
+}
+
+type policyTestResult struct {
+	File       string            `json:"file"`
+	Name       string            `json:"name"`
+	Passed     bool              `json:"passed"`
+	Failures   []string          `json:"failures,omitempty"`
+	Violations []policyViolation `json:"violations"`
+}
+
+// policyTest runs the test cases of a policy directory, each a manifest
+// and the verdict the policies must reach on it, through the same
+// evaluation policy checks use, giving policy authors a red/green loop.
+func policyTest(input map[string]interface{}) map[string]interface{} {
+	var req policyTestRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Dir == "" {
+		req.Dir = "policies"
+	}
+	testsDir := filepath.Join(req.Dir, "tests")
+	if req.Init {
+		return scaffoldPolicyTests(req.Dir, testsDir)
+	}
+
+	set, err := loadPolicies([]string{req.Dir})
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to load policies: " + err.Error(),
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(testsDir, "*.yaml"))
+	more, _ := filepath.Glob(filepath.Join(testsDir, "*.yml"))
+	files = append(files, more...)
+	sort.Strings(files)
+	if len(files) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No test files in " + testsDir + "; run policy-test --init to create them",
+		}
+	}
+
+	var results []policyTestResult
+	var report strings.Builder
+	failed := 0
+	for _, file := range files {
+		cases, err := readPolicyTestFile(file)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		for i, c := range cases {
+			if c.Name == "" {
+				c.Name = fmt.Sprintf("case %d", i+1)
+			}
+			if req.Run != "" && !strings.Contains(c.Name, req.Run) {
+				continue
+			}
+			r := runPolicyTestCase(requestContext(input), set, file, c)
+			results = append(results, r)
+			if r.Passed {
+				fmt.Fprintf(&report, "✓ %s: %s\n", filepath.Base(file), c.Name)
+				continue
+			}
+			failed++
+			fmt.Fprintf(&report, "✗ %s: %s\n", filepath.Base(file), c.Name)
+			for _, f := range r.Failures {
+				fmt.Fprintf(&report, "    %s\n", f)
+			}
+		}
+	}
+	fmt.Fprintf(&report, "%d cases, %d passed, %d failed\n", len(results), len(results)-failed, failed)
+	return map[string]interface{}{
+		"success": true,
+		"passed":  failed == 0,
+		"results": results,
+		"report":  report.String(),
+	}
+}
+
+func readPolicyTestFile(file string) ([]policyTestCase, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	var parsed struct {
+		Cases []policyTestCase `json:"cases"`
+	}
+	if err := decodeInput(asObject(deepCopyJSON(doc)), &parsed); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return parsed.Cases, nil
+}
+
+func runPolicyTestCase(ctx context.Context, set policySet, file string, c policyTestCase) policyTestResult {
+	r := policyTestResult{File: file, Name: c.Name, Violations: []policyViolation{}}
+	fail := func(format string, args ...interface{}) {
+		r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+	}
+	manifest := c.Manifest
+	if c.ManifestFile != "" {
+		path := c.ManifestFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+		data, err := readManifestFile(path)
+		if err != nil {
+			fail("reading manifest: %v", err)
+			return r
+		}
+		manifest = data
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		fail("parsing manifest: %v", err)
+		return r
+	}
+	violations, err := set.evaluate(ctx, objects)
+	if err != nil {
+		fail("evaluating policies: %v", err)
+		return r
+	}
+	r.Violations = append(r.Violations, violations...)
+
+	denied := false
+	for _, v := range violations {
+		if v.Severity == "error" {
+			denied = true
+		}
+	}
+	switch c.Expect {
+	case "deny":
+		if !denied {
+			fail("expected deny, got allow")
+		}
+	case "allow":
+		if denied {
+			fail("expected allow, got deny")
+		}
+	default:
+		fail("expect must be deny or allow, not %q", c.Expect)
+	}
+	for _, rule := range c.Rules {
+		found := false
+		for _, v := range violations {
+			found = found || v.RuleID == rule
+		}
+		if !found {
+			fail("rule %s did not fire", rule)
+		}
+	}
+	for _, msg := range c.Messages {
+		found := false
+		for _, v := range violations {
+			found = found || strings.Contains(v.Message, msg)
+		}
+		if !found {
+			fail("no violation message contains %q", msg)
+		}
+	}
+	if len(r.Failures) > 0 {
+		for _, v := range violations {
+			fail("got %s %s: %s (%s)", v.Severity, v.RuleID, v.Message, v.Resource)
+		}
+	}
+	r.Passed = len(r.Failures) == 0
+	return r
+}
+
+var regoPackage = regexp.MustCompile(`(?m)^package\s+([\w.]+)`)
+
+// examplePolicy is written by policy-test --init into an empty policy
+// directory.
+const examplePolicy = `apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingAdmissionPolicy
+metadata:
+  name: no-latest-tag
+spec:
+  failurePolicy: Fail
+  matchConstraints:
+    resourceRules:
+    - apiGroups: [""]
+      apiVersions: ["v1"]
+      resources: ["pods"]
+      operations: ["CREATE", "UPDATE"]
+  validations:
+  - expression: "object.spec.containers.all(c, !c.image.endsWith(':latest') && c.image.contains(':'))"
+    message: "images must be pinned to a tag other than latest"
+    reason: Invalid
+`
+
+// policyTestSkeleton is the test file written for a policy.
+const policyTestSkeleton = `# Test cases for %s. Run them with: policy-test --dir=%s
+cases:
+- name: allows a compliant pod
+  expect: allow
+  manifest: |
+    apiVersion: v1
+    kind: Pod
+    metadata:
+      name: ok
+    spec:
+      containers:
+      - name: app
+        image: nginx:1.25.3
+- name: denies a non-compliant pod
+  expect: deny
+  manifest: |
+    apiVersion: v1
+    kind: Pod
+    metadata:
+      name: bad
+    spec:
+      containers:
+      - name: app
+        image: nginx:latest
+`
+
+func scaffoldPolicyTests(dir, testsDir string) map[string]interface{} {
+	var created []string
+	write := func(path, content string) error {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return err
+		}
+		created = append(created, path)
+		return nil
+	}
+	set, err := loadPolicies([]string{dir})
+	if err != nil && !os.IsNotExist(err) {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to load policies: " + err.Error(),
+		}
+	}
+	names := map[string]bool{}
+	for _, p := range set.CEL {
+		names[p.Name] = true
+	}
+	for _, f := range set.Rego {
+		if strings.HasSuffix(f, "_test.rego") {
+			continue
+		}
+		data, _ := os.ReadFile(f)
+		if m := regoPackage.FindSubmatch(data); m != nil {
+			names[string(m[1])] = true
+		}
+	}
+	if len(names) == 0 {
+		if err := write(filepath.Join(dir, "no-latest-tag.yaml"), examplePolicy); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		names["no-latest-tag"] = true
+	}
+	for _, name := range sortedSet(names) {
+		if err := write(filepath.Join(testsDir, name+".yaml"), fmt.Sprintf(policyTestSkeleton, name, dir)); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"created": created,
+	}
+}
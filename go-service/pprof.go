@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+)
+
+// Profiling is off unless configured:
+//
+//	INFRAKIT_PPROF_ADDR     serve net/http/pprof on this address while running
+//	INFRAKIT_PPROF_TOKEN    bearer token required by the pprof endpoints;
+//	                        mandatory unless the address is loopback
+//	INFRAKIT_CPU_PROFILE    write a CPU profile of the run to this file
+//	INFRAKIT_HEAP_PROFILE   write a heap profile at the end of the run
+//
+// startProfiling returns a stop function that writes pending profiles.
+func startProfiling() func() {
+	var stops []func()
+	if addr := os.Getenv("INFRAKIT_PPROF_ADDR"); addr != "" {
+		if stop, err := servePprof(addr, os.Getenv("INFRAKIT_PPROF_TOKEN")); err != nil {
+			slog.Warn("pprof disabled", "error", err)
+		} else {
+			stops = append(stops, stop)
+		}
+	}
+	if path := os.Getenv("INFRAKIT_CPU_PROFILE"); path != "" {
+		if f, err := os.Create(path); err != nil {
+			slog.Warn("CPU profile disabled", "error", err)
+		} else if err := runtimepprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			slog.Warn("CPU profile disabled", "error", err)
+		} else {
+			stops = append(stops, func() {
+				runtimepprof.StopCPUProfile()
+				f.Close()
+			})
+		}
+	}
+	if path := os.Getenv("INFRAKIT_HEAP_PROFILE"); path != "" {
+		stops = append(stops, func() {
+			f, err := os.Create(path)
+			if err != nil {
+				slog.Warn("Heap profile failed", "error", err)
+				return
+			}
+			defer f.Close()
+			runtime.GC()
+			if err := runtimepprof.WriteHeapProfile(f); err != nil {
+				slog.Warn("Heap profile failed", "error", err)
+			}
+		})
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+func servePprof(addr, token string) (func(), error) {
+	if err := requireToken(addr, token, "INFRAKIT_PPROF_TOKEN"); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pprof/", pprofHandler(token))
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	return func() { srv.Close() }, nil
+}
+
+// requireToken refuses to serve without a token on anything but a loopback
+// address; env names the setting that supplies it.
+func requireToken(addr, token, env string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New(env + " is required to listen on " + addr)
+	}
+	return nil
+}
+
+// pprofHandler serves the net/http/pprof endpoints under /debug/pprof/,
+// requiring `Authorization: Bearer <token>` when token is set.
+func pprofHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return bearerAuth(token, mux)
+}
+
+// bearerAuth requires `Authorization: Bearer <token>` when token is set.
+func bearerAuth(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// progressiveRequest is the request body for generate-progressive.
+type progressiveRequest struct {
+	// Strategy is argo-canary, argo-bluegreen, flagger or blue-green.
+	Strategy string `json:"strategy"`
+	// Deployment limits the conversion to one Deployment; by default every
+	// Deployment in the manifest is converted.
+	Deployment string `json:"deployment"`
+	// Steps are Argo Rollouts canary steps, passed through verbatim.
+	Steps    []interface{} `json:"steps"`
+	Analysis *struct {
+		// SuccessRate is the minimum percentage of non-5xx requests.
+		SuccessRate       float64 `json:"successRate"`
+		MaxLatencyMs      int     `json:"maxLatencyMs"`
+		Interval          string  `json:"interval"`
+		FailureLimit      int     `json:"failureLimit"`
+		PrometheusAddress string  `json:"prometheusAddress"`
+	} `json:"analysis"`
+	AutoPromote bool   `json:"autoPromote"`
+	ActiveSlot  string `json:"activeSlot"`
+}
+
+var defaultCanarySteps = []interface{}{
+	map[string]interface{}{"setWeight": 20},
+	map[string]interface{}{"pause": map[string]interface{}{"duration": "5m"}},
+	map[string]interface{}{"setWeight": 50},
+	map[string]interface{}{"pause": map[string]interface{}{"duration": "5m"}},
+}
+
+const slotLabel = "infrakit.io/slot"
+
+// generateProgressive converts the Deployments in a manifest (and the
+// Services that front them) into progressive delivery resources: Argo
+// Rollouts canaries or blue/green rollouts, Flagger Canaries, or a plain
+// blue/green Deployment pair switched by the Service selector.
+func generateProgressive(input map[string]interface{}) map[string]interface{} {
+	var req progressiveRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	switch req.Strategy {
+	case "argo-canary", "argo-bluegreen", "flagger", "blue-green":
+	default:
+		return map[string]interface{}{
+			"success": false,
+			"error":   "strategy must be one of argo-canary, argo-bluegreen, flagger or blue-green",
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	var changes []map[string]interface{}
+	change := func(action string, obj map[string]interface{}) {
+		changes = append(changes, map[string]interface{}{"action": action, "resource": refOf(obj)})
+	}
+	replaced := map[int][]map[string]interface{}{}
+	var added []map[string]interface{}
+	for i, obj := range objects {
+		if nestedString(obj, "kind") != "Deployment" || (req.Deployment != "" && nestedString(obj, "metadata", "name") != req.Deployment) {
+			continue
+		}
+		svcIndex := matchingService(objects, obj)
+		var svc map[string]interface{}
+		if svcIndex >= 0 {
+			svc = objects[svcIndex]
+			if _, claimed := replaced[svcIndex]; claimed {
+				return map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Service %s matches more than one Deployment; set 'deployment'", nestedString(svc, "metadata", "name")),
+				}
+			}
+		}
+		out, err := progressiveObjects(req, obj, svc)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		replaced[i] = out.deployment
+		change("replaced", obj)
+		if svcIndex >= 0 {
+			replaced[svcIndex] = out.service
+			if out.service == nil {
+				change("removed", svc)
+			}
+		}
+		for _, obj := range out.added {
+			change("added", obj)
+		}
+		added = append(added, out.added...)
+	}
+	if len(changes) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No matching Deployment found in manifest",
+		}
+	}
+
+	var result []map[string]interface{}
+	for i, obj := range objects {
+		if objs, ok := replaced[i]; ok {
+			result = append(result, objs...)
+		} else {
+			result = append(result, obj)
+		}
+	}
+	result = append(result, added...)
+	return map[string]interface{}{
+		"success":  true,
+		"manifest": encodeManifest(result),
+		"changes":  changes,
+	}
+}
+
+type progressiveOutput struct {
+	deployment []map[string]interface{} // replaces the Deployment
+	service    []map[string]interface{} // replaces its Service; nil removes it
+	added      []map[string]interface{}
+}
+
+func progressiveObjects(req progressiveRequest, deploy, svc map[string]interface{}) (progressiveOutput, error) {
+	name := nestedString(deploy, "metadata", "name")
+	namespace := nestedString(deploy, "metadata", "namespace")
+	meta := func(n string) map[string]interface{} {
+		m := map[string]interface{}{"name": n}
+		if namespace != "" {
+			m["namespace"] = namespace
+		}
+		if labels := nestedMap(deploy, "metadata", "labels"); labels != nil {
+			m["labels"] = deepCopy(labels)
+		}
+		return m
+	}
+	var out progressiveOutput
+	keepService := func() {
+		if svc != nil {
+			out.service = []map[string]interface{}{svc}
+		}
+	}
+
+	switch req.Strategy {
+	case "argo-canary", "argo-bluegreen":
+		rollout := map[string]interface{}{
+			"apiVersion": "argoproj.io/v1alpha1",
+			"kind":       "Rollout",
+			"metadata":   meta(name),
+			"spec":       rolloutSpec(deploy),
+		}
+		var analysisName string
+		if req.Analysis != nil {
+			tmpl := analysisTemplate(req, meta(name+"-analysis"), svc)
+			analysisName = name + "-analysis"
+			out.added = append(out.added, tmpl)
+		}
+		analysisRef := func() map[string]interface{} {
+			ref := map[string]interface{}{"templates": []interface{}{map[string]interface{}{"templateName": analysisName}}}
+			if svc != nil {
+				ref["args"] = []interface{}{map[string]interface{}{"name": "service-name", "value": nestedString(svc, "metadata", "name")}}
+			}
+			return ref
+		}
+		if req.Strategy == "argo-canary" {
+			steps := req.Steps
+			if len(steps) == 0 {
+				steps = defaultCanarySteps
+			}
+			canary := map[string]interface{}{"steps": steps}
+			if svc != nil {
+				svcName := nestedString(svc, "metadata", "name")
+				canary["stableService"] = svcName
+				canary["canaryService"] = svcName + "-canary"
+				out.added = append(out.added, copyService(svc, svcName+"-canary"))
+			}
+			if analysisName != "" {
+				ref := analysisRef()
+				ref["startingStep"] = 1
+				canary["analysis"] = ref
+			}
+			nestedMap(rollout, "spec")["strategy"] = map[string]interface{}{"canary": canary}
+		} else {
+			if svc == nil {
+				return out, fmt.Errorf("argo-bluegreen needs a Service selecting Deployment %s", name)
+			}
+			svcName := nestedString(svc, "metadata", "name")
+			blueGreen := map[string]interface{}{
+				"activeService":        svcName,
+				"previewService":       svcName + "-preview",
+				"autoPromotionEnabled": req.AutoPromote,
+			}
+			if analysisName != "" {
+				blueGreen["prePromotionAnalysis"] = analysisRef()
+			}
+			nestedMap(rollout, "spec")["strategy"] = map[string]interface{}{"blueGreen": blueGreen}
+			out.added = append(out.added, copyService(svc, svcName+"-preview"))
+		}
+		keepService()
+		out.deployment = []map[string]interface{}{rollout}
+
+	case "flagger":
+		if svc == nil {
+			return out, fmt.Errorf("flagger needs a Service selecting Deployment %s", name)
+		}
+		port, _ := nestedSlice(svc, "spec", "ports")[0].(map[string]interface{})
+		service := map[string]interface{}{"port": port["port"]}
+		if tp, ok := port["targetPort"]; ok {
+			service["targetPort"] = tp
+		}
+		interval, successRate, latency, failures := "1m", 99.0, 500, 5
+		if a := req.Analysis; a != nil {
+			if a.Interval != "" {
+				interval = a.Interval
+			}
+			if a.SuccessRate > 0 {
+				successRate = a.SuccessRate
+			}
+			if a.MaxLatencyMs > 0 {
+				latency = a.MaxLatencyMs
+			}
+			if a.FailureLimit > 0 {
+				failures = a.FailureLimit
+			}
+		}
+		canary := map[string]interface{}{
+			"apiVersion": "flagger.app/v1beta1",
+			"kind":       "Canary",
+			"metadata":   meta(name),
+			"spec": map[string]interface{}{
+				"targetRef": map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment", "name": name},
+				"service":   service,
+				"analysis": map[string]interface{}{
+					"interval":   interval,
+					"threshold":  failures,
+					"maxWeight":  50,
+					"stepWeight": 10,
+					"metrics": []interface{}{
+						map[string]interface{}{"name": "request-success-rate", "interval": interval, "thresholdRange": map[string]interface{}{"min": successRate}},
+						map[string]interface{}{"name": "request-duration", "interval": interval, "thresholdRange": map[string]interface{}{"max": latency}},
+					},
+				},
+			},
+		}
+		// Flagger generates the primary and canary Services itself under the
+		// original Service's name, so the original must go.
+		out.deployment = []map[string]interface{}{deploy}
+		out.added = append(out.added, canary)
+
+	case "blue-green":
+		active := req.ActiveSlot
+		if active == "" {
+			active = "blue"
+		}
+		if active != "blue" && active != "green" {
+			return out, fmt.Errorf("activeSlot must be blue or green")
+		}
+		preview := map[string]string{"blue": "green", "green": "blue"}[active]
+		for _, slot := range []string{"blue", "green"} {
+			d := deepCopyObject(deploy)
+			nestedMap(d, "metadata")["name"] = name + "-" + slot
+			setLabel(d, slot, "spec", "selector", "matchLabels")
+			setLabel(d, slot, "spec", "template", "metadata", "labels")
+			out.deployment = append(out.deployment, d)
+		}
+		if svc != nil {
+			activeSvc := deepCopyObject(svc)
+			setLabel(activeSvc, active, "spec", "selector")
+			previewSvc := copyService(svc, nestedString(svc, "metadata", "name")+"-preview")
+			setLabel(previewSvc, preview, "spec", "selector")
+			out.service = []map[string]interface{}{activeSvc}
+			out.added = append(out.added, previewSvc)
+		}
+	}
+	return out, nil
+}
+
+// rolloutSpec copies the pod-level parts of a Deployment spec into a Rollout.
+func rolloutSpec(deploy map[string]interface{}) map[string]interface{} {
+	spec := map[string]interface{}{}
+	for _, field := range []string{"replicas", "selector", "template", "revisionHistoryLimit", "minReadySeconds", "progressDeadlineSeconds"} {
+		if v, ok := nestedMap(deploy, "spec")[field]; ok {
+			spec[field] = deepCopy(v)
+		}
+	}
+	return spec
+}
+
+func analysisTemplate(req progressiveRequest, meta, svc map[string]interface{}) map[string]interface{} {
+	a := req.Analysis
+	interval, successRate, failures := a.Interval, a.SuccessRate, a.FailureLimit
+	if interval == "" {
+		interval = "1m"
+	}
+	if successRate <= 0 {
+		successRate = 99
+	}
+	if failures <= 0 {
+		failures = 3
+	}
+	address := a.PrometheusAddress
+	if address == "" {
+		address = "http://prometheus.monitoring:9090"
+	}
+	query := strings.Join([]string{
+		`sum(rate(http_requests_total{service="{{args.service-name}}",code!~"5.."}[` + interval + `])) /`,
+		`sum(rate(http_requests_total{service="{{args.service-name}}"}[` + interval + `]))`,
+	}, "\n")
+	var args []interface{}
+	if svc != nil {
+		args = []interface{}{map[string]interface{}{"name": "service-name"}}
+	}
+	spec := map[string]interface{}{
+		"metrics": []interface{}{map[string]interface{}{
+			"name":             "success-rate",
+			"interval":         interval,
+			"failureLimit":     failures,
+			"successCondition": fmt.Sprintf("result[0] >= %g", successRate/100),
+			"provider": map[string]interface{}{
+				"prometheus": map[string]interface{}{"address": address, "query": query},
+			},
+		}},
+	}
+	if args != nil {
+		spec["args"] = args
+	}
+	return map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "AnalysisTemplate",
+		"metadata":   meta,
+		"spec":       spec,
+	}
+}
+
+// matchingService returns the index of the Service whose selector picks the
+// Deployment's pods, or -1.
+func matchingService(objects []map[string]interface{}, deploy map[string]interface{}) int {
+	podLabels := nestedMap(deploy, "spec", "template", "metadata", "labels")
+	ns := nestedString(deploy, "metadata", "namespace")
+	for i, obj := range objects {
+		if nestedString(obj, "kind") != "Service" || nestedString(obj, "metadata", "namespace") != ns {
+			continue
+		}
+		selector := nestedMap(obj, "spec", "selector")
+		if len(selector) == 0 || len(nestedSlice(obj, "spec", "ports")) == 0 {
+			continue
+		}
+		matches := true
+		for k, v := range selector {
+			if podLabels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyService clones a Service under a new name, dropping fields the API
+// server allocates.
+func copyService(svc map[string]interface{}, name string) map[string]interface{} {
+	c := deepCopyObject(svc)
+	nestedMap(c, "metadata")["name"] = name
+	spec := nestedMap(c, "spec")
+	delete(spec, "clusterIP")
+	delete(spec, "clusterIPs")
+	for _, p := range nestedSlice(c, "spec", "ports") {
+		if port, ok := p.(map[string]interface{}); ok {
+			delete(port, "nodePort")
+		}
+	}
+	return c
+}
+
+func setLabel(obj map[string]interface{}, slot string, path ...string) {
+	parent := nestedMap(obj, path[:len(path)-1]...)
+	if parent == nil {
+		return
+	}
+	labels, ok := parent[path[len(path)-1]].(map[string]interface{})
+	if !ok {
+		labels = map[string]interface{}{}
+		parent[path[len(path)-1]] = labels
+	}
+	labels[slotLabel] = slot
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// rbacRequest is the request body for generate-rbac.
+type rbacRequest struct {
+	ServiceAccount struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"serviceAccount"`
+	// Verbs granted on every resource found in the manifest.
+	Verbs []string `json:"verbs"`
+	// RestrictNames limits name-addressable verbs to the objects in the manifest.
+	RestrictNames bool `json:"restrictNames"`
+	// AuditLog is Kubernetes audit events, one JSON object per line.
+	AuditLog string `json:"auditLog"`
+}
+
+var defaultManagedVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+
+// nameScopedVerbs can be restricted with resourceNames; list, watch and
+// create cannot, because the request carries no object name to check.
+var nameScopedVerbs = map[string]bool{"get": true, "update": true, "patch": true, "delete": true}
+
+// rbacKey groups permissions into one PolicyRule.
+type rbacKey struct {
+	Namespace string // "" for cluster-scoped rules
+	APIGroup  string
+	Resource  string
+	URL       string // non-resource URL, cluster-scoped only
+}
+
+type rbacGrants map[rbacKey]map[string]map[string]bool // key -> verb -> resourceNames
+
+func (g rbacGrants) add(key rbacKey, verb, name string) {
+	verbs, ok := g[key]
+	if !ok {
+		verbs = map[string]map[string]bool{}
+		g[key] = verbs
+	}
+	names, ok := verbs[verb]
+	if !ok {
+		names = map[string]bool{}
+		verbs[verb] = names
+	}
+	if name != "" {
+		names[name] = true
+	}
+}
+
+// generateRBAC derives the minimal Roles, ClusterRoles and bindings a
+// ServiceAccount needs, either from the objects it manages (input["manifest"]
+// or a chart) or from the requests it actually made (input["auditLog"]).
+func generateRBAC(input map[string]interface{}) map[string]interface{} {
+	var req rbacRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	sa := req.ServiceAccount
+	if sa.Name == "" || sa.Namespace == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "serviceAccount.name and serviceAccount.namespace must be provided",
+		}
+	}
+
+	grants := rbacGrants{}
+	if req.AuditLog != "" {
+		if err := grantsFromAuditLog(grants, req.AuditLog, "system:serviceaccount:"+sa.Namespace+":"+sa.Name); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to parse audit log: " + err.Error(),
+			}
+		}
+	} else {
+		manifest, err := manifestFromInput(input)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		objects, err := parseManifest(manifest)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to parse manifest: " + err.Error(),
+			}
+		}
+		verbs := req.Verbs
+		if len(verbs) == 0 {
+			verbs = defaultManagedVerbs
+		}
+		for _, obj := range objects {
+			ref := refOf(obj)
+			group, _ := splitAPIVersion(ref.APIVersion)
+			key := rbacKey{APIGroup: group, Resource: kindToResource(ref.Kind)}
+			if isNamespaced(ref.Kind, objects) {
+				key.Namespace = ref.Namespace
+				if key.Namespace == "" {
+					key.Namespace = sa.Namespace
+				}
+			}
+			for _, verb := range verbs {
+				name := ""
+				if req.RestrictNames && nameScopedVerbs[verb] {
+					name = ref.Name
+				}
+				grants.add(key, verb, name)
+			}
+		}
+	}
+	if len(grants) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No permissions found for " + sa.Namespace + "/" + sa.Name,
+		}
+	}
+
+	objects := rbacObjects(grants, sa.Name, sa.Namespace)
+	var refs []resourceRef
+	for _, obj := range objects {
+		refs = append(refs, refOf(obj))
+	}
+	return map[string]interface{}{
+		"success":   true,
+		"manifest":  encodeManifest(objects),
+		"resources": refs,
+	}
+}
+
+// grantsFromAuditLog records every request user made in an audit log.
+func grantsFromAuditLog(grants rbacGrants, log, user string) error {
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var event struct {
+			Verb       string `json:"verb"`
+			RequestURI string `json:"requestURI"`
+			User       struct {
+				Username string `json:"username"`
+			} `json:"user"`
+			ObjectRef *struct {
+				Resource    string `json:"resource"`
+				Subresource string `json:"subresource"`
+				Namespace   string `json:"namespace"`
+				APIGroup    string `json:"apiGroup"`
+			} `json:"objectRef"`
+		}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return err
+		}
+		if event.User.Username != user || event.Verb == "" {
+			continue
+		}
+		if event.ObjectRef == nil {
+			url := event.RequestURI
+			if i := strings.Index(url, "?"); i >= 0 {
+				url = url[:i]
+			}
+			grants.add(rbacKey{URL: url}, event.Verb, "")
+			continue
+		}
+		resource := event.ObjectRef.Resource
+		if event.ObjectRef.Subresource != "" {
+			resource += "/" + event.ObjectRef.Subresource
+		}
+		grants.add(rbacKey{
+			Namespace: event.ObjectRef.Namespace,
+			APIGroup:  event.ObjectRef.APIGroup,
+			Resource:  resource,
+		}, event.Verb, "")
+	}
+	return scanner.Err()
+}
+
+// rbacObjects turns grants into one Role and RoleBinding per namespace plus a
+// ClusterRole and ClusterRoleBinding for cluster-scoped access.
+func rbacObjects(grants rbacGrants, saName, saNamespace string) []map[string]interface{} {
+	rulesByNamespace := map[string][]interface{}{}
+	type ruleShape struct {
+		Namespace, APIGroup, URL, Verbs, Names string
+	}
+	merged := map[ruleShape][]string{}
+	var shapes []ruleShape
+	for key, verbs := range grants {
+		// Verbs that share the same resourceNames restriction become one rule.
+		byNames := map[string][]string{}
+		for verb, names := range verbs {
+			list := make([]string, 0, len(names))
+			for n := range names {
+				list = append(list, n)
+			}
+			sort.Strings(list)
+			joined := strings.Join(list, ",")
+			byNames[joined] = append(byNames[joined], verb)
+		}
+		for names, vs := range byNames {
+			sort.Strings(vs)
+			shape := ruleShape{key.Namespace, key.APIGroup, key.URL, strings.Join(vs, ","), names}
+			if _, ok := merged[shape]; !ok {
+				shapes = append(shapes, shape)
+			}
+			if key.URL == "" {
+				merged[shape] = append(merged[shape], key.Resource)
+			}
+		}
+	}
+	sort.Slice(shapes, func(i, j int) bool {
+		a, b := shapes[i], shapes[j]
+		if a.APIGroup != b.APIGroup {
+			return a.APIGroup < b.APIGroup
+		}
+		if a.URL != b.URL {
+			return a.URL < b.URL
+		}
+		return strings.Join(merged[a], ",")+a.Verbs < strings.Join(merged[b], ",")+b.Verbs
+	})
+	for _, shape := range shapes {
+		rule := map[string]interface{}{"verbs": stringList(strings.Split(shape.Verbs, ","))}
+		if shape.URL != "" {
+			rule["nonResourceURLs"] = []interface{}{shape.URL}
+		} else {
+			resources := merged[shape]
+			sort.Strings(resources)
+			rule["apiGroups"] = []interface{}{shape.APIGroup}
+			rule["resources"] = stringList(resources)
+		}
+		if shape.Names != "" {
+			rule["resourceNames"] = stringList(strings.Split(shape.Names, ","))
+		}
+		rulesByNamespace[shape.Namespace] = append(rulesByNamespace[shape.Namespace], rule)
+	}
+
+	namespaces := make([]string, 0, len(rulesByNamespace))
+	for ns := range rulesByNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	subject := map[string]interface{}{"kind": "ServiceAccount", "name": saName, "namespace": saNamespace}
+	var objects []map[string]interface{}
+	for _, ns := range namespaces {
+		roleKind, bindingKind := "Role", "RoleBinding"
+		meta := map[string]interface{}{"name": saName, "namespace": ns}
+		if ns == "" {
+			roleKind, bindingKind = "ClusterRole", "ClusterRoleBinding"
+			meta = map[string]interface{}{"name": saNamespace + "-" + saName}
+		}
+		objects = append(objects,
+			map[string]interface{}{
+				"apiVersion": "rbac.authorization.k8s.io/v1",
+				"kind":       roleKind,
+				"metadata":   meta,
+				"rules":      rulesByNamespace[ns],
+			},
+			map[string]interface{}{
+				"apiVersion": "rbac.authorization.k8s.io/v1",
+				"kind":       bindingKind,
+				"metadata":   meta,
+				"roleRef": map[string]interface{}{
+					"apiGroup": "rbac.authorization.k8s.io",
+					"kind":     roleKind,
+					"name":     meta["name"],
+				},
+				"subjects": []interface{}{subject},
+			})
+	}
+	return objects
+}
+
+func stringList(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
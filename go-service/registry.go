@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageRef is a parsed container image reference.
+type imageRef struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	// Tag or Digest (or both) identify the image; Tag defaults to latest.
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+func (r imageRef) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Registry == "docker.io" {
+		s = strings.TrimPrefix(r.Repository, "library/")
+	}
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// reference is what to ask the registry for: the digest when pinned.
+func (r imageRef) reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// parseImageRef normalizes references the way the container runtime does:
+// "nginx" is docker.io/library/nginx:latest.
+func parseImageRef(image string) (imageRef, error) {
+	image = strings.TrimSpace(image)
+	if image == "" || strings.ContainsAny(image, " \t") {
+		return imageRef{}, fmt.Errorf("invalid image reference %q", image)
+	}
+	var ref imageRef
+	if name, digest, ok := strings.Cut(image, "@"); ok {
+		image, ref.Digest = name, digest
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, ref.Tag = image[:i], image[i+1:]
+	}
+	first, rest, ok := strings.Cut(image, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Registry, ref.Repository = first, rest
+	} else {
+		ref.Registry, ref.Repository = "docker.io", image
+	}
+	if ref.Registry == "docker.io" && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	if ref.Repository == "" {
+		return imageRef{}, fmt.Errorf("invalid image reference %q", image)
+	}
+	return ref, nil
+}
+
+// Media types of image manifests and indexes, OCI and Docker.
+var (
+	indexMediaTypes    = []string{"application/vnd.oci.image.index.v1+json", "application/vnd.docker.distribution.manifest.list.v2+json"}
+	manifestMediaTypes = []string{"application/vnd.oci.image.manifest.v1+json", "application/vnd.docker.distribution.manifest.v2+json"}
+)
+
+// ociDescriptor points at a manifest or blob.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is an image index or manifest; which fields are set depends
+// on MediaType.
+type ociManifest struct {
+	MediaType   string            `json:"mediaType"`
+	Manifests   []ociDescriptor   `json:"manifests"`
+	Config      ociDescriptor     `json:"config"`
+	Layers      []ociDescriptor   `json:"layers"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (m ociManifest) isIndex() bool {
+	return len(m.Manifests) > 0 || containsString(indexMediaTypes, m.MediaType)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// registryClient talks to OCI distribution registries with the anonymous
+// or docker-config credentials a pull would use, caching bearer tokens per
+// repository.
+type registryClient struct {
+	client *http.Client
+	mu     sync.Mutex
+	tokens map[string]string
+	// credentials are base64 user:password by registry, taking precedence
+	// over the docker config's.
+	credentials map[string]string
+}
+
+func newRegistryClient() *registryClient {
+	return &registryClient{client: &http.Client{Timeout: time.Minute}, tokens: map[string]string{}}
+}
+
+func registryHost(registry string) string {
+	if registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return registry
+}
+
+// get fetches a registry API path for repository, answering bearer token
+// challenges.
+func (c *registryClient) get(ref imageRef, path string, accept []string) ([]byte, http.Header, error) {
+	scheme := "https"
+	if strings.HasPrefix(ref.Registry, "localhost") || strings.HasPrefix(ref.Registry, "127.0.0.1") {
+		scheme = "http"
+	}
+	u := scheme + "://" + registryHost(ref.Registry) + "/v2/" + ref.Repository + path
+	key := ref.Registry + "/" + ref.Repository
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		c.mu.Lock()
+		token := c.tokens[key]
+		c.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		} else if basic := c.basicAuth(ref.Registry); basic != "" {
+			req.Header.Set("Authorization", "Basic "+basic)
+		}
+		start := time.Now()
+		resp, err := c.client.Do(req)
+		if err != nil {
+			traceRequest("GET", u, start, 0, err)
+			return nil, nil, err
+		}
+		traceRequest("GET", u, start, resp.StatusCode, nil)
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			token, err := c.token(ref, resp.Header.Get("WWW-Authenticate"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: authentication failed: %v", ref, err)
+			}
+			c.mu.Lock()
+			c.tokens[key] = token
+			c.mu.Unlock()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("%s: %s%s: %s", ref, ref.Repository, path, resp.Status)
+		}
+		return data, resp.Header, nil
+	}
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// token answers a `Bearer realm=...,service=...,scope=...` challenge.
+func (c *registryClient) token(ref imageRef, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", errors.New("unsupported challenge " + challenge)
+	}
+	params := map[string]string{}
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", errors.New("challenge has no realm")
+	}
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + ref.Repository + ":pull"
+	}
+	q.Set("scope", scope)
+	req, err := http.NewRequest("GET", params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if basic := c.basicAuth(ref.Registry); basic != "" {
+		req.Header.Set("Authorization", "Basic "+basic)
+	}
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		traceRequest("GET", req.URL.String(), start, 0, err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	traceRequest("GET", req.URL.String(), start, resp.StatusCode, nil)
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("token endpoint: " + resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return "Bearer " + firstNonEmpty(body.Token, body.AccessToken), nil
+}
+
+// basicAuth returns the credentials to send registry, if any.
+func (c *registryClient) basicAuth(registry string) string {
+	if basic := c.credentials[registry]; basic != "" {
+		return basic
+	}
+	return registryCredentials(registry)
+}
+
+// registryCredentials returns base64 user:password for a registry from the
+// docker config ($DOCKER_CONFIG/config.json or ~/.docker/config.json), or
+// "" to pull anonymously. Credential helpers are not consulted.
+func registryCredentials(registry string) string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(data, &config) != nil {
+		return ""
+	}
+	keys := []string{registry, "https://" + registry}
+	if registry == "docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/", "index.docker.io")
+	}
+	for _, k := range keys {
+		if a, ok := config.Auths[k]; ok && a.Auth != "" {
+			if _, err := base64.StdEncoding.DecodeString(a.Auth); err == nil {
+				return a.Auth
+			}
+		}
+	}
+	return ""
+}
+
+// manifest fetches the manifest or index ref points at, with its digest.
+func (c *registryClient) manifest(ref imageRef, reference string) (ociManifest, string, error) {
+	data, header, err := c.get(ref, "/manifests/"+reference, append(append([]string{}, indexMediaTypes...), manifestMediaTypes...))
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ociManifest{}, "", fmt.Errorf("%s: invalid manifest: %v", ref, err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = header.Get("Content-Type")
+	}
+	digest := header.Get("Docker-Content-Digest")
+	if digest == "" && strings.HasPrefix(reference, "sha256:") {
+		digest = reference
+	}
+	return m, digest, nil
+}
+
+// platformManifest resolves ref to the image manifest for platform
+// ("linux/amd64"), returning the index too when ref names one.
+func (c *registryClient) platformManifest(ref imageRef, platform string) (manifest ociManifest, digest string, index *ociManifest, err error) {
+	m, digest, err := c.manifest(ref, ref.reference())
+	if err != nil || !m.isIndex() {
+		return m, digest, nil, err
+	}
+	osName, arch, _ := strings.Cut(platform, "/")
+	arch, variant, _ := strings.Cut(arch, "/")
+	for _, d := range m.Manifests {
+		if d.Platform == nil || d.Platform.OS != osName || d.Platform.Architecture != arch {
+			continue
+		}
+		if variant != "" && d.Platform.Variant != variant {
+			continue
+		}
+		pm, _, err := c.manifest(ref, d.Digest)
+		return pm, d.Digest, &m, err
+	}
+	return ociManifest{}, "", &m, fmt.Errorf("%s has no %s image", ref, platform)
+}
+
+func (c *registryClient) blob(ref imageRef, digest string) ([]byte, error) {
+	data, _, err := c.get(ref, "/blobs/"+digest, nil)
+	return data, err
+}
+
+// imageConfig returns the config blob of the platform image, which carries
+// its labels.
+func (c *registryClient) imageConfig(ref imageRef, m ociManifest) (map[string]interface{}, error) {
+	data, err := c.blob(ref, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// imageLabels returns the labels from an image config blob.
+func imageLabels(config map[string]interface{}) map[string]string {
+	labels := map[string]string{}
+	for k, v := range nestedMap(config, "config", "Labels") {
+		if s, ok := v.(string); ok {
+			labels[k] = s
+		}
+	}
+	return labels
+}
+
+// imageAttestations returns the in-toto statements (SBOMs, provenance)
+// BuildKit attached to the platform image in an index, keyed by predicate
+// type.
+func (c *registryClient) imageAttestations(ref imageRef, index *ociManifest, digest string) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	if index == nil {
+		return out, nil
+	}
+	for _, d := range index.Manifests {
+		if d.Annotations["vnd.docker.reference.type"] != "attestation-manifest" || d.Annotations["vnd.docker.reference.digest"] != digest {
+			continue
+		}
+		m, _, err := c.manifest(ref, d.Digest)
+		if err != nil {
+			return out, err
+		}
+		for _, layer := range m.Layers {
+			predicate := layer.Annotations["in-toto.io/predicate-type"]
+			if predicate == "" {
+				continue
+			}
+			data, err := c.blob(ref, layer.Digest)
+			if err != nil {
+				return out, err
+			}
+			out[predicate] = data
+		}
+	}
+	return out, nil
+}
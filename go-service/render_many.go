@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// renderJobSpec is one chart of a render-many request.
+type renderJobSpec struct {
+	// ID keys the result; it defaults to the release name.
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Chart     string `json:"chart"`
+	Version   string `json:"version"`
+	Namespace string `json:"namespace"`
+	// ValuesFiles are passed to helm in order, before Values.
+	ValuesFiles []string `json:"valuesFiles"`
+	// Values are passed to helm as a values file.
+	Values map[string]interface{} `json:"values"`
+}
+
+// renderManyRequest is the request body for render-many.
+type renderManyRequest struct {
+	Charts []renderJobSpec `json:"charts"`
+	// Parallelism bounds concurrent helm processes (default: CPU count).
+	Parallelism int `json:"parallelism"`
+	// OutputDir, when set, receives each manifest as <id>.yaml instead of
+	// returning it inline.
+	OutputDir string `json:"outputDir"`
+	// UpdateRepos refreshes repository indexes once before rendering, rather
+	// than every chart paying for it.
+	UpdateRepos bool `json:"updateRepos"`
+	// Incremental skips charts whose templates, values and settings are
+	// unchanged since the last run recorded in StateFile (default
+	// <outputDir>/.render-state.json), reporting them as unchanged.
+	Incremental bool   `json:"incremental"`
+	StateFile   string `json:"stateFile"`
+}
+
+// renderMany renders many chart/values combinations concurrently in one
+// call, with bounded parallelism, instead of one process invocation per
+// chart. Per-chart failures are reported individually; the call itself only
+// fails on a malformed request.
+func renderMany(input map[string]interface{}) map[string]interface{} {
+	var req renderManyRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if len(req.Charts) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No charts provided",
+		}
+	}
+	seen := map[string]bool{}
+	for i := range req.Charts {
+		c := &req.Charts[i]
+		if c.Name == "" || c.Chart == "" {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Every chart needs 'name' and 'chart'",
+			}
+		}
+		if c.ID == "" {
+			c.ID = c.Name
+		}
+		if seen[c.ID] {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Duplicate chart id " + c.ID,
+			}
+		}
+		seen[c.ID] = true
+	}
+	stateFile := req.StateFile
+	if stateFile == "" && req.OutputDir != "" {
+		stateFile = filepath.Join(req.OutputDir, ".render-state.json")
+	}
+	if req.Incremental && stateFile == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Incremental rendering needs 'outputDir' or 'stateFile'",
+		}
+	}
+	var state map[string]string
+	if req.Incremental {
+		state = loadRenderState(stateFile)
+	}
+	digests := make([]string, len(req.Charts))
+
+	parallelism := req.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	if req.UpdateRepos {
+		if err := updateHelmRepos(requestContext(input)); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to update helm repositories: " + err.Error(),
+			}
+		}
+	}
+
+	results := make([]map[string]interface{}, len(req.Charts))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := range req.Charts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			c := req.Charts[i]
+			render := func(w io.Writer) (int64, error) {
+				return renderJob(requestContext(input), w, c)
+			}
+			began := time.Now()
+			result := map[string]interface{}{"id": c.ID}
+			results[i] = result
+			path := ""
+			if req.OutputDir != "" {
+				path = filepath.Join(req.OutputDir, strings.ReplaceAll(c.ID, "/", "_")+".yaml")
+			}
+			if req.Incremental {
+				digests[i] = renderDigest(c)
+				if _, err := os.Stat(path); digests[i] != "" && state[c.ID] == digests[i] && (path == "" || err == nil) {
+					result["success"] = true
+					result["unchanged"] = true
+					if path != "" {
+						result["outputFile"] = path
+					}
+					return
+				}
+			}
+			var err error
+			if path != "" {
+				var size int64
+				var digest string
+				if size, digest, err = writeManifestFile(path, render); err == nil {
+					result["outputFile"] = path
+					result["bytes"] = size
+					result["sha256"] = digest
+				}
+			} else {
+				var b strings.Builder
+				if _, err = render(&b); err == nil {
+					result["manifest"] = b.String()
+				}
+			}
+			result["durationMs"] = time.Since(began).Milliseconds()
+			result["success"] = err == nil
+			if err != nil {
+				result["error"] = err.Error()
+				digests[i] = ""
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	failed, unchanged := 0, 0
+	for _, r := range results {
+		if r["success"] != true {
+			failed++
+		} else if r["unchanged"] == true {
+			unchanged++
+		}
+	}
+	response := map[string]interface{}{
+		"success":    true,
+		"results":    results,
+		"rendered":   len(results) - failed - unchanged,
+		"unchanged":  unchanged,
+		"failed":     failed,
+		"durationMs": time.Since(start).Milliseconds(),
+	}
+	if req.Incremental {
+		// Failed charts drop out of the state so that they render again.
+		next := map[string]string{}
+		for i, c := range req.Charts {
+			if digests[i] != "" {
+				next[c.ID] = digests[i]
+			}
+		}
+		if err := saveRenderState(stateFile, next); err != nil {
+			response["stateError"] = err.Error()
+		}
+	}
+	return response
+}
+
+// renderJob renders one render-many entry into w.
+func renderJob(ctx context.Context, w io.Writer, c renderJobSpec) (int64, error) {
+	var args []string
+	if c.Version != "" {
+		args = append(args, "--version", c.Version)
+	}
+	if c.Namespace != "" {
+		args = append(args, "--namespace", c.Namespace)
+	}
+	values, cleanup, err := helmValues{ValuesFiles: c.ValuesFiles, Values: c.Values}.renderArgs(ctx, c.Chart, args)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	args = append(args, values...)
+	return streamChart(ctx, w, c.Name, c.Chart, args...)
+}
+
+func updateHelmRepos(ctx context.Context) error {
+	unlock, err := lockHelmCache(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = runHelm(ctx, "repo", "update")
+	return err
+}
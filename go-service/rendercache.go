@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRenderCacheTTL = 10 * time.Minute
+	// renderCacheEntries bounds the in-memory cache; the oldest renders
+	// are dropped first.
+	renderCacheEntries = 256
+)
+
+// renderCacheInput is the cache option of generate-helm: "memory" keeps
+// renders in this process (which outlives a request under serve) for
+// INFRAKIT_RENDER_CACHE_TTL, "disk" also in INFRAKIT_RENDER_CACHE for other
+// processes to reuse.
+type renderCacheInput struct {
+	Cache string `json:"cache"`
+}
+
+// renderCache holds manifests helm rendered, by renderCacheKey.
+var renderCache = struct {
+	sync.Mutex
+	entries map[string]renderCacheEntry
+}{entries: map[string]renderCacheEntry{}}
+
+type renderCacheEntry struct {
+	manifest []byte
+	rendered time.Time
+}
+
+func renderCacheTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("INFRAKIT_RENDER_CACHE_TTL")); err == nil {
+		return d
+	}
+	return defaultRenderCacheTTL
+}
+
+// renderCacheDir returns where renders are persisted for "disk" caching.
+func renderCacheDir() string {
+	if dir := os.Getenv("INFRAKIT_RENDER_CACHE"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-render-cache")
+	}
+	return filepath.Join(home, ".infrakit", "render-cache")
+}
+
+func (c renderCacheInput) check() error {
+	switch c.Cache {
+	case "", "memory", "disk":
+		return nil
+	}
+	return errors.New("'cache' must be memory or disk")
+}
+
+// renderCacheKey fingerprints a render of chart (as chartSource resolved
+// it) by req: the chart's version or, for a local chart, its files, the
+// values and values files, and the settings that change what helm renders.
+// Credentials are left out, as they do not. It returns "" for renders that
+// cannot be pinned down, such as a repository chart by version constraint.
+func renderCacheKey(req helmChartInput, chart string) string {
+	var files []string
+	for _, layer := range req.layers() {
+		files = append(files, layer.ValuesFiles...)
+	}
+	digest := renderDigest(renderJobSpec{
+		Name:        req.Name,
+		Chart:       chart,
+		Version:     req.Version,
+		ValuesFiles: files,
+		Values:      req.Values,
+	})
+	if digest == "" {
+		return ""
+	}
+	settings, err := json.Marshal([]interface{}{req.RepoURL, req.Layers, req.Set, req.SopsDecrypt, req.SkipDependencies})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(digest + "\n" + string(settings)))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedRender wraps render to serve it from the cache for key, setting
+// *status to "hit" or "miss", or "bypass" when key is "". A render is
+// buffered whole before it is written, to be stored.
+func cachedRender(mode, key string, render func(io.Writer) (int64, error), status *string) func(io.Writer) (int64, error) {
+	return func(w io.Writer) (int64, error) {
+		if key == "" {
+			*status = "bypass"
+			return render(w)
+		}
+		if manifest, ok := lookupRender(mode, key); ok {
+			*status = "hit"
+			n, err := w.Write(manifest)
+			return int64(n), err
+		}
+		*status = "miss"
+		var b bytes.Buffer
+		if _, err := render(&b); err != nil {
+			return 0, err
+		}
+		storeRender(mode, key, b.Bytes())
+		n, err := w.Write(b.Bytes())
+		return int64(n), err
+	}
+}
+
+func lookupRender(mode, key string) ([]byte, bool) {
+	ttl := renderCacheTTL()
+	renderCache.Lock()
+	entry, ok := renderCache.entries[key]
+	renderCache.Unlock()
+	if ok && time.Since(entry.rendered) < ttl {
+		return entry.manifest, true
+	}
+	if mode != "disk" {
+		return nil, false
+	}
+	path := filepath.Join(renderCacheDir(), key+".yaml")
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) >= ttl {
+		return nil, false
+	}
+	manifest, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	renderCache.Lock()
+	renderCache.entries[key] = renderCacheEntry{manifest, info.ModTime()}
+	renderCache.Unlock()
+	return manifest, true
+}
+
+func storeRender(mode, key string, manifest []byte) {
+	ttl := renderCacheTTL()
+	renderCache.Lock()
+	renderCache.entries[key] = renderCacheEntry{manifest, time.Now()}
+	if len(renderCache.entries) > renderCacheEntries {
+		keys := make([]string, 0, len(renderCache.entries))
+		for k, e := range renderCache.entries {
+			if time.Since(e.rendered) >= ttl {
+				delete(renderCache.entries, k)
+				continue
+			}
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return renderCache.entries[keys[i]].rendered.Before(renderCache.entries[keys[j]].rendered)
+		})
+		for len(keys) > renderCacheEntries {
+			delete(renderCache.entries, keys[0])
+			keys = keys[1:]
+		}
+	}
+	renderCache.Unlock()
+	if mode == "disk" {
+		// Persisting is best effort; a failed write only costs a render.
+		writeCacheFile(filepath.Join(renderCacheDir(), key+".yaml"), manifest)
+	}
+}
+
+// cacheClear drops every cached render, in memory and on disk.
+func cacheClear(input map[string]interface{}) map[string]interface{} {
+	renderCache.Lock()
+	n := len(renderCache.entries)
+	renderCache.entries = map[string]renderCacheEntry{}
+	renderCache.Unlock()
+	dir := renderCacheDir()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"cleared": dir,
+		"entries": n,
+		"files":   len(files),
+	}
+}
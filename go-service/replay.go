@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const redactedValue = "<redacted>"
+
+// sensitiveKeys are lowercase fragments of request keys whose values are
+// never written to disk.
+var sensitiveKeys = []string{"password", "token", "secret", "privatekey", "credential", "kubeconfigcontent"}
+
+// recordedRequest is what replay needs to run an operation again.
+type recordedRequest struct {
+	Command string                 `json:"command"`
+	Input   map[string]interface{} `json:"input"`
+	// Redacted lists the dotted paths of values removed from Input.
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+func requestPath(id string) string {
+	return filepath.Join(opsDir(), "requests", id+".json")
+}
+
+func recordRequest(op *operation, request map[string]interface{}) {
+	rec := recordedRequest{Command: op.Command, Input: deepCopyObject(request)}
+	rec.Redacted = redact(rec.Input, "")
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if os.MkdirAll(filepath.Dir(requestPath(op.ID)), 0o700) == nil {
+		os.WriteFile(requestPath(op.ID), data, 0o600)
+	}
+}
+
+// redact replaces sensitive values in v in place and returns their paths.
+func redact(v interface{}, path string) []string {
+	var paths []string
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(t) {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if isSensitiveKey(k) && t[k] != nil && t[k] != "" {
+				t[k] = redactedValue
+				paths = append(paths, p)
+				continue
+			}
+			paths = append(paths, redact(t[k], p)...)
+		}
+	case []interface{}:
+		for i, item := range t {
+			paths = append(paths, redact(item, path+"["+strconv.Itoa(i)+"]")...)
+		}
+	}
+	return paths
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// replay runs a recorded operation (input["id"], as listed by `ops`) again
+// with the same input, so a CI failure can be reproduced locally.
+// input["overrides"] is merged over the recorded input, e.g. to point at
+// another kubeconfig or to supply redacted credentials; replay refuses to
+// run while redacted values are left unless input["allowRedacted"] is set.
+func replay(input map[string]interface{}) map[string]interface{} {
+	id, _ := input["id"].(string)
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "A valid operation 'id' must be provided",
+		}
+	}
+	data, err := os.ReadFile(requestPath(id))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No recorded request for operation " + id + ": " + err.Error(),
+		}
+	}
+	var rec recordedRequest
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Corrupt recorded request: " + err.Error(),
+		}
+	}
+	if rec.Command == "replay" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Operation " + id + " is itself a replay; replay its original operation",
+		}
+	}
+
+	replayed := rec.Input
+	if overrides, ok := input["overrides"].(map[string]interface{}); ok {
+		mergeOverrides(replayed, overrides)
+	}
+	var missing []string
+	for _, path := range rec.Redacted {
+		if lookupPath(replayed, path) == redactedValue {
+			missing = append(missing, path)
+		}
+	}
+	if allow, _ := input["allowRedacted"].(bool); len(missing) > 0 && !allow {
+		return map[string]interface{}{
+			"success":  false,
+			"error":    "The recorded request had redacted values; supply them in 'overrides' or set 'allowRedacted'",
+			"redacted": missing,
+		}
+	}
+
+	cleanup, err := prepareClusterAccess(requestContext(input), replayed)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	defer cleanup()
+	result, ok := dispatch(requestContext(input), rec.Command, replayed)
+	if !ok {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Unknown command " + rec.Command,
+		}
+	}
+	success, _ := result["success"].(bool)
+	return map[string]interface{}{
+		"success":  success,
+		"replayOf": id,
+		"command":  rec.Command,
+		"result":   result,
+	}
+}
+
+// mergeOverrides merges src into dst, recursing into objects present in
+// both; everything else in src replaces the value in dst.
+func mergeOverrides(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				mergeOverrides(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// lookupPath resolves a dotted path produced by redact.
+func lookupPath(v interface{}, path string) interface{} {
+	for _, part := range strings.Split(path, ".") {
+		name, indexes := part, []string(nil)
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name = part[:i]
+			indexes = strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][")
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+		for _, idx := range indexes {
+			s, ok := v.([]interface{})
+			i, err := strconv.Atoi(idx)
+			if err != nil || !ok || i < 0 || i >= len(s) {
+				return nil
+			}
+			v = s[i]
+		}
+	}
+	return v
+}
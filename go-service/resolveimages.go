@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// resolveImagesRequest is the request body for resolve-images. The manifest
+// comes from the usual manifest, manifestFile or name/chart keys.
+type resolveImagesRequest struct {
+	// KeepTags pins images as name:tag@digest rather than name@digest, so
+	// that the tag still shows what was deployed.
+	KeepTags bool `json:"keepTags"`
+	// RegistryCredentials log in to registries by host (docker.io for
+	// Docker Hub), ahead of the docker config.
+	RegistryCredentials map[string]registryLogin `json:"registryCredentials"`
+}
+
+type registryLogin struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// resolveImages pins the container images of a manifest to the digests
+// their registries serve for them now, so that the manifest deploys the
+// same images however the tags move later. It returns the rewritten
+// manifest the way generate-helm does and "images", each image as written
+// mapped to its pinned reference; images already pinned map to themselves.
+func resolveImages(input map[string]interface{}) map[string]interface{} {
+	var req resolveImagesRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	client := newRegistryClient()
+	client.credentials = map[string]string{}
+	for registry, login := range req.RegistryCredentials {
+		client.credentials[registry] = base64.StdEncoding.EncodeToString([]byte(login.Username + ":" + login.Password))
+	}
+	uses := manifestImages(objects)
+	digests := make([]string, len(uses))
+	errs := make([]error, len(uses))
+	sem := newSemaphore(8)
+	var wg sync.WaitGroup
+	for i, use := range uses {
+		wg.Add(1)
+		go func(i int, image string) {
+			defer wg.Done()
+			defer sem.acquire()()
+			digests[i], errs[i] = resolveDigest(client, image)
+		}(i, use.Image)
+	}
+	wg.Wait()
+
+	unresolved := map[string]string{}
+	for i, err := range errs {
+		if err != nil {
+			unresolved[uses[i].Image] = err.Error()
+		}
+	}
+	if len(unresolved) > 0 {
+		images := make([]string, 0, len(unresolved))
+		for image := range unresolved {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+		return map[string]interface{}{
+			"success":    false,
+			"error":      fmt.Sprintf("Failed to resolve %d of %d images: %s", len(images), len(uses), unresolved[images[0]]),
+			"unresolved": unresolved,
+		}
+	}
+
+	pins := transformStep{Type: "images"}
+	images := map[string]string{}
+	for i, use := range uses {
+		_, tag, digest := splitImage(use.Image)
+		if digest != "" {
+			images[use.Image] = use.Image
+			continue
+		}
+		o := imageOverride{Name: use.Image, Digest: digests[i]}
+		if req.KeepTags {
+			o.NewTag = tag
+		}
+		pins.Images = append(pins.Images, o)
+		images[use.Image] = rewriteImage(transformStep{Type: "images", Images: []imageOverride{o}}, use.Image)
+	}
+	var changes []transformChange
+	result := renderResult(input, transformedRender(func(w io.Writer) (int64, error) {
+		n, err := io.WriteString(w, manifest)
+		return int64(n), err
+	}, []transformStep{pins}, &changes))
+	if result["success"] == true {
+		result["images"] = images
+	}
+	return result
+}
+
+// resolveDigest returns the digest image's tag points at: that of the
+// index for multi-platform images, which is what the runtime pulls by.
+func resolveDigest(client *registryClient, image string) (string, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+	_, digest, err := client.manifest(ref, ref.Tag)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return "", fmt.Errorf("%s: the registry returned no digest", image)
+	}
+	return digest, nil
+}
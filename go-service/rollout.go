@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// rolloutRequest is the request body for plan-rollout.
+type rolloutRequest struct {
+	Clusters []struct {
+		Name string `json:"name"`
+		// Wave pins the cluster to a wave; clusters without one are
+		// assigned waves in order, WaveSize at a time.
+		Wave       int    `json:"wave"`
+		Kubeconfig string `json:"kubeconfig,omitempty"`
+		Context    string `json:"context,omitempty"`
+		// RequireApproval holds the cluster's wave for a manual go-ahead.
+		RequireApproval bool `json:"requireApproval"`
+	} `json:"clusters"`
+	// WaveSize is how many unpinned clusters go out together after the
+	// first, single-cluster canary wave.
+	WaveSize  int `json:"waveSize"`
+	Promotion struct {
+		SoakSeconds    int `json:"soakSeconds"`
+		TimeoutSeconds int `json:"timeoutSeconds"`
+	} `json:"promotion"`
+}
+
+// rolloutWorkloadKinds are the kinds whose readiness gates promotion.
+var rolloutWorkloadKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"Rollout":     true,
+}
+
+// planRollout turns a manifest (or chart) and an ordered list of clusters
+// into a wave-by-wave rollout plan that a CD system can execute: which
+// clusters go out together, which infrakit checks gate each wave, and what
+// must hold before promoting to the next one.
+func planRollout(input map[string]interface{}) map[string]interface{} {
+	var req rolloutRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if len(req.Clusters) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No clusters provided",
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	var workloads []resourceRef
+	for _, obj := range objects {
+		if ref := refOf(obj); rolloutWorkloadKinds[ref.Kind] {
+			workloads = append(workloads, ref)
+		}
+	}
+
+	waveSize := req.WaveSize
+	if waveSize <= 0 {
+		waveSize = 1
+	}
+	soak := req.Promotion.SoakSeconds
+	if soak <= 0 {
+		soak = 600
+	}
+	timeout := req.Promotion.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = 900
+	}
+
+	// Pinned waves keep their number; the rest follow the highest pinned
+	// wave seen so far, a canary of one and then WaveSize at a time.
+	byWave := map[int][]int{}
+	next, inWave := 1, 0
+	for i, c := range req.Clusters {
+		if c.Name == "" {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Every cluster needs a name",
+			}
+		}
+		if c.Wave > 0 {
+			byWave[c.Wave] = append(byWave[c.Wave], i)
+			if c.Wave >= next {
+				next, inWave = c.Wave+1, 0
+			}
+			continue
+		}
+		limit := waveSize
+		if next == 1 {
+			limit = 1
+		}
+		if inWave >= limit {
+			next, inWave = next+1, 0
+		}
+		byWave[next] = append(byWave[next], i)
+		inWave++
+	}
+	numbers := make([]int, 0, len(byWave))
+	for n := range byWave {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	sum := sha256.Sum256([]byte(manifest))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	var waves []map[string]interface{}
+	for i, n := range numbers {
+		var clusters []interface{}
+		var validations []interface{}
+		approval := false
+		for _, idx := range byWave[n] {
+			c := req.Clusters[idx]
+			cluster := map[string]interface{}{"name": c.Name}
+			if c.Kubeconfig != "" {
+				cluster["kubeconfig"] = c.Kubeconfig
+			}
+			if c.Context != "" {
+				cluster["context"] = c.Context
+			}
+			clusters = append(clusters, cluster)
+			validations = append(validations,
+				map[string]interface{}{"cluster": c.Name, "command": "check-compatibility", "require": "decision == go"},
+				map[string]interface{}{"cluster": c.Name, "command": "validate-k8s", "require": "success"},
+			)
+			approval = approval || c.RequireApproval
+		}
+		wave := map[string]interface{}{
+			"wave":        i + 1,
+			"clusters":    clusters,
+			"validations": validations,
+			"steps":       []interface{}{"validate", "apply", "wait-rollout"},
+			// Approval gates the start of the wave, not its promotion.
+			"requiresApproval": approval,
+		}
+		if i < len(numbers)-1 {
+			wave["promotion"] = map[string]interface{}{
+				"workloadsReady":  workloads,
+				"timeoutSeconds":  timeout,
+				"soakSeconds":     soak,
+				"manifestDigest":  digest,
+				"haltOnViolation": true,
+			}
+		}
+		waves = append(waves, wave)
+	}
+
+	return map[string]interface{}{
+		"success": true,
+		"plan": map[string]interface{}{
+			"manifestDigest": digest,
+			"resources":      len(objects),
+			"workloads":      workloads,
+			"waves":          waves,
+		},
+	}
+}
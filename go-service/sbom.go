@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sbomRequest is the request body for sbom. The render comes from the
+// usual manifest, manifestFile or name/chart keys.
+type sbomRequest struct {
+	Name  string `json:"name"`
+	Chart string `json:"chart"`
+	// Format is "cyclonedx" (CycloneDX 1.5, the default) or "spdx" (SPDX
+	// 2.3), both as JSON.
+	Format string `json:"format"`
+	// Images are added to those the manifest references.
+	Images []string `json:"images"`
+	// ResolveDigests looks up the digest of images referenced by tag, so
+	// the document names exactly what the cluster would pull.
+	ResolveDigests bool   `json:"resolveDigests"`
+	OutputFile     string `json:"outputFile"`
+}
+
+// sbomComponent is a chart or image in the document.
+type sbomComponent struct {
+	ref       string
+	kind      string // "chart" or "image"
+	name      string
+	version   string
+	digest    string
+	purl      string
+	licenses  []string
+	resources []string
+	dependsOn []string
+}
+
+// generateSBOM describes the charts (with the subcharts they bundle) and
+// container images a render involves as a CycloneDX or SPDX document, for
+// attaching to supply-chain attestations of a deployment.
+func generateSBOM(input map[string]interface{}) map[string]interface{} {
+	var req sbomRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Format == "" {
+		req.Format = "cyclonedx"
+	}
+	if req.Format != "cyclonedx" && req.Format != "spdx" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'format' must be cyclonedx or spdx",
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+
+	var components []*sbomComponent
+	var root *sbomComponent
+	if req.Chart != "" {
+		charts, err := sbomCharts(requestContext(input), req.Chart)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to read chart: " + err.Error(),
+			}
+		}
+		components = append(components, charts...)
+		root = charts[0]
+	}
+
+	images := manifestImages(objects)
+	for _, image := range req.Images {
+		images = append(images, imageUse{Image: image})
+	}
+	imageComponents := make([]*sbomComponent, len(images))
+	errs := make([]error, len(images))
+	client := newRegistryClient()
+	sem := newSemaphore(8)
+	var wg sync.WaitGroup
+	for i, use := range images {
+		wg.Add(1)
+		go func(i int, use imageUse) {
+			defer wg.Done()
+			defer sem.acquire()()
+			imageComponents[i], errs[i] = sbomImage(client, use, req.ResolveDigests)
+		}(i, use)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   images[i].Image + ": " + err.Error(),
+			}
+		}
+	}
+	components = append(components, imageComponents...)
+	if root != nil {
+		for _, c := range imageComponents {
+			root.dependsOn = append(root.dependsOn, c.ref)
+		}
+	}
+
+	subject := firstNonEmpty(req.Name, "manifest")
+	var doc interface{}
+	if req.Format == "spdx" {
+		doc = spdxDocument(subject, components)
+	} else {
+		doc = cycloneDXDocument(subject, components)
+	}
+	result := map[string]interface{}{
+		"success":    true,
+		"format":     req.Format,
+		"components": len(components),
+	}
+	if req.OutputFile != "" {
+		size, digest, err := writeManifestFile(req.OutputFile, func(w io.Writer) (int64, error) {
+			data, err := json.MarshalIndent(doc, "", "  ")
+			if err != nil {
+				return 0, err
+			}
+			n, err := w.Write(append(data, '\n'))
+			return int64(n), err
+		})
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		result["outputFile"] = req.OutputFile
+		result["bytes"] = size
+		result["sha256"] = digest
+		return result
+	}
+	result["sbom"] = doc
+	return result
+}
+
+// sbomCharts lists a chart and its bundled or pinned dependencies, the
+// chart itself first. Charts that are not local are named as referenced.
+func sbomCharts(ctx context.Context, chart string) ([]*sbomComponent, error) {
+	if _, err := os.Stat(chart); err != nil {
+		name := path.Base(strings.TrimPrefix(chart, "oci://"))
+		return []*sbomComponent{{ref: "chart:" + chart, kind: "chart", name: name}}, nil
+	}
+	found, err := chartLicenses(ctx, chart)
+	if err != nil {
+		return nil, err
+	}
+	var out []*sbomComponent
+	// Dependencies that could not be read (status "error") are still listed,
+	// by the name and version Chart.lock gives them.
+	for _, c := range found {
+		out = append(out, &sbomComponent{
+			ref:      "chart:" + c.Name + "@" + c.Version,
+			kind:     "chart",
+			name:     c.Name,
+			version:  c.Version,
+			licenses: c.Licenses,
+		})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no Chart.yaml in %s", chart)
+	}
+	for _, dep := range out[1:] {
+		out[0].dependsOn = append(out[0].dependsOn, dep.ref)
+	}
+	return out, nil
+}
+
+// sbomImage describes an image, with a package URL in the pkg:oci form.
+func sbomImage(client *registryClient, use imageUse, resolve bool) (*sbomComponent, error) {
+	ref, err := parseImageRef(use.Image)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Digest == "" && resolve {
+		if _, ref.Digest, err = client.manifest(ref, ref.Tag); err != nil {
+			return nil, err
+		}
+	}
+	c := &sbomComponent{
+		ref:       "image:" + use.Image,
+		kind:      "image",
+		name:      ref.Registry + "/" + ref.Repository,
+		version:   firstNonEmpty(ref.Tag, ref.Digest),
+		digest:    ref.Digest,
+		resources: use.Resources,
+	}
+	q := url.Values{}
+	q.Set("repository_url", c.name)
+	if ref.Tag != "" {
+		q.Set("tag", ref.Tag)
+	}
+	c.purl = "pkg:oci/" + path.Base(ref.Repository)
+	if ref.Digest != "" {
+		c.purl += "@" + url.PathEscape(ref.Digest)
+	}
+	c.purl += "?" + q.Encode()
+	return c, nil
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func cycloneDXDocument(subject string, components []*sbomComponent) map[string]interface{} {
+	var list, deps []map[string]interface{}
+	for _, c := range components {
+		entry := map[string]interface{}{
+			"bom-ref": c.ref,
+			"name":    c.name,
+		}
+		if c.version != "" {
+			entry["version"] = c.version
+		}
+		if c.kind == "image" {
+			entry["type"] = "container"
+			entry["purl"] = c.purl
+			if digest := strings.TrimPrefix(c.digest, "sha256:"); digest != c.digest {
+				entry["hashes"] = []map[string]interface{}{{"alg": "SHA-256", "content": digest}}
+			}
+		} else {
+			entry["type"] = "application"
+			entry["properties"] = []map[string]interface{}{{"name": "infrakit:type", "value": "helm-chart"}}
+		}
+		if len(c.licenses) > 0 {
+			entry["licenses"] = []map[string]interface{}{{"expression": strings.Join(c.licenses, " AND ")}}
+		}
+		for _, r := range c.resources {
+			props, _ := entry["properties"].([]map[string]interface{})
+			entry["properties"] = append(props, map[string]interface{}{"name": "infrakit:resource", "value": r})
+		}
+		list = append(list, entry)
+		if len(c.dependsOn) > 0 {
+			deps = append(deps, map[string]interface{}{"ref": c.ref, "dependsOn": c.dependsOn})
+		}
+	}
+	doc := map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + randomUUID(),
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"tools": map[string]interface{}{
+				"components": []map[string]interface{}{{"type": "application", "name": "infrakit", "version": version}},
+			},
+			"component": map[string]interface{}{"type": "application", "bom-ref": "deployment:" + subject, "name": subject},
+		},
+		"components": list,
+	}
+	if len(deps) > 0 {
+		doc["dependencies"] = deps
+	}
+	return doc
+}
+
+var spdxIDChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+func spdxDocument(subject string, components []*sbomComponent) map[string]interface{} {
+	ids := map[string]string{}
+	var packages, relationships []map[string]interface{}
+	for i, c := range components {
+		id := fmt.Sprintf("SPDXRef-%s-%d-%s", c.kind, i+1, strings.Trim(spdxIDChars.ReplaceAllString(c.name, "-"), "-"))
+		ids[c.ref] = id
+		license := "NOASSERTION"
+		if len(c.licenses) > 0 {
+			license = strings.Join(c.licenses, " AND ")
+		}
+		pkg := map[string]interface{}{
+			"SPDXID":           id,
+			"name":             c.name,
+			"downloadLocation": "NOASSERTION",
+			"filesAnalyzed":    false,
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  license,
+		}
+		if c.version != "" {
+			pkg["versionInfo"] = c.version
+		}
+		if c.kind == "image" {
+			pkg["primaryPackagePurpose"] = "CONTAINER"
+			pkg["externalRefs"] = []map[string]interface{}{{"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": c.purl}}
+			if digest := strings.TrimPrefix(c.digest, "sha256:"); digest != c.digest {
+				pkg["checksums"] = []map[string]interface{}{{"algorithm": "SHA256", "checksumValue": digest}}
+			}
+		} else {
+			pkg["primaryPackagePurpose"] = "APPLICATION"
+		}
+		if len(c.resources) > 0 {
+			pkg["comment"] = "Used by " + strings.Join(c.resources, ", ")
+		}
+		packages = append(packages, pkg)
+	}
+	for i, c := range components {
+		// The document describes the top-level chart, or every image of a
+		// plain manifest.
+		if i == 0 && c.kind == "chart" || components[0].kind == "image" {
+			relationships = append(relationships, map[string]interface{}{"spdxElementId": "SPDXRef-DOCUMENT", "relationshipType": "DESCRIBES", "relatedSpdxElement": ids[c.ref]})
+		}
+		for _, dep := range c.dependsOn {
+			relationships = append(relationships, map[string]interface{}{"spdxElementId": ids[c.ref], "relationshipType": "DEPENDS_ON", "relatedSpdxElement": ids[dep]})
+		}
+	}
+	doc := map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              subject,
+		"documentNamespace": "https://infrakit.invalid/spdx/" + url.PathEscape(subject) + "-" + randomUUID(),
+		"creationInfo": map[string]interface{}{
+			"created":  time.Now().UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: infrakit-" + version},
+		},
+		"packages": packages,
+	}
+	if len(relationships) > 0 {
+		doc["relationships"] = relationships
+	}
+	return doc
+}
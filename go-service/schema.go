@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// schemaError is one violation of a schema; Path is a field path such as
+// `spec.template.spec.containers[0].image`.
+type schemaError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// schemaValidator checks decoded JSON against the subset of JSON Schema
+// used by Kubernetes OpenAPI definitions, CRD schemas and chart values
+// schemas: $ref, allOf, oneOf, anyOf, type, properties, patternProperties,
+// additionalProperties, required, items, enum, const, pattern, length,
+// item count and numeric bounds, and the int-or-string /
+// preserve-unknown-fields extensions. With Strict, fields a schema does not
+// declare are errors, as they are for the API server's strict field
+// validation.
+type schemaValidator struct {
+	Definitions map[string]interface{}
+	// Root is the document other "#/..." references point into.
+	Root   map[string]interface{}
+	Strict bool
+}
+
+// validate returns the violations of schema by value, which may come from
+// decodeYAML (with int numbers) or encoding/json.
+func (v schemaValidator) validate(value interface{}, schema map[string]interface{}) []schemaError {
+	var errs []schemaError
+	v.check(deepCopyJSON(value), schema, "", &errs, 0)
+	return errs
+}
+
+func (v schemaValidator) check(value interface{}, schema map[string]interface{}, path string, errs *[]schemaError, depth int) {
+	if schema == nil || depth > 64 {
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "."
+		}
+		*errs = append(*errs, schemaError{p, fmt.Sprintf(format, args...)})
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		if target, ok := v.resolve(ref); ok {
+			v.check(value, target, path, errs, depth+1)
+		}
+		return
+	}
+	for _, s := range schemaList(schema["allOf"]) {
+		v.check(value, s, path, errs, depth+1)
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		alternatives := schemaList(schema[key])
+		if len(alternatives) == 0 {
+			continue
+		}
+		matched := false
+		for _, s := range alternatives {
+			var sub []schemaError
+			v.check(value, s, path, &sub, depth+1)
+			if len(sub) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("does not match any of the allowed schemas")
+		}
+	}
+	// The API server treats null as unset.
+	if value == nil {
+		return
+	}
+
+	intOrString := schema["x-kubernetes-int-or-string"] == true || schema["format"] == "int-or-string"
+	if types := schemaTypes(schema["type"]); len(types) > 0 || intOrString {
+		if intOrString {
+			types = append(types, "integer", "string")
+		}
+		if !matchesType(value, types) {
+			fail("expected %s, got %s", strings.Join(types, " or "), jsonType(value))
+			return
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !valuesEqual(c, value) {
+		fail("must be %s", enumList([]interface{}{c}))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		found := false
+		for _, e := range enum {
+			if valuesEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", enumList(enum))
+		}
+	}
+
+	switch t := value.(type) {
+	case string:
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := cachedRegexp(pattern); err == nil && !re.MatchString(t) {
+				fail("must match %s", pattern)
+			}
+		}
+		if n, ok := schema["maxLength"].(float64); ok && float64(len([]rune(t))) > n {
+			fail("must be at most %d characters", int(n))
+		}
+		if n, ok := schema["minLength"].(float64); ok && float64(len([]rune(t))) < n {
+			fail("must be at least %d characters", int(n))
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && t < n {
+			fail("must be at least %v", n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && t > n {
+			fail("must be at most %v", n)
+		}
+		if n, ok := schema["exclusiveMinimum"].(float64); ok && t <= n {
+			fail("must be more than %v", n)
+		}
+		if n, ok := schema["exclusiveMaximum"].(float64); ok && t >= n {
+			fail("must be less than %v", n)
+		}
+	case []interface{}:
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(t)) > n {
+			fail("must have at most %d items", int(n))
+		}
+		if n, ok := schema["minItems"].(float64); ok && float64(len(t)) < n {
+			fail("must have at least %d items", int(n))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range t {
+				v.check(item, items, fmt.Sprintf("%s[%d]", path, i), errs, depth+1)
+			}
+		}
+	case map[string]interface{}:
+		for _, r := range schemaStrings(schema["required"]) {
+			if _, ok := t[r]; !ok {
+				*errs = append(*errs, schemaError{fieldPathChild(path, r), "required field is missing"})
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		patterns, _ := schema["patternProperties"].(map[string]interface{})
+		additional := schema["additionalProperties"]
+		preserve := schema["x-kubernetes-preserve-unknown-fields"] == true
+		for _, key := range sortedKeys(t) {
+			child := fieldPathChild(path, key)
+			if s, ok := properties[key].(map[string]interface{}); ok {
+				v.check(t[key], s, child, errs, depth+1)
+				continue
+			}
+			matched := false
+			for _, pattern := range sortedKeys(patterns) {
+				s, ok := patterns[pattern].(map[string]interface{})
+				if re, err := cachedRegexp(pattern); ok && err == nil && re.MatchString(key) {
+					v.check(t[key], s, child, errs, depth+1)
+					matched = true
+				}
+			}
+			if matched {
+				continue
+			}
+			switch a := additional.(type) {
+			case map[string]interface{}:
+				v.check(t[key], a, child, errs, depth+1)
+			case bool:
+				if !a && !preserve {
+					*errs = append(*errs, schemaError{child, "unknown field"})
+				}
+			default:
+				if v.Strict && properties != nil && !preserve {
+					*errs = append(*errs, schemaError{child, "unknown field"})
+				}
+			}
+		}
+	}
+}
+
+// resolve returns the schema ref points at: a definition or, for other
+// "#/..." references, the part of Root its JSON Pointer names.
+func (v schemaValidator) resolve(ref string) (map[string]interface{}, bool) {
+	if name, ok := strings.CutPrefix(ref, "#/definitions/"); ok {
+		if target, ok := v.Definitions[name].(map[string]interface{}); ok {
+			return target, true
+		}
+	}
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok || v.Root == nil {
+		return nil, false
+	}
+	var target interface{} = v.Root
+	for _, token := range strings.Split(pointer, "/")[1:] {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch t := target.(type) {
+		case map[string]interface{}:
+			target = t[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			target = t[i]
+		default:
+			return nil, false
+		}
+	}
+	m, ok := target.(map[string]interface{})
+	return m, ok
+}
+
+// fieldPathChild appends a map key to a field path, quoting keys that
+// parseFieldPath would otherwise split.
+func fieldPathChild(path, key string) string {
+	if strings.ContainsAny(key, ".[]\"") || key == "" {
+		return path + `["` + key + `"]`
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func schemaList(v interface{}) []map[string]interface{} {
+	list, _ := v.([]interface{})
+	var out []map[string]interface{}
+	for _, item := range list {
+		if m, ok := item.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func schemaStrings(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var out []string
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func schemaTypes(v interface{}) []string {
+	if s, ok := v.(string); ok {
+		return []string{s}
+	}
+	return schemaStrings(v)
+}
+
+func matchesType(value interface{}, types []string) bool {
+	for _, t := range types {
+		switch t {
+		case "integer":
+			if n, ok := value.(float64); ok && n == math.Trunc(n) {
+				return true
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return true
+			}
+		default:
+			if jsonType(value) == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func enumList(enum []interface{}) string {
+	parts := make([]string, len(enum))
+	for i, e := range enum {
+		data, _ := json.Marshal(e)
+		parts[i] = string(data)
+	}
+	return strings.Join(parts, ", ")
+}
+
+var regexpCache = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: map[string]*regexp.Regexp{}}
+
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.Lock()
+	defer regexpCache.Unlock()
+	if re, ok := regexpCache.m[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.m[pattern] = re
+	return re, nil
+}
+
+// builtinSchemas are the definitions of one Kubernetes version's built-in
+// types, indexed by apiVersion and kind.
+type builtinSchemas struct {
+	Version     string
+	Definitions map[string]interface{}
+	byGVK       map[string]string
+	groups      map[string]bool
+}
+
+var loadedSchemas = struct {
+	sync.Mutex
+	m map[string]*builtinSchemas
+}{m: map[string]*builtinSchemas{}}
+
+// loadBuiltinSchemas reads a version's definitions from the schema cache,
+// downloading them from base first if they are not cached.
+func loadBuiltinSchemas(base, version string) (*builtinSchemas, error) {
+	loadedSchemas.Lock()
+	defer loadedSchemas.Unlock()
+	if s, ok := loadedSchemas.m[version]; ok {
+		return s, nil
+	}
+	if base == "" {
+		base = defaultSchemaBaseURL
+	}
+	if err := cacheBuiltinSchemas(base, version); err != nil {
+		return nil, fmt.Errorf("no schemas for %s in %s and download failed: %v", version, schemaCacheDir(), err)
+	}
+	data, err := os.ReadFile(filepath.Join(schemaCacheDir(), version, "_definitions.json"))
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Definitions map[string]interface{} `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("schemas for %s: %v", version, err)
+	}
+	s := &builtinSchemas{Version: version, Definitions: doc.Definitions, byGVK: map[string]string{}, groups: map[string]bool{}}
+	for _, name := range sortedKeys(doc.Definitions) {
+		def, _ := doc.Definitions[name].(map[string]interface{})
+		for _, gvk := range schemaList(def["x-kubernetes-group-version-kind"]) {
+			group, _ := gvk["group"].(string)
+			ver, _ := gvk["version"].(string)
+			kind, _ := gvk["kind"].(string)
+			s.groups[group] = true
+			apiVersion := ver
+			if group != "" {
+				apiVersion = group + "/" + ver
+			}
+			// Some kinds (e.g. DeleteOptions) are listed under every group;
+			// the first definition wins.
+			if _, ok := s.byGVK[apiVersion+"/"+kind]; !ok {
+				s.byGVK[apiVersion+"/"+kind] = name
+			}
+		}
+	}
+	loadedSchemas.m[version] = s
+	return s, nil
+}
+
+// schemaFor returns the definition of apiVersion/kind, if the version has
+// the type.
+func (s *builtinSchemas) schemaFor(apiVersion, kind string) (map[string]interface{}, bool) {
+	name, ok := s.byGVK[apiVersion+"/"+kind]
+	if !ok {
+		return nil, false
+	}
+	def, ok := s.Definitions[name].(map[string]interface{})
+	return def, ok
+}
+
+// apiVersionsOf lists the apiVersions serving kind in this version, for
+// suggesting a replacement when the one used is missing.
+func (s *builtinSchemas) apiVersionsOf(kind string) []string {
+	var out []string
+	for gvk := range s.byGVK {
+		if i := strings.LastIndex(gvk, "/"); gvk[i+1:] == kind {
+			out = append(out, gvk[:i])
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// builtinGroup tells API groups of Kubernetes itself, including ones this
+// version no longer serves (e.g. policy after PodSecurityPolicy), from the
+// groups of custom resources.
+func (s *builtinSchemas) builtinGroup(apiVersion string) bool {
+	group, _, ok := strings.Cut(apiVersion, "/")
+	return !ok || !strings.Contains(group, ".") || s.groups[group]
+}
+
+// cachedCRDSchema returns a custom resource schema stored by warm.
+func cachedCRDSchema(apiVersion, kind string) (map[string]interface{}, bool) {
+	group, version, ok := strings.Cut(apiVersion, "/")
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(schemaCacheDir(), "crds", group, strings.ToLower(kind)+"_"+version+".json"))
+	if err != nil {
+		return nil, false
+	}
+	var schema map[string]interface{}
+	if json.Unmarshal(data, &schema) != nil {
+		return nil, false
+	}
+	return schema, true
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// version and releasePublicKey are set at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.releasePublicKey=<base64 ed25519 key>"
+var (
+	version          = "dev"
+	releasePublicKey = ""
+)
+
+// defaultReleaseURL serves the assets of the latest release, which include
+// one <channel>.json (and its .sig) per release channel.
+const defaultReleaseURL = "https://github.com/melhemrahmeh/infrakit/releases/latest/download"
+
+// channelManifest describes the current release of a channel. Channel
+// names the channel the manifest was signed for, so one channel's signed
+// file cannot be served as another's. Artifacts are keyed by
+// "<os>/<arch>", e.g. "linux/amd64".
+type channelManifest struct {
+	Channel   string `json:"channel"`
+	Version   string `json:"version"`
+	Artifacts map[string]struct {
+		URL    string `json:"url"`
+		SHA256 string `json:"sha256"`
+	} `json:"artifacts"`
+}
+
+// selfUpdateRequest is the request body for self-update.
+type selfUpdateRequest struct {
+	// Channel defaults to INFRAKIT_RELEASE_CHANNEL, then "stable".
+	Channel string `json:"channel"`
+	// Check reports whether an update is available without installing it.
+	Check bool `json:"check"`
+	// Force reinstalls even when the channel has the running version, and
+	// installs the channel's release even when it is older.
+	Force bool `json:"force"`
+}
+
+func releaseURL() string {
+	if url := os.Getenv("INFRAKIT_RELEASE_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return defaultReleaseURL
+}
+
+// selfUpdate replaces the running binary with the channel's release. The
+// channel manifest must carry a valid signature from releasePublicKey and
+// the artifact must match the manifest's checksum. An older release is
+// only installed with force. The new binary is
+// written next to the old one, run once, and renamed over it, so a failed
+// update leaves the old binary in place.
+func selfUpdate(input map[string]interface{}) map[string]interface{} {
+	var req selfUpdateRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Channel == "" {
+		req.Channel = os.Getenv("INFRAKIT_RELEASE_CHANNEL")
+	}
+	if req.Channel == "" {
+		req.Channel = "stable"
+	}
+	if strings.ContainsAny(req.Channel, "/\\") || strings.HasPrefix(req.Channel, ".") {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid channel: " + req.Channel,
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(releasePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "This build has no release signing key, so updates cannot be verified; build with -ldflags \"-X main.releasePublicKey=...\"",
+		}
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	base := releaseURL()
+	manifestData, err := fetchRelease(client, base+"/"+req.Channel+".json", 1<<20)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to fetch the " + req.Channel + " channel: " + err.Error(),
+		}
+	}
+	sigData, err := fetchRelease(client, base+"/"+req.Channel+".json.sig", 4<<10)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to fetch the channel signature: " + err.Error(),
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), manifestData, sig) {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "The " + req.Channel + " channel manifest has an invalid signature",
+		}
+	}
+	var manifest channelManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid channel manifest: " + err.Error(),
+		}
+	}
+	if manifest.Channel != req.Channel {
+		return map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("The %s channel manifest was signed for the %q channel", req.Channel, manifest.Channel),
+		}
+	}
+	latest, ok := parseSemver(manifest.Version)
+	if !ok {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid channel manifest: version " + manifest.Version + " is not a semantic version",
+		}
+	}
+	// A build without a semantic version (e.g. "dev") is older than any
+	// release.
+	newer := 1
+	if current, ok := parseSemver(version); ok {
+		newer = compareSemver(latest, current)
+	}
+	result := map[string]interface{}{
+		"success":        true,
+		"channel":        req.Channel,
+		"currentVersion": version,
+		"latestVersion":  manifest.Version,
+		"updated":        false,
+	}
+	if newer == 0 && !req.Force {
+		result["message"] = "Already up to date"
+		return result
+	}
+	if newer < 0 && !req.Force {
+		if req.Check {
+			result["updateAvailable"] = false
+			result["message"] = "The " + req.Channel + " channel has an older release"
+			return result
+		}
+		result["success"] = false
+		result["error"] = fmt.Sprintf("Refusing to downgrade %s to %s; use force to install it anyway", version, manifest.Version)
+		return result
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	artifact, ok := manifest.Artifacts[platform]
+	if !ok || artifact.URL == "" || artifact.SHA256 == "" {
+		result["success"] = false
+		result["error"] = "No " + manifest.Version + " release for " + platform
+		return result
+	}
+	if req.Check {
+		result["updateAvailable"] = newer > 0
+		return result
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		result["success"] = false
+		result["error"] = "Cannot locate the running binary: " + err.Error()
+		return result
+	}
+	if err := installRelease(client, exe, artifact.URL, artifact.SHA256); err != nil {
+		result["success"] = false
+		result["error"] = "Update failed: " + err.Error()
+		return result
+	}
+	result["updated"] = true
+	result["path"] = exe
+	result["message"] = fmt.Sprintf("Updated %s to %s", version, manifest.Version)
+	return result
+}
+
+func fetchRelease(client *http.Client, url string, limit int64) ([]byte, error) {
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		traceRequest("GET", url, start, 0, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	traceRequest("GET", url, start, resp.StatusCode, nil)
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(url + ": " + resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errors.New(url + ": response too large")
+	}
+	return data, nil
+}
+
+// installRelease downloads the artifact beside exe, checks its digest and
+// that it runs, then renames it over exe.
+func installRelease(client *http.Client, exe, url, digest string) error {
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		traceRequest("GET", url, start, 0, err)
+		return err
+	}
+	defer resp.Body.Close()
+	traceRequest("GET", url, start, resp.StatusCode, nil)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(url + ": " + resp.Status)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(exe), ".infrakit-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(got, digest) {
+		return fmt.Errorf("checksum mismatch: got sha256 %s, want %s", got, digest)
+	}
+	if err := os.Chmod(f.Name(), info.Mode().Perm()|0o500); err != nil {
+		return err
+	}
+	if out, err := exec.Command(f.Name(), "help").CombinedOutput(); err != nil {
+		return fmt.Errorf("new binary does not run: %v: %s", err, firstLines(string(out), 3))
+	}
+	// Windows cannot replace a running executable, but can rename it.
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(f.Name(), exe)
+}
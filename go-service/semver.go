@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version; missing minor or patch parts are 0.
+type semver struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+var semverFull = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+func parseSemver(s string) (semver, bool) {
+	m := semverFull.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return semver{}, false
+	}
+	var v semver
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	v.Pre = m[4]
+	return v, true
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// compareSemver orders versions by precedence; a pre-release sorts before
+// its release.
+func compareSemver(a, b semver) int {
+	for _, d := range []int{a.Major - b.Major, a.Minor - b.Minor, a.Patch - b.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case a.Pre == b.Pre:
+		return 0
+	case a.Pre == "":
+		return 1
+	case b.Pre == "":
+		return -1
+	}
+	ap, bp := strings.Split(a.Pre, "."), strings.Split(b.Pre, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aerr := strconv.Atoi(ap[i])
+		bn, berr := strconv.Atoi(bp[i])
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			return sign(an - bn)
+		case aerr == nil && berr != nil:
+			return -1
+		case aerr != nil && berr == nil:
+			return 1
+		case ap[i] != bp[i]:
+			return strings.Compare(ap[i], bp[i])
+		}
+	}
+	return sign(len(ap) - len(bp))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// semverChange names the largest part that differs from older to newer:
+// "major", "minor", "patch", "prerelease" or "none".
+func semverChange(older, newer semver) string {
+	switch {
+	case compareSemver(newer, older) <= 0:
+		return "none"
+	case newer.Major != older.Major:
+		return "major"
+	case newer.Minor != older.Minor:
+		return "minor"
+	case newer.Patch != older.Patch:
+		return "patch"
+	}
+	return "prerelease"
+}
+
+// semverConstraint is a Helm (Masterminds) version range such as "^1.2.0",
+// "~1.2", ">=1.0.0 <2.0.0", "1.2.x", "1.0 - 1.4" or "<1 || >=3".
+type semverConstraint struct {
+	any [][]semverBound // OR of ANDs
+}
+
+type semverBound struct {
+	op string
+	v  semver
+}
+
+var constraintPart = regexp.MustCompile(`^(=|!=|>=|<=|>|<|~>|~|\^)?\s*v?([0-9xX*]+(?:\.[0-9xX*]+){0,2}(?:-[0-9A-Za-z.-]+)?)$`)
+
+func parseSemverConstraint(s string) (semverConstraint, error) {
+	var c semverConstraint
+	for _, alt := range strings.Split(s, "||") {
+		alt = strings.TrimSpace(alt)
+		var bounds []semverBound
+		if lo, hi, ok := strings.Cut(alt, " - "); ok {
+			l, err := expandConstraint(">=", strings.TrimSpace(lo))
+			if err != nil {
+				return c, err
+			}
+			h, err := expandConstraint("<=", strings.TrimSpace(hi))
+			if err != nil {
+				return c, err
+			}
+			c.any = append(c.any, append(l, h...))
+			continue
+		}
+		// Operators may be separated from versions by spaces (">= 1.2").
+		fields := strings.Fields(strings.ReplaceAll(alt, ",", " "))
+		for i := 0; i < len(fields); i++ {
+			part := fields[i]
+			if strings.Trim(part, "=!<>~^") == "" && i+1 < len(fields) {
+				part += fields[i+1]
+				i++
+			}
+			m := constraintPart.FindStringSubmatch(part)
+			if m == nil {
+				return c, fmt.Errorf("invalid version constraint %q", part)
+			}
+			b, err := expandConstraint(m[1], m[2])
+			if err != nil {
+				return c, err
+			}
+			bounds = append(bounds, b...)
+		}
+		if len(bounds) == 0 {
+			bounds = []semverBound{{">=", semver{}}}
+		}
+		c.any = append(c.any, bounds)
+	}
+	return c, nil
+}
+
+// expandConstraint turns one operator and a possibly partial or wildcard
+// version into plain comparisons.
+func expandConstraint(op, version string) ([]semverBound, error) {
+	core, pre, _ := strings.Cut(version, "-")
+	parts := strings.Split(core, ".")
+	// known is how many leading parts are given, not wildcards.
+	known := 0
+	nums := [3]int{}
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		nums[i] = n
+		known++
+	}
+	v := semver{nums[0], nums[1], nums[2], pre}
+	// next is the first version past the range a partial version covers.
+	next := func(depth int) semver {
+		switch depth {
+		case 0:
+			return semver{Major: 1 << 30}
+		case 1:
+			return semver{Major: v.Major + 1}
+		case 2:
+			return semver{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return semver{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	switch op {
+	case "", "=":
+		if known == 3 {
+			return []semverBound{{"=", v}}, nil
+		}
+		return []semverBound{{">=", v}, {"<", next(known)}}, nil
+	case "!=":
+		return []semverBound{{"!=", v}}, nil
+	case ">":
+		if known < 3 {
+			return []semverBound{{">=", next(known)}}, nil
+		}
+		return []semverBound{{">", v}}, nil
+	case "<=":
+		if known < 3 {
+			return []semverBound{{"<", next(known)}}, nil
+		}
+		return []semverBound{{"<=", v}}, nil
+	case ">=", "<":
+		return []semverBound{{op, v}}, nil
+	case "~", "~>":
+		depth := 2
+		if known < 2 {
+			depth = 1
+		}
+		return []semverBound{{">=", v}, {"<", next(depth)}}, nil
+	case "^":
+		depth := 1
+		switch {
+		case v.Major == 0 && v.Minor == 0 && known == 3:
+			depth = 3
+		case v.Major == 0 && known >= 2:
+			depth = 2
+		}
+		return []semverBound{{">=", v}, {"<", next(depth)}}, nil
+	}
+	return nil, fmt.Errorf("invalid operator %q", op)
+}
+
+// allows reports whether v is in the range. As in Helm, pre-releases only
+// match when a bound of the same alternative is a pre-release of the same
+// major.minor.patch.
+func (c semverConstraint) allows(v semver) bool {
+	for _, bounds := range c.any {
+		ok, preAllowed := true, v.Pre == ""
+		for _, b := range bounds {
+			if b.v.Pre != "" && b.v.Major == v.Major && b.v.Minor == v.Minor && b.v.Patch == v.Patch {
+				preAllowed = true
+			}
+			cmp := compareSemver(v, b.v)
+			switch b.op {
+			case "=":
+				ok = ok && cmp == 0
+			case "!=":
+				ok = ok && cmp != 0
+			case ">":
+				ok = ok && cmp > 0
+			case ">=":
+				ok = ok && cmp >= 0
+			case "<":
+				ok = ok && cmp < 0
+			case "<=":
+				ok = ok && cmp <= 0
+			}
+		}
+		if ok && preAllowed {
+			return true
+		}
+	}
+	return false
+}
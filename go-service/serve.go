@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The HTTP server is configured by its flags or, failing those:
+//
+//	INFRAKIT_SERVE_ADDR         listen address (default 127.0.0.1:8080)
+//	INFRAKIT_SERVE_TOKEN        bearer token required by every endpoint but
+//	                            the probes; mandatory unless the address is
+//	                            loopback
+//	INFRAKIT_SERVE_TIMEOUT      longest a request may run, queued or running
+//	                            (default 5m)
+//	INFRAKIT_SERVE_MAX_RUNNING  cluster-facing requests run at once; 0 runs
+//	                            every request at once (default 16)
+//	INFRAKIT_SERVE_QUEUE_SIZE   requests waiting for one of those; more are
+//	                            turned away with 429 (default 64)
+//
+// Calls to each cluster are rate limited as INFRAKIT_CLUSTER_RATE sets.
+const (
+	defaultServeAddr            = "127.0.0.1:8080"
+	defaultServeTimeout         = 5 * time.Minute
+	defaultServeShutdownTimeout = 30 * time.Second
+	defaultServeMaxRunning      = 16
+	defaultServeQueueSize       = 64
+	// queueRetryAfter is the Retry-After, in seconds, of a request turned
+	// away by a full queue.
+	queueRetryAfter = 5
+)
+
+// serveExcluded are commands that only make sense from a terminal.
+var serveExcluded = map[string]bool{
+	"serve":       true,
+	"ui":          true,
+	"self-update": true,
+}
+
+// serveRequest is the request body for serve.
+type serveRequest struct {
+	Addr string `json:"addr"`
+	// Timeout bounds each request, ShutdownTimeout how long a stop waits
+	// for requests in flight (Go durations).
+	Timeout         string `json:"timeout"`
+	ShutdownTimeout string `json:"shutdownTimeout"`
+	// MaxRunning bounds the cluster-facing requests run at once, QueueSize
+	// those waiting for them.
+	MaxRunning *int `json:"maxRunning"`
+	QueueSize  *int `json:"queueSize"`
+}
+
+// serve runs the service as a long-lived HTTP server: POST /<command> with
+// the JSON request as body returns the JSON result the command would print,
+// and GET / lists the commands. GET /healthz and /readyz answer liveness
+// and readiness probes, GET /metrics serves Prometheus metrics and GET
+// /schema the describe catalog of the served commands. Each request gets
+// its own cluster access and operation record, as a one-shot run does.
+// Cluster-facing commands wait in a bounded work queue, interactive
+// requests ahead of those with "X-Priority: batch"; when it is full they
+// are answered 429 with a Retry-After. The audit log records the address
+// of each request and the caller named by its X-Caller header.
+// SIGINT or SIGTERM stops accepting requests and waits for those in flight
+// before returning.
+func serve(input map[string]interface{}) map[string]interface{} {
+	var req serveRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	addr := firstNonEmpty(req.Addr, os.Getenv("INFRAKIT_SERVE_ADDR"), defaultServeAddr)
+	timeout, err := serveDuration(req.Timeout, os.Getenv("INFRAKIT_SERVE_TIMEOUT"), defaultServeTimeout)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid timeout: " + err.Error(),
+		}
+	}
+	shutdownTimeout, err := serveDuration(req.ShutdownTimeout, "", defaultServeShutdownTimeout)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid shutdownTimeout: " + err.Error(),
+		}
+	}
+	maxRunning, err := serveLimit(req.MaxRunning, "INFRAKIT_SERVE_MAX_RUNNING", defaultServeMaxRunning)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid maxRunning: " + err.Error(),
+		}
+	}
+	queueSize, err := serveLimit(req.QueueSize, "INFRAKIT_SERVE_QUEUE_SIZE", defaultServeQueueSize)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid queueSize: " + err.Error(),
+		}
+	}
+	token := os.Getenv("INFRAKIT_SERVE_TOKEN")
+	if err := requireToken(addr, token, "INFRAKIT_SERVE_TOKEN"); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+
+	h := &serveHandler{timeout: timeout, queue: newWorkQueue(maxRunning, queueSize)}
+	// Probes come from the kubelet, which sends no token.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", serveReadyz)
+	mux.Handle("/metrics", bearerAuth(token, http.HandlerFunc(serveMetrics)))
+	mux.Handle("/schema", bearerAuth(token, http.HandlerFunc(serveSchema)))
+	mux.Handle("/", bearerAuth(token, h))
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		signal.Stop(signals)
+		slog.Info("Shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- srv.Shutdown(ctx)
+	}()
+	slog.Info("Serving", "url", "http://"+ln.Addr().String())
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	result := map[string]interface{}{
+		"success":  true,
+		"requests": atomic.LoadInt64(&h.requests),
+	}
+	if err := <-stopped; err != nil {
+		result["success"] = false
+		result["error"] = "Requests still running at shutdown: " + err.Error()
+	}
+	return result
+}
+
+func serveDuration(value, env string, def time.Duration) (time.Duration, error) {
+	if value = firstNonEmpty(value, env); value == "" {
+		return def, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// serveLimit is value or, failing that, the limit env sets or def.
+func serveLimit(value *int, env string, def int) (int, error) {
+	n := def
+	if value != nil {
+		n = *value
+	} else if s := os.Getenv(env); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			return 0, fmt.Errorf("%s: %v", env, err)
+		}
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return n, nil
+}
+
+type serveHandler struct {
+	timeout  time.Duration
+	queue    *workQueue
+	requests int64
+}
+
+// ServeHTTP answers a request under the caller's X-Request-ID, or a new
+// ID, which the response carries in the header and the result.
+func (h *serveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, id := withRequestID(r.Context(), r.Header.Get("X-Request-ID"))
+	ctx = withAuditCaller(ctx, auditCaller{Address: r.RemoteAddr, Name: r.Header.Get("X-Caller"), UserAgent: r.UserAgent()})
+	w.Header().Set("X-Request-ID", id)
+	status, result := h.handle(r.WithContext(ctx))
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+	}
+	if m, ok := result.(map[string]interface{}); ok {
+		m["requestId"] = id
+	}
+	writeServeJSON(w, status, result)
+	requestLogger(ctx).Info("request", "method", r.Method, "path", r.URL.Path, "status", status, "durationMs", time.Since(start).Milliseconds())
+}
+
+func (h *serveHandler) handle(r *http.Request) (int, interface{}) {
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" && r.Method == http.MethodGet {
+		var list []map[string]string
+		for _, c := range commands {
+			if !serveExcluded[c.Name] {
+				list = append(list, map[string]string{"name": c.Name, "summary": c.Summary})
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"commands": list}
+	}
+	c, ok := lookupCommand(name)
+	if !ok || serveExcluded[name] {
+		return http.StatusNotFound, map[string]interface{}{
+			"success": false,
+			"error":   "Unknown command",
+		}
+	}
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, map[string]interface{}{
+			"success": false,
+			"error":   "Use POST with the JSON request as body",
+		}
+	}
+	input, err := readInput(r.Body)
+	if err == io.EOF {
+		input, err = map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+	// Both write to the process rather than the response.
+	if input["stream"] == true {
+		return http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "'stream' is not available over HTTP; use 'outputFile' for large results",
+		}
+	}
+	if input["debug"] == true {
+		return http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "'debug' traces are process-wide and not available over HTTP",
+		}
+	}
+	if input["logLevel"] != nil || input["logFormat"] != nil {
+		return http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Logging is process-wide; configure it with the serve flags or INFRAKIT_LOG_LEVEL and INFRAKIT_LOG_FORMAT",
+		}
+	}
+	for _, key := range []string{"toolsConfig", "helmPath", "kubectlPath", "scrubEnv", "sandboxTools"} {
+		if input[key] != nil {
+			return http.StatusBadRequest, map[string]interface{}{
+				"success": false,
+				"error":   "Tool configuration is process-wide; configure it with the serve flags or INFRAKIT_TOOLS_CONFIG",
+			}
+		}
+	}
+	priority := firstNonEmpty(r.Header.Get("X-Priority"), priorityInteractive)
+	if !containsString(requestPriorities, priority) {
+		return http.StatusBadRequest, map[string]interface{}{
+			"success": false,
+			"error":   "Invalid X-Priority: use " + joinWords(requestPriorities, "or"),
+		}
+	}
+	atomic.AddInt64(&h.requests, 1)
+	versioned := input["apiVersion"] != nil
+
+	// A request that times out is answered at once; its command is
+	// stopped through the context, which its processes are bound to, and
+	// left to wind down in the background, holding its queue slot until
+	// it has. The time it waits in the queue counts.
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	leave := func() {}
+	if clusterFacing(c) {
+		var err error
+		leave, err = h.queue.enter(ctx, priority)
+		if err != nil {
+			status, result := http.StatusTooManyRequests, map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+			if _, full := err.(queueFullError); !full {
+				status = http.StatusGatewayTimeout
+				result["error"] = fmt.Sprintf("%s timed out after %s waiting in the request queue", name, h.timeout)
+			}
+			if versioned {
+				result = sealEnvelope(name, result, nil)
+			}
+			return status, result
+		}
+	}
+	done := make(chan map[string]interface{}, 1)
+	go func() {
+		defer leave()
+		done <- runServed(ctx, name, input)
+	}()
+	deadline, _ := ctx.Deadline()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return http.StatusOK, result
+	case <-timer.C:
+		result := map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("%s did not finish within %s", name, h.timeout),
+		}
+		if versioned {
+			result = sealEnvelope(name, result, nil)
+		}
+		return http.StatusGatewayTimeout, result
+	}
+}
+
+// runServed runs one command as main does for a one-shot run.
+func runServed(ctx context.Context, cmd string, input map[string]interface{}) (result map[string]interface{}) {
+	request := deepCopyObject(input)
+	if rejected := precheckEnvelope(cmd, input); rejected != nil {
+		return rejected
+	}
+	finishMetrics := startRequestMetrics(cmd)
+	defer func() { finishMetrics(result) }()
+	cleanup, err := prepareClusterAccess(ctx, input)
+	if err != nil {
+		return failureResult(cmd, input, err)
+	}
+	defer cleanup()
+	op := startOperation(ctx, cmd, request, input)
+	defer func() {
+		if r := recover(); r != nil {
+			result = map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("%s panicked: %v", cmd, r),
+			}
+		}
+		op.finish(result)
+	}()
+	result, _ = dispatch(ctx, cmd, input)
+	return result
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status, data = http.StatusInternalServerError, []byte(`{"success":false,"error":"json marshal error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A signed bundle is a directory holding the manifest, an in-toto statement
+// of its provenance whose subject is the manifest's SHA-256, and the
+// Sigstore bundle of cosign's signature of that statement. Signing the
+// statement rather than the manifest binds both with one signature.
+const (
+	signedManifestFile   = "manifest.yaml"
+	provenanceFile       = "provenance.json"
+	provenanceBundleFile = "provenance.sigstore.json"
+	provenanceBuildType  = "https://github.com/melhemrahmeh/infrakit/render/v1"
+	provenanceBuilderID  = "https://github.com/melhemrahmeh/infrakit"
+)
+
+// cosignOptions choose how cosign signs or verifies: with Key (a key file
+// or a KMS URI such as awskms:///alias/release), or keyless through
+// Sigstore's Fulcio and Rekor when it is empty.
+type cosignOptions struct {
+	Key string `json:"key"`
+	// NoTlog signs without uploading to, or verifies without, the Rekor
+	// transparency log, for private key-based setups.
+	NoTlog bool `json:"noTlog"`
+}
+
+// signRequest is the request body for sign-manifest. The manifest comes
+// from the usual manifest, manifestFile or name/chart keys.
+type signRequest struct {
+	cosignOptions
+	// KeyPassword decrypts Key.
+	KeyPassword string `json:"keyPassword"`
+	// IdentityToken is the OIDC token of a keyless signature, e.g. a CI
+	// job's; without it cosign runs its own OIDC flow.
+	IdentityToken string `json:"identityToken"`
+	// OutputDir receives the bundle; without it the bundle is returned.
+	OutputDir string `json:"outputDir"`
+}
+
+// verifyRequest is the request body for verify-manifest.
+type verifyRequest struct {
+	cosignOptions
+	// Dir is a bundle sign-manifest wrote. The manifest may instead come
+	// from the manifest or manifestFile keys, and the statement and its
+	// signature from ProvenanceFile and BundleFile.
+	Dir            string `json:"dir"`
+	ProvenanceFile string `json:"provenanceFile"`
+	BundleFile     string `json:"bundleFile"`
+	// CertificateIdentity and CertificateOIDCIssuer are who must have
+	// signed keylessly, e.g. a CI workflow's identity and its issuer.
+	CertificateIdentity   string `json:"certificateIdentity"`
+	CertificateOIDCIssuer string `json:"certificateOIDCIssuer"`
+	// Expect lists provenance parameters the bundle must record, e.g.
+	// {"chart": "web", "chartVersion": "1.4.2"}.
+	Expect map[string]string `json:"expect"`
+}
+
+func (r verifyRequest) check() error {
+	if r.Key == "" && (r.CertificateIdentity == "" || r.CertificateOIDCIssuer == "") {
+		return errors.New("Provide 'key', or 'certificateIdentity' and 'certificateOIDCIssuer' for a keyless signature")
+	}
+	return nil
+}
+
+// provenanceStatement is an in-toto statement with a SLSA provenance
+// predicate.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition struct {
+		BuildType string `json:"buildType"`
+		// ExternalParameters are the release name, chart, chartVersion,
+		// repoURL and valuesSha256 of a render.
+		ExternalParameters map[string]string `json:"externalParameters"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string `json:"invocationId,omitempty"`
+			StartedOn    string `json:"startedOn"`
+			FinishedOn   string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// signManifest renders (or takes) a manifest and signs a provenance
+// statement for it with cosign: the manifest's SHA-256 and, for a chart,
+// the chart, its version, a hash of the values and the helm and infrakit
+// versions that rendered it. verify-manifest checks such a bundle.
+func signManifest(input map[string]interface{}) map[string]interface{} {
+	var req signRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	started := time.Now().UTC()
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	ctx := requestContext(input)
+	statement, err := newProvenance(ctx, input, manifest, started)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	data, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	data = append(data, '\n')
+
+	dir := req.OutputDir
+	if dir == "" {
+		ws, err := requestDir(requestContext(input))
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		tmp, err := os.MkdirTemp(ws, "sign-")
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	statementPath := filepath.Join(dir, provenanceFile)
+	bundlePath := filepath.Join(dir, provenanceBundleFile)
+	for path, content := range map[string][]byte{filepath.Join(dir, signedManifestFile): []byte(manifest), statementPath: data} {
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+	}
+	args := []string{"sign-blob", "--yes", "--bundle", bundlePath}
+	if req.Key != "" {
+		args = append(args, "--key", req.Key)
+	}
+	if req.IdentityToken != "" {
+		args = append(args, "--identity-token", req.IdentityToken)
+	}
+	if req.NoTlog {
+		args = append(args, "--tlog-upload=false")
+	}
+	var env []string
+	if req.Key != "" {
+		// cosign prompts for a password without one, even an empty one.
+		env = append(env, "COSIGN_PASSWORD="+req.KeyPassword)
+	}
+	if _, err := runCosign(ctx, env, append(args, statementPath)...); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to sign: " + err.Error(),
+		}
+	}
+
+	result := map[string]interface{}{
+		"success":        true,
+		"manifestSha256": statement.Subject[0].Digest["sha256"],
+		"parameters":     statement.Predicate.BuildDefinition.ExternalParameters,
+	}
+	if req.OutputDir != "" {
+		result["outputDir"] = req.OutputDir
+		return result
+	}
+	bundle, err := os.ReadFile(bundlePath)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	result["manifest"] = manifest
+	result["provenance"] = statement
+	result["bundle"] = json.RawMessage(bundle)
+	return result
+}
+
+// newProvenance describes the render of manifest that input asked for.
+func newProvenance(ctx context.Context, input map[string]interface{}, manifest string, started time.Time) (*provenanceStatement, error) {
+	sum := sha256.Sum256([]byte(manifest))
+	s := &provenanceStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       []provenanceSubject{{Name: signedManifestFile, Digest: map[string]string{"sha256": hex.EncodeToString(sum[:])}}},
+		PredicateType: "https://slsa.dev/provenance/v1",
+	}
+	p := &s.Predicate
+	p.BuildDefinition.BuildType = provenanceBuildType
+	p.BuildDefinition.ExternalParameters = map[string]string{}
+	p.RunDetails.Builder.ID = provenanceBuilderID
+	p.RunDetails.Builder.Version = map[string]string{"infrakit": version}
+	p.RunDetails.Metadata.InvocationID = requestID(ctx)
+
+	var req helmChartInput
+	if err := decodeInput(input, &req); err != nil {
+		return nil, errors.New("Invalid request: " + err.Error())
+	}
+	params := p.BuildDefinition.ExternalParameters
+	if req.Chart != "" {
+		params["name"] = req.Name
+		params["chart"] = req.Chart
+		params["repoURL"] = req.RepoURL
+		chart, args, err := req.chartSource.resolve(ctx, req.Chart)
+		if err != nil {
+			return nil, err
+		}
+		out, err := runHelm(ctx, append([]string{"show", "chart", chart}, args...)...)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the chart: %v", err)
+		}
+		if meta, err := decodeYAML(string(out)); err == nil {
+			params["chart"] = firstNonEmpty(nestedString(asObject(meta), "name"), req.Chart)
+			params["chartVersion"] = nestedString(asObject(meta), "version")
+		}
+		values, err := req.helmValues.effective(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		params["valuesSha256"] = hex.EncodeToString(sum[:])
+		if out, err := runHelm(ctx, "version", "--short"); err == nil {
+			p.RunDetails.Builder.Version["helm"] = strings.TrimSpace(string(out))
+		}
+	}
+	for k, v := range params {
+		if v == "" {
+			delete(params, k)
+		}
+	}
+	p.RunDetails.Metadata.StartedOn = started.Format(time.RFC3339)
+	p.RunDetails.Metadata.FinishedOn = time.Now().UTC().Format(time.RFC3339)
+	return s, nil
+}
+
+// verifyManifest checks a bundle sign-manifest wrote: that cosign verifies
+// the signature of its provenance statement as made with the key or by the
+// identity given, that the statement's subject is the manifest as it is
+// now, and that it records the parameters expected. Any failure fails the
+// request, so that an apply can be gated on it.
+func verifyManifest(input map[string]interface{}) map[string]interface{} {
+	var req verifyRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := req.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	statementPath := req.ProvenanceFile
+	bundlePath := req.BundleFile
+	if req.Dir != "" {
+		statementPath = firstNonEmpty(statementPath, filepath.Join(req.Dir, provenanceFile))
+		bundlePath = firstNonEmpty(bundlePath, filepath.Join(req.Dir, provenanceBundleFile))
+	}
+	if statementPath == "" || bundlePath == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Provide 'dir', or 'provenanceFile' and 'bundleFile'",
+		}
+	}
+	var manifest string
+	var err error
+	if input["manifest"] == nil && input["manifestFile"] == nil && req.Dir != "" {
+		manifest, err = readManifestFile(filepath.Join(req.Dir, signedManifestFile))
+	} else {
+		manifest, err = manifestFromInput(input)
+	}
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+
+	args := []string{"verify-blob", "--bundle", bundlePath}
+	if req.Key != "" {
+		args = append(args, "--key", req.Key)
+	} else {
+		args = append(args, "--certificate-identity", req.CertificateIdentity, "--certificate-oidc-issuer", req.CertificateOIDCIssuer)
+	}
+	if req.NoTlog {
+		args = append(args, "--insecure-ignore-tlog=true")
+	}
+	if _, err := runCosign(requestContext(input), nil, append(args, statementPath)...); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Signature verification failed: " + err.Error(),
+		}
+	}
+
+	data, err := os.ReadFile(statementPath)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	var statement provenanceStatement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid provenance statement: " + err.Error(),
+		}
+	}
+	if statement.Predicate.BuildDefinition.BuildType != provenanceBuildType || len(statement.Subject) != 1 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "The provenance statement does not describe an infrakit render",
+		}
+	}
+	sum := sha256.Sum256([]byte(manifest))
+	digest := hex.EncodeToString(sum[:])
+	if signed := statement.Subject[0].Digest["sha256"]; signed != digest {
+		return map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("The manifest was modified after signing: its SHA-256 is %s, the signed one %s", digest, signed),
+		}
+	}
+	params := statement.Predicate.BuildDefinition.ExternalParameters
+	var mismatches []string
+	for _, k := range sortedStringKeys(req.Expect) {
+		if params[k] != req.Expect[k] {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %q, expected %q", k, params[k], req.Expect[k]))
+		}
+	}
+	if len(mismatches) > 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "The provenance does not match: " + strings.Join(mismatches, "; "),
+		}
+	}
+	return map[string]interface{}{
+		"success":        true,
+		"verified":       true,
+		"manifestSha256": digest,
+		"parameters":     params,
+		"builder":        statement.Predicate.RunDetails.Builder.Version,
+		"signedAt":       statement.Predicate.RunDetails.Metadata.FinishedOn,
+	}
+}
+
+// runCosign runs cosign with args and env added to the environment.
+func runCosign(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	cmd := toolCommand(ctx, "cosign", args...)
+	cmd.Env = append(cmd.Env, env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	err := cmd.Run()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("Signing needs the cosign CLI on PATH (https://github.com/sigstore/cosign)")
+	}
+	if err != nil {
+		return nil, errors.New(strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return stdout.Bytes(), nil
+}
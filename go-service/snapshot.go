@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// snapshotRequest is the request body for snapshot.
+type snapshotRequest struct {
+	renderJobSpec
+	// Manifest is compared as is instead of rendering a chart.
+	Manifest string `json:"manifest"`
+	// Golden is the committed golden file.
+	Golden string `json:"golden"`
+	// Update rewrites the golden file with the current output.
+	Update bool `json:"update"`
+	// Ignore lists fields whose values change on every render (random
+	// passwords, timestamps), e.g. `data.password` or
+	// `metadata.labels["helm.sh/chart"]`.
+	Ignore []string `json:"ignore"`
+}
+
+// snapshot renders a chart, normalizes the output and compares it to a
+// golden file, so chart changes show up as reviewable diffs. With
+// input["update"] the golden file is (re)written instead.
+func snapshot(input map[string]interface{}) map[string]interface{} {
+	var req snapshotRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Golden == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No golden file provided",
+		}
+	}
+	manifest := req.Manifest
+	if manifest == "" {
+		if req.Name == "" || req.Chart == "" {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Either 'manifest' or both 'name' and 'chart' must be provided",
+			}
+		}
+		var b strings.Builder
+		if _, err := renderJob(requestContext(input), &b, req.renderJobSpec); err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		manifest = b.String()
+	}
+	current, err := normalizeManifest(manifest, req.Ignore)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+
+	golden, err := os.ReadFile(req.Golden)
+	if err != nil && !os.IsNotExist(err) {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to read golden file: " + err.Error(),
+		}
+	}
+	exists := err == nil
+	diff := unifiedDiff(string(golden), current, req.Golden, "rendered")
+	result := map[string]interface{}{
+		"success": true,
+		"golden":  req.Golden,
+		"matches": exists && diff == "",
+	}
+	if req.Update {
+		if !exists || diff != "" {
+			if err := os.MkdirAll(filepath.Dir(req.Golden), 0o755); err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"error":   err.Error(),
+				}
+			}
+			// Golden files are committed, so they get regular permissions.
+			if err := os.WriteFile(req.Golden, []byte(current), 0o644); err != nil {
+				return map[string]interface{}{
+					"success": false,
+					"error":   "Failed to write golden file: " + err.Error(),
+				}
+			}
+		}
+		result["updated"] = !exists || diff != ""
+	}
+	if !exists {
+		result["missing"] = true
+	}
+	if diff != "" {
+		result["diff"] = diff
+	}
+	return result
+}
+
+// normalizeManifest re-encodes a manifest so that only meaningful changes
+// show up in a diff: documents sorted by kind, namespace and name, keys
+// sorted, comments dropped and ignored fields masked.
+func normalizeManifest(manifest string, ignore []string) (string, error) {
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return "", errors.New("Failed to parse manifest: " + err.Error())
+	}
+	paths := make([][]string, 0, len(ignore))
+	for _, p := range ignore {
+		path, err := parseFieldPath(p)
+		if err != nil {
+			return "", err
+		}
+		paths = append(paths, path)
+	}
+	for _, obj := range objects {
+		for _, path := range paths {
+			maskField(obj, path)
+		}
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		a, b := refOf(objects[i]), refOf(objects[j])
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	var out strings.Builder
+	for _, obj := range objects {
+		out.WriteString("---\n# " + refOf(obj).String() + "\n")
+		out.WriteString(encodeYAML(obj))
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sopsOptions decrypt SOPS-encrypted files with the sops CLI. Keys come
+// from the environment sops reads (SOPS_AGE_KEY, SOPS_AGE_KEY_FILE, the
+// GPG agent) or from the files named here.
+type sopsOptions struct {
+	// AgeKeyFile is an age identity file; GPGHome a GnuPG home directory.
+	AgeKeyFile string `json:"ageKeyFile"`
+	GPGHome    string `json:"gpgHome"`
+}
+
+// decryptRequest is the request body for decrypt.
+type decryptRequest struct {
+	// File is an encrypted file; Content the same given inline.
+	File    string `json:"file"`
+	Content string `json:"content"`
+	// Format is the file format: yaml (default), json, dotenv, ini or
+	// binary; files are taken by their extension.
+	Format string `json:"format"`
+	sopsOptions
+}
+
+// decrypt decrypts a SOPS-encrypted file or text and returns the plaintext
+// in the result, without writing it anywhere.
+func decrypt(input map[string]interface{}) map[string]interface{} {
+	var req decryptRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if (req.File == "") == (req.Content == "") {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Provide either 'file' or 'content'",
+		}
+	}
+	format := req.Format
+	if format == "" && req.File != "" {
+		format = sopsFormat(req.File)
+	}
+	plaintext, err := req.sopsOptions.decrypt(requestContext(input), req.File, []byte(req.Content), firstNonEmpty(format, "yaml"))
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"content": string(plaintext),
+	}
+}
+
+// decrypt runs `sops --decrypt` on path, or on content when path is "", and
+// returns the plaintext from its stdout.
+func (o sopsOptions) decrypt(ctx context.Context, path string, content []byte, format string) ([]byte, error) {
+	args := []string{"--decrypt", "--input-type", format, "--output-type", format}
+	var stdin *bytes.Reader
+	if path == "" {
+		args = append(args, "/dev/stdin")
+		stdin = bytes.NewReader(content)
+	} else {
+		args = append(args, path)
+	}
+	cmd := toolCommand(ctx, "sops", args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var env []string
+	if o.AgeKeyFile != "" {
+		if _, err := os.Stat(o.AgeKeyFile); err != nil {
+			return nil, errors.New("age key file: " + err.Error())
+		}
+		env = append(env, "SOPS_AGE_KEY_FILE="+o.AgeKeyFile)
+	}
+	if o.GPGHome != "" {
+		env = append(env, "GNUPGHOME="+o.GPGHome)
+	}
+	cmd.Env = append(cmd.Env, env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	err := cmd.Run()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("Decrypting needs the sops CLI on PATH (https://github.com/getsops/sops)")
+	}
+	if err != nil {
+		name := firstNonEmpty(path, "content")
+		return nil, errors.New("Failed to decrypt " + name + ": " + strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return stdout.Bytes(), nil
+}
+
+// sopsFormat is the sops input type of a file, by extension.
+func sopsFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".env":
+		return "dotenv"
+	case ".ini":
+		return "ini"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "binary"
+}
+
+// sopsEncrypted reports whether a values file is SOPS-encrypted, i.e. has
+// the top-level sops metadata key.
+func sopsEncrypted(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Contains(data, []byte("sops")) {
+		return false, nil
+	}
+	doc, err := decodeYAML(string(data))
+	if err != nil {
+		return false, nil
+	}
+	_, ok := asObject(doc)["sops"].(map[string]interface{})
+	return ok, nil
+}
+
+// servePlaintext makes data readable at a path without it being written to
+// disk: the path is a named pipe that a goroutine writes data into for the
+// first reader to open it. helm reads each values file once, to EOF, so a
+// pipe does for a file; another reader only sees the pipe after the writer
+// has closed it.
+func servePlaintext(ctx context.Context, data []byte) (string, func(), error) {
+	workspace, err := requestDir(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp(workspace, "sops-")
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, "values.yaml")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		// Opening blocks until a reader opens the pipe.
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		select {
+		case <-done:
+		default:
+			f.Write(data)
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			// Release the writer from a pending open with a reader of our own.
+			for {
+				if r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+					r.Close()
+				}
+				select {
+				case <-exited:
+					os.RemoveAll(dir)
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+	}
+	return path, stop, nil
+}
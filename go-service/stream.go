@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// streamChunkSize is the size at which streamed manifests are flushed.
+const streamChunkSize = 1 << 20
+
+// streamChart renders a chart as `helm template` would, in process with
+// the Helm SDK (see renderTemplate), and copies the manifest to w. It
+// returns the number of bytes written.
+func streamChart(ctx context.Context, w io.Writer, name, chart string, args ...string) (int64, error) {
+	if cached, rest, err := cachedChart(ctx, chart, args); err != nil {
+		return 0, err
+	} else if cached != "" {
+		chart, args = cached, rest
+	}
+	unlock, err := lockHelmCache(false)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	defer acquireHelm()()
+	cw := &countingWriter{w: w}
+	if err := renderTemplate(ctx, cw, name, chart, args); err != nil {
+		return cw.n, &helmRenderError{
+			msg:    err.Error(),
+			Errors: parseHelmErrors(err.Error()),
+		}
+	}
+	return cw.n, nil
+}
+
+// helmRenderError is a failed render. Errors locates the template and
+// values problems the Helm SDK reported, where it gave a position.
+type helmRenderError struct {
+	msg    string
+	Errors []helmTemplateError
+}
+
+func (e *helmRenderError) Error() string { return e.msg }
+
+// helmTemplateError is one problem in a chart, e.g. a missing required
+// value at mychart/templates/deployment.yaml:7:20.
+type helmTemplateError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Kind    string `json:"kind"` // "parse", "execution", "yaml", "schema" or "other"
+	Message string `json:"message"`
+}
+
+var helmErrorPatterns = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"execution", regexp.MustCompile(`execution error at \(([^:()]+):(\d+):(\d+)\): (.*)`)},
+	{"parse", regexp.MustCompile(`parse error at \(([^:()]+):(\d+)\): (.*)`)},
+	{"execution", regexp.MustCompile(`template: ([^:]+):(\d+):(\d+): (.*)`)},
+	{"yaml", regexp.MustCompile(`YAML parse error on ([^:]+): (?:error converting YAML to JSON: )?yaml: line (\d+): (.*)`)},
+	{"schema", regexp.MustCompile(`values don't meet the specifications of the schema\(s\) in the following chart\(s\):`)},
+}
+
+// parseHelmErrors picks the positions out of a Helm error message, whose
+// lines helm prints as they are. Lines it does not recognise are reported
+// as kind "other", so nothing is lost.
+func parseHelmErrors(stderr string) []helmTemplateError {
+	var out []helmTemplateError
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "Error:"))
+		if line == "" || strings.HasPrefix(line, "Use --debug flag") {
+			continue
+		}
+		e := helmTemplateError{Kind: "other", Message: line}
+		for _, p := range helmErrorPatterns {
+			m := p.re.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			e.Kind = p.kind
+			switch len(m) {
+			case 5:
+				e.File, e.Message = m[1], m[4]
+				e.Line, _ = strconv.Atoi(m[2])
+				e.Column, _ = strconv.Atoi(m[3])
+			case 4:
+				e.File, e.Message = m[1], m[3]
+				e.Line, _ = strconv.Atoi(m[2])
+			}
+			break
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeManifestFile streams a render into path, replacing it only once the
+// render succeeded, and returns the size and SHA-256 of what was written.
+func writeManifestFile(path string, render func(io.Writer) (int64, error)) (int64, string, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return 0, "", err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	n, err := render(io.MultiWriter(f, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// chunkWriter emits a manifest as newline-delimited {"chunk": "..."} JSON
+// lines ahead of the final result. Chunks end on line boundaries so that
+// every chunk is valid UTF-8 and concatenating them restores the manifest.
+type chunkWriter struct {
+	out io.Writer
+	buf []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) >= streamChunkSize {
+		cut := bytes.LastIndexByte(c.buf[:streamChunkSize], '\n') + 1
+		if cut == 0 {
+			cut = bytes.IndexByte(c.buf, '\n') + 1
+			if cut == 0 {
+				break
+			}
+		}
+		if err := c.emit(c.buf[:cut]); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[cut:]
+	}
+	return len(p), nil
+}
+
+// Flush emits whatever is still buffered.
+func (c *chunkWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	err := c.emit(c.buf)
+	c.buf = nil
+	return err
+}
+
+func (c *chunkWriter) emit(p []byte) error {
+	line, err := json.Marshal(map[string]string{"chunk": string(p)})
+	if err != nil {
+		return err
+	}
+	_, err = c.out.Write(append(line, '\n'))
+	return err
+}
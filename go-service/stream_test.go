@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The stderr below is what helm 3 prints for each kind of failure; the
+// Helm SDK returns the same messages without the "Error: " prefix.
+func TestParseHelmErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   []helmTemplateError
+	}{
+		{
+			name:   "required value",
+			stderr: "Error: execution error at (web/templates/deployment.yaml:7:20): image.tag is required\n",
+			want: []helmTemplateError{
+				{File: "web/templates/deployment.yaml", Line: 7, Column: 20, Kind: "execution", Message: "image.tag is required"},
+			},
+		},
+		{
+			name:   "undefined function",
+			stderr: "Error: parse error at (web/templates/service.yaml:12): function \"toYml\" not defined\n",
+			want: []helmTemplateError{
+				{File: "web/templates/service.yaml", Line: 12, Kind: "parse", Message: "function \"toYml\" not defined"},
+			},
+		},
+		{
+			name:   "nil pointer",
+			stderr: "Error: template: web/templates/configmap.yaml:5:14: executing \"web/templates/configmap.yaml\" at <.Values.config.level>: nil pointer evaluating interface {}.level\n",
+			want: []helmTemplateError{
+				{File: "web/templates/configmap.yaml", Line: 5, Column: 14, Kind: "execution",
+					Message: "executing \"web/templates/configmap.yaml\" at <.Values.config.level>: nil pointer evaluating interface {}.level"},
+			},
+		},
+		{
+			name: "invalid YAML",
+			stderr: "Error: YAML parse error on web/templates/deployment.yaml: error converting YAML to JSON: yaml: line 12: did not find expected key\n" +
+				"Use --debug flag to render out invalid YAML\n",
+			want: []helmTemplateError{
+				{File: "web/templates/deployment.yaml", Line: 12, Kind: "yaml", Message: "did not find expected key"},
+			},
+		},
+		{
+			name: "values schema",
+			stderr: "Error: values don't meet the specifications of the schema(s) in the following chart(s):\n" +
+				"web:\n" +
+				"- replicaCount: Invalid type. Expected: integer, given: string\n",
+			want: []helmTemplateError{
+				{Kind: "schema", Message: "values don't meet the specifications of the schema(s) in the following chart(s):"},
+				{Kind: "other", Message: "web:"},
+				{Kind: "other", Message: "- replicaCount: Invalid type. Expected: integer, given: string"},
+			},
+		},
+		{
+			name:   "missing chart",
+			stderr: "Error: path \"./web\" not found\n",
+			want: []helmTemplateError{
+				{Kind: "other", Message: "path \"./web\" not found"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHelmErrors(tt.stderr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHelmErrors() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
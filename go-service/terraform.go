@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// terraformRequest is the request body for terraform-validate and
+// terraform-plan.
+type terraformRequest struct {
+	// Dir is the root module; Files are inline files by name (main.tf,
+	// variables.tf, ...) forming a root module of their own.
+	Dir   string            `json:"dir"`
+	Files map[string]string `json:"files"`
+	// Vars are input variables, of any type; VarFiles are .tfvars files.
+	Vars     map[string]interface{} `json:"vars"`
+	VarFiles []string               `json:"varFiles"`
+	// BackendConfig are -backend-config settings for plan's init; Backend
+	// false plans against local state instead of the configured backend.
+	BackendConfig map[string]string `json:"backendConfig"`
+	Backend       *bool             `json:"backend"`
+	// Destroy plans the destruction of everything in the state.
+	Destroy bool `json:"destroy"`
+}
+
+// terraformDiagnostic is an error or warning terraform reports.
+type terraformDiagnostic struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+}
+
+// terraformChange is what a plan does to one resource. Action is
+// "create", "update", "delete", "replace" or "read".
+type terraformChange struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+}
+
+// terraformPluginCache returns where providers are cached across runs,
+// since every run initializes its own data directory.
+func terraformPluginCache() string {
+	if dir := firstNonEmpty(os.Getenv("INFRAKIT_TF_PLUGIN_CACHE"), os.Getenv("TF_PLUGIN_CACHE_DIR")); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-terraform-plugins")
+	}
+	return filepath.Join(home, ".infrakit", "terraform-plugins")
+}
+
+// terraformValidate checks a Terraform configuration with `terraform
+// validate`, after an init without backend, and returns its diagnostics.
+func terraformValidate(input map[string]interface{}) map[string]interface{} {
+	var req terraformRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	tf, err := newTerraformRun(requestContext(input), req)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	defer tf.cleanup()
+	if _, err := tf.run("init", "-backend=false", "-input=false", "-no-color"); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "terraform init failed: " + err.Error(),
+		}
+	}
+	// validate exits 1 for an invalid configuration but still reports it.
+	out, err := tf.run("validate", "-json", "-no-color")
+	var result struct {
+		Valid       bool `json:"valid"`
+		Diagnostics []struct {
+			Severity string `json:"severity"`
+			Summary  string `json:"summary"`
+			Detail   string `json:"detail"`
+			Range    *struct {
+				Filename string `json:"filename"`
+				Start    struct {
+					Line int `json:"line"`
+				} `json:"start"`
+			} `json:"range"`
+		} `json:"diagnostics"`
+	}
+	if jerr := json.Unmarshal(out, &result); jerr != nil {
+		if err == nil {
+			err = jerr
+		}
+		return map[string]interface{}{
+			"success": false,
+			"error":   "terraform validate failed: " + err.Error(),
+		}
+	}
+	diagnostics := []terraformDiagnostic{}
+	var report strings.Builder
+	for _, d := range result.Diagnostics {
+		diag := terraformDiagnostic{Severity: d.Severity, Summary: d.Summary, Detail: d.Detail}
+		where := ""
+		if d.Range != nil {
+			diag.File, diag.Line = d.Range.Filename, d.Range.Start.Line
+			where = fmt.Sprintf(" (%s:%d)", diag.File, diag.Line)
+		}
+		diagnostics = append(diagnostics, diag)
+		fmt.Fprintf(&report, "%s: %s%s\n", strings.ToUpper(d.Severity), d.Summary, where)
+	}
+	if result.Valid {
+		report.WriteString("The configuration is valid.\n")
+	}
+	return map[string]interface{}{
+		"success":     true,
+		"passed":      result.Valid,
+		"diagnostics": diagnostics,
+		"report":      report.String(),
+	}
+}
+
+// terraformPlan runs init and plan for a Terraform configuration and
+// returns the planned changes from `terraform show -json`: each resource
+// change and the add, change and destroy counts plan prints.
+func terraformPlan(input map[string]interface{}) map[string]interface{} {
+	var req terraformRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	tf, err := newTerraformRun(requestContext(input), req)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	defer tf.cleanup()
+	initArgs := []string{"init", "-input=false", "-no-color"}
+	if req.Backend != nil && !*req.Backend {
+		initArgs = append(initArgs, "-backend=false")
+	}
+	var backendKeys []string
+	for k := range req.BackendConfig {
+		backendKeys = append(backendKeys, k)
+	}
+	sort.Strings(backendKeys)
+	for _, k := range backendKeys {
+		initArgs = append(initArgs, "-backend-config="+k+"="+req.BackendConfig[k])
+	}
+	if _, err := tf.run(initArgs...); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "terraform init failed: " + err.Error(),
+		}
+	}
+	planFile := filepath.Join(tf.dataDir, "infrakit.tfplan")
+	planArgs := append([]string{"plan", "-input=false", "-no-color", "-lock-timeout=60s", "-out=" + planFile}, tf.varArgs...)
+	if req.Destroy {
+		planArgs = append(planArgs, "-destroy")
+	}
+	if _, err := tf.run(planArgs...); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "terraform plan failed: " + err.Error(),
+		}
+	}
+	out, err := tf.run("show", "-json", "-no-color", planFile)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "terraform show failed: " + err.Error(),
+		}
+	}
+	var plan struct {
+		ResourceChanges []struct {
+			Address string `json:"address"`
+			Type    string `json:"type"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_changes"`
+		OutputChanges map[string]struct {
+			Actions []string `json:"actions"`
+		} `json:"output_changes"`
+	}
+	if err := json.Unmarshal(out, &plan); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Unexpected terraform show output: " + err.Error(),
+		}
+	}
+
+	changes := []terraformChange{}
+	summary := map[string]int{"add": 0, "change": 0, "destroy": 0, "replace": 0}
+	var report strings.Builder
+	for _, rc := range plan.ResourceChanges {
+		action := strings.Join(rc.Change.Actions, ",")
+		switch action {
+		case "no-op", "":
+			continue
+		case "delete,create", "create,delete":
+			// Counted as plan does: an add and a destroy.
+			action = "replace"
+			summary["add"]++
+			summary["destroy"]++
+			summary["replace"]++
+		case "create":
+			summary["add"]++
+		case "update":
+			summary["change"]++
+		case "delete":
+			summary["destroy"]++
+		}
+		changes = append(changes, terraformChange{Address: rc.Address, Type: rc.Type, Action: action})
+		fmt.Fprintf(&report, "%s %s (%s)\n", terraformActionMarks[action], rc.Address, action)
+	}
+	outputs := map[string]string{}
+	for name, oc := range plan.OutputChanges {
+		if action := strings.Join(oc.Actions, ","); action != "no-op" {
+			outputs[name] = action
+		}
+	}
+	fmt.Fprintf(&report, "Plan: %d to add, %d to change, %d to destroy.\n", summary["add"], summary["change"], summary["destroy"])
+	return map[string]interface{}{
+		"success":       true,
+		"changed":       len(changes) > 0,
+		"summary":       summary,
+		"changes":       changes,
+		"outputChanges": outputs,
+		"report":        report.String(),
+	}
+}
+
+var terraformActionMarks = map[string]string{"create": "+", "update": "~", "delete": "-", "replace": "-/+", "read": "<="}
+
+// terraformRun is one invocation's working directory and state: its own
+// TF_DATA_DIR in the workspace, so runs neither share nor leave a
+// .terraform directory behind, the variable arguments, and the request
+// context terraform runs within.
+type terraformRun struct {
+	ctx          context.Context
+	dir, dataDir string
+	varArgs      []string
+	temp         []string
+}
+
+func newTerraformRun(ctx context.Context, req terraformRequest) (*terraformRun, error) {
+	if (req.Dir == "") == (len(req.Files) == 0) {
+		return nil, errors.New("Provide either 'dir' or 'files'")
+	}
+	workspace, err := requestDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tf := &terraformRun{ctx: ctx, dir: req.Dir}
+	fail := func(err error) (*terraformRun, error) {
+		tf.cleanup()
+		return nil, err
+	}
+	if tf.dataDir, err = os.MkdirTemp(workspace, "terraform-data-"); err != nil {
+		return nil, err
+	}
+	tf.temp = append(tf.temp, tf.dataDir)
+	if len(req.Files) > 0 {
+		if tf.dir, err = os.MkdirTemp(workspace, "terraform-"); err != nil {
+			return fail(err)
+		}
+		tf.temp = append(tf.temp, tf.dir)
+		for name, content := range req.Files {
+			if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+				return fail(fmt.Errorf("file name %q must not contain a directory", name))
+			}
+			if err := os.WriteFile(filepath.Join(tf.dir, name), []byte(content), 0o600); err != nil {
+				return fail(err)
+			}
+		}
+	} else if info, err := os.Stat(req.Dir); err != nil {
+		return fail(err)
+	} else if !info.IsDir() {
+		return fail(fmt.Errorf("%s is not a directory", req.Dir))
+	}
+	for _, f := range req.VarFiles {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return fail(err)
+		}
+		tf.varArgs = append(tf.varArgs, "-var-file="+abs)
+	}
+	if len(req.Vars) > 0 {
+		// A JSON var file keeps lists, maps and objects typed.
+		data, err := json.Marshal(req.Vars)
+		if err != nil {
+			return fail(err)
+		}
+		path := filepath.Join(tf.dataDir, "infrakit.tfvars.json")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return fail(err)
+		}
+		tf.varArgs = append(tf.varArgs, "-var-file="+path)
+	}
+	return tf, nil
+}
+
+func (tf *terraformRun) cleanup() {
+	for _, dir := range tf.temp {
+		os.RemoveAll(dir)
+	}
+}
+
+// run runs terraform in the module directory. Like runKubectl, it returns
+// stdout even on failure, with stderr in the error.
+func (tf *terraformRun) run(args ...string) ([]byte, error) {
+	cacheDir := terraformPluginCache()
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	cmd := toolCommand(tf.ctx, "terraform", args...)
+	cmd.Dir = tf.dir
+	cmd.Env = append(cmd.Env,
+		"TF_DATA_DIR="+tf.dataDir,
+		"TF_PLUGIN_CACHE_DIR="+cacheDir,
+		"TF_IN_AUTOMATION=1",
+		"TF_INPUT=0",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	defer trackSubprocess(start)
+	err := cmd.Run()
+	traceCommand(cmd, start, stderr.Bytes(), err)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New("terraform commands need the terraform CLI on PATH (https://developer.hashicorp.com/terraform/install)")
+	}
+	if err != nil {
+		return stdout.Bytes(), errors.New(strings.TrimSpace(stderr.String()) + "\n" + err.Error())
+	}
+	return stdout.Bytes(), nil
+}
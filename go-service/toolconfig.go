@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A tools config, read from input["toolsConfig"] or INFRAKIT_TOOLS_CONFIG
+// (YAML or JSON), says which binaries the service runs and what they may
+// see:
+//
+//	tools:
+//	  helm:    {path: /opt/helm/3.14.2/helm, version: v3.14.2}
+//	  kubectl: {version: v1.29.2}      # downloaded, as INFRAKIT_KUBECTL_VERSION
+//	  sops:    {minVersion: 3.8.0}
+//	env:
+//	  scrub: true                      # pass on only the allowlisted variables
+//	  allow: ["AWS_*", "VAULT_ADDR"]
+//	sandbox:
+//	  enabled: true                    # run tools in a working directory of
+//	  dir: /srv/infrakit/sandbox       # their own, with a HOME and TMPDIR in it
+//
+// A path with a version must report that version; a version alone is a
+// managed download. Minimum and exact versions are checked at startup,
+// before any command runs. The helmPath, kubectlPath, scrubEnv and
+// sandboxTools keys override the file.
+type toolsConfig struct {
+	Tools   map[string]toolSettings `json:"tools"`
+	Env     toolEnvSettings         `json:"env"`
+	Sandbox toolSandboxSettings     `json:"sandbox"`
+}
+
+type toolSettings struct {
+	Path       string `json:"path"`
+	Version    string `json:"version"`
+	MinVersion string `json:"minVersion"`
+}
+
+// toolEnvSettings scrubs the environment tools inherit down to
+// scrubbedEnvBase and Allow, where a trailing * matches a prefix.
+type toolEnvSettings struct {
+	Scrub bool     `json:"scrub"`
+	Allow []string `json:"allow"`
+}
+
+// toolSandboxSettings runs tools in Dir (default: a directory in this
+// run's workspace), with HOME, TMPDIR and the XDG directories inside it, so
+// that a chart's plugins and post-renderers cannot write to the real home.
+// Credentials tools need are still passed on: the default kubeconfig and
+// helm's repository and registry configs, unless set already.
+type toolSandboxSettings struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir"`
+}
+
+// scrubbedEnvBase are the variables a scrubbed environment always keeps:
+// what tools need to find binaries, certificates, proxies and clusters.
+var scrubbedEnvBase = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "LANG", "LC_*", "TZ", "TERM", "TMPDIR",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"KUBECONFIG", "HELM_*", "SSH_AUTH_SOCK",
+}
+
+// toolVersionArgs print a tool's version; other tools are run with
+// --version.
+var toolVersionArgs = map[string][]string{
+	"helm":      {"version", "--short"},
+	"kubectl":   {"version", "--client"},
+	"cosign":    {"version"},
+	"opa":       {"version"},
+	"terraform": {"version"},
+	"gcloud":    {"version"},
+	"az":        {"version"},
+}
+
+var toolVersionOutput = regexp.MustCompile(`v?\d+\.\d+\.\d+(-[0-9A-Za-z.]+)?`)
+
+// tools is the tools config of this process, set by configureTools before
+// any command runs and only read after.
+var tools struct {
+	config     toolsConfig
+	sandboxDir string
+}
+
+// configureTools loads the tools config of input and applies it: the
+// binaries to run, the environment they get and their sandbox.
+func configureTools(input map[string]interface{}) error {
+	var cfg toolsConfig
+	path, _ := input["toolsConfig"].(string)
+	if path = firstNonEmpty(path, os.Getenv("INFRAKIT_TOOLS_CONFIG")); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("tools config: %v", err)
+		}
+		doc, err := decodeYAML(string(data))
+		if err != nil {
+			return fmt.Errorf("tools config %s: %v", path, err)
+		}
+		if err := decodeInput(asObject(doc), &cfg); err != nil {
+			return fmt.Errorf("tools config %s: %v", path, err)
+		}
+	}
+	if cfg.Tools == nil {
+		cfg.Tools = map[string]toolSettings{}
+	}
+	for _, name := range []string{"helm", "kubectl"} {
+		if p, _ := input[name+"Path"].(string); p != "" {
+			t := cfg.Tools[name]
+			t.Path = p
+			cfg.Tools[name] = t
+		}
+	}
+	if input["scrubEnv"] == true {
+		cfg.Env.Scrub = true
+	}
+	if input["sandboxTools"] == true {
+		cfg.Sandbox.Enabled = true
+	}
+
+	for _, name := range sortedToolSettings(cfg.Tools) {
+		t := cfg.Tools[name]
+		for _, v := range []string{t.Version, t.MinVersion} {
+			if _, ok := parseSemver(v); v != "" && !ok {
+				return fmt.Errorf("tools.%s: invalid version %q", name, v)
+			}
+		}
+		if t.Path == "" {
+			if _, managed := managedTools[name]; t.Version != "" && !managed {
+				return fmt.Errorf("tools.%s: only helm and kubectl are downloaded; give a path with the version", name)
+			}
+			continue
+		}
+		resolved, err := exec.LookPath(t.Path)
+		if err != nil {
+			return fmt.Errorf("tools.%s.path: %v", name, err)
+		}
+		if resolved, err = filepath.Abs(resolved); err != nil {
+			return fmt.Errorf("tools.%s.path: %v", name, err)
+		}
+		setToolBinary(name, resolved)
+	}
+	tools.config = cfg
+
+	if cfg.Sandbox.Enabled {
+		dir := cfg.Sandbox.Dir
+		if dir == "" {
+			run, err := workspaceDir()
+			if err != nil {
+				return fmt.Errorf("tool sandbox: %v", err)
+			}
+			dir = filepath.Join(run, "sandbox")
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("tool sandbox: %v", err)
+		}
+		for _, sub := range []string{"home", "tmp", "config", "cache", "data"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+				return fmt.Errorf("tool sandbox: %v", err)
+			}
+		}
+		tools.sandboxDir = dir
+	}
+	return nil
+}
+
+func sortedToolSettings(m map[string]toolSettings) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// toolPin returns the managed version of tool to download: its
+// INFRAKIT_*_VERSION, else the config's version, and none for a tool the
+// config gives a path.
+func toolPin(name string) string {
+	t := tools.config.Tools[name]
+	if t.Path != "" {
+		return ""
+	}
+	return firstNonEmpty(os.Getenv(managedTools[name].Env), t.Version)
+}
+
+// toolVersionTimeout bounds each version check, which runs before the
+// request's own timeout applies.
+const toolVersionTimeout = 30 * time.Second
+
+// checkToolVersions runs every tool the config gives a version or minimum
+// version, and fails on the first that does not report a satisfying one.
+func checkToolVersions() error {
+	for _, name := range sortedToolSettings(tools.config.Tools) {
+		t := tools.config.Tools[name]
+		exact := t.Version != "" && t.Path != ""
+		if !exact && t.MinVersion == "" {
+			continue
+		}
+		args, ok := toolVersionArgs[name]
+		if !ok {
+			args = []string{"--version"}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), toolVersionTimeout)
+		out, err := toolCommand(ctx, name, args...).CombinedOutput()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %v: %s", name, err, firstLines(string(out), 2))
+		}
+		got, ok := parseSemver(toolVersionOutput.FindString(string(out)))
+		if !ok {
+			return fmt.Errorf("%s: no version in %q", name, firstLines(string(out), 1))
+		}
+		if exact {
+			want, _ := parseSemver(t.Version)
+			if compareSemver(got, want) != 0 {
+				return fmt.Errorf("%s at %s is %s, not %s", name, toolBinary(name), got, want)
+			}
+		}
+		if min, ok := parseSemver(t.MinVersion); ok && compareSemver(got, min) < 0 {
+			return fmt.Errorf("%s %s is older than the minimum %s", name, got, min)
+		}
+	}
+	return nil
+}
+
+// toolCommand runs tool name with the configured binary, environment and
+// working directory. Callers add variables to cmd.Env, never replace it.
+func toolCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if tools.sandboxDir != "" {
+		args = sandboxArgs(name, args)
+	}
+	cmd := exec.CommandContext(ctx, toolBinary(name), args...)
+	cmd.Env = toolEnviron()
+	cmd.Dir = tools.sandboxDir
+	return cmd
+}
+
+// sandboxFileFlags are the flags of the tools we run whose value names a
+// file or directory.
+var sandboxFileFlags = map[string]bool{
+	"-f": true, "--values": true, "--filename": true, "-k": true, "--kustomize": true,
+	"--kubeconfig": true, "--ca-file": true, "--cert-file": true, "--key-file": true,
+	"--certificate-authority": true, "--client-certificate": true, "--client-key": true,
+	"--destination": true, "--data": true, "--bundle": true, "--key": true,
+}
+
+// sandboxArgs makes the arguments that name files relative to our working
+// directory absolute, so that they still do from the sandbox: the values
+// of sandboxFileFlags and the file argument of sandboxFileArg. Release
+// names, resource words and the like are left alone, even when a file of
+// the same name exists.
+func sandboxArgs(name string, args []string) []string {
+	out := append([]string(nil), args...)
+	for i := 0; i < len(out); i++ {
+		flag, value, inline := strings.Cut(out[i], "=")
+		if !sandboxFileFlags[flag] {
+			continue
+		}
+		if inline {
+			out[i] = flag + "=" + sandboxPath(value)
+		} else if i+1 < len(out) {
+			out[i+1] = sandboxPath(out[i+1])
+			i++
+		}
+	}
+	if i := sandboxFileArg(name, out); i >= 0 {
+		out[i] = sandboxPath(out[i])
+	}
+	return out
+}
+
+// sandboxFileArg returns the index of the argument that names a file
+// without a flag, or -1: the chart of the helm commands we run, after the
+// --flag=value globals of helmClusterCommand, and the file sops decrypts
+// or cosign signs and verifies, which comes last.
+func sandboxFileArg(name string, args []string) int {
+	i := -1
+	switch name {
+	case "helm":
+		i = 0
+		for i < len(args) && strings.HasPrefix(args[i], "-") {
+			i++
+		}
+		if i == len(args) {
+			return -1
+		}
+		switch args[i] {
+		case "template", "install", "upgrade", "show", "dependency":
+			i += 2
+		case "pull", "lint", "package":
+			i++
+		default:
+			return -1
+		}
+	case "sops", "cosign":
+		i = len(args) - 1
+	}
+	if i < 0 || i >= len(args) || strings.HasPrefix(args[i], "-") {
+		return -1
+	}
+	return i
+}
+
+// sandboxPath returns p absolute when it is a relative path that exists.
+func sandboxPath(p string) string {
+	if p == "" || p == "-" || filepath.IsAbs(p) {
+		return p
+	}
+	if _, err := os.Stat(p); err != nil {
+		return p
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+// toolEnviron returns the environment tools start with: ours, scrubbed
+// and sandboxed as configured.
+func toolEnviron() []string {
+	env := os.Environ()
+	if tools.config.Env.Scrub {
+		allow := append(append([]string{}, scrubbedEnvBase...), tools.config.Env.Allow...)
+		var kept []string
+		for _, kv := range env {
+			name, _, _ := strings.Cut(kv, "=")
+			if envAllowed(name, allow) {
+				kept = append(kept, kv)
+			}
+		}
+		env = kept
+	}
+	dir := tools.sandboxDir
+	if dir == "" {
+		return env
+	}
+	set := map[string]bool{}
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		set[name] = true
+	}
+	// Looked up before HOME is moved into the sandbox.
+	home, _ := os.UserHomeDir()
+	config, _ := os.UserConfigDir()
+	for name, path := range map[string]string{
+		"KUBECONFIG":             filepath.Join(home, ".kube", "config"),
+		"HELM_REPOSITORY_CONFIG": filepath.Join(config, "helm", "repositories.yaml"),
+		"HELM_REGISTRY_CONFIG":   filepath.Join(config, "helm", "registry", "config.json"),
+	} {
+		if _, err := os.Stat(path); err == nil && !set[name] {
+			env = append(env, name+"="+path)
+		}
+	}
+	return append(env,
+		"HOME="+filepath.Join(dir, "home"),
+		"TMPDIR="+filepath.Join(dir, "tmp"),
+		"XDG_CONFIG_HOME="+filepath.Join(dir, "config"),
+		"XDG_CACHE_HOME="+filepath.Join(dir, "cache"),
+		"XDG_DATA_HOME="+filepath.Join(dir, "data"),
+	)
+}
+
+func envAllowed(name string, allow []string) bool {
+	for _, a := range allow {
+		if prefix, ok := strings.CutSuffix(a, "*"); (ok && strings.HasPrefix(name, prefix)) || a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredTool reports whether the tools config gives name's path.
+func configuredTool(name string) bool {
+	return tools.config.Tools[name].Path != ""
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Managed tools pin the helm and kubectl every command runs, whatever is on
+// PATH:
+//
+//	INFRAKIT_HELM_VERSION     e.g. "v3.14.2", or "v3.14.2@sha256:<hex>" to
+//	                          also pin the archive digest
+//	INFRAKIT_KUBECTL_VERSION  e.g. "v1.29.2", or with "@sha256:<hex>"
+//	INFRAKIT_TOOLS_DIR        where they are installed (default
+//	                          ~/.infrakit/tools/<tool>/<version>/)
+//	INFRAKIT_TOOLS_MIRROR     a mirror of get.helm.sh and dl.k8s.io, e.g.
+//	                          "https://artifacts.example.com/tools"; paths
+//	                          are kept, so helm archives are fetched from
+//	                          <mirror>/helm-v3.14.2-linux-amd64.tar.gz
+//
+// A pinned version is downloaded on first use and checked against the
+// digest given, or else the one published beside the download.
+
+// managedTool describes how to fetch one tool for a platform ("linux-amd64").
+type managedTool struct {
+	Env string
+	// URL and ChecksumURL take the version and the platform.
+	URL         func(version, platform string) string
+	ChecksumURL func(version, platform string) string
+	// Member is the binary's path in the archive, or "" when URL is the
+	// binary itself.
+	Member func(platform string) string
+}
+
+var managedTools = map[string]managedTool{
+	"helm": {
+		Env: "INFRAKIT_HELM_VERSION",
+		URL: func(version, platform string) string {
+			return "https://get.helm.sh/helm-" + version + "-" + platform + ".tar.gz"
+		},
+		ChecksumURL: func(version, platform string) string {
+			return "https://get.helm.sh/helm-" + version + "-" + platform + ".tar.gz.sha256sum"
+		},
+		Member: func(platform string) string { return platform + "/helm" },
+	},
+	"kubectl": {
+		Env: "INFRAKIT_KUBECTL_VERSION",
+		URL: func(version, platform string) string {
+			return "https://dl.k8s.io/release/" + version + "/bin/" + strings.Replace(platform, "-", "/", 1) + "/kubectl"
+		},
+		ChecksumURL: func(version, platform string) string {
+			return "https://dl.k8s.io/release/" + version + "/bin/" + strings.Replace(platform, "-", "/", 1) + "/kubectl.sha256"
+		},
+	},
+}
+
+var (
+	toolVersionPattern = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.]+)?$`)
+	toolDigestPattern  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// resolvedTools maps tool names to the managed binaries installed by
+// ensureTools; tools missing from it run from PATH.
+var resolvedTools = struct {
+	sync.Mutex
+	paths map[string]string
+}{paths: map[string]string{}}
+
+// mirrored points a download URL at INFRAKIT_TOOLS_MIRROR, if set.
+func mirrored(rawURL string) string {
+	mirror := strings.TrimSuffix(os.Getenv("INFRAKIT_TOOLS_MIRROR"), "/")
+	if mirror == "" {
+		return rawURL
+	}
+	if i := strings.Index(strings.TrimPrefix(rawURL, "https://"), "/"); i >= 0 {
+		return mirror + strings.TrimPrefix(rawURL, "https://")[i:]
+	}
+	return rawURL
+}
+
+func toolsDir() string {
+	if dir := os.Getenv("INFRAKIT_TOOLS_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-tools")
+	}
+	return filepath.Join(home, ".infrakit", "tools")
+}
+
+// toolBinary returns what to execute for a tool: the path the tools config
+// gives, its managed binary when a version is pinned, otherwise the name,
+// looked up on PATH.
+func toolBinary(name string) string {
+	resolvedTools.Lock()
+	defer resolvedTools.Unlock()
+	if path, ok := resolvedTools.paths[name]; ok {
+		return path
+	}
+	return name
+}
+
+// ensureTools installs every pinned tool that is not installed yet, so a
+// failed download fails the command up front rather than as a confusing
+// exec error later.
+func ensureTools() error {
+	for _, name := range sortedToolNames() {
+		pin := toolPin(name)
+		if pin == "" {
+			continue
+		}
+		if _, err := installTool(name, pin); err != nil {
+			return fmt.Errorf("%s %s (%s): %v", name, pin, managedTools[name].Env, err)
+		}
+	}
+	return nil
+}
+
+func sortedToolNames() []string {
+	names := make([]string, 0, len(managedTools))
+	for name := range managedTools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// installedTool is a managed binary and the digest it was verified with.
+type installedTool struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Path      string `json:"path"`
+	SHA256    string `json:"sha256"`
+	Installed bool   `json:"installed"`
+}
+
+// installTool downloads a pinned tool unless it is already present, and
+// makes it the one toolBinary returns.
+func installTool(name, pin string) (installedTool, error) {
+	tool, ok := managedTools[name]
+	if !ok {
+		return installedTool{}, errors.New("not a managed tool")
+	}
+	version, digest, _ := strings.Cut(pin, "@sha256:")
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if !toolVersionPattern.MatchString(version) {
+		return installedTool{}, errors.New("version must look like v1.2.3")
+	}
+	digest = strings.ToLower(digest)
+	if digest != "" && !toolDigestPattern.MatchString(digest) {
+		return installedTool{}, errors.New("digest must be 64 hex characters")
+	}
+	if runtime.GOOS == "windows" {
+		return installedTool{}, errors.New("managed downloads are not supported on windows")
+	}
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	dir := filepath.Join(toolsDir(), name, version)
+	path := filepath.Join(dir, name)
+	result := installedTool{Name: name, Version: version, Path: path}
+
+	// The recorded digest ties an installed binary to its pin, so changing
+	// the pinned digest reinstalls.
+	if recorded, err := os.ReadFile(path + ".sha256"); err == nil {
+		sum := strings.TrimSpace(string(recorded))
+		if _, err := os.Stat(path); err == nil && (digest == "" || sum == digest) {
+			result.SHA256 = sum
+			setToolBinary(name, path)
+			return result, nil
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	if digest == "" {
+		data, err := fetchRelease(client, mirrored(tool.ChecksumURL(version, platform)), 4<<10)
+		if err != nil {
+			return result, fmt.Errorf("fetching checksum: %v", err)
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 || !toolDigestPattern.MatchString(strings.ToLower(fields[0])) {
+			return result, errors.New("published checksum is malformed")
+		}
+		digest = strings.ToLower(fields[0])
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return result, err
+	}
+	if err := downloadTool(client, tool, version, platform, digest, path); err != nil {
+		return result, err
+	}
+	if err := writeCacheFile(path+".sha256", []byte(digest+"\n")); err != nil {
+		return result, err
+	}
+	result.SHA256 = digest
+	result.Installed = true
+	setToolBinary(name, path)
+	return result, nil
+}
+
+func setToolBinary(name, path string) {
+	resolvedTools.Lock()
+	resolvedTools.paths[name] = path
+	resolvedTools.Unlock()
+}
+
+// downloadTool fetches the tool, checks the digest of what was downloaded
+// (the archive, for archived tools) and moves the binary into place.
+func downloadTool(client *http.Client, tool managedTool, version, platform, digest, path string) error {
+	url := mirrored(tool.URL(version, platform))
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		traceRequest("GET", url, start, 0, err)
+		return err
+	}
+	defer resp.Body.Close()
+	traceRequest("GET", url, start, resp.StatusCode, nil)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(url + ": " + resp.Status)
+	}
+	download, err := os.CreateTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(download.Name())
+	defer download.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(download, hash), resp.Body); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("checksum mismatch for %s: got sha256 %s, want %s", url, got, digest)
+	}
+
+	binary := download
+	if tool.Member != nil {
+		if _, err := download.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if binary, err = extractTarMember(download, tool.Member(platform), filepath.Dir(path)); err != nil {
+			return err
+		}
+		defer os.Remove(binary.Name())
+		defer binary.Close()
+	}
+	if err := binary.Chmod(0o755); err != nil {
+		return err
+	}
+	if err := binary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(binary.Name(), path)
+}
+
+// extractTarMember copies one file of a .tar.gz to a temp file in dir.
+func extractTarMember(r io.Reader, member, dir string) (*os.File, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("archive has no " + member)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Clean(hdr.Name) != member || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		f, err := os.CreateTemp(dir, ".extract-")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+// installToolsRequest is the request body for install-tools. Versions
+// default to the pinned INFRAKIT_*_VERSION settings, then the tools config.
+type installToolsRequest struct {
+	HelmVersion    string `json:"helmVersion"`
+	KubectlVersion string `json:"kubectlVersion"`
+}
+
+// installTools downloads tool versions ahead of time, e.g. while building
+// a CI image, and lists every managed version already installed.
+func installTools(input map[string]interface{}) map[string]interface{} {
+	var req installToolsRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	pins := map[string]string{"helm": req.HelmVersion, "kubectl": req.KubectlVersion}
+	var tools []installedTool
+	for _, name := range sortedToolNames() {
+		pin := pins[name]
+		if pin == "" {
+			pin = toolPin(name)
+		}
+		if pin == "" {
+			continue
+		}
+		tool, err := installTool(name, pin)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to install %s %s: %v", name, pin, err),
+				"tools":   tools,
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	available := map[string][]string{}
+	for _, name := range sortedToolNames() {
+		matches, _ := filepath.Glob(filepath.Join(toolsDir(), name, "v*", name))
+		for _, m := range matches {
+			available[name] = append(available[name], filepath.Base(filepath.Dir(m)))
+		}
+		sort.Strings(available[name])
+	}
+	return map[string]interface{}{
+		"success":   true,
+		"tools":     tools,
+		"available": available,
+		"toolsDir":  toolsDir(),
+	}
+}
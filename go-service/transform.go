@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// transformRequest is the request body for transform, and the post-render
+// step of generate-helm.
+type transformRequest struct {
+	// Transforms are applied to the manifest in order, each seeing what the
+	// previous ones made of it.
+	Transforms []transformStep `json:"transforms"`
+}
+
+// transformStep is one mutation of a manifest. Type selects it and the
+// fields it reads:
+//
+//	labels            Labels, on objects and their pod templates
+//	annotations       Annotations, on objects and their pod templates
+//	namespace         Namespace, on namespaced objects and the subjects
+//	                  naming ServiceAccounts of the manifest
+//	images            Images, kustomize-style overrides of container images
+//	registry          From and To, moving the images of registry From to To
+//	imagePullSecrets  Secrets, added to every pod spec
+//
+// Labels are not added to selectors, which are immutable on most workloads.
+type transformStep struct {
+	Type        string            `json:"type"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Namespace   string            `json:"namespace"`
+	Images      []imageOverride   `json:"images"`
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Secrets     []string          `json:"secrets"`
+	// Kinds limits the step to objects of these kinds.
+	Kinds []string `json:"kinds"`
+}
+
+// imageOverride rewrites the containers running image Name, matched
+// whatever its tag or digest unless Name has one itself: NewName replaces
+// the name, NewTag the tag and Digest pins the image (dropping the tag
+// unless NewTag is also given).
+type imageOverride struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName"`
+	NewTag  string `json:"newTag"`
+	Digest  string `json:"digest"`
+}
+
+// transformChange is one field a transform step changed. From is absent for
+// a field the step added.
+type transformChange struct {
+	Step     int         `json:"step"`
+	Type     string      `json:"type"`
+	Resource string      `json:"resource"`
+	Path     string      `json:"path"`
+	From     interface{} `json:"from,omitempty"`
+	To       interface{} `json:"to"`
+}
+
+func (s transformStep) check() error {
+	switch s.Type {
+	case "labels":
+		if len(s.Labels) == 0 {
+			return fmt.Errorf("a labels step needs 'labels'")
+		}
+	case "annotations":
+		if len(s.Annotations) == 0 {
+			return fmt.Errorf("an annotations step needs 'annotations'")
+		}
+	case "namespace":
+		if s.Namespace == "" {
+			return fmt.Errorf("a namespace step needs 'namespace'")
+		}
+	case "images":
+		if len(s.Images) == 0 {
+			return fmt.Errorf("an images step needs 'images'")
+		}
+		for _, o := range s.Images {
+			if _, err := parseImageRef(o.Name); err != nil {
+				return err
+			}
+			if o.NewName == "" && o.NewTag == "" && o.Digest == "" {
+				return fmt.Errorf("image %s: set newName, newTag or digest", o.Name)
+			}
+		}
+	case "registry":
+		if s.From == "" || s.To == "" {
+			return fmt.Errorf("a registry step needs 'from' and 'to'")
+		}
+	case "imagePullSecrets":
+		if len(s.Secrets) == 0 {
+			return fmt.Errorf("an imagePullSecrets step needs 'secrets'")
+		}
+	default:
+		return fmt.Errorf("unknown type %q: use labels, annotations, namespace, images, registry or imagePullSecrets", s.Type)
+	}
+	return nil
+}
+
+// transform applies a pipeline of mutations to a manifest, from the usual
+// manifest, manifestFile or name/chart keys, and returns it the way
+// generate-helm does along with the "changes" made.
+func transform(input map[string]interface{}) map[string]interface{} {
+	var req transformRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if len(req.Transforms) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "'transforms' must list at least one step",
+		}
+	}
+	if err := checkTransforms(req.Transforms); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	changes := []transformChange{}
+	result := renderResult(input, transformedRender(func(w io.Writer) (int64, error) {
+		n, err := io.WriteString(w, manifest)
+		return int64(n), err
+	}, req.Transforms, &changes))
+	if result["success"] == true {
+		result["changes"] = changes
+	}
+	return result
+}
+
+func checkTransforms(steps []transformStep) error {
+	for i, s := range steps {
+		if err := s.check(); err != nil {
+			return fmt.Errorf("transforms[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// transformedRender wraps render so that the manifest goes through steps
+// before being written, recording what they changed in *changes.
+func transformedRender(render func(io.Writer) (int64, error), steps []transformStep, changes *[]transformChange) func(io.Writer) (int64, error) {
+	return func(w io.Writer) (int64, error) {
+		var b strings.Builder
+		if _, err := render(&b); err != nil {
+			return 0, err
+		}
+		manifest, c, err := transformManifest(b.String(), steps)
+		if err != nil {
+			return 0, err
+		}
+		*changes = c
+		n, err := io.WriteString(w, manifest)
+		return int64(n), err
+	}
+}
+
+// transformManifest applies steps to the objects of manifest, items of
+// Lists included. Documents left unchanged keep their YAML as written;
+// changed ones are re-encoded under their leading comments (helm's
+// "# Source:" line among them).
+func transformManifest(manifest string, steps []transformStep) (string, []transformChange, error) {
+	raw := splitYAMLDocuments(manifest)
+	decoded := make([]map[string]interface{}, len(raw))
+	var objects []map[string]interface{}
+	owner := map[int]int{} // index in objects -> document
+	for i, doc := range raw {
+		v, err := decodeYAML(doc)
+		if err != nil {
+			return "", nil, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		decoded[i] = obj
+		if kind, _ := obj["kind"].(string); strings.HasSuffix(kind, "List") && obj["items"] != nil {
+			for _, item := range nestedSlice(obj, "items") {
+				if m, ok := item.(map[string]interface{}); ok {
+					owner[len(objects)] = i
+					objects = append(objects, m)
+				}
+			}
+			continue
+		}
+		owner[len(objects)] = i
+		objects = append(objects, obj)
+	}
+
+	changes := []transformChange{}
+	changed := map[int]bool{}
+	for n, step := range steps {
+		for i, obj := range objects {
+			if len(step.Kinds) > 0 && !containsString(step.Kinds, nestedString(obj, "kind")) {
+				continue
+			}
+			resource := refOf(obj).String()
+			record := func(path string, from, to interface{}) {
+				changes = append(changes, transformChange{Step: n, Type: step.Type, Resource: resource, Path: path, From: from, To: to})
+				changed[owner[i]] = true
+			}
+			applyTransform(step, obj, objects, record)
+		}
+	}
+
+	var b strings.Builder
+	for i, doc := range raw {
+		b.WriteString("---\n")
+		if !changed[i] {
+			b.WriteString(strings.Trim(doc, "\n") + "\n")
+			continue
+		}
+		for _, line := range strings.Split(doc, "\n") {
+			if t := strings.TrimSpace(line); t != "" && !strings.HasPrefix(t, "#") {
+				break
+			} else if t != "" {
+				b.WriteString(line + "\n")
+			}
+		}
+		b.WriteString(encodeYAML(decoded[i]))
+	}
+	return b.String(), changes, nil
+}
+
+// applyTransform applies one step to obj, one of objects, calling record
+// for each field it changes.
+func applyTransform(step transformStep, obj map[string]interface{}, objects []map[string]interface{}, record func(path string, from, to interface{})) {
+	switch step.Type {
+	case "labels", "annotations":
+		values, field := step.Labels, "labels"
+		if step.Type == "annotations" {
+			values, field = step.Annotations, "annotations"
+		}
+		targets := append([]fieldAt{{"", obj}}, podTemplates(obj)...)
+		for _, t := range targets {
+			m := ensureMap(t.m, "metadata", field)
+			for _, k := range sortedStringKeys(values) {
+				old, ok := m[k]
+				if ok && old == values[k] {
+					continue
+				}
+				m[k] = values[k]
+				record(fieldPathChild(fieldPathChild(fieldPathChild(t.path, "metadata"), field), k), old, values[k])
+			}
+		}
+
+	case "namespace":
+		kind := nestedString(obj, "kind")
+		if isNamespaced(kind, objects) {
+			if old := nestedString(obj, "metadata", "namespace"); old != step.Namespace {
+				ensureMap(obj, "metadata")["namespace"] = step.Namespace
+				record("metadata.namespace", emptyToNil(old), step.Namespace)
+			}
+		}
+		if kind != "RoleBinding" && kind != "ClusterRoleBinding" {
+			return
+		}
+		for i, s := range nestedSlice(obj, "subjects") {
+			subject := asObject(s)
+			if nestedString(subject, "kind") != "ServiceAccount" || !hasObject(objects, "ServiceAccount", nestedString(subject, "name")) {
+				continue
+			}
+			if old := nestedString(subject, "namespace"); old != step.Namespace {
+				subject["namespace"] = step.Namespace
+				record(fmt.Sprintf("subjects[%d].namespace", i), emptyToNil(old), step.Namespace)
+			}
+		}
+
+	case "images", "registry":
+		for _, c := range containers(obj) {
+			old := nestedString(c.m, "image")
+			if old == "" {
+				continue
+			}
+			if image := rewriteImage(step, old); image != old {
+				c.m["image"] = image
+				record(fieldPathChild(c.path, "image"), old, image)
+			}
+		}
+
+	case "imagePullSecrets":
+		for _, spec := range podSpecs(obj) {
+			var old, names []string
+			for _, s := range nestedSlice(spec.m, "imagePullSecrets") {
+				old = append(old, nestedString(asObject(s), "name"))
+			}
+			list := nestedSlice(spec.m, "imagePullSecrets")
+			names = append(names, old...)
+			for _, name := range step.Secrets {
+				if !containsString(names, name) {
+					names = append(names, name)
+					list = append(list, map[string]interface{}{"name": name})
+				}
+			}
+			if len(names) == len(old) {
+				continue
+			}
+			spec.m["imagePullSecrets"] = list
+			var from interface{}
+			if len(old) > 0 {
+				from = old
+			}
+			record(fieldPathChild(spec.path, "imagePullSecrets"), from, names)
+		}
+	}
+}
+
+// rewriteImage returns image as an images or registry step makes it.
+func rewriteImage(step transformStep, image string) string {
+	name, tag, digest := splitImage(image)
+	ref, err := parseImageRef(name)
+	if err != nil {
+		return image
+	}
+	if step.Type == "registry" {
+		if ref.Registry != strings.TrimSuffix(step.From, "/") {
+			return image
+		}
+		name = strings.TrimSuffix(step.To, "/") + "/" + ref.Repository
+	} else {
+		for _, o := range step.Images {
+			want, _ := parseImageRef(o.Name)
+			if want.Registry != ref.Registry || want.Repository != ref.Repository {
+				continue
+			}
+			if _, wantTag, wantDigest := splitImage(o.Name); (wantTag != "" || wantDigest != "") && (wantTag != tag || wantDigest != digest) {
+				continue
+			}
+			if o.NewName != "" {
+				name = o.NewName
+			}
+			if o.NewTag != "" {
+				tag, digest = o.NewTag, ""
+			}
+			if o.Digest != "" {
+				digest = o.Digest
+				if o.NewTag == "" {
+					tag = ""
+				}
+			}
+			break
+		}
+	}
+	if tag != "" {
+		name += ":" + tag
+	}
+	if digest != "" {
+		name += "@" + digest
+	}
+	return name
+}
+
+// splitImage splits an image reference as written into its name, tag and
+// digest, without normalizing any of them.
+func splitImage(image string) (name, tag, digest string) {
+	name = image
+	if n, d, ok := strings.Cut(name, "@"); ok {
+		name, digest = n, d
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	return name, tag, digest
+}
+
+// containers returns the containers, init containers and ephemeral
+// containers of obj wherever they are nested, as manifestImages finds them.
+func containers(obj map[string]interface{}) []fieldAt {
+	var found []fieldAt
+	var walk func(v interface{}, path string)
+	walk = func(v interface{}, path string) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for _, k := range sortedKeys(t) {
+				p := fieldPathChild(path, k)
+				if k == "containers" || k == "initContainers" || k == "ephemeralContainers" {
+					for i, c := range nestedSlice(t, k) {
+						if m, ok := c.(map[string]interface{}); ok {
+							found = append(found, fieldAt{fmt.Sprintf("%s[%d]", p, i), m})
+						}
+					}
+					continue
+				}
+				walk(t[k], p)
+			}
+		case []interface{}:
+			for i, item := range t {
+				walk(item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+	walk(obj, "")
+	return found
+}
+
+// fieldAt is a map nested in an object and its field path.
+type fieldAt struct {
+	path string
+	m    map[string]interface{}
+}
+
+// podTemplates returns the pod templates of obj, wherever a workload or
+// custom resource nests them (spec.template, a CronJob's
+// spec.jobTemplate.spec.template, ...).
+func podTemplates(obj map[string]interface{}) []fieldAt {
+	var templates []fieldAt
+	var walk func(v interface{}, path string)
+	walk = func(v interface{}, path string) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for _, k := range sortedKeys(t) {
+				p := fieldPathChild(path, k)
+				if m, ok := t[k].(map[string]interface{}); ok && k == "template" && nestedSlice(m, "spec", "containers") != nil {
+					templates = append(templates, fieldAt{p, m})
+					continue
+				}
+				walk(t[k], p)
+			}
+		case []interface{}:
+			for i, item := range t {
+				walk(item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+	walk(obj["spec"], "spec")
+	return templates
+}
+
+// podSpecs returns the pod specs of obj: a Pod's own and those of its pod
+// templates.
+func podSpecs(obj map[string]interface{}) []fieldAt {
+	var specs []fieldAt
+	if nestedString(obj, "kind") == "Pod" {
+		if spec := nestedMap(obj, "spec"); spec != nil {
+			specs = append(specs, fieldAt{"spec", spec})
+		}
+	}
+	for _, t := range podTemplates(obj) {
+		specs = append(specs, fieldAt{fieldPathChild(t.path, "spec"), nestedMap(t.m, "spec")})
+	}
+	return specs
+}
+
+// ensureMap returns the map at keys in obj, creating it and any missing
+// parents.
+func ensureMap(obj map[string]interface{}, keys ...string) map[string]interface{} {
+	m := obj
+	for _, k := range keys {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[k] = next
+		}
+		m = next
+	}
+	return m
+}
+
+func hasObject(objects []map[string]interface{}, kind, name string) bool {
+	for _, obj := range objects {
+		if nestedString(obj, "kind") == kind && nestedString(obj, "metadata", "name") == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func emptyToNil(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
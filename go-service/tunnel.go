@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sshTunnelSpec describes a jump host used to reach a private API server.
+type sshTunnelSpec struct {
+	// Host is the bastion address, "host" or "host:port".
+	Host           string `json:"host"`
+	User           string `json:"user"`
+	IdentityFile   string `json:"identityFile"`
+	KnownHostsFile string `json:"knownHostsFile"`
+	// TimeoutSeconds bounds how long to wait for the tunnel to come up.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// openTunnel starts an SSH dynamic port forward through input["sshTunnel"]
+// and routes kubectl through it by setting input["proxyURL"] to the local
+// SOCKS endpoint. The returned cleanup tears the tunnel down.
+func openTunnel(input map[string]interface{}) (func(), error) {
+	noop := func() {}
+	m, ok := input["sshTunnel"].(map[string]interface{})
+	if !ok {
+		return noop, nil
+	}
+	if proxy, _ := input["proxyURL"].(string); proxy != "" {
+		return noop, errors.New("Only one of 'proxyURL' and 'sshTunnel' may be provided")
+	}
+	var spec sshTunnelSpec
+	if err := decodeInput(m, &spec); err != nil {
+		return noop, errors.New("Invalid sshTunnel: " + err.Error())
+	}
+	if spec.Host == "" {
+		return noop, errors.New("sshTunnel.host must be provided")
+	}
+
+	port, err := freeLocalPort()
+	if err != nil {
+		return noop, errors.New("Failed to allocate tunnel port: " + err.Error())
+	}
+	local := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	host, sshPort := spec.Host, "22"
+	if h, p, err := net.SplitHostPort(spec.Host); err == nil {
+		host, sshPort = h, p
+	}
+	target := host
+	if spec.User != "" {
+		target = spec.User + "@" + host
+	}
+	args := []string{
+		"-N", "-D", local, "-p", sshPort,
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=15",
+	}
+	if spec.IdentityFile != "" {
+		args = append(args, "-i", sandboxPath(spec.IdentityFile), "-o", "IdentitiesOnly=yes")
+	}
+	if spec.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+sandboxPath(spec.KnownHostsFile), "-o", "StrictHostKeyChecking=yes")
+	}
+	// Through the tools config like every other tool: its ssh binary,
+	// environment and sandbox. The tunnel ends with the request.
+	ctx := requestContext(input)
+	cmd := toolCommand(ctx, "ssh", append(args, target)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return noop, errors.New("Failed to start ssh: " + err.Error())
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	cleanup := func() {
+		cmd.Process.Kill()
+		<-exited
+	}
+
+	timeout := time.Duration(spec.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case err := <-exited:
+			exited <- err
+			if ctx.Err() != nil {
+				return noop, errors.New("Timed out waiting for ssh tunnel to " + spec.Host + ": " + ctx.Err().Error())
+			}
+			return noop, errors.New("ssh tunnel exited: " + strings.TrimSpace(stderr.String()))
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", local, 200*time.Millisecond); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			cleanup()
+			return noop, errors.New("Timed out waiting for ssh tunnel to " + spec.Host)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	input["proxyURL"] = "socks5://" + local
+	return cleanup, nil
+}
+
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
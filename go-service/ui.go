@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// uiFinding is a finding shown by ui, collected from a saved result.
+type uiFinding struct {
+	Severity string
+	Resource string
+	Kind     string
+	Message  string
+}
+
+// uiEntry is a row of the resource list. Status is "+", "-" or "~" against
+// the comparison manifest, or "" when unchanged or not compared.
+type uiEntry struct {
+	ref    resourceRef
+	status string
+	lines  []string
+	old    []string
+}
+
+type uiModel struct {
+	entries  []uiEntry
+	findings []uiFinding
+
+	view   string // "resources", "resource", "diff" or "findings"
+	cursor int
+	scroll int
+	// selected is the entry shown by the resource and diff views.
+	selected int
+
+	kinds      []string
+	kindFilter int // index into kinds, -1 for all
+	severities []string
+	sevFilter  int
+
+	rows, cols int
+}
+
+// ui opens a terminal UI for chart authors iterating locally: browse the
+// resources of a render (input["manifest"], input["manifestFile"] or
+// name+chart), view each one, see side-by-side diffs against
+// input["against"] (a previous render or golden file) and filter the
+// findings of input["findingsFile"] (a saved result of another command) by
+// severity and kind.
+func ui(input map[string]interface{}) map[string]interface{} {
+	manifest, err := manifestFromInput(input)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	objects, err := parseManifest(manifest)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to parse manifest: " + err.Error(),
+		}
+	}
+	m := &uiModel{view: "resources", kindFilter: -1, sevFilter: -1}
+	var previous []map[string]interface{}
+	if path, ok := input["against"].(string); ok && path != "" {
+		data, err := readManifestFile(path)
+		if err == nil {
+			previous, err = parseManifest(data)
+		}
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to read " + path + ": " + err.Error(),
+			}
+		}
+	}
+	m.entries = uiEntries(objects, previous, previous != nil)
+	if path, ok := input["findingsFile"].(string); ok && path != "" {
+		data, err := os.ReadFile(path)
+		var saved interface{}
+		if err == nil {
+			err = json.Unmarshal(data, &saved)
+		}
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to read findings: " + err.Error(),
+			}
+		}
+		m.findings = collectFindings(saved)
+	}
+	m.indexFilters()
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "ui needs a terminal: " + err.Error(),
+		}
+	}
+	defer tty.Close()
+	restore, err := rawTerminal(tty)
+	if err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Failed to set up the terminal: " + err.Error(),
+		}
+	}
+	defer restore()
+	fmt.Fprint(tty, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(tty, "\x1b[?25h\x1b[?1049l")
+
+	keys := bufio.NewReader(tty)
+	for {
+		m.rows, m.cols = terminalSize(tty)
+		m.draw(tty)
+		key, err := readKey(keys)
+		if err != nil || !m.handle(key) {
+			break
+		}
+	}
+	return map[string]interface{}{
+		"success": true,
+		"report":  "",
+	}
+}
+
+// uiEntries pairs the rendered objects with the comparison objects by kind,
+// namespace and name; objects only in the comparison are listed as removed.
+func uiEntries(objects, previous []map[string]interface{}, compare bool) []uiEntry {
+	key := func(r resourceRef) string { return r.Kind + "/" + r.Namespace + "/" + r.Name }
+	old := map[string]map[string]interface{}{}
+	for _, obj := range previous {
+		old[key(refOf(obj))] = obj
+	}
+	seen := map[string]bool{}
+	var entries []uiEntry
+	for _, obj := range objects {
+		e := uiEntry{ref: refOf(obj), lines: splitLines(encodeYAML(obj))}
+		if compare {
+			k := key(e.ref)
+			seen[k] = true
+			if prev, ok := old[k]; !ok {
+				e.status = "+"
+			} else if e.old = splitLines(encodeYAML(prev)); strings.Join(e.old, "\n") != strings.Join(e.lines, "\n") {
+				e.status = "~"
+			}
+		}
+		entries = append(entries, e)
+	}
+	for _, obj := range previous {
+		if ref := refOf(obj); !seen[key(ref)] {
+			entries = append(entries, uiEntry{ref: ref, status: "-", old: splitLines(encodeYAML(obj))})
+		}
+	}
+	return entries
+}
+
+// collectFindings gathers findings from a saved result: entries with a
+// severity and a message, and unsupported resources of check-compatibility.
+func collectFindings(v interface{}) []uiFinding {
+	var findings []uiFinding
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case []interface{}:
+			for _, item := range t {
+				walk(item)
+			}
+		case map[string]interface{}:
+			severity, _ := t["severity"].(string)
+			msg, _ := t["message"].(string)
+			if msg == "" {
+				msg, _ = t["reason"].(string)
+			}
+			if severity == "" && t["status"] == "unsupported" {
+				severity = "error"
+			}
+			if severity != "" && msg != "" {
+				kind, _ := t["kind"].(string)
+				resource, _ := t["resource"].(string)
+				if resource == "" {
+					name, _ := t["name"].(string)
+					ns, _ := t["namespace"].(string)
+					resource = resourceRef{Kind: kind, Name: name, Namespace: ns}.String()
+				}
+				findings = append(findings, uiFinding{Severity: strings.ToLower(severity), Resource: resource, Kind: kind, Message: msg})
+			}
+			for _, k := range sortedKeys(t) {
+				walk(t[k])
+			}
+		}
+	}
+	walk(v)
+	return findings
+}
+
+func (m *uiModel) indexFilters() {
+	kinds, sevs := map[string]bool{}, map[string]bool{}
+	for _, e := range m.entries {
+		kinds[e.ref.Kind] = true
+	}
+	for _, f := range m.findings {
+		if f.Kind != "" {
+			kinds[f.Kind] = true
+		}
+		sevs[f.Severity] = true
+	}
+	m.kinds = sortedSet(kinds)
+	m.severities = sortedSet(sevs)
+}
+
+func (m *uiModel) visibleEntries() []int {
+	var out []int
+	for i, e := range m.entries {
+		if m.kindFilter < 0 || e.ref.Kind == m.kinds[m.kindFilter] {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func (m *uiModel) visibleFindings() []uiFinding {
+	var out []uiFinding
+	for _, f := range m.findings {
+		if m.kindFilter >= 0 && f.Kind != m.kinds[m.kindFilter] {
+			continue
+		}
+		if m.sevFilter >= 0 && f.Severity != m.severities[m.sevFilter] {
+			continue
+		}
+		out = append(out, f)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return severityRank(out[i].Severity) < severityRank(out[j].Severity) })
+	return out
+}
+
+func severityRank(s string) int {
+	switch s {
+	case "critical":
+		return 0
+	case "error", "high":
+		return 1
+	case "warning", "warn", "medium":
+		return 2
+	case "low":
+		return 3
+	}
+	return 4
+}
+
+// handle applies a key press and reports whether the UI keeps running.
+func (m *uiModel) handle(key string) bool {
+	page := m.rows - 3
+	if page < 1 {
+		page = 1
+	}
+	switch key {
+	case "q", "ctrl-c":
+		return false
+	case "esc", "left", "h":
+		if m.view == "resource" || m.view == "diff" {
+			m.view, m.scroll = "resources", 0
+			m.move(0)
+		} else if m.view == "findings" {
+			m.view, m.cursor, m.scroll = "resources", 0, 0
+		}
+	case "up", "k":
+		m.move(-1)
+	case "down", "j":
+		m.move(1)
+	case "pgup":
+		m.move(-page)
+	case "pgdn", " ":
+		m.move(page)
+	case "g":
+		m.move(-1 << 30)
+	case "G":
+		m.move(1 << 30)
+	case "enter", "right", "l":
+		if m.view == "resources" {
+			if rows := m.visibleEntries(); m.cursor < len(rows) {
+				m.selected, m.view, m.scroll = rows[m.cursor], "resource", 0
+			}
+		}
+	case "d":
+		switch m.view {
+		case "resources":
+			if rows := m.visibleEntries(); m.cursor < len(rows) {
+				m.selected, m.view, m.scroll = rows[m.cursor], "diff", 0
+			}
+		case "resource":
+			m.view, m.scroll = "diff", 0
+		}
+	case "f":
+		m.view, m.cursor, m.scroll = "findings", 0, 0
+	case "r":
+		m.view, m.cursor, m.scroll = "resources", 0, 0
+	case "K":
+		m.kindFilter = cycleFilter(m.kindFilter, len(m.kinds))
+		m.cursor, m.scroll = 0, 0
+	case "s":
+		m.sevFilter = cycleFilter(m.sevFilter, len(m.severities))
+		m.cursor, m.scroll = 0, 0
+	}
+	return true
+}
+
+func cycleFilter(current, n int) int {
+	if current+1 >= n {
+		return -1
+	}
+	return current + 1
+}
+
+// move moves the cursor in lists and scrolls in the other views.
+func (m *uiModel) move(delta int) {
+	height := m.rows - 2
+	switch m.view {
+	case "resources", "findings":
+		n := len(m.visibleEntries())
+		if m.view == "findings" {
+			n = len(m.visibleFindings())
+		}
+		m.cursor = clamp(m.cursor+delta, 0, n-1)
+		if m.cursor < m.scroll {
+			m.scroll = m.cursor
+		} else if m.cursor >= m.scroll+height {
+			m.scroll = m.cursor - height + 1
+		}
+	default:
+		m.scroll = clamp(m.scroll+delta, 0, len(m.body())-height)
+	}
+}
+
+func clamp(v, lo, hi int) int {
+	if v > hi {
+		v = hi
+	}
+	if v < lo {
+		v = lo
+	}
+	return v
+}
+
+func (m *uiModel) filterLabel() string {
+	kind, sev := "all kinds", "all severities"
+	if m.kindFilter >= 0 {
+		kind = m.kinds[m.kindFilter]
+	}
+	if m.sevFilter >= 0 {
+		sev = m.severities[m.sevFilter]
+	}
+	return kind + ", " + sev
+}
+
+// body returns the lines of the current view, before scrolling.
+func (m *uiModel) body() []string {
+	switch m.view {
+	case "resources":
+		var lines []string
+		for _, i := range m.visibleEntries() {
+			e := m.entries[i]
+			status := e.status
+			if status == "" {
+				status = " "
+			}
+			count := ""
+			if n := m.findingsFor(e.ref); n > 0 {
+				count = fmt.Sprintf("  \x1b[33m%d finding(s)\x1b[0m", n)
+			}
+			lines = append(lines, fmt.Sprintf("%s %-28s %s%s", colorStatus(status), e.ref.Kind, resourceName(e.ref), count))
+		}
+		return lines
+	case "findings":
+		var lines []string
+		for _, f := range m.visibleFindings() {
+			lines = append(lines, fmt.Sprintf("%s %-40s %s", colorSeverity(f.Severity), f.Resource, f.Message))
+		}
+		return lines
+	case "resource":
+		e := m.entries[m.selected]
+		if e.status == "-" {
+			return e.old
+		}
+		return e.lines
+	case "diff":
+		return sideBySide(m.entries[m.selected].old, m.entries[m.selected].lines, (m.cols-3)/2)
+	}
+	return nil
+}
+
+func (m *uiModel) findingsFor(ref resourceRef) int {
+	n := 0
+	for _, f := range m.findings {
+		if f.Resource == ref.String() {
+			n++
+		}
+	}
+	return n
+}
+
+func resourceName(ref resourceRef) string {
+	if ref.Namespace == "" {
+		return ref.Name
+	}
+	return ref.Namespace + "/" + ref.Name
+}
+
+func (m *uiModel) draw(tty *os.File) {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	title := ""
+	help := ""
+	switch m.view {
+	case "resources":
+		title = fmt.Sprintf("Resources (%d) — %s", len(m.visibleEntries()), m.filterLabel())
+		help = "↑↓ move  enter view  d diff  f findings  K kind  q quit"
+	case "findings":
+		title = fmt.Sprintf("Findings (%d) — %s", len(m.visibleFindings()), m.filterLabel())
+		help = "↑↓ move  s severity  K kind  r resources  q quit"
+	case "resource":
+		title = m.entries[m.selected].ref.String()
+		help = "↑↓ scroll  d diff  esc back  q quit"
+	case "diff":
+		title = "Diff " + m.entries[m.selected].ref.String() + " (previous | current)"
+		help = "↑↓ scroll  esc back  q quit"
+	}
+	b.WriteString("\x1b[1m" + truncate(title, m.cols) + "\x1b[0m\r\n")
+
+	lines := m.body()
+	height := m.rows - 2
+	for i := m.scroll; i < len(lines) && i < m.scroll+height; i++ {
+		line := truncate(lines[i], m.cols)
+		if (m.view == "resources" || m.view == "findings") && i == m.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		b.WriteString(line + "\r\n")
+	}
+	if len(lines) == 0 {
+		b.WriteString("(nothing to show)\r\n")
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[2m%s\x1b[0m", m.rows, truncate(help, m.cols))
+	tty.WriteString(b.String())
+}
+
+// sideBySide lays out a line diff in two columns of width each.
+func sideBySide(a, b []string, width int) []string {
+	if width < 10 {
+		width = 10
+	}
+	cell := func(s string) string {
+		s = truncate(s, width)
+		return s + strings.Repeat(" ", width-visibleLen(s))
+	}
+	ops := diffLines(a, b)
+	var out []string
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			out = append(out, cell(ops[i].text)+" │ "+ops[i].text)
+			i++
+			continue
+		}
+		// Pair a run of removals with the additions that follow it.
+		var del, add []string
+		for ; i < len(ops) && ops[i].kind == '-'; i++ {
+			del = append(del, ops[i].text)
+		}
+		for ; i < len(ops) && ops[i].kind == '+'; i++ {
+			add = append(add, ops[i].text)
+		}
+		for j := 0; j < len(del) || j < len(add); j++ {
+			left, right := cell(""), ""
+			if j < len(del) {
+				left = "\x1b[31m" + cell(del[j]) + "\x1b[0m"
+			}
+			if j < len(add) {
+				right = "\x1b[32m" + add[j] + "\x1b[0m"
+			}
+			out = append(out, left+" │ "+right)
+		}
+	}
+	return out
+}
+
+func colorStatus(s string) string {
+	switch s {
+	case "+":
+		return "\x1b[32m+\x1b[0m"
+	case "-":
+		return "\x1b[31m-\x1b[0m"
+	case "~":
+		return "\x1b[33m~\x1b[0m"
+	}
+	return s
+}
+
+func colorSeverity(s string) string {
+	label := fmt.Sprintf("%-8s", s)
+	switch severityRank(s) {
+	case 0, 1:
+		return "\x1b[31m" + label + "\x1b[0m"
+	case 2:
+		return "\x1b[33m" + label + "\x1b[0m"
+	}
+	return label
+}
+
+// truncate cuts s to width visible characters, keeping escape sequences.
+func truncate(s string, width int) string {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\x1b' {
+			j := strings.IndexByte(s[i:], 'm')
+			if j < 0 {
+				break
+			}
+			b.WriteString(s[i : i+j+1])
+			i += j + 1
+			continue
+		}
+		if n == width {
+			b.WriteString("\x1b[0m")
+			break
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(s[i : i+size])
+		i += size
+		n++
+	}
+	return b.String()
+}
+
+func visibleLen(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\x1b' {
+			if j := strings.IndexByte(s[i:], 'm'); j >= 0 {
+				i += j
+				continue
+			}
+		}
+		if s[i]&0xC0 != 0x80 {
+			n++
+		}
+	}
+	return n
+}
+
+// rawTerminal switches the terminal to raw mode with stty, which works on
+// every Unix without terminal ioctls, and returns a function restoring it.
+func rawTerminal(tty *os.File) (func(), error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = tty
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(saved) }, nil
+}
+
+func terminalSize(tty *os.File) (int, int) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	if err == nil {
+		if f := strings.Fields(string(out)); len(f) == 2 {
+			rows, err1 := strconv.Atoi(f[0])
+			cols, err2 := strconv.Atoi(f[1])
+			if err1 == nil && err2 == nil && rows > 0 && cols > 0 {
+				return rows, cols
+			}
+		}
+	}
+	return 24, 80
+}
+
+// readKey reads one key press, decoding the escape sequences of arrow and
+// page keys.
+func readKey(r *bufio.Reader) (string, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch c {
+	case 3:
+		return "ctrl-c", nil
+	case '\r', '\n':
+		return "enter", nil
+	case 0x1b:
+		if r.Buffered() == 0 {
+			return "esc", nil
+		}
+		if next, _ := r.ReadByte(); next != '[' {
+			return "esc", nil
+		}
+		seq, _ := r.ReadByte()
+		switch seq {
+		case 'A':
+			return "up", nil
+		case 'B':
+			return "down", nil
+		case 'C':
+			return "right", nil
+		case 'D':
+			return "left", nil
+		case '5', '6':
+			r.ReadByte() // trailing '~'
+			if seq == '5' {
+				return "pgup", nil
+			}
+			return "pgdn", nil
+		}
+		return "", nil
+	}
+	return string(c), nil
+}
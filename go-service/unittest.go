@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// unittestRequest is the request body for unittest-helm.
+type unittestRequest struct {
+	// Chart is the local chart under test.
+	Chart string `json:"chart"`
+	// Name is the default release name (default "release-name").
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Suites lists suite files; by default <chart>/tests/*_test.yaml.
+	Suites []string `json:"suites"`
+}
+
+// unittestSuite is a helm-unittest style suite file.
+type unittestSuite struct {
+	Suite     string                 `json:"suite"`
+	Templates []string               `json:"templates"`
+	Values    []string               `json:"values"`
+	Set       map[string]interface{} `json:"set"`
+	Release   unittestRelease        `json:"release"`
+	Tests     []unittestCase         `json:"tests"`
+}
+
+type unittestCase struct {
+	It        string                   `json:"it"`
+	Templates []string                 `json:"templates"`
+	Values    []string                 `json:"values"`
+	Set       map[string]interface{}   `json:"set"`
+	Release   unittestRelease          `json:"release"`
+	Asserts   []map[string]interface{} `json:"asserts"`
+}
+
+type unittestRelease struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// unittestFailure is one failed assertion of a test.
+type unittestFailure struct {
+	Assert        string `json:"assert"`
+	Template      string `json:"template,omitempty"`
+	DocumentIndex *int   `json:"documentIndex,omitempty"`
+	Message       string `json:"message"`
+}
+
+// unittestHelm runs helm-unittest style suites against a chart: each test
+// renders the suite's templates with its values and checks the asserts
+// (equal, contains, matchRegex, isNull, isKind, hasDocuments, ... and their
+// negations) against the rendered documents. The call succeeds when the
+// suites could be run; "passed" reports whether every test passed.
+func unittestHelm(input map[string]interface{}) map[string]interface{} {
+	var req unittestRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if req.Chart == "" {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No chart provided",
+		}
+	}
+	if req.Name == "" {
+		req.Name = "release-name"
+	}
+	suites := req.Suites
+	if len(suites) == 0 {
+		suites, _ = filepath.Glob(filepath.Join(req.Chart, "tests", "*_test.yaml"))
+		if len(suites) == 0 {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "No test suites found in " + filepath.Join(req.Chart, "tests"),
+			}
+		}
+	}
+
+	var results []map[string]interface{}
+	total, failed := 0, 0
+	for _, file := range suites {
+		suite, err := loadUnittestSuite(file)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   file + ": " + err.Error(),
+			}
+		}
+		var tests []map[string]interface{}
+		for _, tc := range suite.Tests {
+			failures := runUnittestCase(requestContext(input), req, file, suite, tc)
+			total++
+			if len(failures) > 0 {
+				failed++
+			}
+			test := map[string]interface{}{
+				"it":     tc.It,
+				"passed": len(failures) == 0,
+			}
+			if len(failures) > 0 {
+				test["failures"] = failures
+			}
+			tests = append(tests, test)
+		}
+		results = append(results, map[string]interface{}{
+			"suite": suite.Suite,
+			"file":  file,
+			"tests": tests,
+		})
+	}
+	return map[string]interface{}{
+		"success": true,
+		"passed":  failed == 0,
+		"total":   total,
+		"failed":  failed,
+		"suites":  results,
+	}
+}
+
+func loadUnittestSuite(path string) (*unittestSuite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeYAML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var suite unittestSuite
+	if err := json.Unmarshal(encoded, &suite); err != nil {
+		return nil, err
+	}
+	if len(suite.Tests) == 0 {
+		return nil, errors.New("suite has no tests")
+	}
+	return &suite, nil
+}
+
+// runUnittestCase renders each template of a test and evaluates its
+// asserts, returning the failures.
+func runUnittestCase(ctx context.Context, req unittestRequest, file string, suite *unittestSuite, tc unittestCase) []unittestFailure {
+	templates := tc.Templates
+	if len(templates) == 0 {
+		templates = suite.Templates
+	}
+	if len(templates) == 0 {
+		return []unittestFailure{{Message: "No templates to test"}}
+	}
+
+	args := []string{}
+	namespace := firstNonEmpty(tc.Release.Namespace, suite.Release.Namespace, req.Namespace)
+	if namespace != "" {
+		args = append(args, "--namespace", namespace)
+	}
+	// Values files are relative to the suite file, as with helm-unittest.
+	for _, v := range append(append([]string{}, suite.Values...), tc.Values...) {
+		if !filepath.IsAbs(v) {
+			v = filepath.Join(filepath.Dir(file), v)
+		}
+		args = append(args, "--values", v)
+	}
+	set := mergedSetValues(suite.Set, tc.Set)
+	if len(set) > 0 {
+		f, err := createTemp(ctx, "values-*.yaml")
+		if err != nil {
+			return []unittestFailure{{Message: err.Error()}}
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(encodeYAML(set))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return []unittestFailure{{Message: err.Error()}}
+		}
+		args = append(args, "--values", f.Name())
+	}
+	name := firstNonEmpty(tc.Release.Name, suite.Release.Name, req.Name)
+
+	rendered := map[string][]map[string]interface{}{}
+	var failures []unittestFailure
+	for _, t := range templates {
+		t = templatePath(t)
+		manifest, err := renderChart(ctx, name, req.Chart, append(args, "--show-only", t)...)
+		if err != nil {
+			failures = append(failures, unittestFailure{Template: t, Message: "Render failed: " + strings.TrimSpace(err.Error())})
+			continue
+		}
+		docs, err := parseManifest(manifest)
+		if err != nil {
+			failures = append(failures, unittestFailure{Template: t, Message: "Failed to parse rendered template: " + err.Error()})
+			continue
+		}
+		rendered[t] = docs
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+
+	for _, a := range tc.Asserts {
+		failures = append(failures, evaluateAssert(a, templates, rendered)...)
+	}
+	return failures
+}
+
+// evaluateAssert checks one assert against the documents of its template,
+// or of every template of the test, and of its documentIndex, or of every
+// document.
+func evaluateAssert(a map[string]interface{}, templates []string, rendered map[string][]map[string]interface{}) []unittestFailure {
+	var kind string
+	var params map[string]interface{}
+	for k, v := range a {
+		switch k {
+		case "not", "documentIndex", "template":
+			continue
+		}
+		if kind != "" {
+			return []unittestFailure{{Assert: kind, Message: "Assert has more than one type: " + kind + ", " + k}}
+		}
+		kind = k
+		params, _ = v.(map[string]interface{})
+	}
+	if kind == "" {
+		return []unittestFailure{{Message: "Assert has no type"}}
+	}
+	negate, _ := a["not"].(bool)
+	if template, ok := a["template"].(string); ok && template != "" {
+		templates = []string{template}
+	}
+	var index *int
+	if f, ok := a["documentIndex"].(float64); ok {
+		i := int(f)
+		index = &i
+	}
+
+	var failures []unittestFailure
+	for _, t := range templates {
+		t = templatePath(t)
+		docs := rendered[t]
+		fail := func(i *int, msg string) {
+			failures = append(failures, unittestFailure{Assert: kind, Template: t, DocumentIndex: i, Message: msg})
+		}
+		if kind == "hasDocuments" {
+			count, _ := params["count"].(float64)
+			if (len(docs) == int(count)) == negate {
+				fail(nil, fmt.Sprintf("Expected %s%d documents, got %d", map[bool]string{true: "other than ", false: ""}[negate], int(count), len(docs)))
+			}
+			continue
+		}
+		indexes := make([]int, len(docs))
+		for i := range docs {
+			indexes[i] = i
+		}
+		if index != nil {
+			if *index < 0 || *index >= len(docs) {
+				fail(index, fmt.Sprintf("Document index %d out of range (%d documents)", *index, len(docs)))
+				continue
+			}
+			indexes = []int{*index}
+		}
+		if len(indexes) == 0 {
+			fail(nil, "Template rendered no documents")
+			continue
+		}
+		for _, i := range indexes {
+			i := i
+			ok, msg, err := checkAssert(kind, params, docs[i])
+			if err != nil {
+				fail(&i, err.Error())
+			} else if ok == negate {
+				if negate {
+					msg = "Negated assert held: " + msg
+				}
+				fail(&i, msg)
+			}
+		}
+	}
+	return failures
+}
+
+// checkAssert evaluates a single assertion against doc. The message
+// describes the expectation and is reported when the result is unwanted.
+func checkAssert(kind string, params map[string]interface{}, doc map[string]interface{}) (bool, string, error) {
+	path, _ := params["path"].(string)
+	var value interface{}
+	var found bool
+	if path != "" {
+		keys, err := parseFieldPath(path)
+		if err != nil {
+			return false, "", err
+		}
+		value, found = lookupField(doc, keys)
+	}
+	needPath := func() error {
+		if path == "" {
+			return errors.New(kind + " requires a path")
+		}
+		return nil
+	}
+
+	switch kind {
+	case "equal", "notEqual":
+		if err := needPath(); err != nil {
+			return false, "", err
+		}
+		ok := found && valuesEqual(value, params["value"])
+		if kind == "notEqual" {
+			return !ok, fmt.Sprintf("Expected %s not to equal %s", path, toJSON(params["value"])), nil
+		}
+		return ok, fmt.Sprintf("Expected %s to equal %s, got %s", path, toJSON(params["value"]), toJSON(value)), nil
+	case "contains", "notContains":
+		if err := needPath(); err != nil {
+			return false, "", err
+		}
+		items, isList := value.([]interface{})
+		if !isList {
+			return false, "", fmt.Errorf("Expected %s to be a list, got %s", path, toJSON(value))
+		}
+		ok := false
+		for _, item := range items {
+			if valuesEqual(item, params["content"]) {
+				ok = true
+				break
+			}
+		}
+		if kind == "notContains" {
+			return !ok, fmt.Sprintf("Expected %s not to contain %s", path, toJSON(params["content"])), nil
+		}
+		return ok, fmt.Sprintf("Expected %s to contain %s", path, toJSON(params["content"])), nil
+	case "matchRegex", "notMatchRegex":
+		if err := needPath(); err != nil {
+			return false, "", err
+		}
+		pattern, _ := params["pattern"].(string)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, "", errors.New("Invalid pattern: " + err.Error())
+		}
+		s, isString := value.(string)
+		if !isString {
+			return false, "", fmt.Errorf("Expected %s to be a string, got %s", path, toJSON(value))
+		}
+		ok := re.MatchString(s)
+		if kind == "notMatchRegex" {
+			return !ok, fmt.Sprintf("Expected %s (%q) not to match %s", path, s, pattern), nil
+		}
+		return ok, fmt.Sprintf("Expected %s (%q) to match %s", path, s, pattern), nil
+	case "isNull":
+		if err := needPath(); err != nil {
+			return false, "", err
+		}
+		return value == nil, fmt.Sprintf("Expected %s to be null, got %s", path, toJSON(value)), nil
+	case "isNotNull":
+		if err := needPath(); err != nil {
+			return false, "", err
+		}
+		return value != nil, fmt.Sprintf("Expected %s not to be null", path), nil
+	case "isKind":
+		of, _ := params["of"].(string)
+		return refOf(doc).Kind == of, fmt.Sprintf("Expected kind %s, got %s", of, refOf(doc).Kind), nil
+	case "isAPIVersion":
+		of, _ := params["of"].(string)
+		got, _ := doc["apiVersion"].(string)
+		return got == of, fmt.Sprintf("Expected apiVersion %s, got %s", of, got), nil
+	}
+	return false, "", errors.New("Unknown assert " + kind)
+}
+
+// valuesEqual compares decoded values by their JSON form, so that numbers
+// compare equal whether YAML decoded them as integers or floats.
+func valuesEqual(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(x) == string(y)
+}
+
+// mergedSetValues turns helm-unittest `set` entries, keyed by dotted paths
+// such as `image.tag`, into a nested values document; test entries override
+// suite entries.
+func mergedSetValues(sets ...map[string]interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, set := range sets {
+		keys := make([]string, 0, len(set))
+		for k := range set {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			path, err := parseFieldPath(k)
+			if err != nil {
+				path = []string{k}
+			}
+			m := values
+			for _, p := range path[:len(path)-1] {
+				next, ok := m[p].(map[string]interface{})
+				if !ok {
+					next = map[string]interface{}{}
+					m[p] = next
+				}
+				m = next
+			}
+			m[path[len(path)-1]] = set[k]
+		}
+	}
+	return values
+}
+
+// templatePath makes a suite template name relative to the chart root, as
+// --show-only expects.
+func templatePath(t string) string {
+	t = filepath.ToSlash(t)
+	if strings.HasPrefix(t, "templates/") || strings.HasPrefix(t, "charts/") {
+		return t
+	}
+	return "templates/" + t
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// chartValuesSchema is where a chart ships the JSON Schema of its values.
+const chartValuesSchema = "values.schema.json"
+
+// valuesError is one value that does not match a values schema.
+type valuesError struct {
+	// Pointer is the value's JSON Pointer, such as /image/tag, and Path
+	// its field path, image.tag.
+	Pointer string `json:"pointer"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	// Schema is values.schema.json, valuesSchema or the valuesSchemaFile.
+	Schema string `json:"schema"`
+}
+
+// valuesSchemaError fails a render whose values do not match the schemas
+// they are checked against.
+type valuesSchemaError struct {
+	Errors []valuesError
+}
+
+func (e *valuesSchemaError) Error() string {
+	const shown = 5
+	var parts []string
+	for i, ve := range e.Errors {
+		if i == shown {
+			parts = append(parts, fmt.Sprintf("and %d more", len(e.Errors)-shown))
+			break
+		}
+		parts = append(parts, firstNonEmpty(ve.Pointer, "/")+": "+ve.Message)
+	}
+	return "Invalid values: " + strings.Join(parts, "; ")
+}
+
+// renderArgs returns args once the values are checked against the schemas
+// of checkSchema, so that values the chart does not accept fail before
+// helm runs, each with its place in the values.
+func (v helmValues) renderArgs(ctx context.Context, chart string, sourceArgs []string) ([]string, func(), error) {
+	if err := v.checkSchema(ctx, chart, sourceArgs); err != nil {
+		return nil, func() {}, err
+	}
+	return v.args(ctx)
+}
+
+// checkSchema validates the values chart renders with, its defaults under
+// the effective values, against the chart's values.schema.json and the
+// request's valuesSchema or valuesSchemaFile. Charts that cannot be read
+// without helm, such as unpinned repository charts, are left to helm,
+// which checks their schema itself; so are the schemas of subcharts and
+// set entries with list indexes, which effective does not follow.
+func (v helmValues) checkSchema(ctx context.Context, chart string, sourceArgs []string) error {
+	if v.SkipSchemaValidation {
+		return nil
+	}
+	for _, s := range v.Set {
+		for _, kv := range splitSetEntry(s) {
+			if key, _, _ := strings.Cut(kv, "="); strings.Contains(key, "[") {
+				return nil
+			}
+		}
+	}
+	type namedSchema struct {
+		name   string
+		schema map[string]interface{}
+	}
+	var schemas []namedSchema
+	files, err := readChartFiles(ctx, chart, sourceArgs, func(name string) bool {
+		return name == "values.yaml" || name == chartValuesSchema
+	})
+	if err != nil && err != errChartNotLocal {
+		return err
+	}
+	if data, ok := files[chartValuesSchema]; ok {
+		var schema map[string]interface{}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			return fmt.Errorf("Invalid %s of chart %s: %v", chartValuesSchema, chart, err)
+		}
+		schemas = append(schemas, namedSchema{chartValuesSchema, schema})
+	}
+	if v.ValuesSchema != nil {
+		schema, _ := deepCopyJSON(v.ValuesSchema).(map[string]interface{})
+		schemas = append(schemas, namedSchema{"valuesSchema", schema})
+	}
+	if v.ValuesSchemaFile != "" {
+		data, err := os.ReadFile(v.ValuesSchemaFile)
+		if err != nil {
+			return fmt.Errorf("values schema: %v", err)
+		}
+		var schema map[string]interface{}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			return fmt.Errorf("Invalid values schema %s: %v", v.ValuesSchemaFile, err)
+		}
+		schemas = append(schemas, namedSchema{v.ValuesSchemaFile, schema})
+	}
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	values := map[string]interface{}{}
+	if data, ok := files["values.yaml"]; ok {
+		doc, err := decodeYAML(string(data))
+		if err != nil {
+			return fmt.Errorf("values.yaml of chart %s: %v", chart, err)
+		}
+		if defaults, ok := doc.(map[string]interface{}); ok {
+			values = defaults
+		}
+	}
+	effective, err := v.effective(ctx)
+	if err != nil {
+		return err
+	}
+	mergeValues(values, effective)
+
+	var failures []valuesError
+	for _, s := range schemas {
+		validator := schemaValidator{Root: s.schema}
+		for _, e := range validator.validate(values, s.schema) {
+			failures = append(failures, valuesError{
+				Pointer: jsonPointer(e.Path),
+				Path:    e.Path,
+				Message: e.Message,
+				Schema:  s.name,
+			})
+		}
+	}
+	if len(failures) > 0 {
+		return &valuesSchemaError{failures}
+	}
+	return nil
+}
+
+// jsonPointer turns a field path of schemaError into a JSON Pointer; the
+// whole document, ".", is "".
+func jsonPointer(path string) string {
+	if path == "." {
+		return ""
+	}
+	keys, err := parseFieldPath(path)
+	if err != nil {
+		return ""
+	}
+	escape := strings.NewReplacer("~", "~0", "/", "~1")
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString("/" + escape.Replace(k))
+	}
+	return b.String()
+}
+
+// valuesErrorsOf returns the values errors behind a failed render, if any.
+func valuesErrorsOf(err error) ([]valuesError, bool) {
+	var verr *valuesSchemaError
+	if errors.As(err, &verr) {
+		return verr.Errors, true
+	}
+	return nil, false
+}
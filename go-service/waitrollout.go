@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRolloutPollInterval = 2 * time.Second
+
+// rolloutWaitKinds are the kinds wait-rollout can wait for.
+var rolloutWaitKinds = []string{"Deployment", "StatefulSet", "DaemonSet", "Job", "Rollout"}
+
+// podFailureReasons are the container waiting reasons that keep a pod from
+// becoming ready until something changes.
+var podFailureReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"ErrImageNeverPull":          true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+// rolloutWaitRequest is the request body for wait-rollout. Without
+// Workloads, the workloads and Jobs of the usual manifest, manifestFile or
+// name/chart keys are waited for.
+type rolloutWaitRequest struct {
+	Workloads []resourceRef `json:"workloads"`
+	// Namespace is that of workloads that do not give one.
+	Namespace string `json:"namespace"`
+	// Timeout (a Go duration, default 5m) bounds the whole wait; Interval
+	// (default 2s) is how often each workload's status is read.
+	Timeout  string `json:"timeout"`
+	Interval string `json:"interval"`
+}
+
+func (req *rolloutWaitRequest) check() error {
+	for i, w := range req.Workloads {
+		if w.Name == "" {
+			return fmt.Errorf("workloads[%d] needs a 'name'", i)
+		}
+		kind, ok := rolloutWaitKind(w.Kind)
+		if !ok {
+			return fmt.Errorf("workloads[%d]: kind must be one of %s", i, strings.Join(rolloutWaitKinds, ", "))
+		}
+		req.Workloads[i].Kind = kind
+	}
+	for _, d := range []string{req.Timeout, req.Interval} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			return fmt.Errorf("Invalid duration %q", d)
+		}
+	}
+	return nil
+}
+
+// rolloutWaitKind returns the kind wait-rollout knows kind as, matched
+// case-insensitively as kubectl matches it.
+func rolloutWaitKind(kind string) (string, bool) {
+	for _, k := range rolloutWaitKinds {
+		if strings.EqualFold(k, kind) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// rolloutStatus is where one workload's rollout ended up. Status is
+// "ready", "progressing" (when the wait timed out), "failed" (when the
+// workload reports it cannot progress) or "missing".
+type rolloutStatus struct {
+	Resource   string        `json:"resource"`
+	Ready      bool          `json:"ready"`
+	Status     string        `json:"status"`
+	Message    string        `json:"message,omitempty"`
+	Reasons    []string      `json:"reasons,omitempty"`
+	Events     []interface{} `json:"events,omitempty"`
+	Pods       []podIssue    `json:"pods,omitempty"`
+	DurationMs int64         `json:"durationMs"`
+}
+
+// podIssue is why a pod of a workload is not ready: a container stuck
+// waiting (CrashLoopBackOff, ImagePullBackOff...), a container that
+// terminated with an error, or a pod that cannot be scheduled.
+type podIssue struct {
+	Pod       string `json:"pod"`
+	Container string `json:"container,omitempty"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message,omitempty"`
+	Restarts  int    `json:"restarts,omitempty"`
+}
+
+// waitRollout watches the rollout of input["workloads"], or of the
+// workloads of a manifest, until each is ready or fails, or the timeout
+// passes. Each workload that does not become ready is reported with its
+// failing conditions, its warning events and what is wrong with its pods.
+func waitRollout(input map[string]interface{}) map[string]interface{} {
+	var req rolloutWaitRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	if err := req.check(); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+	}
+	workloads := req.Workloads
+	if len(workloads) == 0 {
+		manifest, err := manifestFromInput(input)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+		}
+		objects, err := parseManifest(manifest)
+		if err != nil {
+			return map[string]interface{}{
+				"success": false,
+				"error":   "Failed to parse manifest: " + err.Error(),
+			}
+		}
+		for _, obj := range objects {
+			if ref := refOf(obj); ref.Name != "" {
+				if _, ok := rolloutWaitKind(ref.Kind); ok {
+					workloads = append(workloads, ref)
+				}
+			}
+		}
+	}
+	if len(workloads) == 0 {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "No workloads to wait for",
+		}
+	}
+	timeout, interval := defaultWaitTimeout, defaultRolloutPollInterval
+	if req.Timeout != "" {
+		timeout, _ = time.ParseDuration(req.Timeout)
+	}
+	if req.Interval != "" {
+		interval, _ = time.ParseDuration(req.Interval)
+	}
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	results := make([]rolloutStatus, len(workloads))
+	var wg sync.WaitGroup
+	sem := newSemaphore(8)
+	for i, ref := range workloads {
+		ref.Namespace = firstNonEmpty(ref.Namespace, req.Namespace)
+		wg.Add(1)
+		go func(i int, ref resourceRef) {
+			defer wg.Done()
+			results[i] = watchRollout(input, sem, ref, deadline, interval)
+			results[i].DurationMs = time.Since(start).Milliseconds()
+		}(i, ref)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Resource < results[j].Resource })
+
+	ready := 0
+	var report strings.Builder
+	for _, r := range results {
+		if r.Ready {
+			ready++
+			fmt.Fprintf(&report, "READY %s\n", r.Resource)
+			continue
+		}
+		fmt.Fprintf(&report, "%s %s: %s\n", strings.ToUpper(r.Status), r.Resource, r.Message)
+		for _, reason := range r.Reasons {
+			fmt.Fprintf(&report, "  %s\n", reason)
+		}
+		for _, p := range r.Pods {
+			pod := p.Pod
+			if p.Container != "" {
+				pod += "/" + p.Container
+			}
+			fmt.Fprintf(&report, "  pod %s: %s %s\n", pod, p.Reason, p.Message)
+		}
+	}
+	fmt.Fprintf(&report, "%d of %d workloads ready\n", ready, len(results))
+	return map[string]interface{}{
+		"success":    true,
+		"passed":     ready == len(results),
+		"workloads":  results,
+		"ready":      ready,
+		"report":     report.String(),
+		"durationMs": time.Since(start).Milliseconds(),
+	}
+}
+
+// watchRollout reads ref's status every interval until it is ready or
+// failed, or deadline passes, and then explains a workload that is not
+// ready. sem bounds the kubectl processes of all workloads.
+func watchRollout(input map[string]interface{}, sem semaphore, ref resourceRef, deadline time.Time, interval time.Duration) rolloutStatus {
+	ctx := requestContext(input)
+	result := rolloutStatus{Resource: ref.String()}
+	var live map[string]interface{}
+poll:
+	for {
+		release := sem.acquire()
+		out, err := runKubectl(input, "", nsArgs(ref.Namespace, "get", kubectlResourceArg(ref), "--ignore-not-found", "-o", "json")...)
+		release()
+		live = nil
+		switch {
+		case err != nil:
+			result.Status, result.Message = "progressing", strings.TrimSpace(err.Error())
+		case strings.TrimSpace(string(out)) == "":
+			result.Status, result.Message = "missing", "not found"
+		default:
+			if err := json.Unmarshal(out, &live); err != nil {
+				result.Status, result.Message = "progressing", "unreadable status: "+err.Error()
+			} else {
+				result.Status, result.Message, result.Reasons = rolloutProgress(ref.Kind, live)
+			}
+		}
+		if result.Status == "ready" || result.Status == "failed" || !time.Now().Add(interval).Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			result.Message = "wait cancelled: " + ctx.Err().Error()
+			break poll
+		case <-time.After(interval):
+		}
+	}
+	result.Ready = result.Status == "ready"
+	if result.Ready || live == nil {
+		return result
+	}
+
+	defer sem.acquire()()
+	var pods []map[string]interface{}
+	if selector := labelSelector(nestedMap(live, "spec", "selector", "matchLabels")); selector != "" {
+		pods = workloadPods(input, ref.Namespace, selector)
+	}
+	result.Events = warningEvents(objectEvents(input, ref.Namespace, ref.Name))
+	for _, pod := range pods {
+		issues := podIssues(pod)
+		result.Pods = append(result.Pods, issues...)
+		if len(issues) > 0 {
+			result.Events = append(result.Events, warningEvents(objectEvents(input, ref.Namespace, nestedString(pod, "metadata", "name")))...)
+		}
+	}
+	if len(result.Events) > diagnosticMaxEvents {
+		result.Events = result.Events[len(result.Events)-diagnosticMaxEvents:]
+	}
+	return result
+}
+
+// rolloutProgress reads a workload's rollout from its live status, the
+// way kubectl rollout status does, and returns "ready", "progressing" or
+// "failed", what it is waiting on, and the conditions holding it back.
+func rolloutProgress(kind string, live map[string]interface{}) (string, string, []string) {
+	var reasons []string
+	for _, c := range nestedSlice(live, "status", "conditions") {
+		cond, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		typ, _ := cond["type"].(string)
+		status, _ := cond["status"].(string)
+		reason, _ := cond["reason"].(string)
+		message, _ := cond["message"].(string)
+		switch {
+		case kind == "Deployment" && typ == "Progressing" && reason == "ProgressDeadlineExceeded":
+			return "failed", firstNonEmpty(message, reason), reasons
+		case kind == "Job" && typ == "Failed" && status == "True":
+			return "failed", firstNonEmpty(message, reason), reasons
+		case kind == "Job" && typ == "Complete" && status == "True":
+			return "ready", "", nil
+		case typ == "ReplicaFailure" && status == "True", typ == "Progressing" && status == "False":
+			reasons = append(reasons, typ+": "+firstNonEmpty(message, reason))
+		}
+	}
+	if !generationObserved(live) {
+		return "progressing", "waiting for the controller to observe the latest spec", reasons
+	}
+	count := func(path ...string) int {
+		n, _ := intValue(nestedValue(live, path...))
+		return n
+	}
+	replicas := 1
+	if v, ok := intValue(nestedValue(live, "spec", "replicas")); ok {
+		replicas = v
+	}
+	switch kind {
+	case "Deployment":
+		updated := count("status", "updatedReplicas")
+		switch {
+		case updated < replicas:
+			return "progressing", fmt.Sprintf("%d of %d replicas updated", updated, replicas), reasons
+		case count("status", "replicas") > updated:
+			return "progressing", fmt.Sprintf("%d old replicas pending termination", count("status", "replicas")-updated), reasons
+		case count("status", "availableReplicas") < updated:
+			return "progressing", fmt.Sprintf("%d of %d updated replicas available", count("status", "availableReplicas"), updated), reasons
+		}
+	case "StatefulSet":
+		if nestedString(live, "spec", "updateStrategy", "type") == "OnDelete" {
+			return "ready", "", nil
+		}
+		if ready := count("status", "readyReplicas"); ready < replicas {
+			return "progressing", fmt.Sprintf("%d of %d replicas ready", ready, replicas), reasons
+		}
+		if partition := count("spec", "updateStrategy", "rollingUpdate", "partition"); partition > 0 {
+			if updated := count("status", "updatedReplicas"); updated < replicas-partition {
+				return "progressing", fmt.Sprintf("%d of %d replicas above the partition updated", updated, replicas-partition), reasons
+			}
+		} else if nestedString(live, "status", "updateRevision") != nestedString(live, "status", "currentRevision") {
+			return "progressing", fmt.Sprintf("%d of %d replicas at revision %s", count("status", "updatedReplicas"), replicas, nestedString(live, "status", "updateRevision")), reasons
+		}
+	case "DaemonSet":
+		if nestedString(live, "spec", "updateStrategy", "type") == "OnDelete" {
+			return "ready", "", nil
+		}
+		desired := count("status", "desiredNumberScheduled")
+		if updated := count("status", "updatedNumberScheduled"); updated < desired {
+			return "progressing", fmt.Sprintf("%d of %d pods updated", updated, desired), reasons
+		}
+		if available := count("status", "numberAvailable"); available < desired {
+			return "progressing", fmt.Sprintf("%d of %d updated pods available", available, desired), reasons
+		}
+	case "Job":
+		return "progressing", fmt.Sprintf("%d active, %d succeeded, %d failed", count("status", "active"), count("status", "succeeded"), count("status", "failed")), reasons
+	case "Rollout":
+		switch phase := nestedString(live, "status", "phase"); phase {
+		case "Healthy":
+		case "Degraded":
+			return "failed", firstNonEmpty(nestedString(live, "status", "message"), phase), reasons
+		default:
+			return "progressing", strings.TrimSpace(firstNonEmpty(phase, "Progressing") + " " + nestedString(live, "status", "message")), reasons
+		}
+	}
+	return "ready", "", nil
+}
+
+// generationObserved reports whether the controller has seen the latest
+// spec of live. Argo Rollouts records observedGeneration as a string.
+func generationObserved(live map[string]interface{}) bool {
+	generation, ok := intValue(nestedValue(live, "metadata", "generation"))
+	if !ok {
+		return true
+	}
+	var observed int
+	switch v := nestedValue(live, "status", "observedGeneration").(type) {
+	case string:
+		observed, _ = strconv.Atoi(v)
+	default:
+		observed, _ = intValue(v)
+	}
+	return observed >= generation
+}
+
+// workloadPods returns the pods matching selector, or none when kubectl
+// cannot list them.
+func workloadPods(input map[string]interface{}, ns, selector string) []map[string]interface{} {
+	out, err := runKubectl(input, "", nsArgs(ns, "get", "pods", "-l", selector, "-o", "json")...)
+	if err != nil {
+		return nil
+	}
+	var list struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if json.Unmarshal(out, &list) != nil {
+		return nil
+	}
+	return list.Items
+}
+
+// podIssues returns what keeps pod from running: an unschedulable pod,
+// an eviction, or containers (init containers included) that are stuck
+// waiting or terminated with an error.
+func podIssues(pod map[string]interface{}) []podIssue {
+	name := nestedString(pod, "metadata", "name")
+	if nestedString(pod, "status", "phase") == "Succeeded" {
+		return nil
+	}
+	var issues []podIssue
+	if reason := nestedString(pod, "status", "reason"); reason != "" {
+		issues = append(issues, podIssue{Pod: name, Reason: reason, Message: nestedString(pod, "status", "message")})
+	}
+	for _, c := range nestedSlice(pod, "status", "conditions") {
+		cond, ok := c.(map[string]interface{})
+		if ok && cond["type"] == "PodScheduled" && cond["status"] == "False" {
+			reason, _ := cond["reason"].(string)
+			message, _ := cond["message"].(string)
+			issues = append(issues, podIssue{Pod: name, Reason: firstNonEmpty(reason, "Unschedulable"), Message: message})
+		}
+	}
+	statuses := append(append([]interface{}{}, nestedSlice(pod, "status", "initContainerStatuses")...), nestedSlice(pod, "status", "containerStatuses")...)
+	for _, s := range statuses {
+		cs, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		issue := podIssue{Pod: name}
+		issue.Container, _ = cs["name"].(string)
+		issue.Restarts, _ = intValue(cs["restartCount"])
+		waiting := nestedMap(cs, "state", "waiting")
+		terminated := nestedMap(cs, "state", "terminated")
+		switch {
+		case waiting != nil && podFailureReasons[nestedString(waiting, "reason")]:
+			issue.Reason = nestedString(waiting, "reason")
+			issue.Message = nestedString(waiting, "message")
+		case terminated != nil && exitCode(terminated) != 0:
+			issue.Reason = firstNonEmpty(nestedString(terminated, "reason"), "Error")
+			issue.Message = nestedString(terminated, "message")
+		default:
+			continue
+		}
+		// A crashloop's cause is in how the container last exited.
+		if last := nestedMap(cs, "lastState", "terminated"); last != nil {
+			exit := fmt.Sprintf("last exited %s (code %d)", firstNonEmpty(nestedString(last, "reason"), "Error"), exitCode(last))
+			if issue.Message != "" {
+				exit = issue.Message + "; " + exit
+			}
+			issue.Message = exit
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// warningEvents returns the Warning events among events.
+func warningEvents(events []interface{}) []interface{} {
+	var warnings []interface{}
+	for _, e := range events {
+		if m, ok := e.(map[string]interface{}); ok && m["type"] == "Warning" {
+			warnings = append(warnings, m)
+		}
+	}
+	return warnings
+}
+
+// exitCode returns the exitCode of a container's terminated state.
+func exitCode(terminated map[string]interface{}) int {
+	code, _ := intValue(terminated["exitCode"])
+	return code
+}
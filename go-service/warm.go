@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultSchemaBaseURL hosts JSON schemas of the built-in Kubernetes types,
+// one directory per Kubernetes version.
+const defaultSchemaBaseURL = "https://raw.githubusercontent.com/yannh/kubernetes-json-schema/master"
+
+// schemaCacheDir returns where JSON schemas are kept for offline use:
+// <version>/_definitions.json for built-in types and
+// crds/<group>/<kind>_<version>.json for custom resources.
+func schemaCacheDir() string {
+	if dir := os.Getenv("INFRAKIT_SCHEMA_CACHE"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "infrakit-schemas")
+	}
+	return filepath.Join(home, ".infrakit", "schemas")
+}
+
+// warmRequest is the request body for warm.
+type warmRequest struct {
+	// KubernetesVersions to fetch built-in schemas for, e.g. "v1.29.2". The
+	// version of every configured cluster is added.
+	KubernetesVersions []string `json:"kubernetesVersions"`
+	// Kubeconfigs are additional clusters to warm, besides the one the
+	// request targets.
+	Kubeconfigs   []string `json:"kubeconfigs"`
+	SchemaBaseURL string   `json:"schemaBaseURL"`
+	// Charts are pulled into the shared helm cache.
+	Charts []struct {
+		Chart   string `json:"chart"`
+		Version string `json:"version"`
+	} `json:"charts"`
+	// SkipCluster skips discovery of the request's own cluster, for
+	// warming built-in schemas and charts only.
+	SkipCluster bool `json:"skipCluster"`
+}
+
+// warm pre-fetches everything later runs would otherwise download: cluster
+// discovery and OpenAPI documents, CRD schemas, built-in Kubernetes JSON
+// schemas, pinned charts and policy bundles. It reports what it fetched
+// and what failed (per item, without aborting) so a CI image or air-gapped
+// cache can be prepared in one step.
+func warm(input map[string]interface{}) map[string]interface{} {
+	var req warmRequest
+	if err := decodeInput(input, &req); err != nil {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "Invalid request: " + err.Error(),
+		}
+	}
+	var failures []string
+	fail := func(format string, args ...interface{}) {
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+
+	var clusters []map[string]interface{}
+	if !req.SkipCluster {
+		clusters = append(clusters, input)
+	}
+	for _, kubeconfig := range req.Kubeconfigs {
+		cluster := map[string]interface{}{}
+		for k, v := range input {
+			cluster[k] = v
+		}
+		cluster["kubeconfig"] = kubeconfig
+		clusters = append(clusters, cluster)
+	}
+
+	versions := map[string]bool{}
+	for _, v := range req.KubernetesVersions {
+		versions[v] = true
+	}
+	var warmed []interface{}
+	crdSchemas := 0
+	for _, cluster := range clusters {
+		cluster["refreshDiscovery"] = true
+		name, _ := cluster["kubeconfig"].(string)
+		if name == "" {
+			name = "default"
+		}
+		version, err := clusterServerVersion(cluster)
+		if err != nil {
+			fail("%s: cluster version: %v", name, err)
+			continue
+		}
+		versions[version] = true
+		apiVersions, err := clusterAPIVersions(cluster)
+		if err != nil {
+			fail("%s: API discovery: %v", name, err)
+			continue
+		}
+		for _, gv := range sortedSet(apiVersions) {
+			if _, err := clusterAPIResources(cluster, gv); err != nil {
+				fail("%s: resources of %s: %v", name, gv, err)
+			}
+			if _, err := clusterOpenAPISchema(cluster, gv); err != nil {
+				fail("%s: OpenAPI schema of %s: %v", name, gv, err)
+			}
+		}
+		n, err := cacheCRDSchemas(cluster)
+		if err != nil {
+			fail("%s: CRD schemas: %v", name, err)
+		}
+		crdSchemas += n
+		warmed = append(warmed, map[string]interface{}{
+			"cluster":       name,
+			"serverVersion": version,
+			"groupVersions": len(apiVersions),
+		})
+	}
+
+	base := req.SchemaBaseURL
+	if base == "" {
+		base = defaultSchemaBaseURL
+	}
+	var schemaVersions []string
+	for _, v := range sortedSet(versions) {
+		if err := cacheBuiltinSchemas(base, v); err != nil {
+			fail("schemas for %s: %v", v, err)
+			continue
+		}
+		schemaVersions = append(schemaVersions, v)
+	}
+
+	var charts []string
+	for _, c := range req.Charts {
+		path, _, err := cachedChart(requestContext(input), c.Chart, []string{"--version", c.Version})
+		switch {
+		case err != nil:
+			fail("chart %s %s: %v", c.Chart, c.Version, err)
+		case path == "":
+			fail("chart %s %s: only repository or OCI charts with an exact version are cached", c.Chart, c.Version)
+		default:
+			charts = append(charts, path)
+		}
+	}
+
+	// Policy bundles are fetched at their pinned digests, so the rules
+	// later checks apply are on disk too.
+	var policyBundles []string
+	if config, err := loadPolicyConfig(); err != nil {
+		fail("policy config: %v", err)
+	} else {
+		for _, b := range config.Bundles {
+			if !b.cached() {
+				if _, _, err := fetchPolicyBundle(requestContext(input), b, false); err != nil {
+					fail("policy bundle %s: %v", b.Name, err)
+					continue
+				}
+			}
+			policyBundles = append(policyBundles, b.Name)
+		}
+	}
+
+	return map[string]interface{}{
+		"success":        len(failures) == 0,
+		"clusters":       warmed,
+		"policyBundles":  policyBundles,
+		"crdSchemas":     crdSchemas,
+		"schemaVersions": schemaVersions,
+		"charts":         charts,
+		"failures":       failures,
+		"schemaCache":    schemaCacheDir(),
+	}
+}
+
+func sortedSet(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// cacheBuiltinSchemas downloads the definitions of every built-in type for
+// a Kubernetes version, unless they are already cached.
+func cacheBuiltinSchemas(base, version string) error {
+	path := filepath.Join(schemaCacheDir(), version, "_definitions.json")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	client := &http.Client{Timeout: 2 * time.Minute}
+	url := strings.TrimSuffix(base, "/") + "/" + version + "/_definitions.json"
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		traceRequest("GET", url, start, 0, err)
+		return err
+	}
+	traceRequest("GET", url, start, resp.StatusCode, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("download failed: " + resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return errors.New("downloaded schema is not valid JSON")
+	}
+	return writeCacheFile(path, data)
+}
+
+// cacheCRDSchemas stores the schema of every served version of every CRD
+// installed in the cluster.
+func cacheCRDSchemas(input map[string]interface{}) (int, error) {
+	out, err := runKubectl(input, "", "get", "customresourcedefinitions.apiextensions.k8s.io", "-o", "json")
+	if err != nil {
+		return 0, err
+	}
+	var list struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, crd := range list.Items {
+		group := nestedString(crd, "spec", "group")
+		kind := nestedString(crd, "spec", "names", "kind")
+		for _, v := range nestedSlice(crd, "spec", "versions") {
+			version, ok := v.(map[string]interface{})
+			if !ok || version["served"] != true {
+				continue
+			}
+			schema := nestedMap(version, "schema", "openAPIV3Schema")
+			if schema == nil {
+				continue
+			}
+			data, err := json.MarshalIndent(schema, "", "  ")
+			if err != nil {
+				return n, err
+			}
+			name, _ := version["name"].(string)
+			path := filepath.Join(schemaCacheDir(), "crds", group, strings.ToLower(kind)+"_"+name+".json")
+			if err := writeCacheFile(path, data); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// writeCacheFile replaces path atomically, so concurrent readers see either
+// the old or the new content.
+func writeCacheFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Request priorities, from the X-Priority header of a served request.
+// Interactive requests, the default, start before every batch request
+// waiting with them.
+const (
+	priorityInteractive = "interactive"
+	priorityBatch       = "batch"
+)
+
+var requestPriorities = []string{priorityInteractive, priorityBatch}
+
+// queueFullError turns a request away when the work queue is full.
+type queueFullError struct {
+	waiting int
+}
+
+func (e queueFullError) Error() string {
+	return fmt.Sprintf("The request queue is full (%d waiting); retry later", e.waiting)
+}
+
+// workQueue bounds the requests running at once. Up to size more wait,
+// interactive before batch and in arrival order within a priority.
+type workQueue struct {
+	sync.Mutex
+	max, size int
+	running   int
+	waiting   map[string][]chan struct{}
+}
+
+func newWorkQueue(max, size int) *workQueue {
+	return &workQueue{max: max, size: size, waiting: map[string][]chan struct{}{}}
+}
+
+// clusterFacing reports whether c reaches a cluster, and so waits in the
+// work queue.
+func clusterFacing(c command) bool {
+	for _, f := range c.Flags {
+		if f.Name == "kubeconfig" {
+			return true
+		}
+	}
+	return false
+}
+
+// enter waits for a run slot and returns its release. It fails at once
+// with a queueFullError when the queue is full, and with ctx's error when ctx
+// ends before a slot is free.
+func (q *workQueue) enter(ctx context.Context, priority string) (func(), error) {
+	if q.max <= 0 {
+		return func() {}, nil
+	}
+	q.Lock()
+	waiting := q.queued()
+	if q.running < q.max && waiting == 0 {
+		q.running++
+		q.Unlock()
+		return q.leave, nil
+	}
+	if waiting >= q.size {
+		q.Unlock()
+		serviceMetrics.Lock()
+		serviceMetrics.rejected[priority]++
+		serviceMetrics.Unlock()
+		return nil, queueFullError{waiting}
+	}
+	ready := make(chan struct{})
+	q.waiting[priority] = append(q.waiting[priority], ready)
+	q.count(priority, 1)
+	q.Unlock()
+
+	select {
+	case <-ready:
+		return q.leave, nil
+	case <-ctx.Done():
+	}
+	q.Lock()
+	defer q.Unlock()
+	for i, c := range q.waiting[priority] {
+		if c == ready {
+			q.waiting[priority] = append(q.waiting[priority][:i], q.waiting[priority][i+1:]...)
+			q.count(priority, -1)
+			return nil, ctx.Err()
+		}
+	}
+	// The slot was handed over as ctx ended: pass it on.
+	q.handOver()
+	return nil, ctx.Err()
+}
+
+// leave releases a run slot.
+func (q *workQueue) leave() {
+	q.Lock()
+	defer q.Unlock()
+	q.handOver()
+}
+
+// handOver gives the slot of a finished request to the next one waiting,
+// or frees it.
+func (q *workQueue) handOver() {
+	for _, p := range requestPriorities {
+		if len(q.waiting[p]) > 0 {
+			close(q.waiting[p][0])
+			q.waiting[p] = q.waiting[p][1:]
+			q.count(p, -1)
+			return
+		}
+	}
+	q.running--
+}
+
+func (q *workQueue) queued() int {
+	n := 0
+	for _, w := range q.waiting {
+		n += len(w)
+	}
+	return n
+}
+
+func (q *workQueue) count(priority string, delta int64) {
+	serviceMetrics.Lock()
+	serviceMetrics.queued[priority] += delta
+	serviceMetrics.Unlock()
+}
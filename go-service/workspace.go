@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Every temp file this process writes (inline kubeconfigs, manifests being
+// validated, values files) lives in a per-run directory under one workspace
+// root readable only by this user, in a directory of the request that
+// wrote it (see requestDir). Each run directory holds a lock for as long as
+// its process lives, so the startup sweep can tell leftovers of a crashed
+// or killed run from directories still in use.
+var workspace struct {
+	sync.Mutex
+	dir  string
+	lock *os.File
+}
+
+// workspaceRoot returns the directory holding all run directories.
+func workspaceRoot() string {
+	if dir := os.Getenv("INFRAKIT_WORKDIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("infrakit-%d", os.Getuid()))
+}
+
+// workspaceDir returns this run's directory, creating it (and sweeping
+// abandoned ones) on first use.
+func workspaceDir() (string, error) {
+	workspace.Lock()
+	defer workspace.Unlock()
+	if workspace.dir != "" {
+		return workspace.dir, nil
+	}
+	root := workspaceRoot()
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return "", err
+	}
+	// A shared temp dir lets anyone pre-create the root; refuse one owned by
+	// someone else and close up one others could read or plant files in.
+	info, err := os.Lstat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", errors.New("workspace " + root + " is not a directory")
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return "", errors.New("workspace " + root + " is owned by another user")
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		if err := os.Chmod(root, 0o700); err != nil {
+			return "", err
+		}
+	}
+	sweepWorkspace(root)
+
+	dir, err := os.MkdirTemp(root, "run-")
+	if err != nil {
+		return "", err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err == nil {
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", errors.New("failed to lock workspace: " + err.Error())
+	}
+	workspace.dir, workspace.lock = dir, lock
+	return dir, nil
+}
+
+// sweepWorkspace removes run directories whose process is gone.
+func sweepWorkspace(root string) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "run-") {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+		lock, err := os.Open(filepath.Join(dir, ".lock"))
+		if err != nil {
+			// A run that died before taking its lock; give one that is just
+			// starting time to take it.
+			if info, ierr := e.Info(); os.IsNotExist(err) && ierr == nil && time.Since(info.ModTime()) > time.Minute {
+				os.RemoveAll(dir)
+			}
+			continue
+		}
+		if syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			os.RemoveAll(dir)
+		}
+		lock.Close()
+	}
+}
+
+// closeWorkspace removes this run's directory and everything in it.
+func closeWorkspace() {
+	workspace.Lock()
+	defer workspace.Unlock()
+	if workspace.dir == "" {
+		return
+	}
+	os.RemoveAll(workspace.dir)
+	workspace.lock.Close()
+	workspace.dir, workspace.lock = "", nil
+}
+
+// requestWorkspace is the directory of one request's temp files, created
+// under the run directory on first use.
+type requestWorkspace struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+// requestWorkspaceKey is the context key of a request's requestWorkspace.
+type requestWorkspaceKey struct{}
+
+// withRequestWorkspace returns ctx carrying a workspace of its own, unless
+// it is within a request that has one already, and the function removing
+// it once the request is done.
+func withRequestWorkspace(ctx context.Context) (context.Context, func()) {
+	if _, ok := ctx.Value(requestWorkspaceKey{}).(*requestWorkspace); ok {
+		return ctx, func() {}
+	}
+	ws := &requestWorkspace{}
+	return context.WithValue(ctx, requestWorkspaceKey{}, ws), func() {
+		ws.once.Do(func() { ws.err = errors.New("the request has finished") })
+		if ws.dir != "" {
+			os.RemoveAll(ws.dir)
+		}
+	}
+}
+
+// requestDir returns the workspace of ctx's request, so callers of
+// concurrent requests (as in serve) never share temp files; outside a
+// request it is the run directory.
+func requestDir(ctx context.Context) (string, error) {
+	ws, ok := ctx.Value(requestWorkspaceKey{}).(*requestWorkspace)
+	if !ok {
+		return workspaceDir()
+	}
+	ws.once.Do(func() {
+		run, err := workspaceDir()
+		if err != nil {
+			ws.err = err
+			return
+		}
+		ws.dir, ws.err = os.MkdirTemp(run, "request-")
+	})
+	return ws.dir, ws.err
+}
+
+// createTemp creates a temp file in the workspace of ctx's request.
+func createTemp(ctx context.Context, pattern string) (*os.File, error) {
+	dir, err := requestDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, pattern)
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The service only ever needs to read and write Kubernetes manifests, so this
+// file implements the subset of YAML that helm and kubectl actually produce:
+// block mappings and sequences, flow collections, plain/quoted/block scalars,
+// comments, anchors and aliases. Decoded values use the same Go types as
+// encoding/json (map[string]interface{}, []interface{}, string, bool, nil),
+// except that integers decode to int so they round-trip without a decimal.
+
+// decodeYAML parses a single YAML document.
+func decodeYAML(doc string) (interface{}, error) {
+	p := &yamlParser{
+		lines:   strings.Split(strings.ReplaceAll(doc, "\r\n", "\n"), "\n"),
+		anchors: map[string]interface{}{},
+	}
+	p.skipBlank()
+	if p.eof() {
+		return nil, nil
+	}
+	v, err := p.parseBlock(-1)
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if !p.eof() {
+		return nil, p.errorf("unexpected content %q", strings.TrimSpace(p.lines[p.pos]))
+	}
+	return v, nil
+}
+
+// splitYAMLDocuments splits a multi-document stream on "---" separators.
+// Documents that contain only comments or whitespace are dropped.
+func splitYAMLDocuments(stream string) []string {
+	var docs []string
+	var cur []string
+	flush := func() {
+		doc := strings.Join(cur, "\n")
+		cur = nil
+		for _, line := range strings.Split(doc, "\n") {
+			t := strings.TrimSpace(line)
+			if t != "" && !strings.HasPrefix(t, "#") {
+				docs = append(docs, doc)
+				return
+			}
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(stream, "\r\n", "\n"), "\n") {
+		if line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t") || line == "..." {
+			flush()
+			if rest := strings.TrimSpace(strings.TrimPrefix(line, "---")); rest != "" && !strings.HasPrefix(rest, "#") && line != "..." {
+				cur = append(cur, rest)
+			}
+			continue
+		}
+		cur = append(cur, line)
+	}
+	flush()
+	return docs
+}
+
+type yamlParser struct {
+	lines   []string
+	pos     int
+	anchors map[string]interface{}
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *yamlParser) eof() bool { return p.pos >= len(p.lines) }
+
+// skipBlank advances past empty and comment-only lines.
+func (p *yamlParser) skipBlank() {
+	for !p.eof() {
+		t := strings.TrimSpace(p.lines[p.pos])
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return
+		}
+		p.pos++
+	}
+}
+
+func lineIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isSequenceEntry(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseBlock parses the node starting at the current line, whose lines must
+// all be indented deeper than parent.
+func (p *yamlParser) parseBlock(parent int) (interface{}, error) {
+	p.skipBlank()
+	if p.eof() {
+		return nil, nil
+	}
+	line := p.lines[p.pos]
+	ind := lineIndent(line)
+	if ind <= parent {
+		return nil, nil
+	}
+	text := strings.TrimSpace(line)
+	if isSequenceEntry(text) {
+		return p.parseSequence(ind)
+	}
+	if anchor, rest, ok := splitAnchor(text); ok && rest == "" {
+		// "&anchor" alone on a line applies to the following block.
+		p.pos++
+		v, err := p.parseBlock(parent)
+		if err != nil {
+			return nil, err
+		}
+		p.anchors[anchor] = v
+		return v, nil
+	}
+	if _, _, ok := splitMappingKey(text); ok {
+		return p.parseMapping(ind)
+	}
+	p.pos++
+	return p.parseValue(text, parent)
+}
+
+func (p *yamlParser) parseSequence(ind int) (interface{}, error) {
+	seq := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.eof() {
+			break
+		}
+		line := p.lines[p.pos]
+		if lineIndent(line) != ind || !isSequenceEntry(strings.TrimSpace(line)) {
+			break
+		}
+		rest := strings.TrimSpace(line)[1:]
+		trimmed := strings.TrimLeft(rest, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			p.pos++
+			item, err := p.parseBlock(ind)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, item)
+			continue
+		}
+		// Re-indent the entry's content as if the dash were a space so the
+		// item parses like any other nested block.
+		col := ind + 1 + len(rest) - len(trimmed)
+		p.lines[p.pos] = strings.Repeat(" ", col) + trimmed
+		item, err := p.parseBlock(ind)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, item)
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) parseMapping(ind int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for {
+		p.skipBlank()
+		if p.eof() {
+			break
+		}
+		line := p.lines[p.pos]
+		li := lineIndent(line)
+		if li < ind {
+			break
+		}
+		if li > ind {
+			return nil, p.errorf("bad indentation of a mapping entry")
+		}
+		text := strings.TrimSpace(line)
+		if isSequenceEntry(text) {
+			break
+		}
+		key, rest, ok := splitMappingKey(text)
+		if !ok {
+			return nil, p.errorf("expected a mapping key, found %q", text)
+		}
+		p.pos++
+		var anchor string
+		if a, r, ok := splitAnchor(rest); ok {
+			anchor, rest = a, r
+		}
+		var v interface{}
+		var err error
+		if rest == "" {
+			v, err = p.parseBlock(ind)
+			if err == nil && v == nil {
+				p.skipBlank()
+				if !p.eof() && lineIndent(p.lines[p.pos]) == ind && isSequenceEntry(strings.TrimSpace(p.lines[p.pos])) {
+					v, err = p.parseSequence(ind)
+				}
+			}
+		} else {
+			v, err = p.parseValue(rest, ind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if anchor != "" {
+			p.anchors[anchor] = v
+		}
+		if key == "<<" {
+			if merge, ok := v.(map[string]interface{}); ok {
+				for k, mv := range merge {
+					if _, exists := m[k]; !exists {
+						m[k] = mv
+					}
+				}
+				continue
+			}
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// parseValue parses an inline value that began on the line before p.pos.
+// Continuation lines must be indented deeper than parent.
+func (p *yamlParser) parseValue(text string, parent int) (interface{}, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, "*"):
+		name := stripComment(text[1:])
+		v, ok := p.anchors[name]
+		if !ok {
+			return nil, p.errorf("unknown alias %q", name)
+		}
+		return v, nil
+	case strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">"):
+		return p.parseBlockScalar(stripComment(text), parent)
+	case strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{"):
+		full := text
+		for !flowBalanced(full) && !p.eof() {
+			full += " " + strings.TrimSpace(p.lines[p.pos])
+			p.pos++
+		}
+		fp := &flowParser{s: full}
+		v, err := fp.parseValue()
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return v, nil
+	case strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'"):
+		full := text
+		for {
+			if s, n, err := parseQuoted(full); err == nil {
+				if r := strings.TrimSpace(full[n:]); r != "" && !strings.HasPrefix(r, "#") {
+					return nil, p.errorf("unexpected content after quoted string: %q", r)
+				}
+				return s, nil
+			}
+			if p.eof() {
+				return nil, p.errorf("unterminated quoted string")
+			}
+			full += " " + strings.TrimSpace(p.lines[p.pos])
+			p.pos++
+		}
+	}
+	value := stripComment(text)
+	// Plain scalars may continue onto more-indented lines.
+	for !p.eof() {
+		next := p.lines[p.pos]
+		t := strings.TrimSpace(next)
+		if t == "" || strings.HasPrefix(t, "#") || lineIndent(next) <= parent {
+			break
+		}
+		value += " " + stripComment(t)
+		p.pos++
+	}
+	return resolveScalar(value), nil
+}
+
+func (p *yamlParser) parseBlockScalar(header string, parent int) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := byte(0)
+	explicit := 0
+	for _, c := range header[1:] {
+		switch {
+		case c == '-' || c == '+':
+			chomp = byte(c)
+		case c >= '1' && c <= '9':
+			explicit = int(c - '0')
+		default:
+			return nil, p.errorf("invalid block scalar header %q", header)
+		}
+	}
+	contentIndent := -1
+	if explicit > 0 {
+		contentIndent = parent + explicit
+		if parent < 0 {
+			contentIndent = explicit
+		}
+	}
+	var lines []string
+	for !p.eof() {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			p.pos++
+			continue
+		}
+		ind := lineIndent(line)
+		if ind <= parent {
+			break
+		}
+		if contentIndent < 0 {
+			contentIndent = ind
+		}
+		if ind < contentIndent {
+			break
+		}
+		lines = append(lines, line[contentIndent:])
+		p.pos++
+	}
+	// Trailing blank lines are only content for "keep" chomping; give the
+	// rest back so the parser sees them as separators.
+	trailing := 0
+	for i := len(lines) - 1; i >= 0 && lines[i] == ""; i-- {
+		trailing++
+	}
+	body := lines[:len(lines)-trailing]
+	var out string
+	if folded {
+		var b strings.Builder
+		for i, l := range body {
+			if i > 0 {
+				prev := body[i-1]
+				switch {
+				case l == "" || prev == "":
+					b.WriteString("\n")
+				case strings.HasPrefix(l, " ") || strings.HasPrefix(prev, " "):
+					b.WriteString("\n")
+				default:
+					b.WriteString(" ")
+				}
+			}
+			b.WriteString(l)
+		}
+		out = b.String()
+	} else {
+		out = strings.Join(body, "\n")
+	}
+	if len(body) == 0 {
+		out = ""
+	}
+	switch chomp {
+	case '-':
+	case '+':
+		if len(body) > 0 {
+			out += "\n"
+		}
+		out += strings.Repeat("\n", trailing)
+	default:
+		if len(body) > 0 {
+			out += "\n"
+		}
+	}
+	return out, nil
+}
+
+// splitMappingKey splits "key: rest" and reports whether text is a mapping entry.
+func splitMappingKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		key, n, err := parseQuoted(text)
+		if err != nil {
+			return "", "", false
+		}
+		rest := strings.TrimLeft(text[n:], " ")
+		if !strings.HasPrefix(rest, ":") || (len(rest) > 1 && rest[1] != ' ' && rest[1] != '\t') {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") || strings.HasPrefix(text, "#") {
+		return "", "", false
+	}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '#':
+			if i > 0 && (text[i-1] == ' ' || text[i-1] == '\t') {
+				return "", "", false
+			}
+		case ':':
+			if i == len(text)-1 || text[i+1] == ' ' || text[i+1] == '\t' {
+				key := strings.TrimSpace(text[:i])
+				if key == "" {
+					return "", "", false
+				}
+				return key, strings.TrimSpace(text[i+1:]), true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// splitAnchor splits a leading "&name" off a value.
+func splitAnchor(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, "&") {
+		return "", text, false
+	}
+	end := strings.IndexAny(text, " \t")
+	if end < 0 {
+		return text[1:], "", true
+	}
+	return text[1:end], strings.TrimSpace(text[end:]), true
+}
+
+// stripComment removes a trailing " # comment" from a plain scalar.
+func stripComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t') {
+			return strings.TrimSpace(text[:i])
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+// parseQuoted parses a single- or double-quoted scalar at the start of s and
+// returns its value and the number of bytes consumed.
+func parseQuoted(s string) (string, int, error) {
+	q := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if q == '\'' {
+			if c == '\'' {
+				if i+1 < len(s) && s[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				return b.String(), i + 1, nil
+			}
+			b.WriteByte(c)
+			continue
+		}
+		switch c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", 0, fmt.Errorf("unterminated escape")
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't', '\t':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case 'a':
+				b.WriteByte('\a')
+			case 'b':
+				b.WriteByte('\b')
+			case 'e':
+				b.WriteByte(0x1b)
+			case 'f':
+				b.WriteByte('\f')
+			case 'v':
+				b.WriteByte('\v')
+			case 'N':
+				b.WriteRune('\u0085')
+			case '_':
+				b.WriteRune('\u00a0')
+			case 'L':
+				b.WriteRune('\u2028')
+			case 'P':
+				b.WriteRune('\u2029')
+			case ' ', '"', '\\', '/':
+				b.WriteByte(s[i])
+			case 'x', 'u', 'U':
+				n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[i]]
+				if i+n >= len(s) {
+					return "", 0, fmt.Errorf("short escape sequence")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid escape sequence")
+				}
+				b.WriteRune(rune(r))
+				i += n
+			default:
+				return "", 0, fmt.Errorf("unknown escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+// flowBalanced reports whether every bracket opened in s has been closed.
+func flowBalanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+	}
+	return depth <= 0 && quote == 0
+}
+
+type flowParser struct {
+	s string
+	i int
+}
+
+func (f *flowParser) skipSpace() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+func (f *flowParser) parseValue() (interface{}, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, fmt.Errorf("unexpected end of flow collection")
+	}
+	switch f.s[f.i] {
+	case '[':
+		f.i++
+		seq := []interface{}{}
+		for {
+			f.skipSpace()
+			if f.i < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				return seq, nil
+			}
+			v, err := f.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.i++
+		m := map[string]interface{}{}
+		for {
+			f.skipSpace()
+			if f.i < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				return m, nil
+			}
+			k, err := f.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpace()
+			var v interface{}
+			if f.i < len(f.s) && f.s[f.i] == ':' {
+				f.i++
+				if v, err = f.parseValue(); err != nil {
+					return nil, err
+				}
+			}
+			m[fmt.Sprint(k)] = v
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		s, n, err := parseQuoted(f.s[f.i:])
+		if err != nil {
+			return nil, err
+		}
+		f.i += n
+		return s, nil
+	}
+	start := f.i
+	for f.i < len(f.s) {
+		c := f.s[f.i]
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+		if c == ':' && (f.i+1 == len(f.s) || f.s[f.i+1] == ' ' || f.s[f.i+1] == ',') {
+			break
+		}
+		f.i++
+	}
+	return resolveScalar(strings.TrimSpace(f.s[start:f.i])), nil
+}
+
+func (f *flowParser) separator(end byte) error {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return fmt.Errorf("unterminated flow collection")
+	}
+	switch f.s[f.i] {
+	case ',':
+		f.i++
+		return nil
+	case end:
+		return nil
+	}
+	return fmt.Errorf("unexpected %q in flow collection", f.s[f.i])
+}
+
+var (
+	yamlIntPattern   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	yamlFloatPattern = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+// resolveScalar applies the YAML 1.2 core schema to a plain scalar.
+func resolveScalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF":
+		return math.Inf(1)
+	case "-.inf", "-.Inf", "-.INF":
+		return math.Inf(-1)
+	case ".nan", ".NaN", ".NAN":
+		return math.NaN()
+	}
+	if yamlIntPattern.MatchString(s) {
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0o") {
+		if n, err := strconv.ParseInt(s[2:], map[bool]int{true: 16, false: 8}[s[1] == 'x'], 64); err == nil {
+			return int(n)
+		}
+	}
+	if yamlFloatPattern.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
+
+// encodeYAML renders v as a block-style YAML document with sorted keys.
+func encodeYAML(v interface{}) string {
+	var b strings.Builder
+	writeYAMLNode(&b, v, 0)
+	return b.String()
+}
+
+func writeYAMLNode(b *strings.Builder, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		for _, k := range sortedKeys(t) {
+			b.WriteString(pad + yamlScalar(k))
+			writeYAMLValue(b, t[k], indent)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range t {
+			b.WriteString(pad + "-")
+			writeYAMLItem(b, item, indent)
+		}
+	default:
+		b.WriteString(pad + yamlScalarValue(v, indent) + "\n")
+	}
+}
+
+// writeYAMLValue writes the value for a mapping key already on the line.
+func writeYAMLValue(b *strings.Builder, v interface{}, indent int) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			b.WriteString(": {}\n")
+			return
+		}
+		b.WriteString(":\n")
+		writeYAMLNode(b, t, indent+2)
+	case []interface{}:
+		if len(t) == 0 {
+			b.WriteString(": []\n")
+			return
+		}
+		b.WriteString(":\n")
+		writeYAMLNode(b, t, indent)
+	default:
+		b.WriteString(": " + yamlScalarValue(v, indent+2) + "\n")
+	}
+}
+
+// writeYAMLItem writes a sequence item after its "-".
+func writeYAMLItem(b *strings.Builder, v interface{}, indent int) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		for i, k := range sortedKeys(t) {
+			if i == 0 {
+				b.WriteString(" " + yamlScalar(k))
+			} else {
+				b.WriteString(strings.Repeat(" ", indent+2) + yamlScalar(k))
+			}
+			writeYAMLValue(b, t[k], indent+2)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLNode(b, t, indent+2)
+	default:
+		b.WriteString(" " + yamlScalarValue(v, indent+2) + "\n")
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// yamlScalarValue formats a scalar, using a literal block for multi-line strings.
+func yamlScalarValue(v interface{}, indent int) string {
+	s, ok := v.(string)
+	if !ok || !strings.Contains(s, "\n") || strings.HasPrefix(s, " ") || strings.HasSuffix(s, "\n\n") || strings.ContainsAny(s, "\r\t") {
+		return yamlScalar(v)
+	}
+	header := "|-"
+	if strings.HasSuffix(s, "\n") {
+		header = "|"
+		s = strings.TrimSuffix(s, "\n")
+	}
+	pad := strings.Repeat(" ", indent)
+	var b strings.Builder
+	b.WriteString(header)
+	for _, line := range strings.Split(s, "\n") {
+		b.WriteString("\n")
+		if line != "" {
+			b.WriteString(pad + line)
+		}
+	}
+	return b.String()
+}
+
+// yamlScalar formats a scalar on a single line, quoting strings that would
+// otherwise be read back as a different type or break the syntax.
+func yamlScalar(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(t)
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1e15 {
+			return strconv.FormatInt(int64(t), 10)
+		}
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case string:
+		if yamlNeedsQuotes(t) {
+			return yamlQuote(t)
+		}
+		return t
+	}
+	return yamlQuote(fmt.Sprint(v))
+}
+
+// yamlQuote double-quotes s. strconv.Quote's escapes are YAML escapes as
+// well: it writes \xNN only for control characters, which YAML reads back
+// as the same U+00NN, and for bytes that are not UTF-8, which a YAML
+// string cannot hold and so become U+FFFD first.
+func yamlQuote(s string) string {
+	return strconv.Quote(strings.ToValidUTF8(s, "\uFFFD"))
+}
+
+func yamlNeedsQuotes(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) {
+		return true
+	}
+	if _, isString := resolveScalar(s).(string); !isString {
+		return true
+	}
+	// Kubernetes decodes with YAML 1.1 rules, where these are booleans.
+	switch strings.ToLower(s) {
+	case "y", "n", "yes", "no", "on", "off":
+		return true
+	}
+	if strings.ContainsAny(s[:1], ",[]{}#&*!|>'\"%@`") {
+		return true
+	}
+	if strings.ContainsAny(s[:1], "-?:") && (len(s) == 1 || s[1] == ' ') {
+		return true
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return true
+	}
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}